@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Форматы журнала запросов, задаются флагом -access-log
+const (
+	// AccessLogOff журнал не ведется
+	AccessLogOff = "off"
+	// AccessLogCommon Common Log Format, дополненный идентификатором запроса и длительностью
+	AccessLogCommon = "common"
+	// AccessLogJSON объект json на строку
+	AccessLogJSON = "json"
+)
+
+// clfTime формат времени в Common Log Format
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog журнал всех запросов к серверу: строка на каждый обработанный запрос.
+// nil-значение ничего не записывает
+type AccessLog struct {
+	format string
+	// mu не дает перемешаться строкам одновременно завершившихся запросов
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLog создает журнал запросов в формате format, пишущий в w. С AccessLogOff возвращает nil
+func NewAccessLog(format string, w io.Writer) (*AccessLog, error) {
+	switch format {
+	case AccessLogOff:
+		return nil, nil
+	case AccessLogCommon, AccessLogJSON:
+		return &AccessLog{format: format, w: w}, nil
+	}
+	return nil, fmt.Errorf("Unknown access log format %q, must be %s, %s or %s", format, AccessLogOff, AccessLogCommon, AccessLogJSON)
+}
+
+// accessEntry запись журнала о запросе
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// HandleAccessLog записывает в журнал log каждый запрос, обработанный хэндлером h, после его завершения.
+// Идентификатор запроса и адрес клиента берутся из контекста (см. HandleRequestID и HandleClientIP).
+// Без log возвращает h
+func HandleAccessLog(log *AccessLog, h http.Handler) http.Handler {
+	if log == nil {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw}
+		h.ServeHTTP(recorder, r)
+		log.write(accessEntry{
+			Time:       start,
+			ClientIP:   ClientIP(r.Context()),
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Protocol:   r.Proto,
+			Status:     recorder.Status(),
+			Bytes:      recorder.bytes,
+			DurationMs: milliseconds(start, time.Now()),
+			RequestID:  RequestID(r.Context()),
+		})
+	})
+}
+
+// write пишет запись в журнал
+func (l *AccessLog) write(e accessEntry) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if l.format == AccessLogJSON {
+		json.NewEncoder(buf).Encode(e)
+	} else {
+		writeCommonLog(buf, e)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// writeCommonLog пишет запись в Common Log Format: host ident authuser [time] "request" status bytes,
+// дописывая в конце идентификатор запроса и длительность в миллисекундах
+func writeCommonLog(buf *bytes.Buffer, e accessEntry) {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	requestID := e.RequestID
+	if requestID == "" {
+		requestID = "-"
+	}
+	// путь запроса выводится в кавычках, поэтому кавычки и управляющие символы в нем экранируются
+	request := strconv.Quote(e.Method + " " + e.Path + " " + e.Protocol)
+	fmt.Fprintf(buf, "%s - - [%s] %s %d %s %s %.3f\n",
+		e.ClientIP, e.Time.Format(clfTime), request, e.Status, size, requestID, e.DurationMs)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Параметры подстройки числа одновременных запросов (AIMD)
+const (
+	// aimdBackoff во сколько раз уменьшается предел при признаках перегрузки
+	aimdBackoff = 0.5
+	// aimdDecreaseInterval как часто предел может уменьшаться: одна перегрузка вызывает сразу много неудачных
+	// запросов, и предел не должен падать до единицы от одного всплеска
+	aimdDecreaseInterval = time.Second
+	// aimdSlowFactor во сколько раз задержка запроса должна превысить сглаженную, чтобы считаться признаком перегрузки
+	aimdSlowFactor = 2
+	// aimdLatencyAlpha вес нового значения в сглаженной задержке
+	aimdLatencyAlpha = 0.1
+	// aimdWarmup сколько успешных запросов нужно для сглаженной задержки, прежде чем сравнивать с ней
+	aimdWarmup = 10
+)
+
+// aimdLimit предел одновременных запросов, подстраиваемый по результатам запросов: пока запросы успешны
+// и задержки в норме, он растет на единицу за каждые limit запросов, а при таймаутах, ошибках соединения,
+// ответах 5xx и 429 или резком росте задержки уменьшается вдвое. Предел не бывает меньше 1 и больше max
+type aimdLimit struct {
+	limit    float64
+	max      int
+	inFlight int
+	// waiting ожидающие места запросы, канал закрывается при выдаче места
+	waiting []chan struct{}
+	// latency сглаженная задержка успешных запросов в секундах, samples сколько запросов в ней учтено
+	latency      float64
+	samples      int
+	lastDecrease time.Time
+}
+
+// newAimdLimit создает предел, начинающийся с max: подстройка только снижает его при перегрузке
+func newAimdLimit(max int) *aimdLimit {
+	return &aimdLimit{limit: float64(max), max: max}
+}
+
+// free проверяет, что можно начать еще один запрос
+func (a *aimdLimit) free() bool {
+	return a.inFlight < max(int(a.limit), 1)
+}
+
+// observe учитывает завершение запроса длительностью latency; overloaded - результат говорит о перегрузке
+func (a *aimdLimit) observe(latency time.Duration, overloaded bool, now time.Time) {
+	seconds := latency.Seconds()
+	if !overloaded && a.samples >= aimdWarmup && seconds > aimdSlowFactor*a.latency {
+		overloaded = true
+	}
+	if overloaded {
+		if now.Sub(a.lastDecrease) >= aimdDecreaseInterval {
+			a.limit = max(1, a.limit*aimdBackoff)
+			a.lastDecrease = now
+		}
+		return
+	}
+	if a.samples == 0 {
+		a.latency = seconds
+	} else {
+		a.latency += aimdLatencyAlpha * (seconds - a.latency)
+	}
+	a.samples++
+	a.limit = min(float64(a.max), a.limit+1/a.limit)
+}
+
+// wake отдает освободившиеся места ожидающим (вызывается под мьютексом)
+func (a *aimdLimit) wake() {
+	for len(a.waiting) > 0 && a.free() {
+		a.inFlight++
+		close(a.waiting[0])
+		a.waiting = a.waiting[1:]
+	}
+}
+
+// AdaptiveLimiter подстраивает число одновременных запросов url к каждому хосту и по всем хостам вместе
+// (см. aimdLimit). Пределы не превышают статических ограничений -max-conns-per-host и -worker-pool-size,
+// а только снижаются, пока хосты или сеть перегружены.
+// nil-значение ничего не ограничивает
+type AdaptiveLimiter struct {
+	mu      sync.Mutex
+	global  *aimdLimit
+	hosts   map[string]*aimdLimit
+	hostMax int
+}
+
+// NewAdaptiveLimiter создает AdaptiveLimiter с пределами не больше globalMax по всем хостам и hostMax на хост
+func NewAdaptiveLimiter(globalMax, hostMax int) *AdaptiveLimiter {
+	return &AdaptiveLimiter{global: newAimdLimit(globalMax), hosts: make(map[string]*aimdLimit), hostMax: hostMax}
+}
+
+// Acquire дожидается места для запроса к host в пределе хоста и общем пределе.
+// Возвращает ошибку контекста, если ожидание прервано отменой ctx, иначе место нужно освободить через Release
+func (l *AdaptiveLimiter) Acquire(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	// место у хоста занимаем раньше общего, чтобы не держать общее место, ожидая хост
+	h, err := l.acquire(ctx, host, func() *aimdLimit {
+		h := l.hosts[host]
+		if h == nil {
+			h = newAimdLimit(l.hostMax)
+			l.hosts[host] = h
+		}
+		return h
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := l.acquire(ctx, host, func() *aimdLimit { return l.global }); err != nil {
+		l.mu.Lock()
+		h.inFlight--
+		h.wake()
+		l.forget(host, h)
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// acquire дожидается места в пределе, который возвращает limit. limit вызывается под мьютексом,
+// чтобы хост не был забыт между поиском его предела и занятием места
+func (l *AdaptiveLimiter) acquire(ctx context.Context, host string, limit func() *aimdLimit) (*aimdLimit, error) {
+	l.mu.Lock()
+	a := limit()
+	if len(a.waiting) == 0 && a.free() {
+		a.inFlight++
+		l.mu.Unlock()
+		return a, nil
+	}
+	ready := make(chan struct{})
+	a.waiting = append(a.waiting, ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return a, nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// место успело освободиться для нас одновременно с отменой, отдаем его следующему
+		a.inFlight--
+		a.wake()
+	default:
+		a.waiting = slices.DeleteFunc(a.waiting, func(ch chan struct{}) bool { return ch == ready })
+	}
+	if a != l.global {
+		l.forget(host, a)
+	}
+	return nil, ctx.Err()
+}
+
+// Release освобождает место, занятое через Acquire, и подстраивает пределы по результату запроса:
+// latency длительность запроса, overloaded - результат говорит о перегрузке, aborted - запрос прерван
+// пользователем, и о хосте он ничего не говорит
+func (l *AdaptiveLimiter) Release(host string, latency time.Duration, overloaded, aborted bool) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, a := range []*aimdLimit{l.hosts[host], l.global} {
+		a.inFlight--
+		if !aborted {
+			a.observe(latency, overloaded, now)
+		}
+		a.wake()
+	}
+	l.forget(host, l.hosts[host])
+}
+
+// forget перестает учитывать хост без запросов, предел которого не снижен: о нем нечего помнить,
+// а хосты не копятся (вызывается под мьютексом)
+func (l *AdaptiveLimiter) forget(host string, h *aimdLimit) {
+	if h.inFlight == 0 && len(h.waiting) == 0 && h.limit >= float64(h.max) {
+		delete(l.hosts, host)
+	}
+}
+
+// overloadSignal проверяет, говорит ли результат запроса о перегрузке хоста или сети:
+// таймаут, ошибка соединения, ответ 5xx или 429
+func overloadSignal(result UrlResult, err error) bool {
+	if err == nil {
+		return result.StatusCode == http.StatusTooManyRequests || result.StatusCode >= 500 && result.StatusCode <= 599
+	}
+	switch ErrorCode(err) {
+	case ErrorCodeConnect, ErrorCodeConnectTimeout, ErrorCodeReadTimeout:
+		return true
+	}
+	return false
+}
+
+// stats возвращает текущие пределы, для nil-значения - nil
+func (l *AdaptiveLimiter) stats() *AdaptiveStats {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &AdaptiveStats{Global: l.global.stats(""), Hosts: make([]AdaptiveLimitStats, 0, len(l.hosts))}
+	for host, h := range l.hosts {
+		s.Hosts = append(s.Hosts, h.stats(host))
+	}
+	slices.SortFunc(s.Hosts, func(a, b AdaptiveLimitStats) int { return cmp.Compare(a.Host, b.Host) })
+	return s
+}
+
+// stats возвращает состояние предела хоста host (вызывается под мьютексом)
+func (a *aimdLimit) stats(host string) AdaptiveLimitStats {
+	return AdaptiveLimitStats{Host: host, Limit: max(int(a.limit), 1), Max: a.max, InFlight: a.inFlight, Waiting: len(a.waiting)}
+}
+
+// writeText выводит текущие пределы в текстовом формате Prometheus
+func (l *AdaptiveLimiter) writeText(w *metricsWriter) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP fetch_adaptive_global_limit Current adaptive limit of concurrent url requests across all hosts.")
+	fmt.Fprintln(w, "# TYPE fetch_adaptive_global_limit gauge")
+	fmt.Fprintf(w, "fetch_adaptive_global_limit %d\n", max(int(l.global.limit), 1))
+	fmt.Fprintln(w, "# HELP fetch_adaptive_global_in_flight Url requests holding a place in the adaptive limit across all hosts.")
+	fmt.Fprintln(w, "# TYPE fetch_adaptive_global_in_flight gauge")
+	fmt.Fprintf(w, "fetch_adaptive_global_in_flight %d\n", l.global.inFlight)
+	limits := make(map[string]int, len(l.hosts))
+	for host, h := range l.hosts {
+		limits[host] = max(int(h.limit), 1)
+	}
+	fmt.Fprintln(w, "# HELP fetch_adaptive_host_limit Current adaptive limit of concurrent url requests by target host, for hosts in use or with a lowered limit.")
+	fmt.Fprintln(w, "# TYPE fetch_adaptive_host_limit gauge")
+	writeGauges(w, "fetch_adaptive_host_limit", "host", limits)
+}
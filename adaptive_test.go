@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiterStats(t *testing.T) {
+	var l *AdaptiveLimiter
+	if s := l.stats(); s != nil {
+		t.Fatalf("stats() of a disabled limiter = %+v, want nil", s)
+	}
+
+	l = NewAdaptiveLimiter(8, 4)
+	ctx := context.Background()
+	for _, host := range []string{"b.test:443", "a.test:443", "a.test:443"} {
+		if err := l.Acquire(ctx, host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// перегрузка снижает предел хоста и общий предел вдвое
+	l.Release("a.test:443", time.Millisecond, true, false)
+
+	want := &AdaptiveStats{
+		Global: AdaptiveLimitStats{Limit: 4, Max: 8, InFlight: 2},
+		Hosts: []AdaptiveLimitStats{
+			{Host: "a.test:443", Limit: 2, Max: 4, InFlight: 1},
+			{Host: "b.test:443", Limit: 4, Max: 4, InFlight: 1},
+		},
+	}
+	if got := l.stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAdminStatsAdaptive(t *testing.T) {
+	fetcher := NewFetcher(FetcherConfig{AdaptiveConcurrency: true, MaxConnsPerHost: 4, WorkerPoolSize: 8})
+	h := HandleAdminStats("secret", fetcher, NewScheduler(1, make(chan struct{})))
+	req := httptest.NewRequest(http.MethodGet, AdminStatsPattern, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if body := rw.Body.String(); !strings.Contains(body, `"adaptive_concurrency":{"global":{"limit":8,"max":8`) {
+		t.Errorf("stats %s have no adaptive limits", body)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Назначения журнала аудита помимо файла, задаются флагом -audit-log
+const (
+	// AuditSyslog локальный syslog
+	AuditSyslog = "syslog"
+	// AuditSyslogUDP и AuditSyslogTCP префиксы адреса удаленного syslog: syslog+udp://host:port
+	AuditSyslogUDP = "syslog+udp://"
+	AuditSyslogTCP = "syslog+tcp://"
+)
+
+// auditTag имя программы в записях syslog
+const auditTag = "go-test-task"
+
+// auditTailChunk сколько байт с конца файла читается за раз при поиске последней записи
+const auditTailChunk = 64 << 10
+
+// AuditLog журнал аудита: кто (адрес клиента, арендатор, идентификатор запроса) и когда запросил какие url.
+// Записи только дописываются, по одной строке json на запрос пользователя (http, gRPC или задание).
+// В режиме цепочки каждая запись содержит хэш предыдущей и свой, так что удаление или изменение записи видно.
+// nil-значение ничего не записывает
+type AuditLog struct {
+	chain bool
+
+	mu sync.Mutex
+	w  io.WriteCloser
+	// syslog записи отправляются в syslog, каждая отдельным сообщением
+	syslog *syslog.Writer
+	// prev хэш последней записи цепочки
+	prev string
+}
+
+// auditRecord запись журнала аудита
+type auditRecord struct {
+	Time      time.Time  `json:"time"`
+	RequestID string     `json:"request_id,omitempty"`
+	ClientIP  string     `json:"client_ip,omitempty"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Urls      []auditUrl `json:"urls"`
+	// PrevHash хэш предыдущей записи в режиме цепочки, пустой у первой записи
+	PrevHash *string `json:"prev_hash,omitempty"`
+}
+
+// auditUrl запрошенный url (без пароля) с методом и запасными url
+type auditUrl struct {
+	Method    string   `json:"method,omitempty"`
+	Url       string   `json:"url"`
+	Fallbacks []string `json:"fallbacks,omitempty"`
+}
+
+// OpenAuditLog открывает журнал аудита target: файл (записи дописываются в конец) или syslog (AuditSyslog,
+// AuditSyslogUDP, AuditSyslogTCP). С chain записи образуют цепочку хэшей; цепочка в файле продолжается
+// с последней записи, в syslog - начинается заново при каждом запуске
+func OpenAuditLog(target string, chain bool) (*AuditLog, error) {
+	l := &AuditLog{chain: chain}
+	var network, addr string
+	switch {
+	case target == AuditSyslog:
+	case strings.HasPrefix(target, AuditSyslogUDP):
+		network, addr = "udp", strings.TrimPrefix(target, AuditSyslogUDP)
+	case strings.HasPrefix(target, AuditSyslogTCP):
+		network, addr = "tcp", strings.TrimPrefix(target, AuditSyslogTCP)
+	default:
+		f, err := os.OpenFile(target, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		if chain {
+			if l.prev, err = lastAuditHash(f); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Audit log %s: %v", target, err)
+			}
+		}
+		l.w = f
+		return l, nil
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, auditTag)
+	if err != nil {
+		return nil, err
+	}
+	l.syslog, l.w = w, w
+	return l, nil
+}
+
+// lastAuditHash возвращает хэш последней записи журнала f, пустую строку - если журнал пуст
+func lastAuditHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	// последняя строка читается с конца файла кусками, пока не найдется начало строки
+	end := info.Size()
+	var tail []byte
+	for end > 0 {
+		size := min(end, auditTailChunk)
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, end-size); err != nil {
+			return "", err
+		}
+		end -= size
+		tail = append(chunk, tail...)
+		if i := bytes.LastIndexByte(bytes.TrimRight(tail, "\n"), '\n'); i >= 0 {
+			tail = tail[i+1:]
+			break
+		}
+	}
+	tail = bytes.TrimSpace(tail)
+	if len(tail) == 0 {
+		return "", nil
+	}
+	var last struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.Unmarshal(tail, &last); err != nil || last.Hash == "" {
+		return "", errors.New("The last record is not a hash-chained audit record, the chain can not be continued")
+	}
+	return last.Hash, nil
+}
+
+// record записывает в журнал запрос пользователя ctx на url tasks
+func (l *AuditLog) record(ctx context.Context, tasks []UrlRequest) {
+	if l == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: RequestID(ctx),
+		ClientIP:  ClientIP(ctx),
+		Tenant:    Tenant(ctx),
+		Urls:      make([]auditUrl, len(tasks)),
+	}
+	for i, task := range tasks {
+		rec.Urls[i] = auditUrl{Method: task.Method, Url: redactUrl(task.Url)}
+		for _, fallback := range task.Fallbacks {
+			rec.Urls[i].Fallbacks = append(rec.Urls[i].Fallbacks, redactUrl(fallback))
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.chain {
+		rec.PrevHash = &l.prev
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logContext(ctx, slog.LevelError, "Audit log", "error", err)
+		return
+	}
+	if l.chain {
+		// хэш считается по строке записи до поля hash, поэтому проверить цепочку можно, не разбирая json:
+		// sha256 от строки без окончания `,"hash":"..."}` должен совпасть с hash, а prev_hash - с hash предыдущей
+		sum := sha256.Sum256(line[:len(line)-1])
+		hash := hex.EncodeToString(sum[:])
+		line = append(line[:len(line)-1], `,"hash":"`+hash+`"}`...)
+		l.prev = hash
+	}
+	if l.syslog != nil {
+		err = l.syslog.Info(string(line))
+	} else {
+		_, err = l.w.Write(append(line, '\n'))
+	}
+	if err != nil {
+		// запрос уже выполняется: без записи в журнале он виден хотя бы в логе сервера
+		logContext(ctx, slog.LevelError, "Audit log", "error", err)
+	}
+}
+
+// Close закрывает журнал
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Способы аутентификации при запросе url
+const (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+)
+
+// redacted заменяет секреты при выводе в лог и в json
+const redacted = "[REDACTED]"
+
+// UrlAuth параметры аутентификации при запросе url: basic (Username и Password) или bearer (Token).
+// Секреты никогда не выводятся: ни в лог через fmt, ни в json
+type UrlAuth struct {
+	Type     string `json:"type"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// Validate проверяет параметры аутентификации.
+// Текст возвращаемой ошибки предназначен для пользователя
+func (a *UrlAuth) Validate() error {
+	switch a.Type {
+	case AuthBasic:
+		if a.Username == "" {
+			return errors.New("Username is required for basic auth")
+		}
+	case AuthBearer:
+		if a.Token == "" {
+			return errors.New("Token is required for bearer auth")
+		}
+	default:
+		return fmt.Errorf("Unknown auth type %q", a.Type)
+	}
+	return nil
+}
+
+// apply добавляет в запрос заголовок Authorization, заменяя заданный в заголовках url
+func (a *UrlAuth) apply(req *http.Request) {
+	switch a.Type {
+	case AuthBasic:
+		req.SetBasicAuth(a.Username, a.Password)
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+}
+
+// String возвращает описание без секретов, используется при выводе через fmt (%v, %s)
+func (a UrlAuth) String() string {
+	if a.Type == AuthBasic {
+		return fmt.Sprintf("basic %s:%s", a.Username, redacted)
+	}
+	return a.Type + " " + redacted
+}
+
+// GoString как String, но для %#v
+func (a UrlAuth) GoString() string {
+	return a.String()
+}
+
+// MarshalJSON упаковывает параметры со скрытыми секретами
+func (a UrlAuth) MarshalJSON() ([]byte, error) {
+	// plain без метода MarshalJSON, иначе получится бесконечная рекурсия
+	type plain UrlAuth
+	if a.Password != "" {
+		a.Password = redacted
+	}
+	if a.Token != "" {
+		a.Token = redacted
+	}
+	return json.Marshal(plain(a))
+}
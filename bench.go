@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Режимы работы программы, задаются флагом -mode
+const (
+	// ModeServe сервер
+	ModeServe = "serve"
+	// ModeBench нагрузочный тест обработчика запросов (см. RunBench)
+	ModeBench = "bench"
+)
+
+// BenchConfig параметры нагрузочного теста
+type BenchConfig struct {
+	// Requests сколько запросов отправить, Concurrency сколько из них отправляется одновременно
+	Requests    int
+	Concurrency int
+	// Urls число url в каждом запросе
+	Urls int
+	// BodySize размер тела ответа на каждый url, OriginLatency сколько ждать перед ответом
+	BodySize      int
+	OriginLatency time.Duration
+}
+
+// DefaultBenchConfig параметры нагрузочного теста по умолчанию
+var DefaultBenchConfig = BenchConfig{
+	Requests:      1000,
+	Concurrency:   16,
+	Urls:          10,
+	BodySize:      1024,
+	OriginLatency: 10 * time.Millisecond,
+}
+
+// RunBench проверяет, сколько запросов выдерживает сервер с настройками fetcherConfig: отправляет обработчику
+// запросов (тому же, что и у сервера, с тем же ограничением числа одновременных запросов) синтетические запросы
+// на локальный сервер-заглушку и выводит в out пропускную способность, перцентили задержки и число выделений памяти.
+// Запросы передаются обработчику напрямую, без сети, поэтому измеряется работа самого сервиса
+func RunBench(config BenchConfig, fetcherConfig FetcherConfig, out io.Writer) error {
+	if config.Requests <= 0 || config.Concurrency <= 0 || config.Urls <= 0 {
+		return errors.New("Bench requests, concurrency and urls must be positive")
+	}
+	if config.Urls > MaxChunkedUrlCount {
+		return fmt.Errorf("Bench urls must not exceed %d", MaxChunkedUrlCount)
+	}
+
+	body := bytes.Repeat([]byte("x"), max(config.BodySize, 0))
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if config.OriginLatency > 0 {
+			select {
+			case <-time.After(config.OriginLatency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write(body)
+	}))
+	defer origin.Close()
+
+	// заглушка слушает loopback, а политика доступа к хостам сервера ее бы не пропустила
+	fetcherConfig.AllowedNetworks = append(slices.Clone(fetcherConfig.AllowedNetworks), netip.MustParsePrefix("127.0.0.0/8"))
+	fetcherConfig.AllowHosts, fetcherConfig.DenyHosts, fetcherConfig.HTTPSOnly = nil, nil, false
+	fetcher := NewFetcher(fetcherConfig)
+	stop := make(chan struct{})
+	defer close(stop)
+	scheduler := NewBoundedScheduler(CurrentLimits().MaxSimultaneousClients, MaxQueuedClients, MaxClientQueueWait, stop)
+	handler := HandleConnection(scheduler, stop)(HandleFetch(fetcher))
+
+	// тела запросов готовятся заранее, чтобы не учитывать их в выделениях памяти. Url всех запросов разные,
+	// иначе одновременные одинаковые запросы объединялись бы в один
+	requests := make([][]byte, config.Requests)
+	for n := range requests {
+		urls := Urls{Chunked: config.Urls > CurrentLimits().MaxUrlCount}
+		for i := 0; i < config.Urls; i++ {
+			urls.Urls = append(urls.Urls, fmt.Sprintf("%s/%d/%d", origin.URL, n, i))
+		}
+		data, err := json.Marshal(urls)
+		if err != nil {
+			return err
+		}
+		requests[n] = data
+	}
+
+	latencies := make([]float64, config.Requests)
+	var failed atomic.Int64
+	var next atomic.Int64
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < min(config.Concurrency, config.Requests); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := int(next.Add(1)) - 1
+				if n >= config.Requests {
+					return
+				}
+				r, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, FetchPattern, bytes.NewReader(requests[n]))
+				w := &benchResponseWriter{header: make(http.Header)}
+				requestStart := time.Now()
+				handler.ServeHTTP(w, r)
+				latencies[n] = float64(time.Since(requestStart)) / float64(time.Millisecond)
+				if w.failed() {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	slices.Sort(latencies)
+
+	count := float64(config.Requests)
+	fmt.Fprintf(out, "requests:    %d (%d failed), %d urls each, %d at a time\n", config.Requests, failed.Load(), config.Urls, config.Concurrency)
+	fmt.Fprintf(out, "origin:      %d byte bodies after %v\n", config.BodySize, config.OriginLatency)
+	fmt.Fprintf(out, "duration:    %v\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "throughput:  %.1f requests/s, %.1f urls/s\n", count/elapsed.Seconds(), count*float64(config.Urls)/elapsed.Seconds())
+	fmt.Fprintf(out, "latency ms:  min %.2f, p50 %.2f, p90 %.2f, p99 %.2f, max %.2f\n",
+		latencies[0], percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), latencies[len(latencies)-1])
+	fmt.Fprintf(out, "allocations: %.0f allocs/request, %.0f bytes/request\n",
+		float64(after.Mallocs-before.Mallocs)/count, float64(after.TotalAlloc-before.TotalAlloc)/count)
+	fmt.Fprintf(out, "gc:          %d cycles, %v total pause\n", after.NumGC-before.NumGC, time.Duration(after.PauseTotalNs-before.PauseTotalNs))
+	return nil
+}
+
+// benchResponseWriter ответ обработчика в нагрузочном тесте: тело не сохраняется, а только проверяется на ошибку
+type benchResponseWriter struct {
+	header http.Header
+	status int
+	// errored в ответе встретилась ошибка обработки
+	errored bool
+}
+
+func (w *benchResponseWriter) Header() http.Header { return w.header }
+
+func (w *benchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *benchResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if bytes.Contains(p, []byte(`"error_code":`)) {
+		w.errored = true
+	}
+	return len(p), nil
+}
+
+// Flush нужен для потоковых форматов, данные и так никуда не отправляются
+func (w *benchResponseWriter) Flush() {}
+
+// failed проверяет, что запрос завершился ошибкой: кодом ответа или ошибкой в json-ответе
+func (w *benchResponseWriter) failed() bool {
+	return w.status != http.StatusOK || w.errored
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxPooledBuffer буферы больше этого размера не возвращаются в пул, чтобы один большой ответ не держал память
+const maxPooledBuffer = 1 << 20
+
+// bufferPool буферы для чтения тел неизвестного размера и упаковки json: в больших списках url память под них
+// не выделяется заново для каждого результата
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// getBuffer берет пустой буфер из пула, после использования его нужно вернуть через putBuffer
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer возвращает буфер в пул, если он не слишком большой
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// copyBufferPool буферы для пропуска тел через хэш, как у io.Copy
+var copyBufferPool = sync.Pool{New: func() any {
+	buf := make([]byte, 32<<10)
+	return &buf
+}}
+
+// countingReader считает байты, прочитанные из r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// streamedBody тело ответа, прочитанное readBody
+type streamedBody struct {
+	// Data прочитанное тело, не длиннее допустимого размера; в режиме хэша nil
+	Data []byte
+	// Size сколько байт тела прочитано
+	Size int64
+	// SHA256 хэш тела в режиме хэша, при Overflow - хэш его начала
+	SHA256 string
+	// Overflow тело длиннее допустимого размера: в Data только его начало, остаток не прочитан
+	Overflow bool
+}
+
+// readBody читает тело r с параметрами opts, не держа в памяти больше допустимого: в режиме хэша тело
+// только пропускается потоком через SHA-256 и считается, иначе хранится. В обоих случаях читается не больше bodyLimit байт.
+// sizeHint ожидаемый размер тела (-1 - неизвестен): память под тело выделяется сразу, а не удваивается по мере чтения.
+// Тело неизвестного размера читается в буфер из пула и копируется в память ровно по размеру
+func readBody(r io.Reader, sizeHint int64, opts FetchOptions) (*streamedBody, error) {
+	counter := &countingReader{r: r}
+	maxSize, _ := bodyLimit(opts)
+	if opts.HashBody {
+		hash := sha256.New()
+		buf := copyBufferPool.Get().(*[]byte)
+		defer copyBufferPool.Put(buf)
+		if _, err := io.CopyBuffer(hash, io.LimitReader(counter, maxSize), *buf); err != nil {
+			return nil, err
+		}
+		// байт сверх разрешенного в хэш не попадает, по нему только видно, что тело не уместилось
+		if _, err := io.Copy(io.Discard, io.LimitReader(counter, 1)); err != nil {
+			return nil, err
+		}
+		return &streamedBody{Size: min(counter.n, maxSize), SHA256: hex.EncodeToString(hash.Sum(nil)), Overflow: counter.n > maxSize}, nil
+	}
+
+	// читаем на байт больше разрешенного, чтобы понять, что тело не уместилось
+	limit := maxSize + 1
+	var data []byte
+	if sizeHint >= 0 {
+		var err error
+		if data, err = readAllInto(make([]byte, 0, min(sizeHint+1, limit)), io.LimitReader(counter, limit)); err != nil {
+			return nil, err
+		}
+	} else {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if _, err := buf.ReadFrom(io.LimitReader(counter, limit)); err != nil {
+			return nil, err
+		}
+		data = append(make([]byte, 0, buf.Len()), buf.Bytes()...)
+	}
+	body := &streamedBody{Data: data, Size: counter.n}
+	if body.Size > maxSize {
+		body.Data = data[:maxSize]
+		body.Overflow = true
+	}
+	return body, nil
+}
+
+// readAllInto дописывает в data все содержимое r, как io.ReadAll, но в уже выделенную память:
+// если ее хватает, тело не копируется
+func readAllInto(data []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+		n, err := r.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// setHash записывает в результат режима хэша хэш и размер тела вместо самого тела
+func setHash(result *UrlResult, body *streamedBody) {
+	result.Response = nil
+	result.SHA256 = body.SHA256
+	result.ContentLength = body.Size
+}
+
+// bodyLimit возвращает, сколько байт тела можно получить с параметрами opts и обрезается ли тело длиннее без ошибки
+func bodyLimit(opts FetchOptions) (int64, bool) {
+	if opts.MaxBytes > 0 && !opts.HashBody && opts.MaxBytes < opts.MaxBodySize {
+		// предпросмотр: остальное тело не скачивается, а обрезка не считается ошибкой
+		return opts.MaxBytes, true
+	}
+	return opts.MaxBodySize, opts.TruncateBody
+}
+
+// setBody записывает в результат полученное тело с типом contentType: текстовое тело перекодируется в UTF-8,
+// если не попросили иного, и передается строкой, если это возможно и попросили
+func setBody(result *UrlResult, body []byte, contentType string, opts FetchOptions) {
+	result.Response = body
+	result.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		result.Charset = detectCharset(contentType, body)
+	}
+	if result.Charset != "" && !opts.KeepCharset {
+		if text, ok := toUTF8(body, result.Charset); ok {
+			result.Response = text
+		}
+	}
+	// строкой тело можно передать, только если оно в корректной UTF-8
+	validUTF8 := utf8.Valid(result.Response)
+	result.ValidUTF8 = &validUTF8
+	result.BodyEncoding = EncodingBase64
+	if opts.TextBody && validUTF8 {
+		result.BodyEncoding = EncodingText
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestReadBodyHash(t *testing.T) {
+	body := []byte("0123456789")
+	sum := func(b []byte) string {
+		h := sha256.Sum256(b)
+		return hex.EncodeToString(h[:])
+	}
+
+	tests := []struct {
+		name         string
+		opts         FetchOptions
+		wantSize     int64
+		wantSHA256   string
+		wantOverflow bool
+	}{
+		{name: "fits", opts: FetchOptions{MaxBodySize: 10, HashBody: true}, wantSize: 10, wantSHA256: sum(body)},
+		{name: "over the limit", opts: FetchOptions{MaxBodySize: 4, HashBody: true}, wantSize: 4, wantSHA256: sum(body[:4]), wantOverflow: true},
+		// предпросмотр в режиме хэша не действует
+		{name: "preview", opts: FetchOptions{MaxBodySize: 10, MaxBytes: 4, HashBody: true}, wantSize: 10, wantSHA256: sum(body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBody(bytes.NewReader(body), -1, tt.opts)
+			if err != nil {
+				t.Fatalf("readBody() error = %v", err)
+			}
+			if got.Data != nil || got.Size != tt.wantSize || got.SHA256 != tt.wantSHA256 || got.Overflow != tt.wantOverflow {
+				t.Errorf("readBody() = %+v, want size %d, sha256 %s and overflow %v", *got, tt.wantSize, tt.wantSHA256, tt.wantOverflow)
+			}
+		})
+	}
+}
+
+func TestReadLocalBodyHashLimit(t *testing.T) {
+	body := []byte("0123456789")
+	var result UrlResult
+	err := readLocalBody(&result, bytes.NewReader(body), int64(len(body)), "", FetchOptions{MaxBodySize: 4, HashBody: true})
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("readLocalBody() error = %v, want %v", err, ErrBodyTooLarge)
+	}
+
+	result = UrlResult{}
+	err = readLocalBody(&result, bytes.NewReader(body), int64(len(body)), "", FetchOptions{MaxBodySize: 4, HashBody: true, TruncateBody: true})
+	if err != nil || !result.BodyTruncated || result.ContentLength != 4 {
+		t.Errorf("readLocalBody() with truncation = %+v, %v, want a truncated hash of 4 bytes", result, err)
+	}
+}
+
+// BenchmarkReadBody память и время на чтение тела ответа в 64 КиБ
+func BenchmarkReadBody(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4<<10)
+	full := FetchOptions{MaxBodySize: MaxResponseBodySize}
+
+	benchmarks := []struct {
+		name     string
+		sizeHint int64
+		opts     FetchOptions
+	}{
+		{"known size", int64(len(body)), full},
+		{"unknown size", -1, full},
+		{"hash mode", -1, FetchOptions{MaxBodySize: MaxResponseBodySize, HashBody: true}},
+		{"overflow", -1, FetchOptions{MaxBodySize: 16 << 10, TruncateBody: true}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := readBody(bytes.NewReader(body), bm.sizeHint, bm.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
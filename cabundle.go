@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadRootCAs возвращает системные корневые сертификаты вместе с сертификатами из paths.
+// Каждый путь - PEM-файл (в нем может быть несколько сертификатов) или каталог с такими файлами;
+// файлы каталога без сертификатов пропускаются, но хотя бы один сертификат в каталоге должен быть
+func loadRootCAs(paths []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		// системных сертификатов может не быть (например, в минимальном контейнере)
+		pool = x509.NewCertPool()
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle: %v", err)
+		}
+		if !info.IsDir() {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("CA bundle: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("CA bundle: no certificates found in %s", path)
+			}
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle: %v", err)
+		}
+		found := false
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			pem, err := os.ReadFile(filepath.Join(path, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("CA bundle: %v", err)
+			}
+			if pool.AppendCertsFromPEM(pem) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("CA bundle: no certificates found in directory %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// PathFlag список путей, задается повторяющимся флагом
+type PathFlag []string
+
+// String возвращает пути в формате флага
+func (f *PathFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set добавляет путь из значения флага
+func (f *PathFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
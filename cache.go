@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultResponseCacheSize размер кэша ответов в памяти по умолчанию, в байтах
+	DefaultResponseCacheSize = 64 << 20
+	// DefaultResponseCacheTTL сколько хранится ответ без заголовков Cache-Control и Expires
+	DefaultResponseCacheTTL = 24 * time.Hour
+	// DefaultResponseCacheMinTTL минимальное время хранения ответа: даже ответ, который сразу устаревает,
+	// хранится ради валидаторов для условных запросов
+	DefaultResponseCacheMinTTL = time.Minute
+	// DefaultResponseCacheMaxTTL максимальное время хранения ответа
+	DefaultResponseCacheMaxTTL = 7 * 24 * time.Hour
+)
+
+// Источники времени свежести ответа
+const (
+	FreshnessCacheControl = "cache-control"
+	FreshnessExpires      = "expires"
+)
+
+// Freshness свежесть ответа по заголовкам кэширования источника
+type Freshness struct {
+	// Source заголовок, из которого получена свежесть: FreshnessCacheControl или FreshnessExpires
+	Source string `json:"source"`
+	// LifetimeS сколько секунд ответ свеж с момента его создания источником
+	LifetimeS int64 `json:"lifetime_s"`
+	// Expires момент, после которого ответ устаревает
+	Expires time.Time `json:"expires"`
+	// NoStore источник запретил сохранять ответ (Cache-Control: no-store)
+	NoStore bool `json:"no_store,omitempty"`
+}
+
+// parseFreshness определяет свежесть ответа по заголовкам Cache-Control (s-maxage, max-age, no-cache, no-store),
+// Expires, Date и Age, полученным в момент now; если заголовков кэширования нет, возвращает nil
+func parseFreshness(h http.Header, now time.Time) *Freshness {
+	var f *Freshness
+	var maxAge, sharedMaxAge string
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			arg = strings.Trim(arg, `"`)
+			switch strings.ToLower(name) {
+			case "no-store":
+				f = &Freshness{Source: FreshnessCacheControl, NoStore: true}
+			case "no-cache":
+				maxAge = "0"
+			case "max-age":
+				if maxAge == "" {
+					maxAge = arg
+				}
+			case "s-maxage":
+				sharedMaxAge = arg
+			}
+		}
+	}
+	if f != nil {
+		f.Expires = now.Truncate(time.Second)
+		return f
+	}
+
+	// s-maxage относится к общим кэшам, как этот, и важнее max-age, а оба важнее Expires
+	var lifetime time.Duration
+	if seconds, err := strconv.ParseInt(cmp.Or(sharedMaxAge, maxAge), 10, 64); err == nil {
+		f = &Freshness{Source: FreshnessCacheControl}
+		lifetime = time.Duration(max(seconds, 0)) * time.Second
+	} else if expires := h.Get("Expires"); expires != "" {
+		f = &Freshness{Source: FreshnessExpires}
+		// некорректный Expires (например, "0") означает, что ответ уже устарел
+		if t, err := http.ParseTime(expires); err == nil {
+			date, err := http.ParseTime(h.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			lifetime = max(t.Sub(date), 0)
+		}
+	} else {
+		return nil
+	}
+	f.LifetimeS = int64(lifetime / time.Second)
+	// Age - сколько ответ уже пролежал в промежуточных кэшах
+	age, _ := strconv.ParseInt(h.Get("Age"), 10, 64)
+	f.Expires = now.Add(lifetime - time.Duration(max(age, 0))*time.Second).Truncate(time.Second)
+	return f
+}
+
+// CachedResponse сохраненный ответ url: валидаторы для условного запроса и тело
+type CachedResponse struct {
+	// ETag значение заголовка ETag ответа, отправляется в If-None-Match
+	ETag string `json:"etag,omitempty"`
+	// LastModified значение заголовка Last-Modified ответа, отправляется в If-Modified-Since
+	LastModified string `json:"last_modified,omitempty"`
+	// ContentType значение заголовка Content-Type ответа: в ответе 304 его обычно нет, а по нему определяется кодировка тела
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+// size возвращает примерный объем памяти, занимаемый ответом
+func (r *CachedResponse) size() int64 {
+	return int64(len(r.ETag) + len(r.LastModified) + len(r.ContentType) + len(r.Body))
+}
+
+// ResponseCache хранилище ответов url для условных запросов.
+// Реализации должны допускать одновременное использование из разных горутин
+type ResponseCache interface {
+	// Get возвращает сохраненный ответ по ключу, nil - ответа нет
+	Get(ctx context.Context, key string) (*CachedResponse, error)
+	// Set сохраняет ответ по ключу на время ttl
+	Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) error
+}
+
+// ResponseCacheTTL время хранения ответов в кэше
+type ResponseCacheTTL struct {
+	// Default для ответов без заголовков Cache-Control и Expires
+	Default time.Duration
+	// Min и Max ограничения времени, полученного из заголовков
+	Min time.Duration
+	Max time.Duration
+}
+
+// ttl возвращает время хранения ответа со свежестью f, false - ответ сохранять нельзя
+func (t ResponseCacheTTL) ttl(f *Freshness) (time.Duration, bool) {
+	switch {
+	case f == nil:
+		return t.Default, true
+	case f.NoStore:
+		return 0, false
+	}
+	return min(max(time.Until(f.Expires), t.Min), t.Max), true
+}
+
+// responseCacheKey возвращает ключ кэша для запроса url: хэш url, заголовков и аутентификации,
+// чтобы ответы для разных заголовков и пользователей не смешивались, а секреты не попадали в ключ
+func responseCacheKey(task UrlRequest) string {
+	h := sha256.New()
+	h.Write([]byte(task.Url + "\n"))
+	names := make([]string, 0, len(task.Headers))
+	for name := range task.Headers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		h.Write([]byte(name + ": " + task.Headers[name] + "\n"))
+	}
+	if task.Auth != nil {
+		h.Write([]byte(task.Auth.Type + "\x00" + task.Auth.Username + "\x00" + task.Auth.Password + "\x00" + task.Auth.Token))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// memoryCacheEntry ответ в кэше в памяти
+type memoryCacheEntry struct {
+	key  string
+	resp *CachedResponse
+	// expires до какого момента хранится ответ
+	expires time.Time
+}
+
+// MemoryCache кэш ответов в памяти процесса ограниченного размера:
+// при переполнении вытесняются ответы, которые дольше всего не использовались, устаревшие ответы удаляются при обращении
+type MemoryCache struct {
+	maxBytes int64
+
+	mu   sync.Mutex
+	size int64
+	// order ответы от недавно использованных к давно использованным
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewMemoryCache создает кэш размером maxBytes байт, при maxBytes <= 0 возвращает nil (кэш выключен)
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &MemoryCache{maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get возвращает сохраненный ответ по ключу
+func (c *MemoryCache) Get(_ context.Context, key string) (*CachedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.remove(elem)
+		return nil, nil
+	}
+	c.order.MoveToFront(elem)
+	return entry.resp, nil
+}
+
+// Set сохраняет ответ по ключу на время ttl, ответ больше всего кэша не сохраняется
+func (c *MemoryCache) Set(_ context.Context, key string, resp *CachedResponse, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	size := int64(len(key)) + resp.size()
+	if size > c.maxBytes {
+		return nil
+	}
+	for c.size+size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, resp: resp, expires: time.Now().Add(ttl)})
+	c.size += size
+	return nil
+}
+
+// remove удаляет ответ из кэша, вызывается под c.mu
+func (c *MemoryCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*memoryCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.key)) + entry.resp.size()
+}
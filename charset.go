@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Кодировки текста, которые сервис перекодирует в UTF-8 (названия по стандарту WHATWG Encoding)
+const (
+	CharsetUTF8        = "utf-8"
+	CharsetUTF16LE     = "utf-16le"
+	CharsetUTF16BE     = "utf-16be"
+	CharsetWindows1251 = "windows-1251"
+	CharsetKOI8R       = "koi8-r"
+	CharsetIBM866      = "ibm866"
+	CharsetWindows1252 = "windows-1252"
+)
+
+// charsetAliases названия кодировок, встречающиеся в заголовках и HTML, и их канонические названия.
+// Как и браузеры, iso-8859-1 и us-ascii считаются windows-1252: она совпадает с ними во всех печатных символах
+var charsetAliases = map[string]string{
+	"utf-8":             CharsetUTF8,
+	"utf8":              CharsetUTF8,
+	"unicode-1-1-utf-8": CharsetUTF8,
+	"utf-16":            CharsetUTF16LE,
+	"utf-16le":          CharsetUTF16LE,
+	"utf-16be":          CharsetUTF16BE,
+	"windows-1251":      CharsetWindows1251,
+	"cp1251":            CharsetWindows1251,
+	"x-cp1251":          CharsetWindows1251,
+	"koi8-r":            CharsetKOI8R,
+	"koi8r":             CharsetKOI8R,
+	"koi8":              CharsetKOI8R,
+	"cskoi8r":           CharsetKOI8R,
+	"ibm866":            CharsetIBM866,
+	"cp866":             CharsetIBM866,
+	"866":               CharsetIBM866,
+	"csibm866":          CharsetIBM866,
+	"windows-1252":      CharsetWindows1252,
+	"cp1252":            CharsetWindows1252,
+	"x-cp1252":          CharsetWindows1252,
+	"iso-8859-1":        CharsetWindows1252,
+	"iso8859-1":         CharsetWindows1252,
+	"iso_8859-1":        CharsetWindows1252,
+	"latin1":            CharsetWindows1252,
+	"l1":                CharsetWindows1252,
+	"us-ascii":          CharsetWindows1252,
+	"ascii":             CharsetWindows1252,
+}
+
+// singleByteCharsets однобайтовые кодировки: символы для байт 0x80-0xFF, байты 0x00-0x7F совпадают с ASCII
+var singleByteCharsets = map[string][]rune{
+	CharsetWindows1251: []rune("ЂЃ‚ѓ„…†‡€‰Љ‹ЊЌЋЏђ‘’“”•–—\u0098™љ›њќћџ" +
+		"\u00a0ЎўЈ¤Ґ¦§Ё©Є«¬\u00ad®Ї°±Ііґµ¶·ё№є»јЅѕї" +
+		"АБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯ" +
+		"абвгдежзийклмнопрстуфхцчшщъыьэюя"),
+	CharsetKOI8R: []rune("─│┌┐└┘├┤┬┴┼▀▄█▌▐░▒▓⌠■∙√≈≤≥\u00a0⌡°²·÷" +
+		"═║╒ё╓╔╕╖╗╘╙╚╛╜╝╞╟╠╡Ё╢╣╤╥╦╧╨╩╪╫╬©" +
+		"юабцдефгхийклмнопярстужвьызшэщчъ" +
+		"ЮАБЦДЕФГХИЙКЛМНОПЯРСТУЖВЬЫЗШЭЩЧЪ"),
+	CharsetIBM866: []rune("АБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯ" +
+		"абвгдежзийклмноп░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+		"└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+		"рстуфхцчшщъыьэюяЁёЄєЇїЎў°∙·√№¤■\u00a0"),
+	CharsetWindows1252: []rune("€\u0081‚ƒ„…†‡ˆ‰Š‹Œ\u008dŽ\u008f\u0090‘’“”•–—˜™š›œ\u009džŸ" +
+		"\u00a0¡¢£¤¥¦§¨©ª«¬\u00ad®¯°±²³´µ¶·¸¹º»¼½¾¿" +
+		"ÀÁÂÃÄÅÆÇÈÉÊËÌÍÎÏÐÑÒÓÔÕÖ×ØÙÚÛÜÝÞß" +
+		"àáâãäåæçèéêëìíîïðñòóôõö÷øùúûüýþÿ"),
+}
+
+var (
+	// metaCharsetRe кодировка в теге meta HTML: <meta charset="..."> или <meta http-equiv="Content-Type" content="...; charset=...">
+	metaCharsetRe = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_:.-]+)`)
+	// xmlEncodingRe кодировка в объявлении XML
+	xmlEncodingRe = regexp.MustCompile(`(?i)^<\?xml[^>]+encoding\s*=\s*["']([a-z0-9_:.-]+)`)
+)
+
+// charsetSniffSize сколько первых байт тела просматривается в поисках тега meta, как в браузерах
+const charsetSniffSize = 1024
+
+// isTextContent проверяет, что тело с типом mediaType - текст, который имеет смысл перекодировать
+func isTextContent(mediaType string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+xml"), strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// detectCharset определяет кодировку текстового тела: по BOM, по параметру charset заголовка Content-Type,
+// для HTML - по тегу meta, для XML - по объявлению xml. Возвращает название кодировки в нижнем регистре
+// (каноническое, если кодировка известна), пустое - тело не текстовое или кодировка не указана
+func detectCharset(contentType string, body []byte) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !isTextContent(mediaType) {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(body, []byte("\xef\xbb\xbf")):
+		return CharsetUTF8
+	case bytes.HasPrefix(body, []byte("\xff\xfe")):
+		return CharsetUTF16LE
+	case bytes.HasPrefix(body, []byte("\xfe\xff")):
+		return CharsetUTF16BE
+	}
+	label := params["charset"]
+	if label == "" {
+		head := body[:min(len(body), charsetSniffSize)]
+		if m := xmlEncodingRe.FindSubmatch(head); m != nil {
+			label = string(m[1])
+		} else if m := metaCharsetRe.FindSubmatch(head); m != nil && mediaType == "text/html" {
+			label = string(m[1])
+		}
+	}
+	label = strings.ToLower(strings.TrimSpace(label))
+	if charset, ok := charsetAliases[label]; ok {
+		return charset
+	}
+	return label
+}
+
+// toUTF8 перекодирует тело из кодировки charset в UTF-8, false - кодировка не поддерживается.
+// Недопустимые последовательности байт заменяются на U+FFFD
+func toUTF8(body []byte, charset string) ([]byte, bool) {
+	switch charset {
+	case CharsetUTF8:
+		return bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), true
+	case CharsetUTF16LE, CharsetUTF16BE:
+		return utf16ToUTF8(body, charset == CharsetUTF16BE), true
+	}
+	table, ok := singleByteCharsets[charset]
+	if !ok {
+		return body, false
+	}
+	out := make([]byte, 0, len(body)+len(body)/2)
+	for _, b := range body {
+		if b < utf8.RuneSelf {
+			out = append(out, b)
+			continue
+		}
+		out = utf8.AppendRune(out, table[b-0x80])
+	}
+	return out, true
+}
+
+// utf16ToUTF8 перекодирует текст в UTF-16 (с BOM или без) в UTF-8
+func utf16ToUTF8(body []byte, bigEndian bool) []byte {
+	if bytes.HasPrefix(body, []byte("\xff\xfe")) || bytes.HasPrefix(body, []byte("\xfe\xff")) {
+		bigEndian = body[0] == 0xfe
+		body = body[2:]
+	}
+	units := make([]uint16, 0, len(body)/2)
+	for i := 0; i+1 < len(body); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(body[i])<<8|uint16(body[i+1]))
+		} else {
+			units = append(units, uint16(body[i+1])<<8|uint16(body[i]))
+		}
+	}
+	out := make([]byte, 0, len(body))
+	for _, r := range utf16.Decode(units) {
+		out = utf8.AppendRune(out, r)
+	}
+	if len(body)%2 != 0 {
+		// последний байт без пары (например, тело обрезано)
+		out = utf8.AppendRune(out, utf8.RuneError)
+	}
+	return out
+}
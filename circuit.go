@@ -0,0 +1,155 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCircuitFailures число неудачных запросов к хосту подряд, после которого запросы к нему временно не выполняются
+	DefaultCircuitFailures = 5
+	// DefaultCircuitCoolDown время, на которое запросы к хосту прекращаются
+	DefaultCircuitCoolDown = 30 * time.Second
+)
+
+// Состояния запросов к хосту в CircuitBreaker
+const (
+	// CircuitClosed запросы выполняются, но последние из них неудачны
+	CircuitClosed = "closed"
+	// CircuitOpen запросы не выполняются до окончания паузы
+	CircuitOpen = "open"
+	// CircuitHalfOpen пауза прошла, выполняется или ожидается пробный запрос
+	CircuitHalfOpen = "half_open"
+)
+
+// hostCircuit состояние запросов к одному хосту
+type hostCircuit struct {
+	// failures число неудачных запросов подряд
+	failures int
+	// openUntil до какого момента запросы к хосту не выполняются
+	openUntil time.Time
+	// probing после паузы выполняется пробный запрос, остальные ждут его результата
+	probing bool
+}
+
+// CircuitBreaker прекращает запросы к хосту, который несколько раз подряд не ответил:
+// после threshold неудач запросы к нему сразу завершаются ошибкой circuit_open в течение coolDown.
+// Затем выполняется один пробный запрос: при успехе запросы к хосту возобновляются, при неудаче снова прекращаются.
+// nil-значение ничего не ограничивает
+type CircuitBreaker struct {
+	threshold int
+	coolDown  time.Duration
+
+	mu sync.Mutex
+	// hosts хосты с неудачными запросами, после успешного запроса хост удаляется
+	hosts map[string]*hostCircuit
+}
+
+// NewCircuitBreaker создает CircuitBreaker, при threshold <= 0 возвращает nil (ограничение выключено)
+func NewCircuitBreaker(threshold int, coolDown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &CircuitBreaker{threshold: threshold, coolDown: coolDown, hosts: make(map[string]*hostCircuit)}
+}
+
+// Allow проверяет, можно ли сейчас выполнить запрос к host.
+// Каждый разрешенный запрос должен быть завершен вызовом Record или Abort
+func (b *CircuitBreaker) Allow(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil || c.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// Record учитывает результат запроса к host
+func (b *CircuitBreaker) Record(host string, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.hosts, host)
+		return
+	}
+	c := b.hosts[host]
+	if c == nil {
+		c = &hostCircuit{}
+		b.hosts[host] = c
+	}
+	c.failures++
+	c.probing = false
+	if c.failures >= b.threshold {
+		c.openUntil = time.Now().Add(b.coolDown)
+	}
+}
+
+// Abort завершает запрос к host, результат которого ничего не говорит о хосте (например, запрос отменен)
+func (b *CircuitBreaker) Abort(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.hosts[host]; c != nil {
+		c.probing = false
+	}
+}
+
+// stats возвращает состояние хостов с неудачными запросами, отсортированное по хосту
+func (b *CircuitBreaker) stats() []CircuitStats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	stats := make([]CircuitStats, 0, len(b.hosts))
+	for host, c := range b.hosts {
+		s := CircuitStats{Host: host, State: CircuitClosed, Failures: c.failures}
+		switch {
+		case c.failures < b.threshold:
+		case now.Before(c.openUntil) && !c.probing:
+			s.State = CircuitOpen
+			openUntil := c.openUntil
+			s.OpenUntil = &openUntil
+		default:
+			s.State = CircuitHalfOpen
+		}
+		stats = append(stats, s)
+	}
+	slices.SortFunc(stats, func(a, b CircuitStats) int { return cmp.Compare(a.Host, b.Host) })
+	return stats
+}
+
+// hostFailed проверяет, говорит ли результат запроса о неработоспособности хоста:
+// ошибка соединения или обмена по HTTP, либо ответ с кодом 5xx
+func hostFailed(result UrlResult, err error) bool {
+	if err == nil {
+		return result.StatusCode >= 500 && result.StatusCode <= 599
+	}
+	switch ErrorCode(err) {
+	case ErrorCodeDNS, ErrorCodeConnect, ErrorCodeConnectTimeout, ErrorCodeTLS, ErrorCodeReadTimeout, ErrorCodeHTTP:
+		return true
+	}
+	return false
+}
+
+// errCircuitOpen ошибка запроса к хосту, запросы к которому временно прекращены
+func errCircuitOpen(host string) error {
+	return &FetchError{Code: ErrorCodeCircuitOpen, Err: fmt.Errorf("Host %s is failing, requests to it are suspended", host)}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ClientCert клиентский сертификат для хостов, требующих взаимной TLS-аутентификации (mTLS).
+// Сертификат и ключ читаются из файлов и могут быть перечитаны через Reload без перезапуска сервера
+type ClientCert struct {
+	// Pattern хосты, для которых используется сертификат: "example.com", "*.example.com" или "*"
+	Pattern  string
+	CertFile string
+	KeyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// parseClientCert разбирает сертификат в формате [host=]cert.pem,key.pem, без хоста сертификат используется для всех
+func parseClientCert(s string) (*ClientCert, error) {
+	pattern, files, ok := strings.Cut(s, "=")
+	if !ok {
+		pattern, files = "*", s
+	}
+	certFile, keyFile, ok := strings.Cut(files, ",")
+	if pattern == "" || !ok || certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("client certificate %q must look like [host=]cert.pem,key.pem", s)
+	}
+	return &ClientCert{Pattern: strings.ToLower(pattern), CertFile: certFile, KeyFile: keyFile}, nil
+}
+
+// Reload читает сертификат и ключ из файлов. При ошибке продолжает использоваться прежний сертификат
+func (c *ClientCert) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("client certificate for %s: %v", c.Pattern, err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// getClientCertificate вызывается при TLS-рукопожатии, когда сервер запрашивает сертификат клиента
+func (c *ClientCert) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		// сертификат еще не прочитан, отправляем пустой
+		return &tls.Certificate{}, nil
+	}
+	return c.cert, nil
+}
+
+// ClientCertFlag список клиентских сертификатов, задается повторяющимся флагом
+type ClientCertFlag []*ClientCert
+
+// String возвращает сертификаты в формате флага
+func (f *ClientCertFlag) String() string {
+	var parts []string
+	for _, c := range *f {
+		parts = append(parts, c.Pattern+"="+c.CertFile+","+c.KeyFile)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set добавляет сертификат из значения флага, сами файлы читаются позже через Reload
+func (f *ClientCertFlag) Set(s string) error {
+	cert, err := parseClientCert(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, cert)
+	return nil
+}
+
+// reloadClientCerts перечитывает все сертификаты, возвращает ошибки тех, что прочитать не удалось
+func reloadClientCerts(certs []*ClientCert) error {
+	var errs []error
+	for _, c := range certs {
+		if err := c.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReloadClientCerts перечитывает клиентские сертификаты из файлов и закрывает простаивающие соединения,
+// чтобы новые соединения устанавливались уже с новыми сертификатами
+func (f *Fetcher) ReloadClientCerts() error {
+	err := reloadClientCerts(f.clientCerts)
+	if t, ok := f.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+	return err
+}
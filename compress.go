@@ -0,0 +1,132 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MinCompressSize минимальный размер ответа, начиная с которого он сжимается: маленькие ответы от сжатия только растут
+const MinCompressSize = 1024
+
+// HandleCompression сжимает ответ следующего хэндлера h в gzip, если клиент его поддерживает (Accept-Encoding)
+// и ответ не меньше MinCompressSize
+func HandleCompression(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(rw, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip разбирает заголовок Accept-Encoding и проверяет, что gzip разрешен (q > 0)
+func acceptsGzip(header string) bool {
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		coding := strings.TrimSpace(parts[0])
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter откладывает отправку ответа, пока не станет ясно, стоит ли его сжимать:
+// либо набралось MinCompressSize байт, либо хэндлер закончил работу или попросил сбросить буфер
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool         // решение о сжатии принято, заголовки отправлены
+	gz      *gzip.Writer // nil, если ответ отправляется без сжатия
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < MinCompressSize {
+			return len(p), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush отправляет все накопленное клиенту, потоковые ответы (NDJSON, SSE) без него не работают
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// decide принимает решение о сжатии по уже накопленным данным, отправляет заголовки и накопленное
+func (w *gzipResponseWriter) decide() error {
+	w.decided = true
+	header := w.Header()
+	compress := len(w.buf) >= MinCompressSize &&
+		header.Get("Content-Encoding") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified
+
+	if compress {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close завершает ответ после окончания работы хэндлера
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// NewDebugServer создает отладочный сервер на отдельном адресе addr, который не должен быть доступен пользователям:
+// профили CPU, памяти, горутин и т.д. по /debug/pprof/ и переменные expvar по /debug/vars.
+// Среди переменных expvar, помимо cmdline и memstats, публикуется server - снимок состояния сервера от stats
+func NewDebugServer(addr string, stats func() any) *http.Server {
+	expvar.Publish("server", expvar.Func(stats))
+
+	mux := http.NewServeMux()
+	// pprof.Index отдает и именованные профили: /debug/pprof/heap, /debug/pprof/goroutine и т.д.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
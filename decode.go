@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// ContentTypeText тип содержимого запроса со списком url по одному на строку
+	ContentTypeText = "text/plain"
+	// ContentTypeMultipart тип содержимого запроса с загрузкой файлов со списками url
+	ContentTypeMultipart = "multipart/form-data"
+	// MultipartOptionsField поле формы с параметрами запроса в json (все, кроме списков url)
+	MultipartOptionsField = "options"
+)
+
+// MaxRequestBodySize максимальный размер тела запроса в байтах (0 - без ограничения), задается флагом
+// -max-request-body-bytes. Тело читается в память целиком, поэтому ограничение проверяется при чтении,
+// до проверки числа url
+var MaxRequestBodySize int64 = 10 << 20
+
+// ErrRequestTooLarge тело запроса больше MaxRequestBodySize
+var ErrRequestTooLarge = errors.New("Request body is too large")
+
+// DecodeRequest читает и проверяет тело запроса со списком url.
+// Помимо json принимается обычный текст (Content-Type: text/plain) с одним url на строку
+// и загрузка файлов со списками url (multipart/form-data).
+// Текст возвращаемой ошибки предназначен для пользователя, код ответа для нее - DecodeErrorStatus
+func DecodeRequest(rw http.ResponseWriter, r *http.Request) (Urls, error) {
+	var request Urls
+
+	if MaxRequestBodySize > 0 {
+		r.Body = http.MaxBytesReader(rw, r.Body, MaxRequestBodySize)
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return request, fmt.Errorf("%w, the limit is %d bytes", ErrRequestTooLarge, tooLarge.Limit)
+	}
+	if err != nil {
+		return request, errors.New("Could not read body")
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case ContentTypeText:
+		if request.Urls, err = parseUrlList(body); err != nil {
+			return request, err
+		}
+
+	case ContentTypeMultipart:
+		if err = decodeMultipart(body, params["boundary"], &request); err != nil {
+			return request, err
+		}
+
+	default:
+		if err = json.Unmarshal(body, &request); err != nil {
+			return request, errors.New("Incorrect json in request")
+		}
+	}
+
+	return request, request.Validate()
+}
+
+// DecodeErrorStatus возвращает код ответа на ошибку DecodeRequest: 413 для слишком большого тела, иначе 400
+func DecodeErrorStatus(err error) int {
+	if errors.Is(err, ErrRequestTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// parseUrlList разбирает список url по одному на строку.
+// Пустые строки и строки-комментарии, начинающиеся с #, пропускаются.
+// Строка длиннее bufio.MaxScanTokenSize - ошибка, а не конец списка
+func parseUrlList(body []byte) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("Line %d of the url list is longer than %d bytes", lines+1, bufio.MaxScanTokenSize)
+		}
+		return nil, errors.New("Could not read url list")
+	}
+	return urls, nil
+}
+
+// decodeMultipart разбирает форму с файлами списков url: текстовыми (один url на строку) и csv.
+// Поле формы MultipartOptionsField может содержать остальные параметры запроса в json
+func decodeMultipart(body []byte, boundary string, request *Urls) error {
+	if boundary == "" {
+		return errors.New("Incorrect multipart request")
+	}
+
+	// списки url из файлов дописываются к спискам из параметров, в каком бы порядке ни шли поля формы
+	var urls []string
+	var requests []UrlRequest
+
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New("Incorrect multipart request")
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return errors.New("Could not read body")
+		}
+
+		switch {
+		case part.FormName() == MultipartOptionsField:
+			if err = json.Unmarshal(content, request); err != nil {
+				return errors.New("Incorrect json in options")
+			}
+
+		case part.FileName() == "":
+			// прочие поля формы не используются
+
+		case isCSVPart(part):
+			rows, err := parseUrlCSV(content)
+			if err != nil {
+				return fmt.Errorf("Incorrect csv file %s: %v", part.FileName(), err)
+			}
+			requests = append(requests, rows...)
+
+		default:
+			list, err := parseUrlList(content)
+			if err != nil {
+				return fmt.Errorf("Incorrect file %s: %v", part.FileName(), err)
+			}
+			urls = append(urls, list...)
+		}
+	}
+
+	request.Urls = append(request.Urls, urls...)
+	request.Requests = append(request.Requests, requests...)
+	return nil
+}
+
+// isCSVPart проверяет, что загруженный файл в формате csv (по типу содержимого или расширению)
+func isCSVPart(part *multipart.Part) bool {
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	return mediaType == "text/csv" || strings.EqualFold(path.Ext(part.FileName()), ".csv")
+}
+
+// parseUrlCSV разбирает csv со списком url и параметрами их запроса.
+// Если первая строка содержит колонку url, она считается заголовком: колонки url, method, body,
+// а колонки вида header:Имя задают заголовки запроса. Без заголовка колонки идут по порядку: url, method, body
+func parseUrlCSV(content []byte) ([]UrlRequest, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{"url", "method", "body"}
+	if len(rows) > 0 {
+		for _, name := range rows[0] {
+			if strings.EqualFold(strings.TrimSpace(name), "url") {
+				columns, rows = rows[0], rows[1:]
+				break
+			}
+		}
+	}
+
+	requests := make([]UrlRequest, 0, len(rows))
+	for _, row := range rows {
+		var req UrlRequest
+		for i, value := range row {
+			if i >= len(columns) || value == "" {
+				continue
+			}
+			column := strings.TrimSpace(columns[i])
+			switch {
+			case strings.EqualFold(column, "url"):
+				req.Url = strings.TrimSpace(value)
+			case strings.EqualFold(column, "method"):
+				req.Method = strings.ToUpper(strings.TrimSpace(value))
+			case strings.EqualFold(column, "body"):
+				req.Body = value
+			case len(column) > len("header:") && strings.EqualFold(column[:len("header:")], "header:"):
+				if req.Headers == nil {
+					req.Headers = make(map[string]string)
+				}
+				req.Headers[column[len("header:"):]] = value
+			}
+		}
+		// пустые строки пропускаем
+		if req.Url == "" && req.Method == "" && req.Body == "" && req.Headers == nil {
+			continue
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
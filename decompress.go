@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// AcceptEncoding значение Accept-Encoding для запросов url, если пользователь не задал свое: кодировки,
+// которые сервис распаковывает
+const AcceptEncoding = "gzip, deflate, br"
+
+// decodeBody возвращает тело ответа, распакованное по заголовку Content-Encoding, и счетчик байт, полученных
+// в сжатом виде. Если тело не сжато или сжато неподдерживаемой кодировкой, тело возвращается как есть, а счетчик nil
+func decodeBody(resp *http.Response) (io.Reader, *countingReader, error) {
+	raw := bufio.NewReader(resp.Body)
+	if _, err := raw.Peek(1); err == io.EOF {
+		// пустое тело (например, у ответа 304) распаковывать нечего, хотя Content-Encoding бывает указан
+		return raw, nil, nil
+	}
+	var codings []string
+	for _, value := range resp.Header.Values("Content-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	if len(codings) == 0 || slices.ContainsFunc(codings, func(coding string) bool {
+		return coding != "gzip" && coding != "x-gzip" && coding != "deflate" && coding != "br"
+	}) {
+		return raw, nil, nil
+	}
+
+	compressed := &countingReader{r: raw}
+	var body io.Reader = compressed
+	// кодировки перечислены в порядке применения, снимаются в обратном
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = newDeflateReader(body)
+		case "br":
+			body = brotli.NewReader(body)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("decompress %s body: %w", codings[i], err)
+		}
+	}
+	return body, compressed, nil
+}
+
+// newDeflateReader распаковывает тело в кодировке deflate: по стандарту это поток zlib,
+// но часть серверов отправляет поток deflate без обертки zlib
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// заголовок zlib: метод сжатия 8 (deflate), а два байта вместе кратны 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
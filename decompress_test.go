@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestDecodeBody(t *testing.T) {
+	text := bytes.Repeat([]byte("compressed body "), 64)
+	var gz, br, gzbr bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(text)
+	gw.Close()
+	bw := brotli.NewWriter(&br)
+	bw.Write(text)
+	bw.Close()
+	// gzip, затем br
+	bw = brotli.NewWriter(&gzbr)
+	bw.Write(gz.Bytes())
+	bw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte
+		// compressed сколько байт получено в сжатом виде, 0 - тело возвращается как есть
+		compressed int64
+	}{
+		{"identity", "", text, text, 0},
+		{"gzip", "gzip", gz.Bytes(), text, int64(gz.Len())},
+		{"brotli", "br", br.Bytes(), text, int64(br.Len())},
+		{"gzip and brotli", "gzip, br", gzbr.Bytes(), text, int64(gzbr.Len())},
+		{"unknown coding", "zstd", br.Bytes(), br.Bytes(), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(tt.body))}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			body, counter, err := decodeBody(resp)
+			if err != nil {
+				t.Fatalf("decodeBody() error = %v", err)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			var compressed int64
+			if counter != nil {
+				compressed = counter.n
+			}
+			if compressed != tt.compressed {
+				t.Errorf("compressed length = %d, want %d", compressed, tt.compressed)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// NetworkFlag список сетей, задается повторяющимся флагом: сеть в формате CIDR или отдельный адрес
+type NetworkFlag []netip.Prefix
+
+// String возвращает сети в формате флага
+func (f *NetworkFlag) String() string {
+	var parts []string
+	for _, p := range *f {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set добавляет сеть из значения флага
+func (f *NetworkFlag) Set(s string) error {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return fmt.Errorf("%q is neither a CIDR nor an IP address", s)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	*f = append(*f, prefix.Masked())
+	return nil
+}
+
+// dialGuard не дает устанавливать соединения с внутренними адресами (loopback, частные сети, link-local, multicast),
+// чтобы через сервис нельзя было обратиться к нему самому и к его окружению.
+// Проверяется адрес, с которым действительно устанавливается соединение, т.е. после разрешения имени хоста
+// и для каждого перенаправления
+type dialGuard struct {
+	// allowed внутренние сети, соединения с которыми все же разрешены
+	allowed []netip.Prefix
+}
+
+// blockedAddr проверяет, относится ли адрес к запрещенным
+func (g *dialGuard) blockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified()
+}
+
+// checkProxyTarget проверяет хост url перед запросом через прокси: адрес хоста разрешает уже прокси,
+// поэтому заранее можно проверить только адрес, записанный в url, и localhost. Хост, оканчивающийся
+// на число (например, 2130706433 или 0x7f.1), прокси может понять как адрес IPv4, а проверить его нельзя
+func (g *dialGuard) checkProxyTarget(host string) error {
+	host = normalizeHost(host)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if g.blockedAddr(addr) {
+			return &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Address %s is not allowed", addr.Unmap())}
+		}
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		if g.blockedAddr(netip.IPv6Loopback()) || g.blockedAddr(netip.AddrFrom4([4]byte{127, 0, 0, 1})) {
+			return &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Host %s is not allowed", host)}
+		}
+		return nil
+	}
+	label := host[strings.LastIndexByte(host, '.')+1:]
+	if _, err := strconv.ParseUint(label, 0, 32); err == nil {
+		return &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Numeric host %s is not allowed", host)}
+	}
+	return nil
+}
+
+// control вызывается net.Dialer перед установкой каждого соединения с уже известным адресом
+func (g *dialGuard) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Could not check address %s: %v", address, err)}
+	}
+	if g.blockedAddr(addrPort.Addr()) {
+		return &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Address %s is not allowed", addrPort.Addr())}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxDiffLines максимальное число строк в каждом из тел, для которых строится текстовый diff
+	MaxDiffLines = 10000
+	// MaxDiffEdits максимальное число отличающихся строк, при большем текстовый diff не строится
+	MaxDiffEdits = 1000
+	// diffContext число неизмененных строк вокруг изменений в текстовом diff
+	diffContext = 3
+)
+
+// BodyDiff результат сравнения тел ответов двух url в режиме "diff": true
+type BodyDiff struct {
+	// Identical тела ответов совпадают побайтно
+	Identical bool `json:"identical"`
+	// SizeDelta разница размеров тел: второй url минус первый
+	SizeDelta int64 `json:"size_delta"`
+	// Unified текстовый diff в формате unified, только для отличающихся текстовых тел,
+	// если строк и отличий не больше MaxDiffLines и MaxDiffEdits
+	Unified string `json:"unified,omitempty"`
+}
+
+// diffResults сравнивает тела ответов двух url (первым считается url с меньшим номером в запросе).
+// Если url не два или один из них обработан с ошибкой, возвращает nil
+func diffResults(results []UrlResult) *BodyDiff {
+	if len(results) != 2 || results[0].Error != "" || results[1].Error != "" {
+		return nil
+	}
+	from, to := results[0], results[1]
+	if from.Index > to.Index {
+		from, to = to, from
+	}
+
+	diff := &BodyDiff{SizeDelta: to.ContentLength - from.ContentLength}
+	if from.SHA256 != "" || to.SHA256 != "" {
+		// в режиме хэша самих тел нет, сравниваем хэши
+		diff.Identical = from.SHA256 == to.SHA256
+		return diff
+	}
+	diff.Identical = bytes.Equal(from.Response, to.Response)
+	if !diff.Identical && utf8.Valid(from.Response) && utf8.Valid(to.Response) {
+		diff.Unified = unifiedDiff(from.Url, to.Url, splitLines(from.Response), splitLines(to.Response))
+	}
+	return diff
+}
+
+// splitLines разбивает текст на строки без завершающих переводов строки
+func splitLines(text []byte) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+}
+
+// diffOp одна операция редакционного предписания: ' ' - строка без изменений, '-' - удалена, '+' - добавлена
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines строит кратчайшее редакционное предписание, превращающее a в b (алгоритм Майерса).
+// Если отличий больше maxEdits, возвращает false
+func diffLines(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	// v[offset+k] - самая дальняя позиция x на диагонали k = x - y
+	offset := maxEdits + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] - значения v на диагоналях -d-1..d+1 перед шагом d, нужны для восстановления пути
+	var trace [][]int
+
+	for d := 0; d <= maxEdits; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// backtrackDiff восстанавливает редакционное предписание по сохраненным шагам алгоритма Майерса
+func backtrackDiff(a, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		// значение на диагонали k перед шагом d
+		at := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[prevY]})
+			} else {
+				ops = append(ops, diffOp{'-', a[prevX]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	// операции собраны с конца
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff строит текстовый diff в формате unified, пустая строка - если текст слишком большой
+// или отличий слишком много
+func unifiedDiff(fromName, toName string, a, b []string) string {
+	if len(a) > MaxDiffLines || len(b) > MaxDiffLines {
+		return ""
+	}
+	ops, ok := diffLines(a, b, MaxDiffEdits)
+	if !ok {
+		return ""
+	}
+
+	// aPos[i], bPos[i] - число строк a и b перед операцией i
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// изменения, между которыми не больше 2*diffContext одинаковых строк, попадают в один блок
+		end := i + 1
+		for j := end; j < len(ops) && j-end <= 2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aPos[start], aPos[end]), hunkRange(bPos[start], bPos[end]))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange форматирует диапазон строк блока diff: номер первой строки (с единицы) и их число
+func hunkRange(from, to int) string {
+	if to == from {
+		// пустой диапазон указывается строкой перед ним
+		return fmt.Sprintf("%d,0", from)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDNSCacheTTL максимальное время хранения разрешенного имени хоста в кэше
+	DefaultDNSCacheTTL = time.Minute
+	// DefaultDNSNegativeTTL максимальное время хранения в кэше имени, для которого нет адресов
+	DefaultDNSNegativeTTL = 5 * time.Second
+	// maxDNSCacheEntries сколько имен хостов может храниться в кэше
+	maxDNSCacheEntries = 10000
+	// dnsLookupTimeout максимальное время разрешения одного имени
+	dnsLookupTimeout = 10 * time.Second
+	// dnsUDPSize размер буфера для ответа по UDP
+	dnsUDPSize = 4096
+	// dnsMessageType тип содержимого запросов и ответов DNS-over-HTTPS
+	dnsMessageType = "application/dns-message"
+)
+
+// Типы DNS-записей и коды ответа, с которыми работает DNSResolver
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+)
+
+// dialFunc функция установки соединений, как у net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dnsEntry разрешенное имя хоста в кэше
+type dnsEntry struct {
+	addrs []netip.Addr
+	err   error
+	// expires до какого момента результат можно использовать
+	expires time.Time
+	// ready закрывается, когда имя разрешено; до этого все запросы имени ждут одного разрешения
+	ready chan struct{}
+}
+
+// DNSResolver разрешает имена хостов и хранит результаты в кэше, чтобы url на одних и тех же хостах
+// не разрешали их имена каждый раз. Одновременные запросы одного имени ждут одного разрешения.
+// Если задан server, имена разрешаются запросами к нему напрямую (по UDP и TCP или DNS-over-HTTPS, если это url)
+// и хранятся не дольше TTL записей, иначе используется системный резолвер и результаты хранятся ttl.
+// Имена без адресов (NXDOMAIN или нет записей) хранятся не дольше negativeTTL, прочие ошибки не кэшируются.
+// nil-значение разрешает имена системным резолвером без кэша
+type DNSResolver struct {
+	// server адрес DNS-сервера (host:port) или url сервера DNS-over-HTTPS, пустой - системный резолвер
+	server string
+	// doh клиент DNS-over-HTTPS, nil - запросы к server по UDP и TCP
+	doh         *http.Client
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*dnsEntry
+	// lookups обращения к кэшу: найденные имена, в том числе разрешаемые для другого запроса, и не найденные
+	lookups cacheCounter
+}
+
+// NewDNSResolver создает DNSResolver, если кэш выключен (ttl <= 0) и сервер не задан, возвращает nil.
+// Сертификат сервера DNS-over-HTTPS проверяется по rootCAs (nil - системные корневые сертификаты)
+func NewDNSResolver(server string, ttl, negativeTTL time.Duration, rootCAs *x509.CertPool) *DNSResolver {
+	if server == "" && ttl <= 0 {
+		return nil
+	}
+	r := &DNSResolver{server: server, ttl: ttl, negativeTTL: negativeTTL, cache: make(map[string]*dnsEntry)}
+	if strings.HasPrefix(server, "https://") {
+		// имя самого сервера DoH разрешается системным резолвером
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if rootCAs != nil {
+			transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+		}
+		r.doh = &http.Client{Transport: transport}
+	}
+	return r
+}
+
+// parseDNSServer проверяет адрес DNS-сервера: host, host:port (по умолчанию порт 53) или https-url сервера DoH
+func parseDNSServer(s string) (string, error) {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return "", fmt.Errorf("DNS-over-HTTPS server %q must be an https url", s)
+		}
+		return s, nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return net.JoinHostPort(s, "53"), nil
+	}
+	return s, nil
+}
+
+// LookupNetIP возвращает адреса хоста
+func (r *DNSResolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if r == nil {
+		return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	e := r.cache[host]
+	hit := true
+	if e == nil || isClosed(e.ready) && !time.Now().Before(e.expires) {
+		e = &dnsEntry{ready: make(chan struct{})}
+		r.store(host, e)
+		// имя разрешается независимо от ctx: результат нужен и другим запросам
+		go r.resolve(host, e)
+		hit = false
+	}
+	r.mu.Unlock()
+	r.lookups.record(hit)
+
+	select {
+	case <-e.ready:
+		return e.addrs, e.err
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: errors.Is(ctx.Err(), context.DeadlineExceeded)}
+	}
+}
+
+// stats возвращает обращения к кэшу, для nil-значения - nil
+func (r *DNSResolver) stats() *CacheStats {
+	if r == nil {
+		return nil
+	}
+	return r.lookups.stats()
+}
+
+// isClosed проверяет, закрыт ли канал
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// store сохраняет e в кэше, вызывается под r.mu.
+// Если кэш заполнен, из него удаляются устаревшие имена, а если таких нет - e не сохраняется
+func (r *DNSResolver) store(host string, e *dnsEntry) {
+	if len(r.cache) >= maxDNSCacheEntries {
+		now := time.Now()
+		for h, old := range r.cache {
+			if isClosed(old.ready) && !now.Before(old.expires) {
+				delete(r.cache, h)
+			}
+		}
+	}
+	if len(r.cache) < maxDNSCacheEntries {
+		r.cache[host] = e
+	}
+}
+
+// resolve разрешает имя хоста и сохраняет результат в e
+func (r *DNSResolver) resolve(host string, e *dnsEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	var ttl time.Duration
+	if r.server != "" {
+		e.addrs, ttl, e.err = r.lookupServer(ctx, host)
+	} else {
+		e.addrs, e.err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		ttl = r.ttl
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(e.err, &dnsErr) && dnsErr.IsNotFound {
+		ttl = min(ttl, r.negativeTTL)
+	} else if e.err != nil {
+		ttl = 0
+	}
+	ttl = min(ttl, r.ttl)
+
+	r.mu.Lock()
+	e.expires = time.Now().Add(ttl)
+	if ttl <= 0 && r.cache[host] == e {
+		delete(r.cache, host)
+	}
+	r.mu.Unlock()
+	close(e.ready)
+}
+
+// dnsResponse разобранный ответ DNS-сервера
+type dnsResponse struct {
+	rcode int
+	addrs []netip.Addr
+	// ttl наименьший TTL записей ответа
+	ttl uint32
+	// negativeTTL сколько можно хранить отсутствие записей (по записи SOA), если ее нет - 0
+	negativeTTL uint32
+}
+
+// lookupServer разрешает имя запросами записей A и AAAA к r.server, возвращает адреса и время,
+// на которое их можно сохранить (для имени без адресов - время хранения отрицательного ответа)
+func (r *DNSResolver) lookupServer(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	type result struct {
+		resp dnsResponse
+		err  error
+	}
+	qtypes := []uint16{dnsTypeA, dnsTypeAAAA}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].resp, results[i].err = r.exchange(ctx, host, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var ttl, negativeTTL time.Duration = -1, -1
+	var lastErr error
+	notFound := true
+	for _, res := range results {
+		if res.err != nil {
+			lastErr, notFound = res.err, false
+			continue
+		}
+		switch {
+		case len(res.resp.addrs) > 0:
+			addrs = append(addrs, res.resp.addrs...)
+			if t := time.Duration(res.resp.ttl) * time.Second; ttl < 0 || t < ttl {
+				ttl = t
+			}
+		case res.resp.rcode == dnsRcodeSuccess || res.resp.rcode == dnsRcodeNXDomain:
+			if t := time.Duration(res.resp.negativeTTL) * time.Second; res.resp.negativeTTL > 0 && (negativeTTL < 0 || t < negativeTTL) {
+				negativeTTL = t
+			}
+		default:
+			lastErr, notFound = fmt.Errorf("server misbehaving (rcode %d)", res.resp.rcode), false
+		}
+	}
+
+	switch {
+	case len(addrs) > 0:
+		return addrs, ttl, nil
+	case notFound:
+		if negativeTTL < 0 {
+			negativeTTL = r.negativeTTL
+		}
+		return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: host, Server: r.server, IsNotFound: true}
+	}
+	var netErr net.Error
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host, Server: r.server,
+		IsTimeout: errors.As(lastErr, &netErr) && netErr.Timeout(), IsTemporary: true}
+}
+
+// exchange отправляет r.server запрос записей qtype для host по UDP, а если ответ не поместился - по TCP.
+// Для сервера DNS-over-HTTPS запрос отправляется по HTTPS
+func (r *DNSResolver) exchange(ctx context.Context, host string, qtype uint16) (dnsResponse, error) {
+	id := uint16(rand.N(1 << 16))
+	if r.doh != nil {
+		// в DoH id запроса 0, чтобы ответы могли кэшироваться по HTTP (RFC 8484)
+		id = 0
+	}
+	query, err := dnsQuery(id, host, qtype)
+	if err != nil {
+		return dnsResponse{}, err
+	}
+	if r.doh != nil {
+		msg, err := r.roundTripHTTPS(ctx, query)
+		if err != nil {
+			return dnsResponse{}, err
+		}
+		resp, _, err := parseDNSResponse(msg, id, qtype)
+		return resp, err
+	}
+	msg, err := r.roundTrip(ctx, "udp", query)
+	if err != nil {
+		return dnsResponse{}, err
+	}
+	resp, truncated, err := parseDNSResponse(msg, id, qtype)
+	if err != nil || !truncated {
+		return resp, err
+	}
+	if msg, err = r.roundTrip(ctx, "tcp", query); err != nil {
+		return dnsResponse{}, err
+	}
+	resp, _, err = parseDNSResponse(msg, id, qtype)
+	return resp, err
+}
+
+// roundTrip отправляет запрос r.server и читает ответ; по TCP сообщения предваряются двухбайтовой длиной
+func (r *DNSResolver) roundTrip(ctx context.Context, network string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// roundTripHTTPS отправляет запрос серверу DNS-over-HTTPS методом POST и читает ответ
+func (r *DNSResolver) roundTripHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := r.doh.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server responded with status %d", resp.StatusCode)
+	}
+	// DNS-сообщение не бывает длиннее 64 КБ
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+}
+
+// dnsQuery формирует рекурсивный запрос записей qtype для name
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	// заголовок: id, флаг RD (нужна рекурсия), один вопрос
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, &net.DNSError{Err: "invalid host name", Name: name, IsNotFound: true}
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	// класс IN
+	return binary.BigEndian.AppendUint16(msg, 1), nil
+}
+
+// errDNSMalformed ответ DNS-сервера не удалось разобрать
+var errDNSMalformed = errors.New("malformed DNS response")
+
+// skipDNSName возвращает смещение после имени, начинающегося в msg со смещения off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			// ссылка на имя в другом месте сообщения завершает имя
+			if off+2 > len(msg) {
+				return 0, errDNSMalformed
+			}
+			return off + 2, nil
+		}
+		off += 1 + l
+	}
+}
+
+// parseDNSResponse разбирает ответ на запрос id записей qtype, возвращает также, был ли ответ обрезан.
+// Адреса собираются из всех записей qtype ответа, в том числе полученных по цепочке CNAME
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) (dnsResponse, bool, error) {
+	var resp dnsResponse
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return resp, false, errDNSMalformed
+	}
+	truncated := msg[2]&0x02 != 0
+	resp.rcode = int(msg[3] & 0x0f)
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	authorities := int(binary.BigEndian.Uint16(msg[8:]))
+
+	off := 12
+	var err error
+	for range questions {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return resp, false, err
+		}
+		off += 4
+	}
+
+	first := true
+	for i := range answers + authorities {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return resp, false, err
+		}
+		if off+10 > len(msg) {
+			return resp, false, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdata := off + 10
+		off = rdata + int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off > len(msg) {
+			return resp, false, errDNSMalformed
+		}
+
+		if i < answers {
+			// TTL цепочки CNAME - наименьший TTL ее записей
+			if first || ttl < resp.ttl {
+				resp.ttl, first = ttl, false
+			}
+			if rtype == qtype {
+				if addr, ok := netip.AddrFromSlice(msg[rdata:off]); ok {
+					resp.addrs = append(resp.addrs, addr.Unmap())
+				}
+			}
+			continue
+		}
+		if rtype == dnsTypeSOA {
+			// отрицательный ответ хранится не дольше TTL записи SOA и ее поля minimum (RFC 2308)
+			end := rdata
+			for range 2 {
+				if end, err = skipDNSName(msg, end); err != nil {
+					return resp, false, err
+				}
+			}
+			if end+20 > off {
+				return resp, false, errDNSMalformed
+			}
+			resp.negativeTTL = min(ttl, binary.BigEndian.Uint32(msg[end+16:]))
+		}
+	}
+	return resp, truncated, nil
+}
+
+// filterAddrFamily оставляет адреса, подходящие для сети network: tcp4 и udp4 - только IPv4, tcp6 и udp6 - только IPv6
+func filterAddrFamily(addrs []netip.Addr, network string) []netip.Addr {
+	var want4 bool
+	switch network {
+	case "tcp4", "udp4":
+		want4 = true
+	case "tcp6", "udp6":
+	default:
+		return addrs
+	}
+	var filtered []netip.Addr
+	for _, a := range addrs {
+		// системный резолвер может вернуть IPv4-адрес в виде IPv6 (::ffff:a.b.c.d)
+		if a.Unmap().Is4() == want4 {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
+// dialContext возвращает функцию установки соединений, разрешающую имя хоста через r
+// и соединяющуюся по очереди с его адресами через dialer
+func (r *DNSResolver) dialContext(dialer *net.Dialer) dialFunc {
+	if r == nil {
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		// этапы разрешения имени отмечаются в трассировке, как это делает net.Dialer
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.DNSStart != nil {
+			trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+		}
+		addrs, err := r.LookupNetIP(ctx, host)
+		if trace != nil && trace.DNSDone != nil {
+			info := httptrace.DNSDoneInfo{Err: err}
+			for _, a := range addrs {
+				info.Addrs = append(info.Addrs, net.IPAddr{IP: a.AsSlice()})
+			}
+			trace.DNSDone(info)
+		}
+		if err == nil {
+			addrs = filterAddrFamily(addrs, network)
+			if len(addrs) == 0 {
+				err = &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+			}
+		}
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+
+		var deadline time.Time
+		if dialer.Timeout > 0 {
+			deadline = time.Now().Add(dialer.Timeout)
+		}
+		if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+		return dialParallel(ctx, dialer, network, port, addrs, deadline)
+	}
+}
+
+// dialSerial соединяется по очереди с адресами addrs до первого успешного соединения.
+// Время до deadline делится поровну между оставшимися адресами, как у net.Dialer
+func dialSerial(ctx context.Context, dialer *net.Dialer, network, port string, addrs []netip.Addr, deadline time.Time) (net.Conn, error) {
+	var err error
+	for i, a := range addrs {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		if !deadline.IsZero() {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+		}
+		var conn net.Conn
+		conn, err = dialer.DialContext(attemptCtx, network, net.JoinHostPort(a.String(), port))
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// dialParallel соединяется с адресами семейства первого адреса, а если за dialer.FallbackDelay соединиться
+// не удалось, параллельно и с адресами другого семейства (Happy Eyeballs, как у net.Dialer).
+// Возвращается первое установленное соединение, остальные закрываются
+func dialParallel(ctx context.Context, dialer *net.Dialer, network, port string, addrs []netip.Addr, deadline time.Time) (net.Conn, error) {
+	var primaries, fallbacks []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == addrs[0].Is4() {
+			primaries = append(primaries, a)
+		} else {
+			fallbacks = append(fallbacks, a)
+		}
+	}
+	if len(fallbacks) == 0 || dialer.FallbackDelay < 0 {
+		return dialSerial(ctx, dialer, network, port, addrs, deadline)
+	}
+	delay := dialer.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	race := func(addrs []netip.Addr, primary bool) {
+		conn, err := dialSerial(ctx, dialer, network, port, addrs, deadline)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-returned:
+			// соединение уже установлено с другим адресом
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go race(primaries, true)
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+	var primaryErr error
+	var primaryDone, fallbackDone bool
+	for {
+		select {
+		case <-fallbackTimer.C:
+			go race(fallbacks, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryDone, primaryErr = true, res.err
+				// основные адреса недоступны: запасные пробуем сразу, не дожидаясь задержки
+				if fallbackTimer.Stop() {
+					fallbackTimer.Reset(0)
+				}
+			} else {
+				fallbackDone = true
+			}
+			if primaryDone && fallbackDone {
+				return nil, primaryErr
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// Категории ошибок запроса url, возвращаются пользователю вместе с текстом ошибки
+const (
+	// ErrorCodeInvalidUrl url или запрос к нему не удалось составить
+	ErrorCodeInvalidUrl = "invalid_url"
+	// ErrorCodeDNS не удалось получить адрес хоста
+	ErrorCodeDNS = "dns_error"
+	// ErrorCodeConnect не удалось установить соединение (отказ в соединении, хост недоступен)
+	ErrorCodeConnect = "connect_error"
+	// ErrorCodeConnectTimeout таймаут истек до установки соединения
+	ErrorCodeConnectTimeout = "connect_timeout"
+	// ErrorCodeTLS ошибка TLS-рукопожатия или проверки сертификата (для SFTP - ключа сервера)
+	ErrorCodeTLS = "tls_error"
+	// ErrorCodeReadTimeout таймаут истек после установки соединения, при ожидании или чтении ответа
+	ErrorCodeReadTimeout = "read_timeout"
+	// ErrorCodeTooLarge тело ответа больше разрешенного размера
+	ErrorCodeTooLarge = "too_large"
+	// ErrorCodeHeadersTooLarge заголовки ответа больше разрешенного размера или их слишком много
+	ErrorCodeHeadersTooLarge = "headers_too_large"
+	// ErrorCodeUnexpectedStatus код ответа не входит в список ожидаемых
+	ErrorCodeUnexpectedStatus = "unexpected_status"
+	// ErrorCodeBudgetExceeded url не запрашивался из-за исчерпания бюджета max_total_bytes
+	ErrorCodeBudgetExceeded = "budget_exceeded"
+	// ErrorCodeBlockedByPolicy запрос к адресу url запрещен настройками сервера
+	ErrorCodeBlockedByPolicy = "blocked_by_policy"
+	// ErrorCodeCircuitOpen запросы к хосту временно прекращены после нескольких неудач подряд
+	ErrorCodeCircuitOpen = "circuit_open"
+	// ErrorCodeCancelled url не обработан из-за отмены
+	ErrorCodeCancelled = "cancelled"
+	// ErrorCodeDeadlineExceeded обработка запроса не уложилась в срок, отведенный сервером на запрос
+	ErrorCodeDeadlineExceeded = "deadline_exceeded"
+	// ErrorCodeHTTP прочие ошибки обмена по HTTP (некорректный ответ, слишком много перенаправлений и т.п.)
+	ErrorCodeHTTP = "http_error"
+)
+
+// FetchError ошибка запроса url с категорией, известной в месте ее возникновения
+type FetchError struct {
+	Code string
+	Err  error
+}
+
+func (e *FetchError) Error() string { return e.Err.Error() }
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// ErrorCode возвращает категорию ошибки запроса url
+func ErrorCode(err error) string {
+	var fetchErr *FetchError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &fetchErr):
+		return fetchErr.Code
+	case errors.Is(err, ErrBodyTooLarge):
+		return ErrorCodeTooLarge
+	case errors.Is(err, ErrUnexpectedStatus):
+		return ErrorCodeUnexpectedStatus
+	case errors.Is(err, ErrBudgetExceeded):
+		return ErrorCodeBudgetExceeded
+	case errors.Is(err, ErrCancelled):
+		return ErrorCodeCancelled
+	case errors.Is(err, ErrDeadlineExceeded):
+		return ErrorCodeDeadlineExceeded
+	case errors.As(err, &dnsErr):
+		return ErrorCodeDNS
+	case errors.As(err, &certErr), errors.As(err, &alertErr), errors.As(err, &recordErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorCodeTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return ErrorCodeConnectTimeout
+		}
+		return ErrorCodeConnect
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorCodeReadTimeout
+	}
+	return ErrorCodeHTTP
+}
@@ -0,0 +1,29 @@
+package main
+
+import "context"
+
+// fetchWithFallbacks запрашивает url из task (с повторами и проверкой кода ответа), а если это не удалось -
+// по очереди его запасные url, пока один из них не ответит успешно.
+// Возвращает результат первого успешного запроса или последнего неудачного.
+// В результате всегда указывается url из task, а запасной url, с которого получен результат, - в FallbackUrl
+func (f *Fetcher) fetchWithFallbacks(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	candidate := task
+	for i := 0; ; i++ {
+		result, err := f.RequestUrlWithRetries(ctx, candidate, opts)
+		if err == nil {
+			err = checkStatus(candidate, result)
+		}
+		if i > 0 {
+			result.Url = task.Url
+			result.FallbackUrl = candidate.Url
+		}
+		if err == nil || i == len(task.Fallbacks) {
+			return result, err
+		}
+
+		if ctx.Err() != nil {
+			return result, err
+		}
+		candidate.Url = task.Fallbacks[i]
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultMaxIdleConnsPerHost число простаивающих соединений с одним хостом, которые держатся открытыми для повторного использования
+	DefaultMaxIdleConnsPerHost = 16
+	// DefaultIdleConnTimeout время, через которое простаивающее соединение закрывается
+	DefaultIdleConnTimeout = 90 * time.Second
+	// DefaultConnectTimeout время на установку TCP-соединения с хостом
+	DefaultConnectTimeout = 30 * time.Second
+	// DefaultTCPKeepAlive период проверки простаивающих TCP-соединений (keep-alive)
+	DefaultTCPKeepAlive = 30 * time.Second
+	// DefaultMaxResponseHeaderBytes максимальный размер заголовков ответа
+	DefaultMaxResponseHeaderBytes = 1 << 20
+	// DefaultMaxResponseHeaders максимальное число заголовков ответа (повторяющиеся заголовки считаются каждый)
+	DefaultMaxResponseHeaders = 200
+	// DefaultFallbackDelay через сколько, не дождавшись соединения по IPv6, параллельно пробовать IPv4 (Happy Eyeballs)
+	DefaultFallbackDelay = 300 * time.Millisecond
+)
+
+// FetcherConfig настройки Fetcher
+type FetcherConfig struct {
+	// MaxIdleConnsPerHost число простаивающих соединений с одним хостом, которые держатся открытыми
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout время, через которое простаивающее соединение закрывается
+	IdleConnTimeout time.Duration
+	// ConnectTimeout время на установку TCP-соединения, 0 - ограничено только таймаутом url.
+	// Таймаут url при этом действует на весь запрос, так что соединение ограничено меньшим из них
+	ConnectTimeout time.Duration
+	// TCPKeepAlive период проверки простаивающих соединений, отрицательный - без проверки
+	TCPKeepAlive time.Duration
+	// FallbackDelay через сколько, не дождавшись соединения по IPv6, параллельно пробовать IPv4,
+	// отрицательный - адреса пробуются строго по очереди
+	FallbackDelay time.Duration
+	// MaxResponseHeaderBytes максимальный размер заголовков ответа, 0 - по умолчанию net/http
+	MaxResponseHeaderBytes int64
+	// MaxResponseHeaders максимальное число заголовков ответа, 0 - без ограничения
+	MaxResponseHeaders int
+	// Retries политика повторов для url, в запросе которых повторы не заданы (только GET и HEAD)
+	Retries RetryPolicy
+	// CircuitFailures число неудачных запросов к хосту подряд, после которого запросы к нему прекращаются, 0 - не прекращать
+	CircuitFailures int
+	// CircuitCoolDown время, на которое прекращаются запросы к хосту
+	CircuitCoolDown time.Duration
+	// RateLimits ограничения частоты запросов к хостам
+	RateLimits []RateLimit
+	// MaxConnsPerHost число одновременных запросов к одному хосту, 0 - без ограничения
+	MaxConnsPerHost int
+	// WorkerPoolSize число url, запрашиваемых одновременно по всем запросам, 0 - у каждого запроса свои горутины
+	WorkerPoolSize int
+	// AdaptiveConcurrency снижать число одновременных запросов к хостам и по всем хостам при признаках перегрузки
+	// и возвращать его, пока запросы успешны (не больше MaxConnsPerHost и WorkerPoolSize)
+	AdaptiveConcurrency bool
+	// ShedHeapBytes, ShedGoroutines, ShedPendingBytes пороги занятой кучи, числа горутин и размера полученных,
+	// но не отправленных тел ответов, выше которых новые запросы отклоняются (см. LoadShedder), 0 - не проверять
+	ShedHeapBytes    uint64
+	ShedGoroutines   int
+	ShedPendingBytes int64
+	// AllowedNetworks внутренние сети (loopback, частные и т.п.), запросы к которым разрешены
+	AllowedNetworks []netip.Prefix
+	// AllowHosts, DenyHosts правила политики доступа к хостам
+	AllowHosts []PolicyRule
+	DenyHosts  []PolicyRule
+	// HTTPSOnly запрашивать url только по https, кроме хостов из HTTPHosts
+	HTTPSOnly bool
+	// HTTPHosts шаблоны хостов, к которым в режиме HTTPSOnly можно обращаться по http
+	HTTPHosts []string
+	// ClientCerts клиентские сертификаты для хостов, требующих mTLS, для хоста действует первый подходящий
+	ClientCerts []*ClientCert
+	// InsecureTLSHosts шаблоны хостов, для которых по запросу пользователя можно не проверять сертификат сервера
+	InsecureTLSHosts []string
+	// RootCAs корневые сертификаты для проверки сертификатов серверов, nil - системные
+	RootCAs *x509.CertPool
+	// HTTPVersions версии HTTP по хостам, для хоста действует первая подходящая
+	HTTPVersions []HostHTTPVersion
+	// HTTP3AltSvc запрашивать по HTTP/3 хосты без заданной версии, объявившие его в заголовке Alt-Svc.
+	// С Proxies HTTP/3 не используется: через прокси HTTP он не передается
+	HTTP3AltSvc bool
+	// Proxies прокси по хостам: прокси с одинаковым шаблоном образуют пул, для хоста действует первый
+	// подходящий пул; если не заданы, прокси берется из переменных окружения HTTP_PROXY, HTTPS_PROXY и NO_PROXY
+	Proxies []HostProxy
+	// ProxyRotation стратегия выбора прокси из пула: ProxyRoundRobin или ProxyLeastErrors
+	ProxyRotation string
+	// DNSServer адрес DNS-сервера (host:port) или url сервера DNS-over-HTTPS для разрешения имен хостов,
+	// пустой - системный резолвер
+	DNSServer string
+	// DNSCacheTTL максимальное время хранения разрешенных имен, 0 - без кэша
+	DNSCacheTTL time.Duration
+	// DNSNegativeTTL максимальное время хранения имен, для которых нет адресов
+	DNSNegativeTTL time.Duration
+	// ResponseCache хранилище ответов для условных запросов, nil - условные запросы не выполняются
+	ResponseCache ResponseCache
+	// ResponseCacheTTL время хранения ответов в ResponseCache
+	ResponseCacheTTL ResponseCacheTTL
+	// Backend выполняет запросы url вместо HTTPFetcher (например, подмена в тестах), nil - HTTPFetcher
+	// с транспортом по остальным настройкам
+	Backend UrlFetcher
+	// Schemes обработчики url схем помимо http и https (например, file и data), по умолчанию их нет
+	Schemes map[string]UrlFetcher
+	// FTP запрашивать url ftp:// с учетными данными по хостам FTPCredentials
+	FTP            bool
+	FTPCredentials []FTPCredential
+	// SFTP запрашивать url sftp:// с учетными данными по хостам SFTPCredentials и ключом SFTPSigner,
+	// ключи серверов проверяются SFTPHostKeys (см. LoadSFTPKeys)
+	SFTP            bool
+	SFTPCredentials []FTPCredential
+	SFTPHostKeys    ssh.HostKeyCallback
+	SFTPSigner      ssh.Signer
+	// Coalesce объединять одинаковые запросы url, выполняющиеся одновременно, в один
+	Coalesce bool
+	// Tracer записывает операции запросов url, nil - трассировка выключена
+	Tracer *Tracer
+	// SlowUrlThreshold и SlowRequestThreshold длительность запроса url и обработки запроса пользователя,
+	// начиная с которой они записываются в лог как медленные, 0 - не записываются
+	SlowUrlThreshold     time.Duration
+	SlowRequestThreshold time.Duration
+	// RequestIDHeader заголовок, в котором идентификатор запроса пользователя передается хостам url,
+	// пустой - не передается
+	RequestIDHeader string
+	// AuditLog журнал аудита запросов пользователей, nil - не ведется
+	AuditLog *AuditLog
+}
+
+// DefaultRetryPolicy политика повторов сервера по умолчанию: повтор при ошибках соединения и ответах 5xx
+var DefaultRetryPolicy = RetryPolicy{
+	Max:             2,
+	BackoffMs:       100,
+	MaxBackoffMs:    1000,
+	RetryOn:         []string{RetryOnConnection, RetryOn5xx},
+	MaxRetryAfterMs: DefaultMaxRetryAfterMs,
+}
+
+// Fetcher запрашивает url пользовательских запросов. Общий для всех запросов (http, gRPC, задания),
+// поэтому соединения с хостами (и TLS-сессии) используются повторно между запросами
+type Fetcher struct {
+	transport http.RoundTripper
+	// retries политика повторов по умолчанию
+	retries RetryPolicy
+	// circuits прекращает запросы к неработающим хостам
+	circuits *CircuitBreaker
+	// hostErrors неудачные запросы к хостам по категориям
+	hostErrors *HostErrors
+	// rateLimits ограничивает частоту запросов к хостам
+	rateLimits *HostRateLimiter
+	// hostConns ограничивает число одновременных запросов к хостам
+	hostConns *HostSemaphore
+	// policy политика доступа к хостам
+	policy *HostPolicy
+	// clientCerts клиентские сертификаты для mTLS
+	clientCerts []*ClientCert
+	// insecureTLSHosts хосты, для которых можно не проверять сертификат сервера
+	insecureTLSHosts []string
+	// backend выполняет запросы url
+	backend UrlFetcher
+	// flights одновременно выполняющиеся запросы url, nil - одинаковые запросы не объединяются
+	flights *flightGroup
+	// metrics метрики исходящих соединений
+	metrics *ConnMetrics
+	// pool общий пул рабочих горутин, запрашивающих url всех запросов
+	pool *WorkerPool
+	// adaptive подстраивает число одновременных запросов к хостам, nil - подстройка выключена
+	adaptive *AdaptiveLimiter
+	// shedder отклоняет новые запросы при перегрузке сервера, nil - не отклоняет
+	shedder *LoadShedder
+	// requests метрики обработки запросов и их url
+	requests *RequestMetrics
+	// tracer записывает операции запросов url, nil - трассировка выключена
+	tracer *Tracer
+	// resolver разрешает имена хостов, responseCache считает обращения к кэшу ответов (nil - кэша нет)
+	resolver      *DNSResolver
+	responseCache *cacheCounter
+	// slowUrl и slowRequest пороги записи в лог медленных запросов url и пользователей, 0 - не записываются
+	slowUrl, slowRequest time.Duration
+	// audit журнал аудита запросов пользователей, nil - не ведется
+	audit *AuditLog
+}
+
+// NewFetcher создает Fetcher с общим пулом соединений по настройкам config
+func NewFetcher(config FetcherConfig) *Fetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// параметры соединений из настроек, с проверкой адреса перед соединением
+	guard := &dialGuard{allowed: config.AllowedNetworks}
+	dialer := &net.Dialer{
+		Timeout:       config.ConnectTimeout,
+		KeepAlive:     config.TCPKeepAlive,
+		FallbackDelay: config.FallbackDelay,
+		Control:       guard.control,
+	}
+	resolver := NewDNSResolver(config.DNSServer, config.DNSCacheTTL, config.DNSNegativeTTL, config.RootCAs)
+	metrics := NewConnMetrics()
+	transport.DialContext = metrics.dialContext(resolver.dialContext(dialer))
+	// FTP и SFTP через прокси не поддерживаются, поэтому соединения с их хостами всегда прямые
+	directDial := transport.DialContext
+	proxies := NewProxyRotator(config.Proxies, config.ProxyRotation, guard)
+	if proxies != nil {
+		transport.Proxy = proxies.proxy
+		direct := &net.Dialer{Timeout: dialer.Timeout, KeepAlive: dialer.KeepAlive, FallbackDelay: dialer.FallbackDelay}
+		transport.DialContext = proxies.dialContext(transport.DialContext, direct)
+	}
+	if config.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: config.RootCAs}
+	}
+	// тело ответа распаковывает HTTPFetcher: так известен и размер сжатого тела, и поддерживается deflate
+	transport.DisableCompression = true
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.MaxResponseHeaderBytes = config.MaxResponseHeaderBytes
+	// общее ограничение не должно быть меньше ограничения на один хост
+	if transport.MaxIdleConns < config.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = config.MaxIdleConnsPerHost
+	}
+	var quicDial *quicDialer
+	if proxies == nil {
+		quicDial = &quicDialer{guard: guard, resolver: resolver, timeout: config.ConnectTimeout}
+	}
+	roundTripper := newHostTransport(transport, config.ClientCerts, config.InsecureTLSHosts, config.HTTPVersions, quicDial, config.HTTP3AltSvc)
+	roundTripper = &headerLimitTransport{base: roundTripper, maxHeaders: config.MaxResponseHeaders}
+	if proxies != nil {
+		roundTripper = &proxyTransport{base: roundTripper, rotator: proxies}
+	}
+	policy := NewHostPolicy(config.AllowHosts, config.DenyHosts, config.HTTPSOnly, config.HTTPHosts, resolver)
+	var responseCache *cacheCounter
+	cache := config.ResponseCache
+	if cache != nil {
+		responseCache = &cacheCounter{}
+		cache = &countingCache{ResponseCache: cache, counter: responseCache}
+	}
+	backend := config.Backend
+	if backend == nil {
+		backend = NewHTTPFetcher(&http.Client{Transport: roundTripper}, policy, cache, config.ResponseCacheTTL, metrics, config.RequestIDHeader)
+	}
+	schemes := maps.Clone(config.Schemes)
+	if (config.FTP || config.SFTP) && schemes == nil {
+		schemes = make(map[string]UrlFetcher)
+	}
+	if config.FTP {
+		schemes[SchemeFTP] = NewFTPFetcher(directDial, config.FTPCredentials)
+	}
+	if config.SFTP {
+		schemes[SchemeSFTP] = NewSFTPFetcher(directDial, config.SFTPCredentials, config.SFTPHostKeys, config.SFTPSigner)
+	}
+	backend = NewSchemeFetcher(backend, schemes)
+	var adaptive *AdaptiveLimiter
+	if config.AdaptiveConcurrency {
+		globalMax, hostMax := config.WorkerPoolSize, config.MaxConnsPerHost
+		if globalMax <= 0 {
+			globalMax = DefaultWorkerPoolSize
+		}
+		if hostMax <= 0 {
+			hostMax = DefaultMaxConnsPerHost
+		}
+		adaptive = NewAdaptiveLimiter(globalMax, hostMax)
+	}
+	pool := NewWorkerPool(config.WorkerPoolSize)
+	return &Fetcher{
+		transport:        roundTripper,
+		backend:          backend,
+		retries:          config.Retries.normalized(),
+		circuits:         NewCircuitBreaker(config.CircuitFailures, config.CircuitCoolDown),
+		hostErrors:       NewHostErrors(),
+		rateLimits:       NewHostRateLimiter(config.RateLimits),
+		hostConns:        NewHostSemaphore(config.MaxConnsPerHost),
+		policy:           policy,
+		clientCerts:      config.ClientCerts,
+		insecureTLSHosts: config.InsecureTLSHosts,
+		flights:          newFlightGroup(config.Coalesce),
+		metrics:          metrics,
+		pool:             pool,
+		adaptive:         adaptive,
+		shedder:          NewLoadShedder(config.ShedHeapBytes, config.ShedGoroutines, config.ShedPendingBytes, pool),
+		requests:         NewRequestMetrics(),
+		tracer:           config.Tracer,
+		slowUrl:          config.SlowUrlThreshold,
+		slowRequest:      config.SlowRequestThreshold,
+		resolver:         resolver,
+		responseCache:    responseCache,
+		audit:            config.AuditLog,
+	}
+}
+
+// checkPolicy проверяет доступ к хосту url по политике сервера и то, что для хоста разрешено
+// не проверять сертификат, если пользователь это просит. Ошибку разбора url не возвращает, ее вернет backend
+func (f *Fetcher) checkPolicy(ctx context.Context, rawUrl string, opts FetchOptions) (*PolicyDecision, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || localScheme(u.Scheme) {
+		// у локальных url нет хоста, к которому применялась бы политика
+		return nil, nil
+	}
+	decision, err := f.policy.Check(ctx, u)
+	if err == nil && opts.InsecureTLS && !matchAnyHostPattern(f.insecureTLSHosts, normalizeHost(u.Hostname())) {
+		err = &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Insecure TLS is not allowed for host %s", u.Hostname())}
+	}
+	return decision, err
+}
+
+// requestHost запрашивает url через backend с учетом ограничений на его хост: дожидается очереди
+// по частоте запросов и свободного места среди одновременных запросов к хосту,
+// не выполняет запрос, если запросы к хосту прекращены из-за неудач
+func (f *Fetcher) requestHost(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	u, err := url.Parse(task.Url)
+	if err != nil || localScheme(u.Scheme) {
+		// ошибку разбора url вернет backend, а локальные url к хостам не обращаются
+		return f.backend.Fetch(ctx, task, opts)
+	}
+	host := strings.ToLower(u.Host)
+
+	if err := f.rateLimits.Wait(ctx, normalizeHost(u.Hostname())); err != nil {
+		return UrlResult{Url: task.Url, Response: []byte{}}, err
+	}
+	if err := f.hostConns.Acquire(ctx, host); err != nil {
+		return UrlResult{Url: task.Url, Response: []byte{}}, err
+	}
+	defer f.hostConns.Release(host)
+	if err := f.adaptive.Acquire(ctx, host); err != nil {
+		return UrlResult{Url: task.Url, Response: []byte{}}, err
+	}
+	if !f.circuits.Allow(host) {
+		f.adaptive.Release(host, 0, false, true)
+		return UrlResult{Url: task.Url, Response: []byte{}}, errCircuitOpen(host)
+	}
+	f.metrics.requestStarted(host)
+	start := time.Now()
+	result, err := f.backend.Fetch(ctx, task, opts)
+	f.adaptive.Release(host, time.Since(start), overloadSignal(result, err), ctx.Err() != nil)
+	f.metrics.requestFinished(host)
+	if ctx.Err() != nil {
+		f.circuits.Abort(host)
+	} else {
+		f.circuits.Record(host, hostFailed(result, err))
+		f.hostErrors.record(host, result, err)
+	}
+	return result, err
+}
+
+// requestShared запрашивает url через requestHost, но если такой же запрос url уже выполняется
+// (например, для другого клиента), дожидается и возвращает его результат, не запрашивая url повторно
+func (f *Fetcher) requestShared(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	key, ok := flightKey(task, opts)
+	if !ok {
+		return f.requestHost(ctx, task, opts)
+	}
+	result, err, shared := f.flights.do(ctx, key, func(ctx context.Context) (UrlResult, error) {
+		return f.requestHost(ctx, task, opts)
+	})
+	result.Url = task.Url
+	result.Coalesced = shared
+	return result, err
+}
+
+// checkStatus проверяет, что код ответа входит в список ожидаемых кодов task (если он задан)
+func checkStatus(task UrlRequest, result UrlResult) error {
+	if len(task.ExpectStatus) == 0 {
+		return nil
+	}
+	for _, code := range task.ExpectStatus {
+		if result.StatusCode == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %d", ErrUnexpectedStatus, result.StatusCode)
+}
+
+// QueryUrls запрашивает информацию по всем url в списке (urls), записывает результаты в канал (out)
+// и возвращается, когда все рабочие горутины завершены
+// urls список запросов url
+// opts параметры запроса url
+// workersCount кол-во одновременно запрашивающих горутин (в том числе из общего пула)
+// out канал для записи результатов, вмещающий результаты всех url: горутины общего пула не ждут того,
+// кто их читает, поэтому медленный клиент не занимает пул, а ограничение памяти под неотправленные результаты
+// обеспечивает LoadShedder. Канал не закрывается: QueryUrls возвращается, только когда записей в него больше не будет
+// ctx контекст обработки, при его отмене рабочие горутины прерывают запросы и завершаются, не дожидаясь места в out,
+// даже если он меньше числа url
+func (f *Fetcher) QueryUrls(ctx context.Context, urls []UrlRequest, opts FetchOptions, workersCount int, out chan<- UrlResult) {
+	// задачи выполняются в общем пуле рабочих горутин (или в собственных, если пула нет)
+	f.pool.Run(ctx, len(urls), workersCount, func(task int) {
+		start := time.Now()
+		urlCtx, span := f.tracer.Start(ctx, "fetch url", SpanKindClient, nil)
+		result, err := f.fetchWithFallbacks(urlCtx, urls[task], opts)
+		urlSpanAttrs(span, urls[task], result, err)
+		span.End()
+		result.elapsed = time.Since(start)
+		f.requests.observeUrl(ctx, result.elapsed, result, err)
+		if f.slowUrl > 0 && result.elapsed >= f.slowUrl {
+			logUrl(ctx, slog.LevelWarn, "Slow url fetch", urls[task], result, err)
+		} else {
+			logUrl(ctx, slog.LevelDebug, "Url fetched", urls[task], result, err)
+		}
+		result.error = err
+		result.task = task
+		// тело учитывается как неотправленное, пока результат не передан пользователю
+		f.shedder.hold(len(result.Response))
+		select {
+		case out <- result:
+		case <-ctx.Done():
+			// результат уже никто не прочитает
+			f.shedder.release(len(result.Response))
+		}
+	})
+}
+
+// ErrCancelled обработка запроса прервана (клиент закрыл соединение, задание отменено)
+var ErrCancelled = errors.New("processing cancelled")
+
+// ErrDeadlineExceeded обработка запроса не уложилась в срок RequestDeadline, причина отмены его контекста
+var ErrDeadlineExceeded = errors.New("Request deadline exceeded")
+
+// ProcessUrls опрашивает все url из запроса и передает результаты writer по мере готовности,
+// по окончании обработки вызывает writer.Finish.
+// Отмена ctx (закрытие соединения клиентом, отмена задания, завершение работы сервера) прерывает обработку
+// вместе с уже начатыми запросами url.
+// Если обработка прервана, итог не отправляется и возвращается ErrCancelled или ошибка записи результата.
+// Исключение - срок запроса (отмена ctx с причиной ErrDeadlineExceeded): итог отправляется с этой ошибкой
+func (f *Fetcher) ProcessUrls(ctx context.Context, request Urls, writer ResultWriter) error {
+	started := time.Now()
+	tasks := request.Tasks()
+	urlCount := len(tasks)
+	f.audit.record(ctx, tasks)
+	// positions[i] - номера url в запросе, которым соответствует задача i:
+	// первый получает результат задачи, остальные (повторы) - его копии
+	var positions [][]int
+	if request.Dedupe {
+		tasks, positions = dedupeTasks(tasks)
+	}
+	if request.Ordered {
+		writer = newOrderedResultWriter(writer)
+	}
+
+	opts := request.FetchOptions()
+
+	var interrupted error // причина прерывания, если отправлять итог не надо
+	var resultErr error   // ошибка обработки url, которую надо сообщить пользователю
+	var totalBytes int64  // суммарный размер полученных тел ответов
+	var failed int        // число url, обработанных с ошибкой
+	var slowest UrlResult // самый долгий из обработанных url
+	written := make([]bool, len(tasks))
+
+	// write передает результат задачи writer, а повторам url (при dedupe) - его копии
+	write := func(res UrlResult) error {
+		written[res.task] = true
+		if err := writer.WriteResult(res); err != nil {
+			return err
+		}
+		for n := 1; positions != nil && n < len(positions[res.task]); n++ {
+			duplicate := res
+			duplicate.Index = positions[res.task][n]
+			duplicate.Deduplicated = true
+			if err := writer.WriteResult(duplicate); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// processChunk опрашивает задачи с номерами [start, end) и передает результаты пользователю.
+	// Возвращает true, если обработку надо прекратить
+	processChunk := func(start, end int) bool {
+		pipeline := make(chan UrlResult, end-start) // канал результатов обработки urlов
+
+		// количество одновременно запрашивающих горутин по умолчанию не больше Limits.MaxSimultaneousUrlRequests
+		workersCount := request.WorkersCount(end - start)
+
+		// запросы url и разбор их результатов - одна группа: причина прекращения обработки, которую вернет разбор,
+		// отменяет контекст группы, а с ним и начатые запросы url, и Wait возвращается, только когда завершены все горутины
+		group, groupCtx := newTaskGroup(ctx)
+		// опращиваем урлы
+		group.Go(func() error {
+			f.QueryUrls(groupCtx, tasks[start:end], opts, workersCount, pipeline)
+			return nil
+		})
+		// формируем итоговый ответ пользователю
+		group.Go(func() error {
+			for i := start; i < end; i++ {
+				select {
+				case <-groupCtx.Done():
+					// в этом случае отправлять итог не надо, т.к. уже некому
+					interrupted = ErrCancelled
+					return interrupted
+
+				case res := <-pipeline:
+					f.shedder.release(len(res.Response))
+					// номер задачи в части переводим в номер во всем списке
+					res.task += start
+					res.Index = res.task
+					if positions != nil {
+						res.Index = positions[res.task][0]
+					}
+					if res.error != nil {
+						// при ошибке в обработке хоть одного url завершаем работу, если пользователь не попросил иного
+						if request.IsFailFast() {
+							resultErr = res.error
+							return resultErr
+						}
+						// иначе ошибка отправляется вместе с результатом этого url
+						res.Error = res.error.Error()
+						res.ErrorCode = ErrorCode(res.error)
+						failed++
+					}
+					if res.elapsed > slowest.elapsed {
+						slowest = res
+					}
+					if err := write(res); err != nil {
+						// записать результат не удалось, значит отправлять дальше некуда
+						interrupted = err
+						return interrupted
+					}
+
+					if res.ContentLength > 0 {
+						totalBytes += res.ContentLength
+					}
+					if request.MaxTotalBytes > 0 && totalBytes > request.MaxTotalBytes {
+						// бюджет исчерпан, остальные url не запрашиваем
+						return ErrBudgetExceeded
+					}
+				}
+			}
+			return nil
+		})
+		// после Wait рабочих горутин уже нет, и в pipeline никто не пишет: результаты, которые остались в нем
+		// и уже не будут переданы пользователю, больше не учитываются как неотправленные
+		stop := group.Wait() != nil
+		for len(pipeline) > 0 {
+			f.shedder.release(len((<-pipeline).Response))
+		}
+		return stop
+	}
+
+	// большие списки (при "chunked": true) обрабатываются последовательно частями не больше Limits.MaxUrlCount url
+	// с теми же ограничениями на число одновременных запросов
+	chunkSize := CurrentLimits().MaxUrlCount
+	for start := 0; start < len(tasks); start += chunkSize {
+		if processChunk(start, min(start+chunkSize, len(tasks))) {
+			break
+		}
+	}
+
+	switch {
+	case errors.Is(context.Cause(ctx), ErrDeadlineExceeded) && (interrupted == ErrCancelled || resultErr != nil):
+		// обработка не уложилась в срок запроса, но пользователь еще ждет ответа: сообщаем ему об этом,
+		// а не об ошибке url, прерванного вместе с запросом
+		interrupted, resultErr = nil, ErrDeadlineExceeded
+	case ctx.Err() != nil && interrupted == nil && resultErr != nil:
+		// при отмене запроса ошибку url, прерванного отменой, разбор мог получить раньше, чем увидел саму отмену
+		interrupted, resultErr = ErrCancelled, nil
+	}
+
+	if interrupted == nil && resultErr == nil {
+		// url, не обработанные из-за исчерпания бюджета, попадают в результаты с ошибкой
+		for task, done := range written {
+			if done {
+				continue
+			}
+			index := task
+			if positions != nil {
+				index = positions[task][0]
+			}
+			skipped := UrlResult{Index: index, Url: tasks[task].Url, Error: ErrBudgetExceeded.Error(), ErrorCode: ErrorCodeBudgetExceeded, task: task}
+			if err := write(skipped); err != nil {
+				interrupted = err
+				break
+			}
+		}
+	}
+
+	f.requests.observeRequest(ctx, urlCount, interrupted, resultErr)
+	f.logProcessed(ctx, started, urlCount, failed, totalBytes, slowest, requestOutcome(interrupted, resultErr))
+	span := spanFromContext(ctx)
+	span.SetAttr("fetch.urls", urlCount)
+	span.SetError(resultErr)
+	if interrupted != nil {
+		span.SetAttr("fetch.interrupted", true)
+	}
+	if interrupted != nil {
+		return interrupted
+	}
+	writer.Finish(resultErr)
+	return nil
+}
+
+// dedupeTasks убирает из списка повторяющиеся запросы url.
+// Возвращает уникальные запросы и для каждого из них номера всех его вхождений в исходном списке
+func dedupeTasks(tasks []UrlRequest) ([]UrlRequest, [][]int) {
+	unique := make([]UrlRequest, 0, len(tasks))
+	positions := make([][]int, 0, len(tasks))
+	seen := make(map[string]int, len(tasks)) // ключ запроса -> номер в unique
+
+	for i, task := range tasks {
+		key := taskKey(task)
+		if u, ok := seen[key]; ok {
+			positions[u] = append(positions[u], i)
+			continue
+		}
+		seen[key] = len(unique)
+		unique = append(unique, task)
+		positions = append(positions, []int{i})
+	}
+	return unique, positions
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingWriter ResultWriter, запоминающий результаты и итог обработки
+type recordingWriter struct {
+	mu       sync.Mutex
+	results  []UrlResult
+	finished bool
+	err      error
+}
+
+func (w *recordingWriter) WriteResult(res UrlResult) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.results = append(w.results, res)
+	return nil
+}
+
+func (w *recordingWriter) Finish(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.finished, w.err = true, err
+}
+
+// codes возвращает коды ошибок результатов по url, пустой код - url обработан успешно
+func (w *recordingWriter) codes() map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	codes := make(map[string]string, len(w.results))
+	for _, res := range w.results {
+		codes[res.Url] = res.ErrorCode
+	}
+	return codes
+}
+
+// errFakeStatus ошибка url, которую возвращает тестовый backend
+var errFakeStatus = &FetchError{Code: ErrorCodeUnexpectedStatus, Err: errors.New("Unexpected status 500")}
+
+// testUrls возвращает url http://example.test/0 ... http://example.test/<n-1>
+func testUrls(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://example.test/%d", i)
+	}
+	return urls
+}
+
+// fakeBody отвечает на url телом из 4 байт
+func fakeBody(ctx context.Context, task UrlRequest) (UrlResult, error) {
+	return UrlResult{Url: task.Url, Response: []byte("body"), ContentLength: 4, StatusCode: 200}, nil
+}
+
+// setTestLimits меняет действующие ограничения на время теста
+func setTestLimits(t *testing.T, update func(*Limits)) {
+	t.Helper()
+	limits := CurrentLimits()
+	update(&limits)
+	previous := currentLimits.Swap(&limits)
+	t.Cleanup(func() { currentLimits.Store(previous) })
+}
+
+func TestProcessUrls(t *testing.T) {
+	failFast := false
+
+	// по chunkDone проверяется, что url следующей части запрашиваются только после завершения всех url предыдущей
+	var chunkMu sync.Mutex
+	chunkDone := make(map[int]bool)
+	var chunkErr error
+	const chunkSize = 2
+
+	tests := []struct {
+		name    string
+		request Urls
+		fetch   func(ctx context.Context, task UrlRequest) (UrlResult, error)
+		// deadline срок обработки запроса, 0 - без срока
+		deadline time.Duration
+		// chunkSize размер части при chunked, 0 - ограничения по умолчанию
+		chunkSize int
+		// wantFinish итог, переданный writer
+		wantFinish error
+		// wantCodes коды ошибок результатов по url, nil - результаты не проверяются
+		wantCodes map[string]string
+	}{
+		{
+			name:    "all urls succeed",
+			request: Urls{Urls: testUrls(3)},
+			fetch: func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+				return fakeBody(ctx, task)
+			},
+			wantCodes: map[string]string{"http://example.test/0": "", "http://example.test/1": "", "http://example.test/2": ""},
+		},
+		{
+			name:    "fail_fast stops on the first error",
+			request: Urls{Urls: testUrls(3)},
+			fetch: func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+				if strings.HasSuffix(task.Url, "/1") {
+					return UrlResult{Url: task.Url}, errFakeStatus
+				}
+				return fakeBody(ctx, task)
+			},
+			wantFinish: errFakeStatus,
+		},
+		{
+			name:    "fail_fast off reports errors per url",
+			request: Urls{Urls: testUrls(3), FailFast: &failFast},
+			fetch: func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+				if strings.HasSuffix(task.Url, "/1") {
+					return UrlResult{Url: task.Url}, errFakeStatus
+				}
+				return fakeBody(ctx, task)
+			},
+			wantCodes: map[string]string{"http://example.test/0": "", "http://example.test/1": ErrorCodeUnexpectedStatus, "http://example.test/2": ""},
+		},
+		{
+			// два url по 4 байта исчерпывают бюджет в 5 байт, третий к этому времени еще не ответил
+			name:    "budget_exceeded for unwritten urls",
+			request: Urls{Urls: testUrls(3), MaxTotalBytes: 5},
+			fetch: func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+				if strings.HasSuffix(task.Url, "/2") {
+					<-ctx.Done()
+					return UrlResult{Url: task.Url}, ctx.Err()
+				}
+				return fakeBody(ctx, task)
+			},
+			wantCodes: map[string]string{"http://example.test/0": "", "http://example.test/1": "", "http://example.test/2": ErrorCodeBudgetExceeded},
+		},
+		{
+			name:    "deadline replaces the error of an interrupted url",
+			request: Urls{Urls: testUrls(2)},
+			fetch: func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+				if strings.HasSuffix(task.Url, "/1") {
+					<-ctx.Done()
+					return UrlResult{Url: task.Url}, ctx.Err()
+				}
+				return fakeBody(ctx, task)
+			},
+			deadline:   50 * time.Millisecond,
+			wantFinish: ErrDeadlineExceeded,
+		},
+		{
+			name:    "deadline with fail_fast off",
+			request: Urls{Urls: testUrls(2), FailFast: &failFast},
+			fetch: func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+				if strings.HasSuffix(task.Url, "/1") {
+					<-ctx.Done()
+					return UrlResult{Url: task.Url}, ctx.Err()
+				}
+				return fakeBody(ctx, task)
+			},
+			deadline:   50 * time.Millisecond,
+			wantFinish: ErrDeadlineExceeded,
+		},
+		{
+			name:    "chunks are processed one after another",
+			request: Urls{Urls: testUrls(5), Chunked: true},
+			fetch: func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+				var n int
+				fmt.Sscanf(task.Url, "http://example.test/%d", &n)
+				chunkMu.Lock()
+				for prev := 0; prev < n/chunkSize*chunkSize; prev++ {
+					if !chunkDone[prev] && chunkErr == nil {
+						chunkErr = fmt.Errorf("url %d started before url %d of the previous chunk finished", n, prev)
+					}
+				}
+				chunkMu.Unlock()
+				// без задержки части, запущенные одновременно, могли бы случайно не пересечься
+				time.Sleep(5 * time.Millisecond)
+				chunkMu.Lock()
+				chunkDone[n] = true
+				chunkMu.Unlock()
+				return fakeBody(ctx, task)
+			},
+			chunkSize: chunkSize,
+			wantCodes: map[string]string{
+				"http://example.test/0": "", "http://example.test/1": "", "http://example.test/2": "",
+				"http://example.test/3": "", "http://example.test/4": "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.chunkSize > 0 {
+				setTestLimits(t, func(l *Limits) { l.MaxUrlCount = tt.chunkSize })
+			}
+			fetcher := NewFetcher(FetcherConfig{
+				Backend: UrlFetcherFunc(func(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+					return tt.fetch(ctx, task)
+				}),
+			})
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeoutCause(ctx, tt.deadline, ErrDeadlineExceeded)
+				defer cancel()
+			}
+
+			writer := &recordingWriter{}
+			err := fetcher.ProcessUrls(ctx, tt.request, writer)
+			if err != nil {
+				t.Fatalf("ProcessUrls() error = %v", err)
+			}
+			if !writer.finished {
+				t.Fatal("Finish was not called")
+			}
+			if !errors.Is(writer.err, tt.wantFinish) {
+				t.Errorf("Finish(%v), want %v", writer.err, tt.wantFinish)
+			}
+			if tt.wantCodes != nil {
+				codes := writer.codes()
+				if len(codes) != len(tt.wantCodes) {
+					t.Errorf("got results for %d urls, want %d", len(codes), len(tt.wantCodes))
+				}
+				for url, want := range tt.wantCodes {
+					if got, ok := codes[url]; !ok {
+						t.Errorf("no result for %s", url)
+					} else if got != want {
+						t.Errorf("error code of %s = %q, want %q", url, got, want)
+					}
+				}
+			}
+		})
+	}
+
+	if chunkErr != nil {
+		t.Error(chunkErr)
+	}
+}
+
+func TestProcessUrlsCancelled(t *testing.T) {
+	started := make(chan struct{}, 3)
+	fetcher := NewFetcher(FetcherConfig{
+		Backend: UrlFetcherFunc(func(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+			started <- struct{}{}
+			<-ctx.Done()
+			return UrlResult{Url: task.Url}, ctx.Err()
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	writer := &recordingWriter{}
+	if err := fetcher.ProcessUrls(ctx, Urls{Urls: testUrls(3)}, writer); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("ProcessUrls() error = %v, want %v", err, ErrCancelled)
+	}
+	if writer.finished {
+		t.Errorf("Finish(%v) called for a cancelled request", writer.err)
+	}
+}
+
+// cancelWriter ResultWriter, который на первом результате дожидается отмены запроса и возвращает ошибку,
+// как запись клиенту, закрывшему соединение
+type cancelWriter struct {
+	ctx     context.Context
+	written chan struct{}
+	once    sync.Once
+}
+
+func (w *cancelWriter) WriteResult(res UrlResult) error {
+	w.once.Do(func() { close(w.written) })
+	<-w.ctx.Done()
+	return w.ctx.Err()
+}
+
+func (w *cancelWriter) Finish(err error) {}
+
+func TestProcessUrlsCancelledMidBatch(t *testing.T) {
+	for _, poolSize := range []int{0, 4} {
+		t.Run(fmt.Sprintf("pool %d", poolSize), func(t *testing.T) {
+			var inFlight atomic.Int64
+			fetcher := NewFetcher(FetcherConfig{
+				WorkerPoolSize:   poolSize,
+				ShedPendingBytes: 1 << 30,
+				Backend: UrlFetcherFunc(func(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+					inFlight.Add(1)
+					defer inFlight.Add(-1)
+					var n int
+					fmt.Sscanf(task.Url, "http://example.test/%d", &n)
+					if n%2 == 1 {
+						// тело получено уже после отмены запроса и передано быть не может
+						<-ctx.Done()
+					}
+					return UrlResult{Url: task.Url, Response: make([]byte, 1024), ContentLength: 1024}, nil
+				}),
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			writer := &cancelWriter{ctx: ctx, written: make(chan struct{})}
+			go func() {
+				<-writer.written
+				// пока первый результат пишется, быстрые url успевают попасть в очередь неотправленных
+				time.Sleep(20 * time.Millisecond)
+				cancel()
+			}()
+
+			if err := fetcher.ProcessUrls(ctx, Urls{Urls: testUrls(20)}, writer); !errors.Is(err, context.Canceled) {
+				t.Fatalf("ProcessUrls() error = %v, want %v", err, context.Canceled)
+			}
+			if n := inFlight.Load(); n != 0 {
+				t.Errorf("%d url fetches still running", n)
+			}
+			if stats := fetcher.pool.stats(); stats != nil && (stats.Busy != 0 || stats.QueuedUrls != 0) {
+				t.Errorf("pool busy = %d, queued = %d, want 0", stats.Busy, stats.QueuedUrls)
+			}
+			if held := fetcher.shedder.pending.Load(); held != 0 {
+				t.Errorf("shedder holds %d bytes, want 0", held)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchemeFTP схема url файлов на серверах FTP, по умолчанию выключена
+const SchemeFTP = "ftp"
+
+// Пользователь FTP по умолчанию, если учетные данные не заданы ни в url, ни в запросе, ни на сервере
+const (
+	ftpAnonymousUser     = "anonymous"
+	ftpAnonymousPassword = "anonymous@"
+)
+
+// FTPCredential учетные данные FTP для хостов, подходящих под Pattern
+type FTPCredential struct {
+	// Pattern хост ("example.com"), все его поддомены ("*.example.com") или все хосты ("*")
+	Pattern  string
+	Username string
+	Password string
+}
+
+// parseFTPCredential разбирает учетные данные вида pattern=user:password
+func parseFTPCredential(s string) (FTPCredential, error) {
+	pattern, value, ok := strings.Cut(s, "=")
+	username, password, hasPassword := strings.Cut(value, ":")
+	if !ok || pattern == "" || !hasPassword || username == "" {
+		return FTPCredential{}, fmt.Errorf("ftp credentials %q must look like host=user:password", s)
+	}
+	return FTPCredential{Pattern: strings.ToLower(pattern), Username: username, Password: password}, nil
+}
+
+// FTPCredentialFlag список учетных данных FTP по хостам, задается повторяющимся флагом
+type FTPCredentialFlag []FTPCredential
+
+// String возвращает учетные данные в формате флага, но без паролей
+func (f *FTPCredentialFlag) String() string {
+	var parts []string
+	for _, c := range *f {
+		parts = append(parts, fmt.Sprintf("%s=%s:%s", c.Pattern, c.Username, redacted))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set добавляет учетные данные из значения флага
+func (f *FTPCredentialFlag) Set(s string) error {
+	credential, err := parseFTPCredential(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, credential)
+	return nil
+}
+
+// FTPFetcher скачивает файлы по url вида ftp://[user:password@]host[:port]/path в пассивном режиме.
+// Путь url отсчитывается от каталога пользователя после входа, абсолютный путь задается с %2F:
+// ftp://host/%2Fpub/a.txt. Url, оканчивающийся на "/", возвращает список файлов каталога
+type FTPFetcher struct {
+	// dial устанавливает соединения с проверкой адреса, как и для HTTP
+	dial dialFunc
+	// credentials учетные данные по хостам, для хоста действуют первые подходящие
+	credentials []FTPCredential
+}
+
+// NewFTPFetcher создает FTPFetcher, соединения устанавливаются через dial
+func NewFTPFetcher(dial dialFunc, credentials []FTPCredential) *FTPFetcher {
+	return &FTPFetcher{dial: dial, credentials: credentials}
+}
+
+// login возвращает учетные данные для url: из самого url, из аутентификации basic запроса,
+// из настроек сервера для хоста или анонимного пользователя
+func (f *FTPFetcher) login(u *url.URL, task UrlRequest) (string, string) {
+	if u.User != nil {
+		password, _ := u.User.Password()
+		return u.User.Username(), password
+	}
+	if task.Auth != nil && task.Auth.Type == AuthBasic {
+		return task.Auth.Username, task.Auth.Password
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, c := range f.credentials {
+		if matchHostPattern(c.Pattern, host) {
+			return c.Username, c.Password
+		}
+	}
+	return ftpAnonymousUser, ftpAnonymousPassword
+}
+
+// Fetch скачивает файл url как тело ответа с кодом 200. Отказы сервера FTP возвращаются кодами HTTP:
+// не выполнен вход - 401, файла нет - 404, временная ошибка - 503, остальные - 502
+func (f *FTPFetcher) Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	start := time.Now()
+	result := UrlResult{Url: task.Url, Response: []byte{}, FinalUrl: task.Url, Protocol: "FTP"}
+	timing := &UrlTiming{}
+	defer func() {
+		timing.Total = milliseconds(start, time.Now())
+		result.Timing = timing
+	}()
+
+	method, err := readOnlyMethod(task, opts)
+	if err != nil {
+		return result, err
+	}
+	u, err := url.Parse(task.Url)
+	if err != nil {
+		return result, &FetchError{Code: ErrorCodeInvalidUrl, Err: err}
+	}
+	user, password := f.login(u, task)
+	name := strings.TrimPrefix(u.Path, "/")
+	// перевод строки в пути или учетных данных стал бы лишней командой FTP
+	if strings.ContainsAny(name+user+password, "\r\n") {
+		return result, &FetchError{Code: ErrorCodeInvalidUrl, Err: fmt.Errorf("Ftp url %q must not contain line breaks", task.Url)}
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	network := "tcp"
+	switch opts.IPFamily {
+	case IPFamilyV4:
+		network = "tcp4"
+	case IPFamilyV6:
+		network = "tcp6"
+	}
+	port := u.Port()
+	if port == "" {
+		port = "21"
+	}
+	conn, err := f.dial(ctx, network, net.JoinHostPort(u.Hostname(), port))
+	timing.TCPConnect = milliseconds(start, time.Now())
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	result.RemoteAddr = conn.RemoteAddr().String()
+	// отмена ctx прерывает ожидание ответа сервера
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c := &ftpConn{ctx: ctx, conn: conn, text: textproto.NewConn(conn), dial: f.dial, network: network}
+	err = c.get(&result, user, password, name, method, opts)
+	timing.TTFB = c.ttfb(start)
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		// отказ сервера - это ответ, а не ошибка соединения
+		result.StatusCode = ftpStatus(reply.Code)
+		err = nil
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	c.quit()
+	return result, err
+}
+
+// ftpStatus возвращает код HTTP, соответствующий коду отказа сервера FTP
+func ftpStatus(code int) int {
+	switch {
+	case code == 530 || code == 532:
+		// не выполнен вход
+		return http.StatusUnauthorized
+	case code == 550:
+		return http.StatusNotFound
+	case code/100 == 4:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// ftpConn управляющее соединение с сервером FTP
+type ftpConn struct {
+	// ctx контекст запроса url, его отмена прерывает и соединения для передачи данных
+	ctx     context.Context
+	conn    net.Conn
+	text    *textproto.Conn
+	dial    dialFunc
+	network string
+	// firstByte момент начала передачи файла
+	firstByte time.Time
+}
+
+// cmd отправляет команду и читает ответ: код ответа должен начинаться с expect, 0 - любой код
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+// get входит на сервер и записывает в result файл name (или список файлов каталога, если name пустое
+// или оканчивается на "/"): для HEAD только размер и время изменения
+func (c *ftpConn) get(result *UrlResult, user, password, name, method string, opts FetchOptions) error {
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return err
+	}
+	code, msg, err := c.cmd(0, "USER %s", user)
+	switch {
+	case err != nil:
+		return err
+	case code == 331 || code == 332:
+		if _, _, err := c.cmd(2, "PASS %s", password); err != nil {
+			return err
+		}
+	case code/100 != 2:
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return err
+	}
+
+	listing := name == "" || strings.HasSuffix(name, "/")
+	contentType := "text/plain; charset=utf-8"
+	size := int64(-1)
+	if !listing {
+		result.Headers = make(map[string]string)
+		// SIZE и MDTM поддерживают не все серверы, без них файл все равно можно скачать
+		if code, msg, err := c.cmd(0, "SIZE %s", name); err != nil {
+			return err
+		} else if code == 213 {
+			size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+		} else if code == 550 && method == http.MethodHead {
+			return &textproto.Error{Code: code, Msg: msg}
+		}
+		if code, msg, err := c.cmd(0, "MDTM %s", name); err != nil {
+			return err
+		} else if modified, err := time.Parse("20060102150405", truncateString(strings.TrimSpace(msg), 14)); code == 213 && err == nil {
+			result.Headers["Last-Modified"] = modified.Format(http.TimeFormat)
+		}
+		if method == http.MethodHead {
+			result.StatusCode = http.StatusOK
+			result.ContentLength = size
+			if contentType = contentTypeOf(name, nil); contentType != "" {
+				result.Headers["Content-Type"] = contentType
+			}
+			return nil
+		}
+		if opts.MaxBytes > 0 && size >= 0 {
+			result.FullLength = size
+		}
+	}
+
+	data, err := c.passive()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	switch {
+	case name == "":
+		_, _, err = c.cmd(1, "NLST")
+	case listing:
+		_, _, err = c.cmd(1, "NLST %s", strings.TrimSuffix(name, "/"))
+	default:
+		_, _, err = c.cmd(1, "RETR %s", name)
+	}
+	if err != nil {
+		return err
+	}
+	c.firstByte = time.Now()
+	result.StatusCode = http.StatusOK
+	body := bufio.NewReader(data)
+	if !listing {
+		contentType = contentTypeOf(name, body)
+		result.Headers["Content-Type"] = contentType
+	}
+	if err := readLocalBody(result, body, size, contentType, opts); err != nil {
+		return err
+	}
+	data.Close()
+	if result.BodyTruncated {
+		// передача прервана на полпути, ответ о ее завершении уже не важен
+		return nil
+	}
+	// ответ 226 подтверждает, что файл передан целиком
+	_, _, err = c.text.ReadResponse(2)
+	return err
+}
+
+// pasvRe адрес в ответе на PASV: h1,h2,h3,h4,p1,p2
+var pasvRe = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
+// passive открывает соединение для передачи данных в пассивном режиме (EPSV, а если он не поддерживается, PASV).
+// Соединение устанавливается с тем же адресом, что и управляющее: адрес из ответа PASV не используется,
+// чтобы сервер не мог направить соединение на другой хост
+func (c *ftpConn) passive() (net.Conn, error) {
+	var port int
+	code, msg, err := c.cmd(0, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	if code == 229 {
+		// ответ вида "Entering Extended Passive Mode (|||port|)"
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start+2 {
+			return nil, fmt.Errorf("Invalid ftp EPSV reply %q", msg)
+		}
+		fields := strings.Split(msg[start+2:end], msg[start+1:start+2])
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Invalid ftp EPSV reply %q", msg)
+		}
+		port, err = strconv.Atoi(fields[2])
+	} else {
+		if _, msg, err = c.cmd(227, "PASV"); err != nil {
+			return nil, err
+		}
+		match := pasvRe.FindStringSubmatch(msg)
+		if match == nil {
+			return nil, fmt.Errorf("Invalid ftp PASV reply %q", msg)
+		}
+		high, _ := strconv.Atoi(match[5])
+		low, _ := strconv.Atoi(match[6])
+		port = high<<8 | low
+	}
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid ftp passive port in reply %q", msg)
+	}
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	conn, err := c.dial(c.ctx, c.network, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(c.ctx, func() { conn.SetDeadline(time.Now()) })
+	return &ftpData{Conn: conn, stop: stop}, nil
+}
+
+// ftpData соединение для передачи данных: как и управляющее, прерывается отменой запроса
+type ftpData struct {
+	net.Conn
+	stop func() bool
+}
+
+// Close закрывает соединение, повторный вызов ничего не делает
+func (d *ftpData) Close() error {
+	d.stop()
+	return d.Conn.Close()
+}
+
+// ttfb возвращает время от start до начала передачи файла, 0 - передача не началась
+func (c *ftpConn) ttfb(start time.Time) float64 {
+	if c.firstByte.IsZero() {
+		return 0
+	}
+	return milliseconds(start, c.firstByte)
+}
+
+// quit завершает сеанс, не дожидаясь ответа сервера: соединение все равно закрывается
+func (c *ftpConn) quit() {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.text.Cmd("QUIT")
+}
+
+// truncateString возвращает не больше n первых байт s
+func truncateString(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -1,3 +1,18 @@
 module github.com/klimov-andre/go-test-task
 
-go 1.16
+go 1.24.0
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	github.com/pkg/sftp v1.13.9
+	github.com/quic-go/quic-go v0.59.0
+	golang.org/x/crypto v0.45.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/net v0.47.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+)
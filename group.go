@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// taskGroup группа горутин одной обработки, как errgroup.Group из golang.org/x/sync (модуль ради нее
+// не подключается, см. «Зависимости» в README):
+// первая ошибка горутины отменяет общий контекст группы, а Wait дожидается всех горутин и возвращает эту ошибку
+type taskGroup struct {
+	wg     sync.WaitGroup
+	cancel context.CancelCauseFunc
+	once   sync.Once
+	err    error
+}
+
+// newTaskGroup создает группу и ее контекст, производный от ctx: он отменяется первой ошибкой горутины группы
+// или завершением Wait
+func newTaskGroup(ctx context.Context) (*taskGroup, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &taskGroup{cancel: cancel}, ctx
+}
+
+// Go запускает fn в горутине группы
+func (g *taskGroup) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel(err)
+			})
+		}
+	}()
+}
+
+// Wait дожидается завершения всех горутин группы и возвращает первую ошибку
+func (g *taskGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel(g.err)
+	return g.err
+}
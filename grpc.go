@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// GrpcFetchMethod путь метода FetchService.Fetch (см. proto/fetch.proto)
+	GrpcFetchMethod = "/fetch.v1.FetchService/Fetch"
+	// ContentTypeGrpc тип содержимого gRPC-запросов
+	ContentTypeGrpc = "application/grpc"
+	// MaxGrpcMessageSize максимальный размер входящего сообщения FetchRequest
+	MaxGrpcMessageSize = 1 << 20
+)
+
+// коды статусов gRPC, которые может вернуть сервис
+const (
+	grpcOK                = 0
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+)
+
+// NewGrpcServer создает сервер gRPC-api на отдельном адресе.
+// gRPC работает поверх HTTP/2 без TLS (h2c), поэтому обычный HTTP/1 на этом адресе выключен
+func NewGrpcServer(addr string, h http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	mux := http.NewServeMux()
+	mux.Handle(GrpcFetchMethod, h)
+	return &http.Server{Addr: addr, Handler: mux, Protocols: &protocols}
+}
+
+// HandleGrpcFetch обрабатывает вызов FetchService.Fetch: результаты отправляются потоком сообщений UrlResult.
+// url запрашиваются через fetcher
+func HandleGrpcFetch(fetcher *Fetcher) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), ContentTypeGrpc) {
+			http.Error(rw, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		flusher, canFlush := rw.(http.Flusher)
+		writer := &grpcResultWriter{rw: rw, flusher: flusher}
+		if !canFlush {
+			// без отправки сообщений по мере готовности поток теряет смысл
+			writer.finishWithStatus(grpcUnknown, "Streaming is not supported")
+			return
+		}
+		if err := fetcher.shedder.Check(); err != nil {
+			writer.finishWithStatus(grpcUnavailable, err.Error())
+			return
+		}
+
+		// тело ограничено так же, как тело json-запроса: оно читается до срока запроса и очереди
+		if MaxRequestBodySize > 0 {
+			r.Body = http.MaxBytesReader(rw, r.Body, MaxRequestBodySize)
+		}
+		message, err := readGrpcMessage(r.Body)
+		if errors.Is(err, ErrRequestTooLarge) {
+			writer.finishWithStatus(grpcResourceExhausted, err.Error())
+			return
+		}
+		if err != nil {
+			writer.finishWithStatus(grpcInvalidArgument, err.Error())
+			return
+		}
+
+		var request Urls
+		if err = request.UnmarshalProto(message); err != nil {
+			writer.finishWithStatus(grpcInvalidArgument, err.Error())
+			return
+		}
+		// ограничения те же, что и для json-запроса
+		if err = request.Validate(); err != nil {
+			writer.finishWithStatus(grpcInvalidArgument, err.Error())
+			return
+		}
+
+		// срок запроса тот же, что и для json-запроса
+		ctx, cancel := withRequestDeadline(r.Context())
+		defer cancel()
+		release, err := Admit(r, request.Priority, ctx.Done())
+		if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueTimeout) {
+			writer.finishWithStatus(grpcResourceExhausted, err.Error())
+			return
+		}
+		if err != nil && errors.Is(context.Cause(ctx), ErrDeadlineExceeded) {
+			writer.finishWithStatus(grpcDeadlineExceeded, ErrDeadlineExceeded.Error())
+			return
+		}
+		if err != nil {
+			writer.finishWithStatus(grpcUnavailable, "server is shutting down")
+			return
+		}
+		defer release()
+
+		fetcher.ProcessUrls(ctx, request, writer)
+	})
+}
+
+// readGrpcMessage читает единственное сообщение запроса: флаг сжатия, длина и само сообщение.
+// После сообщения тело должно закончиться: метод унарный, и второе сообщение - ошибка клиента
+func readGrpcMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcReadError(err)
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("Compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > MaxGrpcMessageSize {
+		return nil, fmt.Errorf("Message is too large")
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, grpcReadError(err)
+	}
+	var extra [1]byte
+	if n, err := io.ReadFull(body, extra[:]); n > 0 {
+		return nil, errors.New("Only one request message is allowed")
+	} else if err != io.EOF {
+		return nil, grpcReadError(err)
+	}
+	return message, nil
+}
+
+// grpcReadError возвращает ошибку чтения тела вызова: превышение MaxRequestBodySize - ErrRequestTooLarge
+func grpcReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("%w, the limit is %d bytes", ErrRequestTooLarge, tooLarge.Limit)
+	}
+	return fmt.Errorf("Could not read message: %v", err)
+}
+
+// grpcResultWriter отправляет каждый результат отдельным сообщением потока,
+// итог обработки передается статусом в трейлерах
+type grpcResultWriter struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func (w *grpcResultWriter) WriteResult(res UrlResult) error {
+	message := res.MarshalProto()
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	w.start()
+	if _, err := w.rw.Write(frame); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+func (w *grpcResultWriter) Finish(err error) {
+	if errors.Is(err, ErrDeadlineExceeded) {
+		w.finishWithStatus(grpcDeadlineExceeded, err.Error())
+		return
+	}
+	if err != nil {
+		w.finishWithStatus(grpcUnknown, err.Error())
+		return
+	}
+	w.finishWithStatus(grpcOK, "")
+}
+
+// start отправляет заголовки ответа перед первым сообщением
+func (w *grpcResultWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.rw.Header().Set("Content-Type", ContentTypeGrpc)
+	w.rw.WriteHeader(http.StatusOK)
+}
+
+// finishWithStatus завершает вызов статусом code с сообщением message
+func (w *grpcResultWriter) finishWithStatus(code int, message string) {
+	header := w.rw.Header()
+	prefix := ""
+	if w.started {
+		// заголовки уже отправлены, статус передаем трейлерами
+		prefix = http.TrailerPrefix
+	} else {
+		// ответ без сообщений: статус передается прямо в заголовках (trailers-only)
+		header.Set("Content-Type", ContentTypeGrpc)
+	}
+	header.Set(prefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		// grpc-message передается в percent-encoding
+		header.Set(prefix+"Grpc-Message", url.PathEscape(message))
+	}
+	if !w.started {
+		w.started = true
+		w.rw.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// grpcFrame упаковывает сообщение в кадр gRPC без сжатия
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// fetchRequestProto кодирует сообщение FetchRequest со списком url
+func fetchRequestProto(urls ...string) []byte {
+	var b []byte
+	for _, u := range urls {
+		b = appendProtoString(b, 1, u)
+	}
+	return b
+}
+
+func TestReadGrpcMessage(t *testing.T) {
+	message := fetchRequestProto("http://example.test/")
+	tooLong := make([]byte, 5)
+	binary.BigEndian.PutUint32(tooLong[1:], MaxGrpcMessageSize+1)
+
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr bool
+	}{
+		{name: "one message", body: grpcFrame(message)},
+		{name: "empty message", body: grpcFrame(nil)},
+		{name: "no prefix", body: []byte{0, 0}, wantErr: true},
+		{name: "compressed", body: append([]byte{1}, grpcFrame(message)[1:]...), wantErr: true},
+		{name: "message over the limit", body: tooLong, wantErr: true},
+		{name: "truncated message", body: grpcFrame(message)[:8], wantErr: true},
+		{name: "second message", body: append(grpcFrame(message), grpcFrame(message)...), wantErr: true},
+		{name: "trailing byte", body: append(grpcFrame(message), 0), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readGrpcMessage(bytes.NewReader(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("readGrpcMessage() = %x, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readGrpcMessage() error = %v", err)
+			}
+			if want := tt.body[5:]; !bytes.Equal(got, want) {
+				t.Errorf("readGrpcMessage() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+// callGrpcFetch вызывает FetchService.Fetch с телом body и возвращает сообщения ответа и статус вызова
+func callGrpcFetch(t *testing.T, fetcher *Fetcher, body []byte) ([][]byte, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, GrpcFetchMethod, bytes.NewReader(body))
+	req.Header.Set("Content-Type", ContentTypeGrpc)
+	rec := httptest.NewRecorder()
+	HandleGrpcFetch(fetcher).ServeHTTP(rec, req)
+
+	res := rec.Result()
+	var messages [][]byte
+	for rest := rec.Body.Bytes(); len(rest) > 0; {
+		if len(rest) < 5 {
+			t.Fatalf("truncated response frame %x", rest)
+		}
+		length := int(binary.BigEndian.Uint32(rest[1:5]))
+		messages = append(messages, rest[5:5+length])
+		rest = rest[5+length:]
+	}
+	status := res.Header.Get("Grpc-Status")
+	if status == "" {
+		status = res.Trailer.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		t.Fatalf("Grpc-Status = %q", status)
+	}
+	return messages, code
+}
+
+func TestHandleGrpcFetch(t *testing.T) {
+	fetcher := NewFetcher(FetcherConfig{
+		Backend: UrlFetcherFunc(func(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+			return fakeBody(ctx, task)
+		}),
+	})
+
+	messages, code := callGrpcFetch(t, fetcher, grpcFrame(fetchRequestProto(testUrls(2)...)))
+	if code != grpcOK || len(messages) != 2 {
+		t.Errorf("Fetch() = %d messages with status %d, want 2 with status %d", len(messages), code, grpcOK)
+	}
+
+	if _, code := callGrpcFetch(t, fetcher, append(grpcFrame(fetchRequestProto(testUrls(1)...)), 0)); code != grpcInvalidArgument {
+		t.Errorf("Fetch() with a trailing byte status = %d, want %d", code, grpcInvalidArgument)
+	}
+	if _, code := callGrpcFetch(t, fetcher, grpcFrame(fetchRequestProto(testUrls(21)...))); code != grpcInvalidArgument {
+		t.Errorf("Fetch() with too many urls status = %d, want %d", code, grpcInvalidArgument)
+	}
+}
+
+func TestHandleGrpcFetchBodyLimit(t *testing.T) {
+	previous := MaxRequestBodySize
+	MaxRequestBodySize = 64
+	t.Cleanup(func() { MaxRequestBodySize = previous })
+
+	fetcher := NewFetcher(FetcherConfig{
+		Backend: UrlFetcherFunc(func(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+			return UrlResult{}, errors.New("url must not be fetched")
+		}),
+	})
+	// сообщение в пределах MaxGrpcMessageSize, но тело больше MaxRequestBodySize
+	message := fetchRequestProto(testUrls(10)...)
+	if _, code := callGrpcFetch(t, fetcher, grpcFrame(message)); code != grpcResourceExhausted {
+		t.Errorf("Fetch() status = %d, want %d", code, grpcResourceExhausted)
+	}
+	// после единственного сообщения тело дальше не читается
+	body := append(grpcFrame(fetchRequestProto(testUrls(1)...)), make([]byte, 1<<20)...)
+	if _, code := callGrpcFetch(t, fetcher, body); code != grpcInvalidArgument {
+		t.Errorf("Fetch() with a large tail status = %d, want %d", code, grpcInvalidArgument)
+	}
+}
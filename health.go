@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	// HealthzPattern путь проверки того, что процесс жив (liveness probe)
+	HealthzPattern = "/healthz"
+	// ReadyzPattern путь проверки того, что сервер готов принимать запросы (readiness probe)
+	ReadyzPattern = "/readyz"
+)
+
+// ReadinessCheck проверка зависимости сервера: Check возвращает ошибку, если зависимость недоступна
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Readiness готовность сервера принимать запросы: сервер не готов, пока не запущен (см. SetReady),
+// после начала завершения работы (см. Drain) и пока не проходит любая из проверок зависимостей
+type Readiness struct {
+	ready    atomic.Bool
+	draining atomic.Bool
+	checks   []ReadinessCheck
+}
+
+// NewReadiness создает неготовый сервер с проверками зависимостей checks
+func NewReadiness(checks ...ReadinessCheck) *Readiness {
+	return &Readiness{checks: checks}
+}
+
+// SetReady отмечает, что сервер запущен: общий пул и обработчики созданы, серверы слушают адреса
+func (r *Readiness) SetReady() {
+	r.ready.Store(true)
+}
+
+// Drain отмечает начало завершения работы: сервер еще обрабатывает запросы, но балансировщику пора перестать их присылать
+func (r *Readiness) Drain() {
+	r.draining.Store(true)
+}
+
+// readinessStatus ответ проверок готовности
+type readinessStatus struct {
+	Status string `json:"status"`
+	// Checks результат проверок готовности по названиям: "ok" или ошибка
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HandleHealthz отвечает 200, пока процесс способен обрабатывать http-запросы
+func HandleHealthz() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, readinessStatus{Status: "ok"})
+	})
+}
+
+// HandleReadyz отвечает 200, если сервер готов принимать запросы, иначе 503 с причиной в checks
+func HandleReadyz(readiness *Readiness) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		status := readinessStatus{Status: "ok", Checks: make(map[string]string)}
+		fail := func(name, reason string) {
+			status.Status = "unavailable"
+			status.Checks[name] = reason
+		}
+		if readiness.ready.Load() {
+			status.Checks["started"] = "ok"
+		} else {
+			fail("started", "Server is starting")
+		}
+		if readiness.draining.Load() {
+			fail("shutdown", "Server is shutting down")
+		} else {
+			status.Checks["shutdown"] = "ok"
+		}
+		for _, check := range readiness.checks {
+			if err := check.Check(r.Context()); err != nil {
+				fail(check.Name, err.Error())
+			} else {
+				status.Checks[check.Name] = "ok"
+			}
+		}
+		code := http.StatusOK
+		if status.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(rw, code, status)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultMaxConnsPerHost число одновременных запросов к одному хосту по умолчанию (по всем запросам пользователей)
+const DefaultMaxConnsPerHost = 16
+
+// hostSlots занятые места одного хоста
+type hostSlots struct {
+	slots chan struct{}
+	// users число запросов, занявших или ожидающих место, хост удаляется из учета, когда их не остается
+	users int
+}
+
+// HostSemaphore ограничивает число одновременных запросов к каждому хосту.
+// nil-значение ничего не ограничивает
+type HostSemaphore struct {
+	limit int
+
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+// NewHostSemaphore создает HostSemaphore на limit одновременных запросов к хосту, при limit <= 0 возвращает nil
+func NewHostSemaphore(limit int) *HostSemaphore {
+	if limit <= 0 {
+		return nil
+	}
+	return &HostSemaphore{limit: limit, hosts: make(map[string]*hostSlots)}
+}
+
+// Acquire дожидается свободного места для запроса к host.
+// Возвращает ошибку контекста, если ожидание прервано отменой ctx, иначе место нужно освободить через Release
+func (s *HostSemaphore) Acquire(ctx context.Context, host string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	h := s.hosts[host]
+	if h == nil {
+		h = &hostSlots{slots: make(chan struct{}, s.limit)}
+		s.hosts[host] = h
+	}
+	h.users++
+	s.mu.Unlock()
+
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		s.leave(host, h)
+		return ctx.Err()
+	}
+}
+
+// Release освобождает место, занятое через Acquire
+func (s *HostSemaphore) Release(host string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	h := s.hosts[host]
+	s.mu.Unlock()
+	<-h.slots
+	s.leave(host, h)
+}
+
+// leave учитывает, что запрос больше не занимает и не ждет место
+func (s *HostSemaphore) leave(host string, h *hostSlots) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.users--
+	if h.users == 0 {
+		delete(s.hosts, host)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// MaxErrorHosts сколько хостов учитывается в HostErrors по отдельности, ошибки остальных учитываются вместе
+const MaxErrorHosts = 1000
+
+// ErrorHostOther хост, под которым учитываются ошибки хостов сверх MaxErrorHosts
+const ErrorHostOther = "_other"
+
+// Категории ошибок запросов к хостам
+const (
+	HostErrorDNS     = "dns"
+	HostErrorConnect = "connect"
+	HostErrorTLS     = "tls"
+	HostErrorTimeout = "timeout"
+	// HostErrorHTTP нарушение протокола HTTP: хост оборвал соединение или прислал некорректный ответ
+	HostErrorHTTP = "http"
+	HostError4xx  = "4xx"
+	HostError5xx  = "5xx"
+)
+
+// HostErrors считает неудачные запросы к хостам по категориям, чтобы один сбоящий хост был сразу виден.
+// Ошибки, не связанные с хостом (запрет политикой, превышение размера, отмена пользователем), не учитываются.
+// nil-значение ничего не учитывает
+type HostErrors struct {
+	mu sync.Mutex
+	// hosts число ошибок по хостам (host:port) и категориям
+	hosts map[string]map[string]uint64
+}
+
+// NewHostErrors создает пустой учет ошибок
+func NewHostErrors() *HostErrors {
+	return &HostErrors{hosts: make(map[string]map[string]uint64)}
+}
+
+// hostErrorCategory возвращает категорию неудачного запроса к хосту по результату result и ошибке err,
+// пустую строку - если запрос удачный или ошибка не связана с хостом
+func hostErrorCategory(result UrlResult, err error) string {
+	if err != nil {
+		switch ErrorCode(err) {
+		case ErrorCodeDNS:
+			return HostErrorDNS
+		case ErrorCodeConnect:
+			return HostErrorConnect
+		case ErrorCodeTLS:
+			return HostErrorTLS
+		case ErrorCodeConnectTimeout, ErrorCodeReadTimeout:
+			return HostErrorTimeout
+		case ErrorCodeHTTP:
+			return HostErrorHTTP
+		}
+	}
+	switch {
+	case result.StatusCode >= 500 && result.StatusCode <= 599:
+		return HostError5xx
+	case result.StatusCode >= 400 && result.StatusCode <= 499:
+		return HostError4xx
+	}
+	return ""
+}
+
+// record учитывает запрос к host с результатом result и ошибкой err
+func (e *HostErrors) record(host string, result UrlResult, err error) {
+	if e == nil {
+		return
+	}
+	category := hostErrorCategory(result, err)
+	if category == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	counts := e.hosts[host]
+	if counts == nil {
+		if len(e.hosts) >= MaxErrorHosts {
+			host = ErrorHostOther
+			counts = e.hosts[host]
+		}
+		if counts == nil {
+			counts = make(map[string]uint64)
+			e.hosts[host] = counts
+		}
+	}
+	counts[category]++
+}
+
+// stats возвращает копию числа ошибок по хостам и категориям, для nil-значения - nil
+func (e *HostErrors) stats() map[string]map[string]uint64 {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := make(map[string]map[string]uint64, len(e.hosts))
+	for host, counts := range e.hosts {
+		stats[host] = maps.Clone(counts)
+	}
+	return stats
+}
+
+// writeText выводит ошибки по хостам и категориям в текстовом формате Prometheus
+func (e *HostErrors) writeText(w *metricsWriter) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w.counterHeader("fetch_host_errors_total", "Failed requests to target hosts, retries included, by host and category: dns, connect, tls, timeout, http, 4xx or 5xx.")
+	for _, host := range slices.Sorted(maps.Keys(e.hosts)) {
+		counts := e.hosts[host]
+		for _, category := range slices.Sorted(maps.Keys(counts)) {
+			fmt.Fprintf(w, "fetch_host_errors_total{host=\"%s\",category=%q} %d\n", labelEscaper.Replace(host), category, counts[category])
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicDialer устанавливает соединения QUIC для HTTP/3 с теми же разрешением имен и проверкой адресов,
+// что и соединения TCP. Все соединения используют один UDP-сокет, он открывается при первом соединении
+type quicDialer struct {
+	guard    *dialGuard
+	resolver *DNSResolver
+	// timeout время на установку соединения с одним адресом, 0 - ограничено только контекстом
+	timeout time.Duration
+
+	once      sync.Once
+	transport *quic.Transport
+	err       error
+}
+
+// altSvcAddrKey ключ в контексте запроса url: адрес HTTP/3, объявленный сервером в Alt-Svc,
+// с которым надо соединиться вместо адреса из url
+type altSvcAddrKey struct{}
+
+// dial соединяется с addr (или с адресом из Alt-Svc) по очереди по его адресам до первого успешного соединения
+func (d *quicDialer) dial(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	if alt, ok := ctx.Value(altSvcAddrKey{}).(string); ok {
+		addr = alt
+	}
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port in %s", addr)
+	}
+	network := "udp"
+	switch family, _ := ctx.Value(ipFamilyKey{}).(string); family {
+	case IPFamilyV4:
+		network = "udp4"
+	case IPFamilyV6:
+		network = "udp6"
+	}
+	addrs := []netip.Addr{}
+	if a, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, a)
+	} else if addrs, err = d.resolver.LookupNetIP(ctx, host); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	addrs = filterAddrFamily(addrs, network)
+	if len(addrs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}}
+	}
+	transport, err := d.quicTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	for _, a := range addrs {
+		if d.guard.blockedAddr(a) {
+			err = &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Address %s is not allowed", a.Unmap())}
+			continue
+		}
+		remote := net.UDPAddrFromAddrPort(netip.AddrPortFrom(a.Unmap(), uint16(port)))
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if d.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, d.timeout)
+		}
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart(network, remote.String())
+		}
+		var conn *quic.Conn
+		conn, err = transport.DialEarly(attemptCtx, remote, tlsCfg, cfg)
+		cancel()
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone(network, remote.String(), err)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		err = &net.OpError{Op: "dial", Net: network, Addr: remote, Err: err}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// quicTransport возвращает общий для всех соединений транспорт QUIC, открывая его сокет при первом вызове
+func (d *quicDialer) quicTransport() (*quic.Transport, error) {
+	d.once.Do(func() {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.transport = &quic.Transport{Conn: conn}
+	})
+	return d.transport, d.err
+}
+
+// maxAltSvcEntries сколько хостов с объявленным HTTP/3 запоминается
+const maxAltSvcEntries = 10000
+
+// defaultAltSvcMaxAge сколько действует объявление Alt-Svc без параметра ma (RFC 7838)
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// altSvcCache адреса HTTP/3, объявленные серверами в заголовке Alt-Svc ответов по HTTP/1.1 и HTTP/2,
+// по origin (хост:порт url https). Запоминаются только адреса на том же хосте, что и origin:
+// политика доступа к хостам проверяется по хосту url
+type altSvcCache struct {
+	mu      sync.Mutex
+	entries map[string]altSvcEntry
+}
+
+// altSvcEntry объявленный адрес HTTP/3 и срок действия объявления
+type altSvcEntry struct {
+	addr    string
+	expires time.Time
+}
+
+// newAltSvcCache создает пустой altSvcCache
+func newAltSvcCache() *altSvcCache {
+	return &altSvcCache{entries: make(map[string]altSvcEntry)}
+}
+
+// lookup возвращает действующий адрес HTTP/3 для origin
+func (c *altSvcCache) lookup(origin string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[origin]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, origin)
+		return "", false
+	}
+	return entry.addr, ok
+}
+
+// update запоминает объявление HTTP/3 из заголовка Alt-Svc ответа origin или забывает его при Alt-Svc: clear
+func (c *altSvcCache) update(origin, header string) {
+	if header == "" {
+		return
+	}
+	host, _, _ := net.SplitHostPort(origin)
+	addr, maxAge, ok := parseAltSvc(header, host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok || maxAge <= 0 {
+		delete(c.entries, origin)
+		return
+	}
+	now := time.Now()
+	if _, known := c.entries[origin]; !known && len(c.entries) >= maxAltSvcEntries {
+		for o, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, o)
+			}
+		}
+		if len(c.entries) >= maxAltSvcEntries {
+			return
+		}
+	}
+	c.entries[origin] = altSvcEntry{addr: addr, expires: now.Add(maxAge)}
+}
+
+// forget забывает объявление HTTP/3 для origin, например когда соединиться по нему не удалось
+func (c *altSvcCache) forget(origin string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, origin)
+}
+
+// parseAltSvc возвращает из значения Alt-Svc первый адрес h3 на хосте host и срок его действия.
+// false - HTTP/3 не объявлен или объявление отменено (clear)
+func parseAltSvc(header, host string) (string, time.Duration, bool) {
+	for _, alternative := range strings.Split(header, ",") {
+		params := strings.Split(alternative, ";")
+		protocol, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || protocol != "h3" {
+			continue
+		}
+		altHost, port, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil || altHost != "" && !strings.EqualFold(altHost, host) {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			continue
+		}
+		maxAge := defaultAltSvcMaxAge
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name == "ma" {
+				seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+				if err != nil {
+					continue
+				}
+				maxAge = time.Duration(min(seconds, int64(365*24*time.Hour/time.Second))) * time.Second
+			}
+		}
+		return net.JoinHostPort(host, port), maxAge, true
+	}
+	return "", 0, false
+}
+
+// urlOrigin возвращает origin url https: хост и порт
+func urlOrigin(req *http.Request) string {
+	port := req.URL.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(req.URL.Hostname()), port)
+}
+
+// rewindable проверяет, можно ли повторить запрос по другому протоколу: тела нет или его можно получить заново
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryOverTCP возвращает копию запроса для повтора по TCP с заново полученным телом
+func retryOverTCP(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startHTTP3Server запускает сервер HTTPS по TCP и HTTP/3 с одним сертификатом. Оба отвечают версией HTTP запроса,
+// а ответ по TCP объявляет в Alt-Svc порт altPort (0 - порт сервера HTTP/3).
+// Возвращает сервер HTTPS и порт сервера HTTP/3
+func startHTTP3Server(t *testing.T, altPort int) (*httptest.Server, int) {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	if altPort == 0 {
+		altPort = port
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=60`, altPort))
+		io.WriteString(w, r.Proto)
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: srv.TLS.Certificates})}
+	go h3.Serve(udp)
+	t.Cleanup(func() {
+		h3.Close()
+		udp.Close()
+	})
+	return srv, port
+}
+
+// newHTTP3Client создает клиента с hostTransport, доверяющего сертификату srv и соединяющегося с loopback
+func newHTTP3Client(srv *httptest.Server, versions []HostHTTPVersion, altSvc bool, allowed ...netip.Prefix) *http.Client {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	base.TLSClientConfig = &tls.Config{RootCAs: roots}
+	dial := &quicDialer{guard: &dialGuard{allowed: allowed}, timeout: time.Second}
+	return &http.Client{Transport: newHostTransport(base, nil, nil, versions, dial, altSvc)}
+}
+
+// getProto запрашивает url и возвращает версию HTTP, которой ответил сервер
+func getProto(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != resp.Proto {
+		t.Errorf("server saw %s, client got %s", body, resp.Proto)
+	}
+	return resp.Proto
+}
+
+var loopback = netip.MustParsePrefix("127.0.0.0/8")
+
+func TestHTTP3Version(t *testing.T) {
+	srv, port := startHTTP3Server(t, 0)
+	client := newHTTP3Client(srv, []HostHTTPVersion{{Pattern: "127.0.0.1", Version: HTTPVersion3}}, false, loopback)
+	if proto := getProto(t, client, "https://127.0.0.1:"+strconv.Itoa(port)+"/"); proto != "HTTP/3.0" {
+		t.Errorf("proto = %s, want HTTP/3.0", proto)
+	}
+}
+
+func TestHTTP3BlockedAddress(t *testing.T) {
+	srv, port := startHTTP3Server(t, 0)
+	client := newHTTP3Client(srv, []HostHTTPVersion{{Pattern: "*", Version: HTTPVersion3}}, false)
+	_, err := client.Get("https://127.0.0.1:" + strconv.Itoa(port) + "/")
+	if code := ErrorCode(err); code != ErrorCodeBlockedByPolicy {
+		t.Errorf("error = %v (%s), want %s", err, code, ErrorCodeBlockedByPolicy)
+	}
+}
+
+func TestHTTP3AltSvc(t *testing.T) {
+	srv, _ := startHTTP3Server(t, 0)
+	client := newHTTP3Client(srv, nil, true, loopback)
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/1.1" {
+		t.Errorf("first request proto = %s, want HTTP/1.1", proto)
+	}
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/3.0" {
+		t.Errorf("proto after Alt-Svc = %s, want HTTP/3.0", proto)
+	}
+
+	// без -http3-alt-svc объявление не учитывается
+	client = newHTTP3Client(srv, nil, false, loopback)
+	getProto(t, client, srv.URL)
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/1.1" {
+		t.Errorf("proto without alt-svc discovery = %s, want HTTP/1.1", proto)
+	}
+}
+
+func TestHTTP3AltSvcFallback(t *testing.T) {
+	// порт, на котором никто не слушает
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := udp.LocalAddr().(*net.UDPAddr).Port
+	udp.Close()
+
+	srv, _ := startHTTP3Server(t, deadPort)
+	client := newHTTP3Client(srv, nil, true, loopback)
+	getProto(t, client, srv.URL)
+	if proto := getProto(t, client, srv.URL); proto != "HTTP/1.1" {
+		t.Errorf("proto after failed HTTP/3 = %s, want HTTP/1.1", proto)
+	}
+}
+
+func TestParseAltSvc(t *testing.T) {
+	tests := []struct {
+		header   string
+		wantAddr string
+		wantAge  time.Duration
+		wantOK   bool
+	}{
+		{`h3=":443"; ma=86400`, "example.com:443", 24 * time.Hour, true},
+		{`h3=":8443"`, "example.com:8443", defaultAltSvcMaxAge, true},
+		{`h2=":443", h3-29=":443", h3=":4433"; ma=60; persist=1`, "example.com:4433", time.Minute, true},
+		{`h3="example.com:443"`, "example.com:443", defaultAltSvcMaxAge, true},
+		{`h3="other.example.com:443"`, "", 0, false},
+		{`h3=":0"`, "", 0, false},
+		{`clear`, "", 0, false},
+	}
+	for _, tt := range tests {
+		addr, age, ok := parseAltSvc(tt.header, "example.com")
+		if addr != tt.wantAddr || age != tt.wantAge || ok != tt.wantOK {
+			t.Errorf("parseAltSvc(%q) = %q, %v, %v, want %q, %v, %v", tt.header, addr, age, ok, tt.wantAddr, tt.wantAge, tt.wantOK)
+		}
+	}
+}
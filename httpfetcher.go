@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// UrlFetcher выполняет одну попытку запроса url. Fetcher вызывает его, когда политика доступа, ограничения
+// частоты и одновременных запросов к хосту уже проверены, а повторы и запасные url выполняет сам,
+// поэтому реализации можно подменять (например, в тестах) и оборачивать (кэш, запись запросов)
+type UrlFetcher interface {
+	Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error)
+}
+
+// UrlFetcherFunc функция, реализующая UrlFetcher
+type UrlFetcherFunc func(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error)
+
+// Fetch вызывает f
+func (f UrlFetcherFunc) Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	return f(ctx, task, opts)
+}
+
+// HTTPFetcher запрашивает url по HTTP через общий http.Client
+type HTTPFetcher struct {
+	// client основа клиентов запросов: транспорт с общим пулом соединений
+	client *http.Client
+	// policy политика доступа к хостам, проверяется при перенаправлениях
+	policy *HostPolicy
+	// cache ответы url для условных запросов, nil - условные запросы не выполняются
+	cache ResponseCache
+	// cacheTTL время хранения ответов в cache
+	cacheTTL ResponseCacheTTL
+	// metrics метрики соединений, nil - не учитываются
+	metrics *ConnMetrics
+	// requestIDHeader заголовок с идентификатором запроса пользователя, пустой - не отправляется
+	requestIDHeader string
+}
+
+// NewHTTPFetcher создает HTTPFetcher на основе client: для каждого запроса используется его копия
+// с таймаутом, перенаправлениями и куками запроса, а транспорт (и пул соединений) общий.
+// Полученные запросами соединения и этапы их установки учитываются в metrics.
+// Идентификатор запроса пользователя передается хостам в заголовке requestIDHeader, если он не пустой
+func NewHTTPFetcher(client *http.Client, policy *HostPolicy, cache ResponseCache, cacheTTL ResponseCacheTTL, metrics *ConnMetrics, requestIDHeader string) *HTTPFetcher {
+	return &HTTPFetcher{client: client, policy: policy, cache: cache, cacheTTL: cacheTTL, metrics: metrics, requestIDHeader: requestIDHeader}
+}
+
+// Fetch запрашивает информацию по url указанным в task методом (по умолчанию GET, в режиме проверки HEAD)
+// с параметрами opts, возвращает результат (тело, код и заголовки ответа) и ошибку.
+// Отмена ctx прерывает запрос. Если все ok, то error == nil
+func (f *HTTPFetcher) Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	result := UrlResult{Url: task.Url, Response: []byte{}}
+
+	method := task.Method
+	if method == "" {
+		method = http.MethodGet
+		if opts.Probe {
+			method = http.MethodHead
+		}
+	}
+	var reqBody io.Reader
+	if task.Body != "" {
+		reqBody = strings.NewReader(task.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, task.Url, reqBody)
+	if err != nil {
+		return result, &FetchError{Code: ErrorCodeInvalidUrl, Err: err}
+	}
+	for name, value := range task.Headers {
+		req.Header.Set(name, value)
+	}
+	// заголовок Host в net/http задается отдельным полем
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if task.Auth != nil {
+		task.Auth.apply(req)
+	}
+	// заголовок, заданный пользователем для url, не перезаписывается
+	if id := RequestID(ctx); f.requestIDHeader != "" && id != "" && req.Header.Get(f.requestIDHeader) == "" {
+		req.Header.Set(f.requestIDHeader, id)
+	}
+	if opts.UseRange && opts.MaxBytes > 0 && method == http.MethodGet && !opts.HashBody && req.Header.Get("Range") == "" {
+		req.Header.Set("Range", rangeHeader(opts.MaxBytes))
+		// часть сжатого тела не распаковать, поэтому тело запрашивается без сжатия
+		if req.Header.Get("Accept-Encoding") == "" {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", AcceptEncoding)
+	}
+	// условный запрос: если ответ url уже сохранен, сервер может ответить 304 без тела
+	var cacheKey string
+	var cached *CachedResponse
+	if opts.Conditional && f.cache != nil && method == http.MethodGet && !opts.HashBody {
+		cacheKey = responseCacheKey(task)
+		if cached, err = f.cache.Get(ctx, cacheKey); err != nil {
+			// без кэша url запрашивается как обычно
+			slog.Warn("Response cache", "error", err)
+		}
+		if cached != nil && cached.ETag != "" && req.Header.Get("If-None-Match") == "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached != nil && cached.LastModified != "" && req.Header.Get("If-Modified-Since") == "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	if opts.InsecureTLS {
+		// транспорт не проверяет сертификат только для разрешенных хостов, в том числе при перенаправлениях
+		req = req.WithContext(withInsecureTLS(req.Context()))
+	}
+	if opts.IPFamily != "" {
+		req = req.WithContext(withIPFamily(req.Context(), opts.IPFamily))
+	}
+	// замеряем длительность этапов запроса
+	trace := newTimingTrace(f.metrics)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.ClientTrace()))
+
+	redirects := &redirectRecorder{max: opts.MaxRedirects, policy: f.policy}
+	// клиент на каждый запрос свой (у запросов разные таймауты и перенаправления), а пул соединений общий
+	client := *f.client
+	client.Timeout = opts.Timeout
+	client.CheckRedirect = redirects.CheckRedirect
+	client.Jar = opts.Jar
+	resp, err := client.Do(req)
+	result.Redirects = redirects.hops
+	result.RemoteAddr = trace.RemoteAddr()
+	if err != nil {
+		result.Timing = trace.Timing()
+		if len(result.Redirects) > 0 {
+			// ответа нет, но видно, на каком переходе цепочка оборвалась
+			result.FinalUrl = result.Redirects[len(result.Redirects)-1].Location
+		}
+		// по таймауту клиента не видно, на каком этапе он истек, поэтому смотрим, успело ли установиться соединение
+		if ErrorCode(err) == ErrorCodeReadTimeout && !trace.Connected() {
+			err = &FetchError{Code: ErrorCodeConnectTimeout, Err: err}
+		}
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			result.RetryAfterMs = delay.Milliseconds()
+		}
+	}
+	result.Protocol = resp.Proto
+	result.FinalUrl = resp.Request.URL.String()
+	result.TLS = newTLSInfo(resp.TLS)
+	if opts.IncludeCookies {
+		result.Cookies = resp.Header.Values("Set-Cookie")
+	}
+	for _, name := range ReportedHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			if result.Headers == nil {
+				result.Headers = make(map[string]string, len(ReportedHeaders))
+			}
+			result.Headers[name] = value
+		}
+	}
+
+	if req.Method == http.MethodHead {
+		// тела у ответа на HEAD нет, размер известен только из заголовков
+		result.ContentLength = resp.ContentLength
+		result.Timing = trace.Timing()
+		return result, nil
+	}
+
+	bodyReader, compressed, err := decodeBody(resp)
+	if err != nil {
+		result.Timing = trace.Timing()
+		return result, err
+	}
+	// размер из Content-Length сжатого ответа относится к сжатому телу
+	sizeHint := resp.ContentLength
+	if compressed != nil {
+		sizeHint = -1
+	}
+	// ограничение относится к распакованному телу, поэтому сильно сжатый ответ не займет больше памяти, чем разрешено
+	streamed, err := readBody(bodyReader, sizeHint, opts)
+	if err != nil {
+		result.Timing = trace.Timing()
+		return result, err
+	}
+	if compressed != nil {
+		result.CompressedLength = compressed.n
+	}
+	if opts.HashBody {
+		setHash(&result, streamed)
+		if streamed.Overflow {
+			result.Timing = trace.Timing()
+			if _, truncate := bodyLimit(opts); !truncate {
+				return result, ErrBodyTooLarge
+			}
+			result.BodyTruncated = true
+			return result, nil
+		}
+		if opts.IncludeCookies {
+			// трейлеры известны только после чтения тела
+			result.Trailers = joinHeaderValues(resp.Trailer)
+		}
+		result.Timing = trace.Timing()
+		return result, nil
+	}
+
+	maxSize, truncate := bodyLimit(opts)
+	body, overflow := streamed.Data, streamed.Overflow
+	if cacheKey != "" {
+		// свежесть сообщается и для 304: источник присылает в нем актуальные заголовки кэширования
+		result.Freshness = parseFreshness(resp.Header, time.Now())
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		result.NotModified = true
+		if opts.CachedBody {
+			body, overflow = cached.Body, int64(len(cached.Body)) > maxSize
+			if overflow {
+				body = body[:maxSize]
+			}
+			contentType = cached.ContentType
+		}
+		// ответ подтвержден источником: если источник прислал заголовки кэширования, продлеваем хранение по ним
+		if result.Freshness != nil {
+			f.storeResponse(ctx, cacheKey, cached, result.Freshness)
+		}
+	}
+	if opts.MaxBytes > 0 {
+		result.FullLength = fullLength(resp, compressed != nil, int64(len(body)), overflow)
+	}
+	if overflow {
+		if !truncate {
+			result.Timing = trace.Timing()
+			return result, ErrBodyTooLarge
+		}
+		result.BodyTruncated = true
+	} else if resp.StatusCode == http.StatusPartialContent && result.FullLength != int64(len(body)) {
+		// сервер выполнил Range-запрос: получена только часть тела
+		result.BodyTruncated = true
+	} else if opts.IncludeCookies {
+		// трейлеры известны только после чтения всего тела
+		result.Trailers = joinHeaderValues(resp.Trailer)
+	}
+	// в кэш ниже попадает тело в исходной кодировке, перекодированное тело только возвращается
+	setBody(&result, body, contentType, opts)
+	if cacheKey != "" && resp.StatusCode == http.StatusOK && !result.BodyTruncated {
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			cached := &CachedResponse{ETag: etag, LastModified: lastModified, ContentType: contentType, Body: body}
+			f.storeResponse(ctx, cacheKey, cached, result.Freshness)
+		}
+	}
+	result.Timing = trace.Timing()
+	return result, nil
+}
+
+// fullLength возвращает полный размер тела ответа, size байт которого прочитано (overflow - тело длиннее
+// и прочитано не целиком), 0 - размер неизвестен. Размер из Content-Length сжатого ответа относится к сжатому телу
+func fullLength(resp *http.Response, compressed bool, size int64, overflow bool) int64 {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return max(contentRangeTotal(resp.Header.Get("Content-Range")), 0)
+	case !overflow:
+		// тело прочитано целиком
+		return size
+	case !compressed && resp.ContentLength >= 0:
+		return resp.ContentLength
+	}
+	return 0
+}
+
+// storeResponse сохраняет ответ в кэш на время, зависящее от его свежести; ответы с no-store не сохраняются
+func (f *HTTPFetcher) storeResponse(ctx context.Context, key string, resp *CachedResponse, freshness *Freshness) {
+	ttl, ok := f.cacheTTL.ttl(freshness)
+	if !ok {
+		return
+	}
+	if err := f.cache.Set(ctx, key, resp, ttl); err != nil {
+		slog.Warn("Response cache", "error", err)
+	}
+}
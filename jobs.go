@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// JobsPattern путь api асинхронных заданий
+	JobsPattern = "/v1/jobs"
+	// LegacyJobsPattern устаревший путь api асинхронных заданий, оставлен для совместимости
+	LegacyJobsPattern = "/jobs"
+	// JobResultTTL время хранения завершенного задания
+	JobResultTTL time.Duration = 10 * time.Minute
+	// MaxRunningJobs максимальное число одновременно выполняющихся заданий, остальные ждут в очереди
+	MaxRunningJobs int = 10
+	// MaxStoredJobs максимальное число хранимых заданий (ждущих, выполняющихся и завершенных),
+	// новые задания сверх него отклоняются с кодом 429
+	MaxStoredJobs int = 1000
+	// JobSweepInterval период удаления завершенных заданий, срок хранения которых истек
+	JobSweepInterval time.Duration = time.Minute
+	// DefaultResultsPageSize размер страницы результатов задания, если передан только курсор
+	DefaultResultsPageSize int = 100
+	// MaxResultsPageSize максимальный размер страницы результатов задания
+	MaxResultsPageSize int = 1000
+)
+
+// JobStatus состояние асинхронного задания
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobDone      JobStatus = "done"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// JobDeadline срок выполнения задания целиком, включая ожидание очереди (0 - без ограничения),
+// задается флагом -job-deadline. По его истечении задание завершается ошибкой ErrDeadlineExceeded
+var JobDeadline = 30 * time.Minute
+
+// ErrTooManyJobs хранилище заданий заполнено
+var ErrTooManyJobs = errors.New("Too many jobs, try again later")
+
+// CancelledUrlError текст ошибки для url, не обработанных из-за отмены задания
+const CancelledUrlError = "cancelled"
+
+// Job асинхронное задание на обработку списка url
+type Job struct {
+	mu sync.Mutex
+
+	id       string
+	request  Urls
+	status   JobStatus
+	results  ResultToUser
+	created  time.Time
+	finished time.Time
+	// total число url задания, включая полученные из шаблона
+	total int
+	// completed число уже обработанных url
+	completed int
+
+	// ctx контекст выполнения задания, отменяется через cancel при отмене задания
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stopped закрывается, когда выполнение задания закончено
+	stopped chan struct{}
+}
+
+// JobInfo структура ответа о состоянии задания
+type JobInfo struct {
+	ID         string     `json:"job_id"`
+	Status     JobStatus  `json:"status"`
+	Total      int        `json:"total"`
+	Completed  int        `json:"completed"`
+	Failed     int        `json:"failed"`
+	Cancelled  int        `json:"cancelled,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Info возвращает текущее состояние задания
+func (j *Job) Info() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info := JobInfo{
+		ID:        j.id,
+		Status:    j.status,
+		Total:     j.total,
+		Completed: j.completed,
+		Failed:    j.results.Failed,
+		Error:     j.results.Error,
+		CreatedAt: j.created,
+	}
+	if j.status == JobCancelled {
+		info.Cancelled = info.Total - info.Completed
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		info.FinishedAt = &finished
+	}
+	return info
+}
+
+// isFinished возвращает, завершено ли задание (вызывается под мьютексом)
+func (j *Job) isFinished() bool {
+	return j.status == JobDone || j.status == JobFailed || j.status == JobCancelled
+}
+
+// Cancel прерывает выполнение задания, повторные вызовы ничего не делают
+func (j *Job) Cancel() {
+	j.cancel()
+}
+
+// markCancelled завершает задание как отмененное:
+// все еще не обработанные url попадают в результаты с ошибкой CancelledUrlError
+func (j *Job) markCancelled() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// отмечаем уже обработанные url
+	done := make(map[int]bool, len(j.results.Responses))
+	for _, res := range j.results.Responses {
+		done[res.Index] = true
+	}
+	for i, task := range j.request.Tasks() {
+		if done[i] {
+			continue
+		}
+		// отмененные url не считаются неудачными, поэтому добавляем их напрямую
+		j.results.Responses = append(j.results.Responses, UrlResult{Index: i, Url: task.Url, Error: CancelledUrlError, ErrorCode: ErrorCodeCancelled})
+	}
+	j.results.Summary.finish()
+	j.status = JobCancelled
+	j.finished = time.Now()
+}
+
+// WriteResult сохраняет результат обработки url, реализует ResultWriter
+func (j *Job) WriteResult(res UrlResult) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.results.add(res)
+	j.completed++
+	return nil
+}
+
+// Finish завершает задание, реализует ResultWriter
+func (j *Job) Finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.results.finish(err)
+	j.status = JobDone
+	if err != nil {
+		j.status = JobFailed
+	}
+	j.finished = time.Now()
+}
+
+// JobStore хранилище асинхронных заданий
+type JobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+
+	// scheduler ограничивает число одновременно выполняющихся заданий, задания ждут в очереди по приоритету
+	scheduler *Scheduler
+	// shutdown закрывается при завершении работы сервера, прерывая выполнение заданий
+	shutdown chan struct{}
+	fetcher  *Fetcher
+}
+
+// NewJobStore создает хранилище заданий, url заданий запрашиваются через fetcher
+// shutdown служит индикатором того, что выполнение заданий придется прервать
+func NewJobStore(shutdown chan struct{}, fetcher *Fetcher) *JobStore {
+	s := &JobStore{
+		jobs:      make(map[string]*Job),
+		scheduler: NewScheduler(MaxRunningJobs, shutdown),
+		shutdown:  shutdown,
+		fetcher:   fetcher,
+	}
+
+	go s.sweep()
+	return s
+}
+
+// sweep периодически удаляет задания, срок хранения которых истек, даже если новые задания не создаются,
+// а при завершении работы сервера отменяет все задания
+func (s *JobStore) sweep() {
+	ticker := time.NewTicker(JobSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.removeExpired()
+			s.mu.Unlock()
+		case <-s.shutdown:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, job := range s.jobs {
+				job.Cancel()
+			}
+			return
+		}
+	}
+}
+
+// Submit создает задание по запросу и запускает его выполнение в фоне. Из ctx запроса на создание задания
+// берутся его идентификатор и трасса, в которой записывается выполнение задания.
+// Если хранится уже MaxStoredJobs заданий, возвращает ErrTooManyJobs
+func (s *JobStore) Submit(ctx context.Context, request Urls) (*Job, error) {
+	requestID := RequestID(ctx)
+	job := &Job{
+		id:      newJobID(),
+		request: request,
+		total:   len(request.Tasks()),
+		results: ResultToUser{RequestID: requestID, diff: request.Diff},
+		status:  JobQueued,
+		created: time.Now(),
+		stopped: make(chan struct{}),
+	}
+	// задание выполняется дольше запроса на его создание, но с его идентификатором, адресом клиента и в той же трассе
+	ctx = context.WithoutCancel(ctx)
+	if JobDeadline > 0 {
+		job.ctx, job.cancel = context.WithTimeoutCause(ctx, JobDeadline, ErrDeadlineExceeded)
+	} else {
+		job.ctx, job.cancel = context.WithCancel(ctx)
+	}
+
+	s.mu.Lock()
+	s.removeExpired()
+	if len(s.jobs) >= MaxStoredJobs {
+		s.mu.Unlock()
+		job.cancel()
+		return nil, ErrTooManyJobs
+	}
+	s.jobs[job.id] = job
+	s.mu.Unlock()
+
+	// задание, созданное во время завершения работы сервера, сразу отменяем
+	select {
+	case <-s.shutdown:
+		job.Cancel()
+	default:
+	}
+
+	go s.run(job)
+	return job, nil
+}
+
+// Get возвращает задание по идентификатору
+func (s *JobStore) Get(id string) (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// run дожидается свободного места и выполняет задание
+func (s *JobStore) run(job *Job) {
+	defer close(job.stopped)
+
+	if s.scheduler.Acquire(job.request.Priority, job.ctx.Done()) != nil {
+		// ожидание прерывает срок задания или его отмена, в том числе при завершении работы сервера
+		if errors.Is(context.Cause(job.ctx), ErrDeadlineExceeded) {
+			job.Finish(ErrDeadlineExceeded)
+		} else {
+			job.markCancelled()
+		}
+		return
+	}
+	defer s.scheduler.Release()
+
+	job.mu.Lock()
+	job.status = JobRunning
+	job.mu.Unlock()
+
+	ctx, span := s.fetcher.tracer.Start(job.ctx, "job", SpanKindInternal, nil)
+	defer span.End()
+	span.SetAttr("job.id", job.id)
+	// по истечении срока задания ProcessUrls сам завершает его с ErrDeadlineExceeded
+	err := s.fetcher.ProcessUrls(ctx, job.request, job)
+	switch {
+	case err == ErrCancelled:
+		job.markCancelled()
+	case err != nil:
+		job.Finish(err)
+	}
+}
+
+// removeExpired удаляет завершенные задания, срок хранения которых истек (вызывается под мьютексом)
+func (s *JobStore) removeExpired() {
+	now := time.Now()
+	for id, job := range s.jobs {
+		job.mu.Lock()
+		expired := job.isFinished() && now.Sub(job.finished) > JobResultTTL
+		job.mu.Unlock()
+		if expired {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// newJobID генерирует случайный идентификатор задания
+func newJobID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// без источника случайности работать дальше нельзя
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// HandleJobs обрабатывает api асинхронных заданий:
+// POST /jobs - создание задания, GET /jobs/{id} - состояние, DELETE /jobs/{id} - отмена,
+// GET /jobs/{id}/results - итоговый результат
+func HandleJobs(store *JobStore) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// разбираем путь вида /jobs[/{id}[/results]]
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, JobsPattern), "/"), "/")
+
+		switch {
+		case len(parts) == 1 && parts[0] == "":
+			handleJobSubmit(store, rw, r)
+		case len(parts) == 1:
+			handleJobInfo(store, parts[0], rw, r)
+		case len(parts) == 2 && parts[1] == "results":
+			handleJobResults(store, parts[0], rw, r)
+		default:
+			http.NotFound(rw, r)
+		}
+	})
+}
+
+// handleJobSubmit создает задание: POST /jobs
+func handleJobSubmit(store *JobStore, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	// задания держат результаты в памяти, поэтому перегруженный сервер их тоже не принимает
+	if err := store.fetcher.shedder.Check(); err != nil {
+		rejectOverloaded(rw, err)
+		return
+	}
+
+	request, err := DecodeRequest(rw, r)
+	if err != nil {
+		http.Error(rw, err.Error(), DecodeErrorStatus(err))
+		return
+	}
+
+	job, err := store.Submit(r.Context(), request)
+	if err != nil {
+		// место освобождается по мере истечения срока хранения завершенных заданий
+		rw.Header().Set("Retry-After", strconv.Itoa(int(JobSweepInterval.Seconds())))
+		http.Error(rw, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	rw.Header().Set("Location", JobsPattern+"/"+job.id)
+	writeJSON(rw, http.StatusAccepted, JobCreated{job.id})
+}
+
+// handleJobInfo возвращает состояние задания: GET /jobs/{id}
+// или отменяет его: DELETE /jobs/{id}
+func handleJobInfo(store *JobStore, id string, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, ok := store.Get(id)
+	if !ok {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		// отмена завершенного задания ничего не меняет
+		job.Cancel()
+		// дожидаемся, пока задание зафиксирует отмену, чтобы вернуть итоговое состояние
+		<-job.stopped
+	}
+	writeJSON(rw, http.StatusOK, job.Info())
+}
+
+// handleJobResults возвращает итоговый результат задания: GET /jobs/{id}/results.
+// С параметрами ?cursor=...&limit=... результаты отдаются постранично
+func handleJobResults(store *JobStore, id string, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	paginate := query.Has("cursor") || query.Has("limit")
+	offset, limit, err := parsePage(query.Get("cursor"), query.Get("limit"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, ok := store.Get(id)
+	if !ok {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	// результаты завершенного задания больше не меняются, поэтому отправляются уже без мьютекса:
+	// медленный клиент не должен задерживать удаление устаревших заданий и создание новых
+	job.mu.Lock()
+	finished, results := job.isFinished(), job.results
+	job.mu.Unlock()
+	if !finished {
+		http.Error(rw, "Job is not finished yet", http.StatusConflict)
+		return
+	}
+	if !paginate {
+		writeResults(rw, r.Header.Get("Accept"), results)
+		return
+	}
+	writeResults(rw, r.Header.Get("Accept"), results.page(offset, limit))
+}
+
+// page возвращает страницу ответа: не больше limit результатов начиная с offset
+// и курсор следующей страницы, если она есть. Статистика остается по всем результатам
+func (r ResultToUser) page(offset, limit int) ResultToUser {
+	if offset > len(r.Responses) {
+		offset = len(r.Responses)
+	}
+	end := len(r.Responses)
+	if end-offset > limit {
+		end = offset + limit
+		r.NextCursor = strconv.Itoa(end)
+	}
+	if r.Responses != nil {
+		r.Responses = r.Responses[offset:end]
+	}
+	return r
+}
+
+// parsePage разбирает параметры страницы результатов: курсор (номер первого результата) и размер страницы.
+// Текст возвращаемой ошибки предназначен для пользователя
+func parsePage(cursor, limit string) (int, int, error) {
+	offset, size := 0, DefaultResultsPageSize
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("Invalid cursor")
+		}
+		offset = n
+	}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return 0, 0, errors.New("Limit must be positive")
+		}
+		size = n
+	}
+	if size > MaxResultsPageSize {
+		size = MaxResultsPageSize
+	}
+	return offset, size, nil
+}
+
+// writeJSON упаковывает v и отправляет пользователю с кодом status
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		// идентификатор запроса выставлен в заголовке ответа (см. HandleRequestID)
+		logRequest(slog.LevelError, rw.Header().Get(RequestIDHeader), "Error on marshal", "error", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	// без перевода строки, который добавляет Encode
+	rw.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
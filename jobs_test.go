@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestJobStore создает хранилище заданий, url которых запрашиваются через fetch
+func newTestJobStore(t *testing.T, fetch func(ctx context.Context, task UrlRequest) (UrlResult, error)) *JobStore {
+	t.Helper()
+	shutdown := make(chan struct{})
+	t.Cleanup(func() { close(shutdown) })
+	fetcher := NewFetcher(FetcherConfig{
+		Backend: UrlFetcherFunc(func(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+			return fetch(ctx, task)
+		}),
+	})
+	return NewJobStore(shutdown, fetcher)
+}
+
+// blockingResponseWriter ResponseWriter клиента, который не читает ответ, пока не закрыт release
+type blockingResponseWriter struct {
+	header  http.Header
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingResponseWriter) Header() http.Header { return w.header }
+
+func (w *blockingResponseWriter) WriteHeader(status int) {}
+
+func (w *blockingResponseWriter) Write(p []byte) (int, error) {
+	close(w.writing)
+	<-w.release
+	return len(p), nil
+}
+
+func TestJobResultsSlowClient(t *testing.T) {
+	store := newTestJobStore(t, fakeBody)
+	job, err := store.Submit(context.Background(), Urls{Urls: testUrls(3)})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	<-job.stopped
+
+	rw := &blockingResponseWriter{header: http.Header{}, writing: make(chan struct{}), release: make(chan struct{})}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		handleJobResults(store, job.id, rw, httptest.NewRequest(http.MethodGet, JobsPattern+"/"+job.id+"/results", nil))
+	}()
+	<-rw.writing
+
+	// пока результаты отправляются, создание задания проверяет срок хранения всех заданий, в том числе этого
+	submitted := make(chan error, 1)
+	go func() {
+		_, err := store.Submit(context.Background(), Urls{Urls: testUrls(1)})
+		submitted <- err
+	}()
+	select {
+	case err := <-submitted:
+		if err != nil {
+			t.Errorf("Submit() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Submit() blocked while job results were being sent")
+	}
+	close(rw.release)
+	<-sent
+}
+
+// doJobRequest выполняет запрос к api заданий и разбирает json-ответ в v, если он передан
+func doJobRequest(t *testing.T, h http.Handler, method, target, body string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s response %s is not json: %v", method, target, rec.Body, err)
+		}
+	}
+	return rec
+}
+
+func TestHandleJobs(t *testing.T) {
+	store := newTestJobStore(t, fakeBody)
+	h := HandleJobs(store)
+
+	var created JobCreated
+	rec := doJobRequest(t, h, http.MethodPost, JobsPattern, `{"urls":["http://example.test/0","http://example.test/1","http://example.test/2"]}`, &created)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Location") != JobsPattern+"/"+created.ID {
+		t.Fatalf("POST %s = %d with Location %q", JobsPattern, rec.Code, rec.Header().Get("Location"))
+	}
+	job, ok := store.Get(created.ID)
+	if !ok {
+		t.Fatalf("job %s is not stored", created.ID)
+	}
+	<-job.stopped
+
+	var info JobInfo
+	doJobRequest(t, h, http.MethodGet, JobsPattern+"/"+created.ID, "", &info)
+	if info.Status != JobDone || info.Total != 3 || info.Completed != 3 || info.FinishedAt == nil {
+		t.Errorf("job info = %+v, want 3 of 3 urls done", info)
+	}
+
+	var results ResultToUser
+	doJobRequest(t, h, http.MethodGet, JobsPattern+"/"+created.ID+"/results", "", &results)
+	if len(results.Responses) != 3 || results.NextCursor != "" {
+		t.Errorf("results have %d responses and cursor %q, want 3 without a cursor", len(results.Responses), results.NextCursor)
+	}
+
+	var page ResultToUser
+	doJobRequest(t, h, http.MethodGet, JobsPattern+"/"+created.ID+"/results?limit=2", "", &page)
+	if len(page.Responses) != 2 || page.NextCursor != "2" {
+		t.Errorf("first page has %d responses and cursor %q, want 2 and \"2\"", len(page.Responses), page.NextCursor)
+	}
+	page = ResultToUser{}
+	doJobRequest(t, h, http.MethodGet, JobsPattern+"/"+created.ID+"/results?cursor=2&limit=2", "", &page)
+	if len(page.Responses) != 1 || page.NextCursor != "" {
+		t.Errorf("last page has %d responses and cursor %q, want 1 without a cursor", len(page.Responses), page.NextCursor)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{name: "unknown job", method: http.MethodGet, target: JobsPattern + "/unknown", wantStatus: http.StatusNotFound},
+		{name: "unknown job results", method: http.MethodGet, target: JobsPattern + "/unknown/results", wantStatus: http.StatusNotFound},
+		{name: "invalid cursor", method: http.MethodGet, target: JobsPattern + "/" + created.ID + "/results?cursor=x", wantStatus: http.StatusBadRequest},
+		{name: "unknown path", method: http.MethodGet, target: JobsPattern + "/" + created.ID + "/other", wantStatus: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodPut, target: JobsPattern + "/" + created.ID, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := doJobRequest(t, h, tt.method, tt.target, "", nil); rec.Code != tt.wantStatus {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.target, rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandleJobsCancel(t *testing.T) {
+	started := make(chan struct{}, 2)
+	store := newTestJobStore(t, func(ctx context.Context, task UrlRequest) (UrlResult, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return UrlResult{}, ctx.Err()
+	})
+	h := HandleJobs(store)
+
+	var created JobCreated
+	doJobRequest(t, h, http.MethodPost, JobsPattern, `{"urls":["http://example.test/0","http://example.test/1"]}`, &created)
+	<-started
+	if rec := doJobRequest(t, h, http.MethodGet, JobsPattern+"/"+created.ID+"/results", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("results of a running job status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	var info JobInfo
+	doJobRequest(t, h, http.MethodDelete, JobsPattern+"/"+created.ID, "", &info)
+	if info.Status != JobCancelled || info.Cancelled != info.Total-info.Completed {
+		t.Errorf("cancelled job info = %+v", info)
+	}
+
+	var results ResultToUser
+	doJobRequest(t, h, http.MethodGet, JobsPattern+"/"+created.ID+"/results", "", &results)
+	if len(results.Responses) != 2 {
+		t.Fatalf("cancelled job has %d results, want 2", len(results.Responses))
+	}
+	for _, res := range results.Responses {
+		if res.Error == "" {
+			t.Errorf("result of %s has no error", res.Url)
+		}
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		cursor, limit string
+		wantOffset    int
+		wantSize      int
+		wantErr       bool
+	}{
+		{wantOffset: 0, wantSize: DefaultResultsPageSize},
+		{cursor: "5", limit: "10", wantOffset: 5, wantSize: 10},
+		{limit: "100000", wantSize: MaxResultsPageSize},
+		{cursor: "-1", wantErr: true},
+		{cursor: "x", wantErr: true},
+		{limit: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		offset, size, err := parsePage(tt.cursor, tt.limit)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && (offset != tt.wantOffset || size != tt.wantSize)) {
+			t.Errorf("parsePage(%q, %q) = %d, %d, %v", tt.cursor, tt.limit, offset, size, err)
+		}
+	}
+}
+
+func TestResultPage(t *testing.T) {
+	results := ResultToUser{Responses: make([]UrlResult, 5), Failed: 1}
+	if page := results.page(10, 2); len(page.Responses) != 0 || page.NextCursor != "" {
+		t.Errorf("page after the end = %d results with cursor %q", len(page.Responses), page.NextCursor)
+	}
+	// статистика страницы относится ко всем результатам
+	if page := results.page(2, 2); len(page.Responses) != 2 || page.NextCursor != "4" || page.Failed != 1 {
+		t.Errorf("page(2, 2) = %d results with cursor %q and %d failed", len(page.Responses), page.NextCursor, page.Failed)
+	}
+}
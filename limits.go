@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdminLimitsPattern путь, по которому администратор читает и меняет ограничения сервера
+const AdminLimitsPattern = "/admin/limits"
+
+// maxLimitsSize максимальный размер тела запроса и файла ограничений
+const maxLimitsSize = 64 << 10
+
+// Limits ограничения обработки запросов, которые можно менять без перезапуска сервера:
+// через AdminLimitsPattern или файлом ограничений, перечитываемым по SIGHUP.
+// Новые значения действуют для запросов, поступивших после изменения
+type Limits struct {
+	// MaxUrlCount максимальное число url в запросе пользователя (и размер части при "chunked": true)
+	MaxUrlCount int `json:"max_url_count"`
+	// MaxSimultaneousClients максимальное число одновременно обрабатываемых запросов
+	MaxSimultaneousClients int `json:"max_simultaneous_clients"`
+	// MaxSimultaneousUrlRequests число одновременно обрабатываемых url одного запроса по умолчанию
+	MaxSimultaneousUrlRequests int `json:"max_simultaneous_url_requests"`
+	// RequestUrlTimeoutMs таймаут запроса одного url по умолчанию в миллисекундах
+	RequestUrlTimeoutMs int `json:"request_url_timeout_ms"`
+}
+
+// DefaultLimits ограничения при запуске сервера
+var DefaultLimits = Limits{
+	MaxUrlCount:                DefaultMaxUrlCount,
+	MaxSimultaneousClients:     DefaultMaxSimultaneousClients,
+	MaxSimultaneousUrlRequests: DefaultMaxSimultaneousUrlRequests,
+	RequestUrlTimeoutMs:        int(DefaultRequestUrlTimeout / time.Millisecond),
+}
+
+// RequestUrlTimeout возвращает таймаут запроса одного url по умолчанию
+func (l Limits) RequestUrlTimeout() time.Duration {
+	return time.Duration(l.RequestUrlTimeoutMs) * time.Millisecond
+}
+
+// Validate проверяет ограничения.
+// Текст возвращаемой ошибки предназначен для администратора
+func (l Limits) Validate() error {
+	switch {
+	case l.MaxUrlCount < 1 || l.MaxUrlCount > MaxChunkedUrlCount:
+		return fmt.Errorf("max_url_count must be between 1 and %d", MaxChunkedUrlCount)
+	case l.MaxSimultaneousClients < 1:
+		return errors.New("max_simultaneous_clients must be positive")
+	case l.MaxSimultaneousUrlRequests < 1:
+		return errors.New("max_simultaneous_url_requests must be positive")
+	case l.RequestUrlTimeoutMs < 1 || l.RequestUrlTimeout() > MaxRequestUrlTimeout:
+		return fmt.Errorf("request_url_timeout_ms must be between 1 and %d", MaxRequestUrlTimeout/time.Millisecond)
+	}
+	return nil
+}
+
+// currentLimits действующие ограничения, nil - DefaultLimits. Меняются целиком, поэтому запрос
+// никогда не видит часть старых и часть новых значений
+var currentLimits atomic.Pointer[Limits]
+
+// limitsMu упорядочивает изменения ограничений: каждое изменение применяется к результату предыдущего
+var limitsMu sync.Mutex
+
+// CurrentLimits возвращает действующие ограничения
+func CurrentLimits() Limits {
+	if l := currentLimits.Load(); l != nil {
+		return *l
+	}
+	return DefaultLimits
+}
+
+// UpdateLimits меняет ограничения: update получает копию base (nil - действующих ограничений) и меняет ее,
+// проверенный результат становится действующим, а число мест scheduler - равным MaxSimultaneousClients.
+// Возвращает новые ограничения
+func UpdateLimits(base *Limits, update func(*Limits) error, scheduler *Scheduler) (Limits, error) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+
+	limits := CurrentLimits()
+	if base != nil {
+		limits = *base
+	}
+	if err := update(&limits); err != nil {
+		return Limits{}, err
+	}
+	if err := limits.Validate(); err != nil {
+		return Limits{}, err
+	}
+	scheduler.SetCapacity(limits.MaxSimultaneousClients)
+	currentLimits.Store(&limits)
+	return limits, nil
+}
+
+// decodeLimits читает изменения ограничений в формате json из r в l: не указанные поля не меняются
+func decodeLimits(r io.Reader, l *Limits) error {
+	decoder := json.NewDecoder(io.LimitReader(r, maxLimitsSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(l); err != nil {
+		return fmt.Errorf("Invalid limits: %v", err)
+	}
+	return nil
+}
+
+// LoadLimitsFile делает действующими ограничения из файла path в формате json: не указанные в файле
+// ограничения возвращаются к значениям по умолчанию
+func LoadLimitsFile(path string, scheduler *Scheduler) (Limits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Limits{}, err
+	}
+	defaults := DefaultLimits
+	return UpdateLimits(&defaults, func(l *Limits) error {
+		return decodeLimits(bytes.NewReader(data), l)
+	}, scheduler)
+}
+
+// ReadAdminToken читает токен администратора из файла path, пробелы и переводы строк по краям отбрасываются
+func ReadAdminToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Admin token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// HandleAdminLimits отдает действующие ограничения (GET) и меняет их (PATCH с полями, которые надо изменить).
+// Доступ только с заголовком Authorization: Bearer <token>. Изменения применяются к scheduler
+func HandleAdminLimits(token string, scheduler *Scheduler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(rw, r, token) {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(rw, http.StatusOK, CurrentLimits())
+		case http.MethodPatch:
+			limits, err := UpdateLimits(nil, func(l *Limits) error { return decodeLimits(r.Body, l) }, scheduler)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logContext(r.Context(), slog.LevelInfo, "Limits updated", "limits", limits)
+			writeJSON(rw, http.StatusOK, limits)
+		default:
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// checkAdmin проверяет токен администратора в запросе r и, если он неверный, отвечает кодом 401
+func checkAdmin(rw http.ResponseWriter, r *http.Request, token string) bool {
+	if validAdminToken(r, token) {
+		return true
+	}
+	rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+	http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+// validAdminToken проверяет токен администратора в запросе, сравнивая за время, не зависящее от совпадения
+func validAdminToken(r *http.Request, token string) bool {
+	scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) == 1
+}
+
+// reloadLimits перечитывает файл ограничений path по SIGHUP
+func reloadLimits(path string, scheduler *Scheduler) {
+	limits, err := LoadLimitsFile(path, scheduler)
+	if err != nil {
+		slog.Error("Reload limits", "error", err)
+		return
+	}
+	slog.Info("Limits reloaded", "limits", limits)
+}
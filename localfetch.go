@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Схемы url для локальных файлов и встроенных данных, по умолчанию выключены
+const (
+	SchemeFile = "file"
+	SchemeData = "data"
+)
+
+// ExtraSchemes схемы url помимо http и https, включенные при запуске сервера
+var ExtraSchemes []string
+
+// localScheme проверяет, что url схемы scheme не обращаются к сети: к ним не применяются
+// политика доступа к хостам и ограничения запросов к хостам
+func localScheme(scheme string) bool {
+	scheme = strings.ToLower(scheme)
+	return scheme == SchemeFile || scheme == SchemeData
+}
+
+// SchemeFetcher запрашивает url схем из schemes через их UrlFetcher, а url остальных схем - через fallback
+type SchemeFetcher struct {
+	fallback UrlFetcher
+	schemes  map[string]UrlFetcher
+}
+
+// NewSchemeFetcher создает UrlFetcher, выбирающий обработчик по схеме url; без schemes возвращает fallback
+func NewSchemeFetcher(fallback UrlFetcher, schemes map[string]UrlFetcher) UrlFetcher {
+	if len(schemes) == 0 {
+		return fallback
+	}
+	return &SchemeFetcher{fallback: fallback, schemes: schemes}
+}
+
+// Fetch запрашивает url через обработчик его схемы
+func (f *SchemeFetcher) Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	if u, err := url.Parse(task.Url); err == nil {
+		if fetcher, ok := f.schemes[strings.ToLower(u.Scheme)]; ok {
+			return fetcher.Fetch(ctx, task, opts)
+		}
+	}
+	return f.fallback.Fetch(ctx, task, opts)
+}
+
+// FileFetcher читает файлы по url вида file:///path из каталога: путь url отсчитывается от него,
+// а выйти за его пределы (в том числе по символическим ссылкам) нельзя
+type FileFetcher struct {
+	root *os.Root
+}
+
+// NewFileFetcher создает FileFetcher для файлов каталога dir
+func NewFileFetcher(dir string) (*FileFetcher, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &FileFetcher{root: root}, nil
+}
+
+// Fetch читает файл url как тело ответа с кодом 200. Для несуществующего файла результат - код 404,
+// для каталога и недоступного файла - 403, как ответил бы HTTP-сервер со статическими файлами
+func (f *FileFetcher) Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	start := time.Now()
+	result := UrlResult{Url: task.Url, Response: []byte{}, FinalUrl: task.Url}
+	defer func() { result.Timing = &UrlTiming{Total: milliseconds(start, time.Now())} }()
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	method, err := readOnlyMethod(task, opts)
+	if err != nil {
+		return result, err
+	}
+	u, err := url.Parse(task.Url)
+	if err != nil {
+		return result, &FetchError{Code: ErrorCodeInvalidUrl, Err: err}
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return result, &FetchError{Code: ErrorCodeInvalidUrl, Err: fmt.Errorf("File url %q must not have a host", task.Url)}
+	}
+	name := strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	file, err := f.root.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		result.StatusCode = http.StatusNotFound
+		return result, nil
+	}
+	if err != nil {
+		// нет прав или путь ведет за пределы каталога
+		result.StatusCode = http.StatusForbidden
+		return result, nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return result, err
+	}
+	if info.IsDir() {
+		result.StatusCode = http.StatusForbidden
+		return result, nil
+	}
+
+	result.StatusCode = http.StatusOK
+	body := bufio.NewReader(file)
+	contentType := contentTypeOf(name, body)
+	result.Headers = map[string]string{
+		"Content-Type":  contentType,
+		"Last-Modified": info.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if method == http.MethodHead {
+		result.ContentLength = info.Size()
+		return result, nil
+	}
+	if opts.MaxBytes > 0 {
+		result.FullLength = info.Size()
+	}
+	return result, readLocalBody(&result, body, info.Size(), contentType, opts)
+}
+
+// DataFetcher возвращает данные, встроенные в url вида data:[<тип>][;base64],<данные> (RFC 2397)
+type DataFetcher struct{}
+
+// Fetch возвращает данные url как тело ответа с кодом 200 и указанным в url типом
+func (DataFetcher) Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	start := time.Now()
+	result := UrlResult{Url: task.Url, Response: []byte{}, FinalUrl: task.Url}
+	defer func() { result.Timing = &UrlTiming{Total: milliseconds(start, time.Now())} }()
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	method, err := readOnlyMethod(task, opts)
+	if err != nil {
+		return result, err
+	}
+	contentType, data, err := parseDataUrl(task.Url)
+	if err != nil {
+		return result, &FetchError{Code: ErrorCodeInvalidUrl, Err: err}
+	}
+
+	result.StatusCode = http.StatusOK
+	result.Headers = map[string]string{"Content-Type": contentType}
+	if method == http.MethodHead {
+		result.ContentLength = int64(len(data))
+		return result, nil
+	}
+	if opts.MaxBytes > 0 {
+		result.FullLength = int64(len(data))
+	}
+	return result, readLocalBody(&result, bytes.NewReader(data), int64(len(data)), contentType, opts)
+}
+
+// parseDataUrl разбирает url вида data:[<тип>][;base64],<данные> и возвращает тип и данные.
+// Без типа данные - text/plain (по умолчанию в кодировке US-ASCII)
+func parseDataUrl(rawUrl string) (string, []byte, error) {
+	if len(rawUrl) < len(SchemeData)+1 || !strings.EqualFold(rawUrl[:len(SchemeData)+1], SchemeData+":") {
+		return "", nil, fmt.Errorf("Data url must start with %s:", SchemeData)
+	}
+	meta, encoded, ok := strings.Cut(rawUrl[len(SchemeData)+1:], ",")
+	if !ok {
+		return "", nil, errors.New("Data url must contain a comma before the data")
+	}
+	isBase64 := len(meta) >= len(";base64") && strings.EqualFold(meta[len(meta)-len(";base64"):], ";base64")
+	if isBase64 {
+		meta = meta[:len(meta)-len(";base64")]
+	}
+	contentType, err := url.PathUnescape(meta)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid data url type: %w", err)
+	}
+	if contentType == "" {
+		contentType = "text/plain;charset=US-ASCII"
+	} else if strings.HasPrefix(contentType, ";") {
+		contentType = "text/plain" + contentType
+	}
+	text, err := url.PathUnescape(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid data url data: %w", err)
+	}
+	if !isBase64 {
+		return contentType, []byte(text), nil
+	}
+	// пробелы и переводы строк в base64 допускаются, а дополнение "=" часто опускают
+	text = strings.Join(strings.Fields(text), "")
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "=")); err != nil {
+			return "", nil, fmt.Errorf("Invalid data url base64: %w", err)
+		}
+	}
+	return contentType, data, nil
+}
+
+// contentTypeOf возвращает тип файла name по расширению, а если оно неизвестно, то, как http.FileServer,
+// по началу содержимого body. Без body тип по содержимому не определяется, результат может быть пустым
+func contentTypeOf(name string, body *bufio.Reader) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" || body == nil {
+		return contentType
+	}
+	head, _ := body.Peek(512)
+	return http.DetectContentType(head)
+}
+
+// readOnlyMethod возвращает метод запроса url схемы, из которой можно только читать (file, data, ftp):
+// поддерживаются только GET и HEAD
+func readOnlyMethod(task UrlRequest, opts FetchOptions) (string, error) {
+	switch {
+	case task.Method == "" && opts.Probe:
+		return http.MethodHead, nil
+	case task.Method == "" || task.Method == http.MethodGet:
+		return http.MethodGet, nil
+	case task.Method == http.MethodHead:
+		return http.MethodHead, nil
+	}
+	return "", &FetchError{Code: ErrorCodeInvalidUrl, Err: fmt.Errorf("Method %s is not supported for url %q", task.Method, task.Url)}
+}
+
+// readLocalBody записывает тело r размера size (-1 - неизвестен) с типом contentType в результат так же,
+// как тело ответа HTTP: в режиме хэша - только его SHA-256 и размер, иначе тело с учетом ограничения размера
+func readLocalBody(result *UrlResult, r io.Reader, size int64, contentType string, opts FetchOptions) error {
+	body, err := readBody(r, size, opts)
+	if err != nil {
+		return err
+	}
+	if body.Overflow {
+		if _, truncate := bodyLimit(opts); !truncate {
+			return ErrBodyTooLarge
+		}
+		result.BodyTruncated = true
+	}
+	if opts.HashBody {
+		setHash(result, body)
+		return nil
+	}
+	setBody(result, body.Data, contentType, opts)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logBackupTime формат времени ротации в имени старого файла лога: server.log.2026-10-15T11-06-46.891
+const logBackupTime = "2006-01-02T15-04-05.000"
+
+// RotatingFile файл лога, который переименовывается и начинается заново, когда его размер превысил бы maxBytes
+// или с его начала прошло interval. Старых файлов хранится не больше maxBackups, более ранние удаляются
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	interval   time.Duration
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	// size размер текущего файла, opened когда он начат
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile открывает (или создает) файл лога path, дописывая в его конец.
+// maxBytes и interval 0 - без ротации по размеру и по времени, maxBackups 0 - старые файлы не удаляются
+func OpenRotatingFile(path string, maxBytes int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxBytes: maxBytes, interval: interval, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open открывает файл лога
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write дописывает p в файл, предварительно начиная новый, если пора.
+// Запись не делится между файлами, поэтому файл может превышать maxBytes на размер записи, большей maxBytes
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && ((f.maxBytes > 0 && f.size+int64(len(p)) > f.maxBytes) ||
+		(f.interval > 0 && time.Since(f.opened) >= f.interval)) {
+		if err := f.rotate(); err != nil {
+			// без ротации запись все равно делается, потерять лог хуже, чем превысить размер
+			f.opened = time.Now()
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate переименовывает текущий файл, открывает новый и удаляет лишние старые файлы
+func (f *RotatingFile) rotate() error {
+	backup := f.path + "." + time.Now().Format(logBackupTime)
+	if _, err := os.Lstat(backup); err == nil {
+		// ротация в ту же миллисекунду затерла бы предыдущий файл, текущий продолжается до следующей записи
+		return os.ErrExist
+	}
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	f.file.Close()
+	if err := f.open(); err != nil {
+		// пишем хотя бы в переименованный файл
+		file, reopenErr := os.OpenFile(backup, os.O_WRONLY|os.O_APPEND, 0)
+		if reopenErr == nil {
+			f.file = file
+		}
+		return err
+	}
+	f.removeBackups()
+	return nil
+}
+
+// removeBackups удаляет старые файлы сверх maxBackups, начиная с самых ранних
+func (f *RotatingFile) removeBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	matches, _ := filepath.Glob(f.path + ".*")
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(logBackupTime, strings.TrimPrefix(match, f.path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// время в имени записано так, что порядок имен совпадает с порядком ротаций
+	slices.Sort(backups)
+	for len(backups) > f.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// Close закрывает файл
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Форматы логов, задаются флагом -log-format
+const (
+	// LogFormatText строки вида key=value
+	LogFormatText = "text"
+	// LogFormatJSON объект json на строку, для систем сбора логов
+	LogFormatJSON = "json"
+)
+
+// NewLogger создает логгер, пишущий в w записи уровня не ниже level в формате format.
+// Записи уровня debug с одинаковым сообщением пишутся не чаще debugRate в секунду, 0 - без ограничения
+func NewLogger(w io.Writer, format string, level slog.Level, debugRate int) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case LogFormatText:
+		h = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("Unknown log format %q, must be %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	if debugRate > 0 {
+		h = &samplingHandler{Handler: h, rate: debugRate, windows: &sampleWindows{byMsg: make(map[string]*sampleWindow)}}
+	}
+	return slog.New(h), nil
+}
+
+// samplingHandler пропускает не больше rate записей уровня debug с одинаковым сообщением в секунду,
+// чтобы частые записи (например, Url fetched под нагрузкой) не заполняли лог. Число пропущенных записей
+// добавляется полем sampled_out к следующей записанной с тем же сообщением
+type samplingHandler struct {
+	slog.Handler
+	rate int
+	// windows общие для логгеров, созданных With
+	windows *sampleWindows
+}
+
+// sampleWindows счетчики записей по сообщениям. Сообщения - константы в коде, поэтому их число ограничено
+type sampleWindows struct {
+	mu    sync.Mutex
+	byMsg map[string]*sampleWindow
+}
+
+// sampleWindow записи с одним сообщением за текущую секунду
+type sampleWindow struct {
+	start   time.Time
+	count   int
+	dropped int
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level > slog.LevelDebug {
+		return h.Handler.Handle(ctx, r)
+	}
+	h.windows.mu.Lock()
+	w := h.windows.byMsg[r.Message]
+	if w == nil {
+		w = &sampleWindow{}
+		h.windows.byMsg[r.Message] = w
+	}
+	if r.Time.Sub(w.start) >= time.Second {
+		w.start, w.count = r.Time, 0
+	}
+	w.count++
+	if w.count > h.rate {
+		w.dropped++
+		h.windows.mu.Unlock()
+		return nil
+	}
+	dropped := w.dropped
+	w.dropped = 0
+	h.windows.mu.Unlock()
+
+	if dropped > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("sampled_out", dropped))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), rate: h.rate, windows: h.windows}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), rate: h.rate, windows: h.windows}
+}
+
+// logRequest пишет в лог сообщение msg уровня level, относящееся к запросу с идентификатором requestID
+func logRequest(level slog.Level, requestID string, msg string, args ...any) {
+	if requestID != "" {
+		args = append([]any{slog.String("request_id", requestID)}, args...)
+	}
+	slog.Log(context.Background(), level, msg, args...)
+}
+
+// logContext пишет в лог сообщение msg уровня level, добавляя идентификатор запроса и адрес клиента из ctx
+func logContext(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if ip := ClientIP(ctx); ip != "" {
+		args = append([]any{slog.String("client_ip", ip)}, args...)
+	}
+	logRequest(level, RequestID(ctx), msg, args...)
+}
+
+// logUrl пишет в лог сообщение msg уровня level о запросе url task с результатом result и ошибкой err:
+// длительность с повторами и разбивку последней попытки по этапам
+func logUrl(ctx context.Context, level slog.Level, msg string, task UrlRequest, result UrlResult, err error) {
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	args := []any{"url", redactUrl(task.Url), "status", result.StatusCode, "bytes", result.ContentLength,
+		"attempts", result.Attempts, "duration_ms", float64(result.elapsed) / float64(time.Millisecond)}
+	if result.RemoteAddr != "" {
+		args = append(args, "remote_addr", result.RemoteAddr)
+	}
+	if t := result.Timing; t != nil {
+		args = append(args, slog.Group("timing", "dns_lookup_ms", t.DNSLookup, "tcp_connect_ms", t.TCPConnect,
+			"tls_handshake_ms", t.TLSHandshake, "ttfb_ms", t.TTFB, "total_ms", t.Total, "conn_reused", t.ConnReused))
+	}
+	if err != nil {
+		args = append(args, "error_code", ErrorCode(err), "error", err)
+	}
+	logContext(ctx, level, msg, args...)
+}
+
+// logProcessed пишет в лог итог обработки запроса пользователя, начатой в started: число url и url с ошибкой,
+// размер полученных тел и исход. Запрос дольше порога slowRequest записывается как предупреждение
+// вместе с самым долгим url slowest
+func (f *Fetcher) logProcessed(ctx context.Context, started time.Time, urls, failed int, bytes int64, slowest UrlResult, outcome string) {
+	elapsed := time.Since(started)
+	args := []any{"urls", urls, "duration_ms", float64(elapsed) / float64(time.Millisecond), "outcome", outcome}
+	if f.slowRequest <= 0 || elapsed < f.slowRequest {
+		logContext(ctx, slog.LevelInfo, "Request processed", args...)
+		return
+	}
+	args = append(args, "failed", failed, "bytes", bytes)
+	if slowest.Url != "" {
+		args = append(args, "slowest_url", redactUrl(slowest.Url), "slowest_url_ms", float64(slowest.elapsed)/float64(time.Millisecond))
+	}
+	logContext(ctx, slog.LevelWarn, "Slow request", args...)
+}
+
+// redactUrl возвращает url без пароля, чтобы учетные данные не попадали в лог
+func redactUrl(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// fatal пишет в лог ошибку, с которой сервер не может работать, и завершает программу
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -3,225 +3,943 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"os"
 	"os/signal"
-	"sync"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 )
 
 const (
-	// Максимальное разрешенное число url в запросе пользователя
-	MaxUrlCount int = 20
-	// Таймаут запроса одного url
-	RequestUrlTimeout time.Duration = 1 * time.Second
-	// Максимальное число одновременно обрабатываемых запросов
-	MaxSimultaneousClients int = 100
-	// Максимальное число одновременно обрабатываемых url в одном пользовательском запросе
-	MaxSimultaneousUrlRequests int = 4
+	// Максимальное разрешенное число url в запросе пользователя по умолчанию (см. Limits)
+	DefaultMaxUrlCount int = 20
+	// Максимальное разрешенное число url в запросе с разбиением на части ("chunked": true)
+	MaxChunkedUrlCount int = 1000
+	// Таймаут запроса одного url по умолчанию (см. Limits)
+	DefaultRequestUrlTimeout time.Duration = 1 * time.Second
+	// Максимальный таймаут запроса одного url, который может указать пользователь
+	MaxRequestUrlTimeout time.Duration = 30 * time.Second
+	// Максимальный размер тела ответа одного url в байтах
+	MaxResponseBodySize int64 = 10 << 20
+	// Максимальное число одновременно обрабатываемых запросов по умолчанию (см. Limits)
+	DefaultMaxSimultaneousClients int = 100
+	// Максимальное число одновременно обрабатываемых url в одном пользовательском запросе по умолчанию (см. Limits)
+	DefaultMaxSimultaneousUrlRequests int = 4
 )
 
+// MaxUrlConcurrency максимальное число одновременно обрабатываемых url в одном запросе,
+// которое может указать пользователь. Задается флагом -max-concurrency
+var MaxUrlConcurrency = 16
+
+// MaxQueuedClients максимальное число запросов, ожидающих своей очереди на обработку, и MaxClientQueueWait
+// сколько запрос может ее ждать (0 - без ограничения), остальные отклоняются с кодом 429.
+// Задаются флагами -max-queued-requests и -max-queue-wait
+var (
+	MaxQueuedClients   = 1000
+	MaxClientQueueWait = 30 * time.Second
+)
+
+// RequestDeadline срок обработки одного запроса целиком: ожидание очереди, запросы всех url и отправка
+// результатов (0 - без ограничения). Задается флагом -request-deadline
+var RequestDeadline = 60 * time.Second
+
+const (
+	// FetchPattern путь обработки списка url
+	FetchPattern = "/v1/fetch"
+	// LegacyFetchPattern устаревший путь обработки списка url, оставлен для совместимости
+	LegacyFetchPattern = "/post"
+)
+
+// UrlRequest описание запроса одного url: метод, заголовки и тело.
+// По умолчанию выполняется GET без тела
+type UrlRequest struct {
+	Url     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// ExpectStatus допустимые коды ответа, с другим кодом url считается обработанным с ошибкой
+	ExpectStatus []int `json:"expect_status,omitempty"`
+	// Fallbacks запасные url (зеркала), которые запрашиваются по очереди, если запрос url завершился ошибкой
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	// Auth аутентификация при запросе url (и его запасных url)
+	Auth *UrlAuth `json:"auth,omitempty"`
+}
+
 // Urls структура входящего запроса
 type Urls struct {
 	Urls []string `json:"urls"`
+	// Requests расширенная форма списка: для каждого url можно задать метод, заголовки и тело.
+	// Может использоваться вместе с Urls, тогда сначала идут url из Urls
+	Requests []UrlRequest `json:"requests,omitempty"`
+	// FailFast прекращать ли обработку при первой ошибке (по умолчанию да).
+	// При false ошибки записываются в результаты отдельных url, а успешные результаты все равно возвращаются
+	FailFast *bool `json:"fail_fast,omitempty"`
+	// TimeoutMs таймаут запроса одного url в миллисекундах вместо Limits.RequestUrlTimeoutMs,
+	// ограничивается сверху MaxRequestUrlTimeout
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+	// MaxBodySize максимальный размер тела ответа одного url в байтах,
+	// ограничивается сверху MaxResponseBodySize
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// TruncateBody обрезать ли слишком большое тело ответа вместо ошибки
+	TruncateBody bool `json:"truncate_body,omitempty"`
+	// MaxBytes сколько первых байт тела получать для предпросмотра: тело длиннее обрезается без ошибки
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// UseRange запрашивать только первые MaxBytes байт заголовком Range, если сервер их поддерживает
+	UseRange bool `json:"use_range,omitempty"`
+	// BodyMode что возвращать вместо тела ответа: BodyModeFull (по умолчанию) или BodyModeHash
+	BodyMode string `json:"body,omitempty"`
+	// Probe проверять url HEAD-запросом без скачивания тела (для url, у которых метод не задан явно)
+	Probe bool `json:"probe,omitempty"`
+	// Encoding как передавать тело ответа: EncodingBase64 (по умолчанию) или EncodingText
+	Encoding string `json:"encoding,omitempty"`
+	// Dedupe запрашивать одинаковые url (с одинаковыми методом, заголовками и телом) только один раз,
+	// результат при этом возвращается для каждого вхождения url в списке
+	Dedupe bool `json:"dedupe,omitempty"`
+	// Ordered возвращать результаты в порядке url в запросе, а не по мере готовности
+	Ordered bool `json:"ordered,omitempty"`
+	// Retries повторные попытки запроса url при ошибках, по умолчанию - политика сервера (см. FetcherConfig.Retries)
+	Retries *RetryPolicy `json:"retries,omitempty"`
+	// Redirects параметры перехода по перенаправлениям, по умолчанию до MaxRedirects переходов
+	Redirects *RedirectPolicy `json:"redirects,omitempty"`
+	// ExpectStatus допустимые коды ответа для url, у которых они не заданы в расширенной форме
+	ExpectStatus []int `json:"expect_status,omitempty"`
+	// Template шаблон url с переменными вида {name}, раскрывается в url со всеми сочетаниями значений из Vars.
+	// Полученные url идут после Urls и Requests
+	Template string `json:"template,omitempty"`
+	// Vars значения переменных шаблона Template
+	Vars map[string][]string `json:"vars,omitempty"`
+	// Chunked разрешить больше Limits.MaxUrlCount url (до MaxChunkedUrlCount): список обрабатывается
+	// последовательными частями по Limits.MaxUrlCount, а результаты возвращаются одним ответом
+	Chunked bool `json:"chunked,omitempty"`
+	// IncludeCookies возвращать в результатах url заголовки Set-Cookie и трейлеры ответа
+	IncludeCookies bool `json:"include_cookies,omitempty"`
+	// CookieJar передавать куки, полученные от предыдущих url, следующим url того же домена.
+	// Url при этом обрабатываются по одному в порядке запроса
+	CookieJar bool `json:"cookie_jar,omitempty"`
+	// InsecureTLS не проверять сертификат сервера, например для внутренних хостов с самоподписанными сертификатами.
+	// Действует только для хостов, разрешенных при запуске сервера, url остальных хостов завершаются ошибкой
+	InsecureTLS bool `json:"insecure_tls,omitempty"`
+	// IPFamily семейство адресов, с которыми устанавливаются соединения: IPFamilyV4, IPFamilyV6
+	// или IPFamilyAny (по умолчанию)
+	IPFamily string `json:"ip_family,omitempty"`
+	// Conditional выполнять GET-запросы url условными: если ответ url сохранен с ETag или Last-Modified,
+	// отправляются If-None-Match и If-Modified-Since, а ответ 304 отмечается в результате как not_modified
+	Conditional bool `json:"conditional,omitempty"`
+	// CachedBody при ответе 304 возвращать сохраненное тело ответа
+	CachedBody bool `json:"cached_body,omitempty"`
+	// KeepCharset возвращать текстовые тела в исходной кодировке, не перекодируя их в UTF-8
+	KeepCharset bool `json:"keep_charset,omitempty"`
+	// MaxTotalBytes бюджет на суммарный размер тел ответов в байтах: после его превышения
+	// оставшиеся url не запрашиваются и попадают в результаты с ошибкой budget_exceeded
+	MaxTotalBytes int64 `json:"max_total_bytes,omitempty"`
+	// Priority приоритет запроса (PriorityHigh, PriorityNormal, PriorityLow): когда сервер перегружен,
+	// запросы с более высоким приоритетом обрабатываются раньше. По умолчанию PriorityNormal
+	Priority string `json:"priority,omitempty"`
+	// Diff режим сравнения: запрашиваются ровно два url, а в ответе кроме результатов приходит сравнение их тел
+	Diff bool `json:"diff,omitempty"`
+	// Concurrency число одновременно обрабатываемых url вместо Limits.MaxSimultaneousUrlRequests,
+	// ограничивается сверху MaxUrlConcurrency
+	Concurrency int `json:"concurrency,omitempty"`
 }
 
-// UrlResult структура содержащая результат (Response) запроса Url (Url) и возникшую при этом ошибку (error)
-type UrlResult struct {
-	Url      string `json:"url"`
-	Response []byte `json:"response"`
-	error    error  // error служебное поле, не экспортируем
-}
+// Способы передачи тела ответа в json
+const (
+	// EncodingBase64 тело передается в base64, подходит для любых данных
+	EncodingBase64 = "base64"
+	// EncodingText тело передается обычной строкой, если оно в корректной UTF-8, иначе все равно в base64
+	EncodingText = "text"
+)
 
-// ResultToUser структура итогового ответа пользователю
-type ResultToUser struct {
-	Error     string      `json:"error"`
-	Responses []UrlResult `json:"responses"`
+// Режимы возврата тела ответа
+const (
+	// BodyModeFull тело ответа возвращается целиком
+	BodyModeFull = "full"
+	// BodyModeHash тело ответа не возвращается, только его SHA-256 и размер
+	BodyModeHash = "hash"
+)
+
+// ErrBodyTooLarge тело ответа больше разрешенного размера
+var ErrBodyTooLarge = errors.New("body_too_large")
+
+// ErrBudgetExceeded url не запрашивался, т.к. суммарный размер полученных тел превысил max_total_bytes
+var ErrBudgetExceeded = errors.New("budget_exceeded")
+
+// ErrUnexpectedStatus код ответа не входит в список ожидаемых (expect_status)
+var ErrUnexpectedStatus = errors.New("unexpected_status")
+
+// FetchOptions параметры запроса url, общие для всех url пользовательского запроса
+type FetchOptions struct {
+	// Timeout таймаут запроса одного url
+	Timeout time.Duration
+	// MaxBodySize максимальный размер тела ответа
+	MaxBodySize int64
+	// TruncateBody обрезать слишком большое тело ответа вместо ошибки
+	TruncateBody bool
+	// MaxBytes размер предпросмотра тела, 0 - тело целиком
+	MaxBytes int64
+	// UseRange запрашивать только предпросмотр заголовком Range
+	UseRange bool
+	// HashBody вместо тела ответа вернуть его SHA-256, тело при этом в памяти не хранится
+	HashBody bool
+	// Probe выполнять HEAD вместо GET для url без явно заданного метода
+	Probe bool
+	// TextBody передавать тело строкой, если оно в корректной UTF-8
+	TextBody bool
+	// Retries повторные попытки запроса url, nil - политика сервера по умолчанию
+	Retries *RetryPolicy
+	// MaxRedirects максимальное число перенаправлений, 0 - не переходить по ним
+	MaxRedirects int
+	// IncludeCookies возвращать заголовки Set-Cookie и трейлеры ответа
+	IncludeCookies bool
+	// Jar общие куки всех url запроса, nil - куки не сохраняются
+	Jar http.CookieJar
+	// InsecureTLS не проверять сертификат сервера (только для хостов, разрешенных на сервере)
+	InsecureTLS bool
+	// IPFamily семейство адресов для соединений (IPFamilyV4 или IPFamilyV6), пустое - любое
+	IPFamily string
+	// Conditional выполнять условные запросы с сохраненными валидаторами ответов
+	Conditional bool
+	// CachedBody при ответе 304 возвращать сохраненное тело
+	CachedBody bool
+	// KeepCharset не перекодировать текстовые тела в UTF-8
+	KeepCharset bool
 }
 
-// RequestUrl запрашивает информацию по url с помощью Get-метода
-// возвращает тело результата и ошибку.
-// Если все ok, то error == nil
-func RequestUrl(url string) ([]byte, error) {
-	client := http.Client{
-		Timeout: RequestUrlTimeout,
+// FetchOptions возвращает параметры запроса url с учетом ограничений сервера.
+// Вызывается один раз на обработку запроса: в параметрах хранятся общие куки url
+func (u *Urls) FetchOptions() FetchOptions {
+	opts := FetchOptions{
+		Timeout:        CurrentLimits().RequestUrlTimeout(),
+		MaxBodySize:    MaxResponseBodySize,
+		TruncateBody:   u.TruncateBody,
+		MaxBytes:       u.MaxBytes,
+		UseRange:       u.UseRange,
+		HashBody:       u.BodyMode == BodyModeHash,
+		Probe:          u.Probe,
+		TextBody:       u.Encoding == EncodingText,
+		MaxRedirects:   u.Redirects.maxRedirects(),
+		IncludeCookies: u.IncludeCookies,
+		InsecureTLS:    u.InsecureTLS,
+		Conditional:    u.Conditional,
+		CachedBody:     u.CachedBody,
+		KeepCharset:    u.KeepCharset,
 	}
-	resp, err := client.Get(url)
-	if err != nil {
-		return []byte{}, err
+	if u.IPFamily != IPFamilyAny {
+		opts.IPFamily = u.IPFamily
+	}
+	if u.CookieJar {
+		// без списка публичных суффиксов куки не передаются между разными доменами второго уровня
+		opts.Jar, _ = cookiejar.New(nil)
+	}
+	if u.MaxBodySize > 0 && u.MaxBodySize < MaxResponseBodySize {
+		opts.MaxBodySize = u.MaxBodySize
+	}
+	if u.Retries != nil {
+		retries := u.Retries.normalized()
+		opts.Retries = &retries
+	}
+	if u.TimeoutMs > 0 {
+		opts.Timeout = time.Duration(u.TimeoutMs) * time.Millisecond
+		if opts.Timeout > MaxRequestUrlTimeout {
+			opts.Timeout = MaxRequestUrlTimeout
+		}
 	}
+	return opts
+}
 
-	return ioutil.ReadAll(resp.Body)
+// Tasks возвращает единый список запросов url: простые url из Urls превращаются в GET-запросы
+func (u *Urls) Tasks() []UrlRequest {
+	tasks := make([]UrlRequest, 0, len(u.Urls)+len(u.Requests))
+	for _, url := range u.Urls {
+		tasks = append(tasks, UrlRequest{Url: url, ExpectStatus: u.ExpectStatus})
+	}
+	for _, req := range u.Requests {
+		if req.ExpectStatus == nil {
+			req.ExpectStatus = u.ExpectStatus
+		}
+		tasks = append(tasks, req)
+	}
+	if u.Template != "" {
+		for _, url := range expandUrlTemplate(u.Template, u.Vars) {
+			tasks = append(tasks, UrlRequest{Url: url, ExpectStatus: u.ExpectStatus})
+		}
+	}
+	return tasks
 }
 
-// QueryUrls асинхронно запрашивает информацию по всем url в списке (urls) и записывает результат в канал (out)
-// parentWg - WaitGroup вызывающего метода
-// urls список url
-// workersCount кол-во одновременно запрашивающих горутин
-// out канал для записи результатов
-// quit канал для опроса экстренного выхода
-func QueryUrls(parentWg *sync.WaitGroup, urls []string, workersCount int, out chan<- UrlResult, quit chan struct{}) {
-	defer parentWg.Done()
-	tasks := make(chan string, len(urls)) // список urlов-задач
-
-	var wg sync.WaitGroup
-	// создаем рабочие горутины, которые будут посылать запросы
-	for i := 0; i < workersCount; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			for {
-				select {
-				case task, ok := <-tasks:
-					// канал закрыт, значит уже нет заданий и можно завершаться
-					if !ok {
-						return
-					}
-					result, err := RequestUrl(task)
-					out <- UrlResult{task, result, err}
-
-				case <-quit:
-					// прекращаем работу
-					return
-				}
+// Validate проверяет ограничения сервера на запрос.
+// Текст возвращаемой ошибки предназначен для пользователя
+func (u *Urls) Validate() error {
+	if err := validateTemplate(u.Template, u.Vars); err != nil {
+		return err
+	}
+	// Сервер не обрабатывает запросы, где число url больше Limits.MaxUrlCount (MaxChunkedUrlCount при разбиении на части)
+	maxUrlCount := CurrentLimits().MaxUrlCount
+	limit := maxUrlCount
+	if u.Chunked {
+		limit = MaxChunkedUrlCount
+	}
+	if len(u.Urls)+len(u.Requests)+templateUrlCount(u.Template, u.Vars, limit) > limit {
+		return fmt.Errorf("Maximum allowed urls in one request is %d", limit)
+	}
+	for _, req := range u.Requests {
+		if req.Url == "" {
+			return errors.New("Url is required for every request")
+		}
+		for _, fallback := range req.Fallbacks {
+			if fallback == "" {
+				return errors.New("Fallback url must not be empty")
+			}
+		}
+		if err := validateStatusCodes(req.ExpectStatus); err != nil {
+			return err
+		}
+		if req.Auth != nil {
+			if err := req.Auth.Validate(); err != nil {
+				return err
 			}
-		}()
+		}
 	}
-
-	//список задач спокойно формируем синхронно
-	for _, url := range urls {
-		tasks <- url
+	if err := validateStatusCodes(u.ExpectStatus); err != nil {
+		return err
 	}
-	// все задачи сформированы, можно закрыть канал
-	close(tasks)
-	// ждем завершения работающих горутин
-	wg.Wait()
+	for _, task := range u.Tasks() {
+		if err := validateUrlScheme(task.Url); err != nil {
+			return err
+		}
+		for _, fallback := range task.Fallbacks {
+			if err := validateUrlScheme(fallback); err != nil {
+				return err
+			}
+		}
+	}
+	if u.Diff && len(u.Urls)+len(u.Requests)+templateUrlCount(u.Template, u.Vars, maxUrlCount) != 2 {
+		return errors.New("Diff mode requires exactly two urls")
+	}
+	if err := validatePriority(u.Priority); err != nil {
+		return err
+	}
+	if u.MaxTotalBytes < 0 {
+		return errors.New("Max total bytes must be positive")
+	}
+	if u.Concurrency < 0 {
+		return errors.New("Concurrency must be positive")
+	}
+	if u.TimeoutMs < 0 {
+		return errors.New("Timeout must be positive")
+	}
+	if u.MaxBodySize < 0 {
+		return errors.New("Max body size must be positive")
+	}
+	if u.MaxBytes < 0 {
+		return errors.New("Max bytes must be positive")
+	}
+	if u.UseRange && u.MaxBytes == 0 {
+		return errors.New("Range requests require max bytes")
+	}
+	if u.BodyMode != "" && u.BodyMode != BodyModeFull && u.BodyMode != BodyModeHash {
+		return fmt.Errorf("Unknown body mode %q", u.BodyMode)
+	}
+	if u.Encoding != "" && u.Encoding != EncodingBase64 && u.Encoding != EncodingText {
+		return fmt.Errorf("Unknown encoding %q", u.Encoding)
+	}
+	if u.IPFamily != "" && u.IPFamily != IPFamilyAny && u.IPFamily != IPFamilyV4 && u.IPFamily != IPFamilyV6 {
+		return fmt.Errorf("Unknown ip family %q", u.IPFamily)
+	}
+	if u.Redirects != nil {
+		if err := u.Redirects.Validate(); err != nil {
+			return err
+		}
+	}
+	if u.Retries != nil {
+		return u.Retries.Validate()
+	}
+	return nil
 }
 
-// Handle обрабатывает непосредственно сам POST-запрос
-func Handle(rw http.ResponseWriter, r *http.Request) {
-	// проверяем HTTP-метод, сервер обрабатывает только POST
-	if r.Method != http.MethodPost {
-		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
+// validateStatusCodes проверяет, что в списке ожидаемых кодов только коды HTTP-ответа
+func validateStatusCodes(codes []int) error {
+	for _, code := range codes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("Invalid expected status code %d", code)
+		}
 	}
+	return nil
+}
 
-	body, err := ioutil.ReadAll(r.Body)
+// validateUrlScheme проверяет, что url запрашивается по http или https.
+// Url, который не удается разобрать, не проверяется: ошибка invalid_url вернется в его результате
+func validateUrlScheme(rawUrl string) error {
+	parsed, err := url.Parse(rawUrl)
 	if err != nil {
-		http.Error(rw, "Could not read body", http.StatusBadRequest)
-		return
+		return nil
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	switch scheme {
+	case "http", "https":
+		return nil
+	case "":
+		return fmt.Errorf("Url %q must start with http:// or https://", rawUrl)
+	}
+	if slices.Contains(ExtraSchemes, scheme) {
+		return nil
 	}
+	allowed := append([]string{"http", "https"}, ExtraSchemes...)
+	return fmt.Errorf("Unsupported scheme %q in url %q, only %s and %s are allowed",
+		parsed.Scheme, rawUrl, strings.Join(allowed[:len(allowed)-1], ", "), allowed[len(allowed)-1])
+}
 
-	var request Urls
-	if err = json.Unmarshal(body, &request); err != nil {
-		http.Error(rw, "Incorrect json in request", http.StatusBadRequest)
-		return
+// WorkersCount возвращает число одновременно обрабатываемых url для tasks запросов
+func (u *Urls) WorkersCount(tasks int) int {
+	workers := CurrentLimits().MaxSimultaneousUrlRequests
+	if u.Concurrency > 0 {
+		workers = u.Concurrency
+	}
+	if u.CookieJar {
+		// url могут зависеть от кук предыдущих, поэтому обрабатываются строго по очереди
+		workers = 1
 	}
+	if workers > MaxUrlConcurrency {
+		workers = MaxUrlConcurrency
+	}
+	if tasks < workers {
+		workers = tasks
+	}
+	return workers
+}
 
-	// Сервер не обрабатывает запросы, где число url больше MaxUrlCount
-	if len(request.Urls) > MaxUrlCount {
-		http.Error(rw, fmt.Sprintf("Maximum allowed urls in one request is %d", MaxUrlCount), http.StatusBadRequest)
-		return
+// IsFailFast возвращает, нужно ли прекращать обработку при первой ошибке
+func (u *Urls) IsFailFast() bool {
+	return u.FailFast == nil || *u.FailFast
+}
+
+// ReportedHeaders заголовки ответа, которые передаются пользователю в результате запроса url
+var ReportedHeaders = []string{"Content-Type", "Content-Encoding", "Content-Language", "Last-Modified", "ETag", "Cache-Control", "Server"}
+
+// joinHeaderValues объединяет значения заголовков через запятую, nil - если заголовков нет
+func joinHeaderValues(header http.Header) map[string]string {
+	if len(header) == 0 {
+		return nil
+	}
+	joined := make(map[string]string, len(header))
+	for name, values := range header {
+		joined[name] = strings.Join(values, ", ")
 	}
+	return joined
+}
 
-	results := ResultToUser{}
-	pipeline := make(chan UrlResult, len(request.Urls)) // канал результатов обработки urlов
-	quit := make(chan struct{})                         // канал обработки закрытия соединения клиентом
-
-	// количество одновременно запрашивающих горутин не больше MaxSimultaneousUrlRequests
-	workersCount := MaxSimultaneousUrlRequests
-	if len(request.Urls) < MaxSimultaneousUrlRequests {
-		workersCount = len(request.Urls)
-	}
-
-	// опращиваем урлы
-	var wait sync.WaitGroup
-	wait.Add(1)
-	go QueryUrls(&wait, request.Urls, workersCount, pipeline, quit)
-
-	needToSend := true // по умолчанию результаты отослать надо, но если сервер закрыл соединение - то нет
-
-	// Ставим оповещение на закрытие соединения клиентом
-	connectionClose := rw.(http.CloseNotifier).CloseNotify()
-
-	// формируем итоговый ответ пользователю
-Loop:
-	for i := 0; i < len(request.Urls); i++ {
-		select {
-		case <-connectionClose:
-			// оповещаем рабочие горутины о необходимости завершения
-			close(quit)
-			// в этом случае отправлять пользователю ничего не надо, т.к. уже некуда
-			needToSend = false
-			break Loop
-
-		case res := <-pipeline:
-			// при ошибке в обработке хоть одного url завершаем работу
-			if res.error != nil {
-				// завершаем все остальные горутины
-				close(quit)
-				// пишем ошибку в результирующую структуру
-				results.Error = res.error.Error()
-				// результаты запросов из ответа убираем
-				results.Responses = nil
-				break Loop
-			} else {
-				results.Responses = append(results.Responses, res)
-			}
+// UrlResult структура содержащая результат (Response) запроса Url (Url) и возникшую при этом ошибку (error)
+type UrlResult struct {
+	// Index номер url в запросе (сначала идут url из urls, затем из requests, затем из шаблона)
+	Index    int    `json:"index"`
+	Url      string `json:"url"`
+	Response []byte `json:"response"`
+	// StatusCode код HTTP-ответа
+	StatusCode int `json:"status_code,omitempty"`
+	// Headers значения заголовков ответа из списка ReportedHeaders
+	Headers map[string]string `json:"headers,omitempty"`
+	// ContentLength размер полученного тела ответа в байтах,
+	// для HEAD-запроса - размер из заголовка Content-Length (-1, если он неизвестен)
+	ContentLength int64 `json:"content_length"`
+	// CompressedLength размер тела в байтах в том виде, в котором оно получено, только для сжатых ответов
+	// (Content-Encoding gzip или deflate), тело при этом возвращается распакованным
+	CompressedLength int64 `json:"compressed_length,omitempty"`
+	// RetryAfterMs через сколько миллисекунд сервер просит повторить запрос (Retry-After в ответе 429 или 503)
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// FullLength полный размер тела, если он известен (из Content-Range или Content-Length), только при max_bytes
+	FullLength int64 `json:"full_length,omitempty"`
+	// Charset исходная кодировка текстового тела (из Content-Type, тега meta или BOM); тело, если кодировка
+	// поддерживается и не попросили иного, возвращается перекодированным в UTF-8
+	Charset string `json:"charset,omitempty"`
+	// Protocol версия HTTP ответа, например "HTTP/1.1" или "HTTP/2.0"
+	Protocol string `json:"protocol,omitempty"`
+	// RemoteAddr адрес (ip:port), с которым установлено соединение для итогового ответа; при запросе через прокси - адрес прокси
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// NotModified сервер ответил 304 на условный запрос: ответ не изменился с сохраненного
+	NotModified bool `json:"not_modified,omitempty"`
+	// Freshness свежесть ответа по заголовкам Cache-Control и Expires, только для условных запросов
+	Freshness *Freshness `json:"freshness,omitempty"`
+	// FinalUrl url, с которого в итоге получен ответ (после всех перенаправлений); если запрос после
+	// перенаправлений завершился ошибкой - url, на котором он оборвался
+	FinalUrl string `json:"final_url,omitempty"`
+	// Redirects цепочка перенаправлений, пройденных до итогового ответа
+	Redirects []RedirectHop `json:"redirects,omitempty"`
+	// FallbackUrl запасной url, с которого получен результат, если запрос основного url не удался
+	FallbackUrl string `json:"fallback_url,omitempty"`
+	// Cookies значения заголовков Set-Cookie ответа как есть, только при "include_cookies": true
+	Cookies []string `json:"cookies,omitempty"`
+	// Trailers трейлеры ответа (заголовки после тела), только при "include_cookies": true
+	Trailers map[string]string `json:"trailers,omitempty"`
+	// TLS параметры TLS-соединения и сертификат сервера, только для https
+	TLS *TLSInfo `json:"tls,omitempty"`
+	// Policy решение политики доступа к хосту url, только если политика задана при запуске сервера
+	Policy *PolicyDecision `json:"policy,omitempty"`
+	// BodyTruncated тело ответа обрезано до максимального размера
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+	// SHA256 хэш тела ответа в hex, только в режиме "body": "hash"
+	SHA256 string `json:"sha256,omitempty"`
+	// BodyEncoding как передано тело ответа в json: EncodingBase64 или EncodingText
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// ValidUTF8 является ли тело ответа корректной строкой UTF-8
+	ValidUTF8 *bool `json:"valid_utf8,omitempty"`
+	// Deduplicated результат не запрашивался отдельно, а взят у такого же url выше по списку
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Coalesced результат получен одним запросом url вместе с другими одновременными такими же запросами
+	// (в том числе других клиентов)
+	Coalesced bool `json:"coalesced,omitempty"`
+	// Attempts сколько раз запрашивался url (больше одного при повторных попытках)
+	Attempts int `json:"attempts,omitempty"`
+	// Timing разбивка времени запроса по этапам
+	Timing *UrlTiming `json:"timing,omitempty"`
+	// Error текст ошибки запроса url, заполняется только в режиме fail_fast: false
+	Error string `json:"error,omitempty"`
+	// ErrorCode категория ошибки запроса url (ErrorCodeDNS, ErrorCodeConnectTimeout и т.д.)
+	ErrorCode string        `json:"error_code,omitempty"`
+	error     error         // error служебное поле, не экспортируем
+	task      int           // task служебное поле, номер задачи в списке, переданном QueryUrls
+	elapsed   time.Duration // elapsed служебное поле, время запроса url с повторами и запасными url
+}
+
+// MarshalJSON упаковывает результат, передавая тело строкой, если выбран EncodingText
+func (r UrlResult) MarshalJSON() ([]byte, error) {
+	// plain без метода MarshalJSON, иначе получится бесконечная рекурсия
+	type plain UrlResult
+	if r.BodyEncoding != EncodingText {
+		return json.Marshal(plain(r))
+	}
+	// поле Response внешней структуры перекрывает одноименное поле plain
+	return json.Marshal(struct {
+		plain
+		Response string `json:"response"`
+	}{plain(r), string(r.Response)})
+}
+
+// ResultToUser структура итогового ответа пользователю
+type ResultToUser struct {
+	Error string `json:"error"`
+	// ErrorCode категория ошибки url, из-за которой прекращена обработка
+	ErrorCode string      `json:"error_code,omitempty"`
+	Responses []UrlResult `json:"responses"`
+	// Failed число url, обработанных с ошибкой (в режиме fail_fast: false)
+	Failed int `json:"failed,omitempty"`
+	// Summary сводная статистика по обработанным url
+	Summary Summary `json:"summary"`
+	// RequestID идентификатор запроса (X-Request-ID), по которому его можно найти в логах
+	RequestID string `json:"request_id,omitempty"`
+	// Diff сравнение тел ответов в режиме "diff": true
+	Diff *BodyDiff `json:"diff,omitempty"`
+	// NextCursor курсор следующей страницы результатов задания, пустой на последней странице
+	NextCursor string `json:"next_cursor,omitempty"`
+	diff       bool   // diff служебное поле, сравнивать ли тела ответов по окончании обработки
+}
+
+// add добавляет результат запроса url к итоговому ответу
+func (r *ResultToUser) add(res UrlResult) {
+	if res.Error != "" {
+		r.Failed++
+	}
+	r.Responses = append(r.Responses, res)
+	r.Summary.add(res)
+}
 
+// finish завершает итоговый ответ: рассчитывает статистику и записывает ошибку обработки, если она есть
+func (r *ResultToUser) finish(err error) {
+	r.Summary.finish()
+	if err == nil {
+		if r.diff {
+			r.Diff = diffResults(r.Responses)
 		}
+		return
 	}
+	// пишем ошибку в результирующую структуру
+	r.Error = err.Error()
+	r.ErrorCode = ErrorCode(err)
+	// результаты запросов из ответа убираем
+	r.Responses = nil
+}
 
-	// Ожидаем завершения всех работающих горутин
-	wait.Wait()
+// withRequestDeadline ограничивает обработку запроса сроком RequestDeadline: по его истечении ctx отменяется
+// с причиной ErrDeadlineExceeded
+func withRequestDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if RequestDeadline <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, RequestDeadline, ErrDeadlineExceeded)
+}
 
-	if needToSend {
-		// упаковываем и отправляем
-		res, err := json.Marshal(results)
+// HandleFetch обрабатывает непосредственно сам POST-запрос, url запрашиваются через fetcher
+func HandleFetch(fetcher *Fetcher) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// проверяем HTTP-метод, сервер обрабатывает только POST
+		if r.Method != http.MethodPost {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		// перегруженный сервер отклоняет запрос сразу, не читая его
+		if err := fetcher.shedder.Check(); err != nil {
+			rejectOverloaded(rw, err)
+			return
+		}
+
+		request, err := DecodeRequest(rw, r)
+		if err != nil {
+			http.Error(rw, err.Error(), DecodeErrorStatus(err))
+			return
+		}
+
+		// контекст запроса отменяется при закрытии соединения клиентом, при завершении работы сервера
+		// и по истечении срока запроса, который включает и ожидание очереди
+		ctx, cancel := withRequestDeadline(r.Context())
+		defer cancel()
+
+		// дожидаемся своей очереди на обработку
+		release, err := Admit(r, request.Priority, ctx.Done())
+		if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueTimeout) {
+			rejectBusy(rw, r, err)
+			return
+		}
+		if err != nil && errors.Is(context.Cause(ctx), ErrDeadlineExceeded) {
+			http.Error(rw, ErrDeadlineExceeded.Error(), http.StatusGatewayTimeout)
+			return
+		}
 		if err != nil {
-			log.Println("Error on marshal ", err.Error())
 			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		rw.Header().Set("Content-Type", "application/json")
-		rw.Write(res)
-	}
+		defer release()
 
+		fetcher.ProcessUrls(ctx, request, NewResultWriter(rw, r, request))
+	})
 }
 
-// HandleConnection проверяет условие, что сервер не обслуживает больше 100 запросов одновременно
-// конечно горутины будут висеть в ожидании, но зато не будут отклоняться запросы пользователей
+// HandleConnection проверяет условие, что сервер не обслуживает больше запросов одновременно, чем позволяет scheduler:
+// остальные ждут в его очереди, а если она заполнена или ожидание затянулось, отклоняются с кодом 429
 // shutdown служит индикатором того, что придется закрыть все соединения
-// h следующий хэндлер
-func HandleConnection(shutdown chan struct{}, h http.Handler) http.Handler {
-	// limiter своего рода семафор для контроля числа одновременно обрабатывающихся запросов
-	limiter := make(chan struct{}, MaxSimultaneousClients)
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		select {
-		case <-shutdown: // нотификация от системы на завершение
-			// чтобы пользователь не волновался, скинем ему ошибку
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+// Возвращает обертку для следующих хэндлеров, все обернутые ею хэндлеры (http и gRPC) делят общее ограничение.
+// Приоритет запроса известен только из его тела, поэтому место занимает сам хэндлер через Admit после разбора запроса
+func HandleConnection(scheduler *Scheduler, shutdown chan struct{}) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-shutdown: // нотификация от системы на завершение
+				// запрос можно повторить на другом экземпляре, соединение с этим больше не нужно
+				w.Header().Set("Connection", "close")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			default:
+				// передаем запрос следующему хэндлу
+				h.ServeHTTP(w, withScheduler(r, scheduler))
+			}
+		})
+	}
+}
 
-		case limiter <- struct{}{}: // пробуем добавить значение в канал-семафор
-			defer func() { <-limiter }()
-			// передаем запрос следующему хэндлу
-			h.ServeHTTP(w, r)
-		}
+// HandleDeprecated обслуживает устаревший путь prefix тем же хэндлером h, что и актуальный путь successor:
+// путь запроса переписывается на актуальный, а в ответ добавляются заголовки Deprecation и Link на актуальный путь
+func HandleDeprecated(prefix, successor string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Deprecation", "true")
+		rw.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+
+		// как и http.StripPrefix, меняем путь в копии запроса
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = successor + strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = ""
+		h.ServeHTTP(rw, r2)
 	})
 }
 
 func main() {
 	var (
-		ListenAddr    string = ":8080"
-		HandlePattern string = "/post"
+		ListenAddr     string = ":8080"
+		GrpcListenAddr string = ":9090"
 	)
+	fetcherConfig := FetcherConfig{
+		MaxIdleConnsPerHost:    DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:        DefaultIdleConnTimeout,
+		ConnectTimeout:         DefaultConnectTimeout,
+		TCPKeepAlive:           DefaultTCPKeepAlive,
+		FallbackDelay:          DefaultFallbackDelay,
+		MaxResponseHeaderBytes: DefaultMaxResponseHeaderBytes,
+		MaxResponseHeaders:     DefaultMaxResponseHeaders,
+		Retries:                DefaultRetryPolicy,
+		CircuitFailures:        DefaultCircuitFailures,
+		CircuitCoolDown:        DefaultCircuitCoolDown,
+		MaxConnsPerHost:        DefaultMaxConnsPerHost,
+		WorkerPoolSize:         DefaultWorkerPoolSize,
+		DNSCacheTTL:            DefaultDNSCacheTTL,
+		DNSNegativeTTL:         DefaultDNSNegativeTTL,
+		Coalesce:               true,
+		ResponseCacheTTL: ResponseCacheTTL{
+			Default: DefaultResponseCacheTTL,
+			Min:     DefaultResponseCacheMinTTL,
+			Max:     DefaultResponseCacheMaxTTL,
+		},
+	}
+	retryBackoff := time.Duration(DefaultRetryPolicy.BackoffMs) * time.Millisecond
+	retryMaxBackoff := time.Duration(DefaultRetryPolicy.MaxBackoffMs) * time.Millisecond
+	retryMaxRetryAfter := time.Duration(DefaultRetryPolicy.MaxRetryAfterMs) * time.Millisecond
+	flag.IntVar(&MaxUrlConcurrency, "max-concurrency", MaxUrlConcurrency, "maximum concurrency a request may ask for")
+	flag.IntVar(&MaxQueuedClients, "max-queued-requests", MaxQueuedClients, "maximum requests waiting for their turn, more are rejected with 429, 0 means unlimited")
+	flag.DurationVar(&MaxClientQueueWait, "max-queue-wait", MaxClientQueueWait, "how long a request may wait for its turn before it is rejected with 429, 0 means unlimited")
+	flag.Int64Var(&MaxRequestBodySize, "max-request-body-bytes", MaxRequestBodySize, "maximum size in bytes of a request body, larger requests are rejected with 413, 0 means unlimited")
+	flag.DurationVar(&RequestDeadline, "request-deadline", RequestDeadline, "how long a request may take in total, including its wait in the queue, 0 means unlimited")
+	flag.DurationVar(&JobDeadline, "job-deadline", JobDeadline, "how long an async job may take in total, including its wait in the queue, 0 means unlimited")
+	var limitsFile, adminTokenFile string
+	flag.StringVar(&limitsFile, "limits-file", "", "json file with max_url_count, max_simultaneous_clients, max_simultaneous_url_requests and request_url_timeout_ms overriding the defaults; reloaded on SIGHUP")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "file with the bearer token for "+AdminLimitsPattern+" to read and change limits at runtime and "+AdminStatsPattern+" to read server state; the endpoints are disabled when empty")
+	flag.IntVar(&fetcherConfig.MaxConnsPerHost, "max-conns-per-host", fetcherConfig.MaxConnsPerHost, "maximum concurrent requests to a single target host across all clients, 0 means unlimited")
+	flag.IntVar(&fetcherConfig.WorkerPoolSize, "worker-pool-size", fetcherConfig.WorkerPoolSize, "maximum urls fetched at the same time across all requests, 0 gives every request its own workers")
+	flag.BoolVar(&fetcherConfig.AdaptiveConcurrency, "adaptive-concurrency", false, "lower concurrent requests per target host and across hosts on timeouts, connection errors, 5xx, 429 and latency spikes, and raise them back while requests succeed")
+	flag.Uint64Var(&fetcherConfig.ShedHeapBytes, "shed-heap-bytes", 0, "heap size in bytes above which new requests are rejected with 503 and fewer urls are fetched at the same time, 0 disables")
+	flag.IntVar(&fetcherConfig.ShedGoroutines, "shed-goroutines", 0, "number of goroutines above which new requests are rejected with 503 and fewer urls are fetched at the same time, 0 disables")
+	flag.Int64Var(&fetcherConfig.ShedPendingBytes, "shed-pending-bytes", 0, "size in bytes of fetched response bodies not yet sent to clients above which new requests are rejected with 503 and fewer urls are fetched at the same time, 0 disables")
+	flag.IntVar(&fetcherConfig.MaxIdleConnsPerHost, "max-idle-conns-per-host", fetcherConfig.MaxIdleConnsPerHost, "idle connections kept open per target host")
+	flag.DurationVar(&fetcherConfig.IdleConnTimeout, "idle-conn-timeout", fetcherConfig.IdleConnTimeout, "how long an idle connection to a target host is kept open")
+	flag.DurationVar(&fetcherConfig.ConnectTimeout, "connect-timeout", fetcherConfig.ConnectTimeout, "how long establishing a TCP connection to a target host may take, 0 means only the url timeout applies")
+	flag.DurationVar(&fetcherConfig.TCPKeepAlive, "tcp-keepalive", fetcherConfig.TCPKeepAlive, "interval of TCP keep-alive probes on connections to target hosts, negative disables them")
+	flag.DurationVar(&fetcherConfig.FallbackDelay, "fallback-delay", fetcherConfig.FallbackDelay, "how long to wait for a connection over the first address family before also trying the other one (Happy Eyeballs), negative disables the race")
+	flag.Int64Var(&fetcherConfig.MaxResponseHeaderBytes, "max-response-header-bytes", fetcherConfig.MaxResponseHeaderBytes, "maximum size of response headers from a target host")
+	flag.IntVar(&fetcherConfig.MaxResponseHeaders, "max-response-headers", fetcherConfig.MaxResponseHeaders, "maximum number of response headers from a target host, 0 means unlimited")
+	flag.IntVar(&fetcherConfig.Retries.Max, "retries", fetcherConfig.Retries.Max, "default number of retries for idempotent requests on connection errors and 5xx, 0 disables")
+	flag.DurationVar(&retryBackoff, "retry-backoff", retryBackoff, "pause before the first default retry, doubled for each next one")
+	flag.DurationVar(&retryMaxBackoff, "retry-max-backoff", retryMaxBackoff, "maximum pause between default retries")
+	flag.DurationVar(&retryMaxRetryAfter, "max-retry-after", retryMaxRetryAfter, "longest Retry-After delay of 429 and 503 responses to wait before a default retry")
+	flag.IntVar(&fetcherConfig.CircuitFailures, "circuit-failures", fetcherConfig.CircuitFailures, "consecutive failures after which requests to a host are suspended, 0 disables")
+	flag.DurationVar(&fetcherConfig.CircuitCoolDown, "circuit-cooldown", fetcherConfig.CircuitCoolDown, "how long requests to a failing host are suspended")
+	var allowedNetworks NetworkFlag
+	flag.Var(&allowedNetworks, "allow-network", "internal network (CIDR or IP) target hosts may resolve to, repeatable; loopback, private, link-local and multicast addresses are blocked otherwise")
+	var allowHosts, denyHosts PolicyRuleFlag
+	flag.Var(&allowHosts, "allow-host", "host pattern (example.com, *.example.com) or CIDR that may be requested, repeatable; when set, other hosts are denied")
+	flag.Var(&denyHosts, "deny-host", "host pattern (example.com, *.example.com) or CIDR that must not be requested, repeatable; takes precedence over -allow-host")
+	flag.BoolVar(&fetcherConfig.HTTPSOnly, "https-only", false, "fetch urls only over https, except hosts given with -allow-http-host")
+	var httpHosts HostPatternFlag
+	flag.Var(&httpHosts, "allow-http-host", "host pattern (example.com, *.example.com) that may still be fetched over plain http with -https-only, repeatable")
+	var clientCerts ClientCertFlag
+	flag.Var(&clientCerts, "client-cert", "client certificate for mutual TLS as [host=]cert.pem,key.pem (host may be *.domain), repeatable, first match wins; reloaded on SIGHUP")
+	var insecureHosts HostPatternFlag
+	flag.Var(&insecureHosts, "allow-insecure-tls-host", "host pattern (example.com, *.example.com) for which requests may disable certificate verification with insecure_tls, repeatable")
+	var caBundles PathFlag
+	flag.Var(&caBundles, "ca-bundle", "PEM file or directory with additional root CA certificates trusted for target hosts, repeatable")
+	var proxies ProxyFlag
+	flag.Var(&proxies, "proxy", "egress proxy as [host=]url (http, https, socks5 or socks5h, credentials in the url) or [host=]direct, repeatable; proxies with the same host form a pool, first matching pool wins; overrides HTTP_PROXY/HTTPS_PROXY")
+	fetcherConfig.ProxyRotation = ProxyRoundRobin
+	flag.Func("proxy-rotation", "how requests are spread over proxies given for the same host: round_robin (default) or least_errors", func(s string) (err error) {
+		fetcherConfig.ProxyRotation, err = ParseProxyRotation(s)
+		return err
+	})
+	flag.Func("dns-server", "DNS server (host or host:port) or DNS-over-HTTPS url (https://...) used to resolve target hosts instead of the system resolver; record TTLs are respected", func(s string) (err error) {
+		fetcherConfig.DNSServer, err = parseDNSServer(s)
+		return err
+	})
+	flag.DurationVar(&fetcherConfig.DNSCacheTTL, "dns-cache-ttl", fetcherConfig.DNSCacheTTL, "how long resolved target hosts are cached at most, 0 disables the cache")
+	flag.DurationVar(&fetcherConfig.DNSNegativeTTL, "dns-negative-ttl", fetcherConfig.DNSNegativeTTL, "how long hosts that do not resolve are cached at most")
+	var responseCacheSize int64 = DefaultResponseCacheSize
+	flag.Int64Var(&responseCacheSize, "response-cache-size", responseCacheSize, "memory in bytes for responses kept for conditional requests, 0 disables them")
+	var redisCache string
+	flag.StringVar(&redisCache, "response-cache-redis", "", "keep responses for conditional requests in Redis shared by all instances, as redis://[:password@]host[:port][/db] (rediss:// for TLS)")
+	flag.DurationVar(&fetcherConfig.ResponseCacheTTL.Default, "response-cache-ttl", fetcherConfig.ResponseCacheTTL.Default, "how long responses without Cache-Control or Expires are kept for conditional requests")
+	flag.DurationVar(&fetcherConfig.ResponseCacheTTL.Min, "response-cache-min-ttl", fetcherConfig.ResponseCacheTTL.Min, "how long responses are kept at least, even if Cache-Control or Expires says they are already stale")
+	flag.DurationVar(&fetcherConfig.ResponseCacheTTL.Max, "response-cache-max-ttl", fetcherConfig.ResponseCacheTTL.Max, "how long responses are kept at most, whatever Cache-Control or Expires says")
+	flag.BoolVar(&fetcherConfig.Coalesce, "coalesce", fetcherConfig.Coalesce, "make one upstream request for identical GET and HEAD requests in flight at the same time, even from different clients")
+	var httpVersions HTTPVersionFlag
+	flag.Var(&httpVersions, "http-version", "HTTP version for target hosts as host=1.1|2|h2c|3 (host may be *.domain or *), repeatable, first match wins; h2c uses HTTP/2 with prior knowledge for plain http, 3 uses HTTP/3 over QUIC for https")
+	flag.BoolVar(&fetcherConfig.HTTP3AltSvc, "http3-alt-svc", false, "fetch https urls over HTTP/3 from hosts without -http-version that advertise h3 in Alt-Svc, falling back to TCP if QUIC fails")
+	var rateLimits RateLimitFlag
+	flag.Var(&rateLimits, "host-rate-limit", "per-host request rate as host=rate[/burst] (rate per second, host may be *.domain or *), repeatable, first match wins")
+	var fileRoot string
+	flag.StringVar(&fileRoot, "file-root", "", "enable file:// urls, read from this directory (file:///a.txt is dir/a.txt); disabled when empty")
+	var dataUrls bool
+	flag.BoolVar(&dataUrls, "allow-data-urls", false, "enable data: urls with inline content (RFC 2397)")
+	flag.BoolVar(&fetcherConfig.FTP, "allow-ftp", false, "enable ftp:// urls (passive mode, anonymous login unless credentials are given)")
+	var ftpCredentials FTPCredentialFlag
+	flag.Var(&ftpCredentials, "ftp-credentials", "login for ftp:// urls as host=user:password (host may be *.domain or *), repeatable, first match wins; credentials in the url or basic auth of the request take precedence")
+	flag.BoolVar(&fetcherConfig.SFTP, "allow-sftp", false, "enable sftp:// urls (server host keys are checked against -sftp-known-hosts)")
+	var sftpCredentials SFTPCredentialFlag
+	flag.Var(&sftpCredentials, "sftp-credentials", "login for sftp:// urls as host=user:password or host=user to log in with -sftp-key-file only (host may be *.domain or *), repeatable, first match wins; credentials in the url or basic auth of the request take precedence")
+	var sftpKnownHosts, sftpKeyFile string
+	flag.StringVar(&sftpKnownHosts, "sftp-known-hosts", "", "OpenSSH known_hosts file with trusted sftp server keys (default ~/.ssh/known_hosts)")
+	flag.StringVar(&sftpKeyFile, "sftp-key-file", "", "unencrypted private key for public key login to sftp servers")
+	mode := ModeServe
+	logFormat, logLevel := LogFormatText, slog.LevelInfo
+	flag.StringVar(&logFormat, "log-format", logFormat, "log format: text (key=value) or json (one object per line)")
+	flag.TextVar(&logLevel, "log-level", logLevel, "minimum level of logged messages: debug, info, warn or error")
+	var logFile string
+	var logMaxBytes int64
+	var logRotateInterval time.Duration
+	logMaxBackups, logDebugRate := 7, 0
+	flag.StringVar(&logFile, "log-file", "", "write the log to this file instead of stderr")
+	flag.Int64Var(&logMaxBytes, "log-max-bytes", 100<<20, "size in bytes after which the log file is renamed with a timestamp suffix and a new one is started, 0 disables")
+	flag.DurationVar(&logRotateInterval, "log-rotate-interval", 0, "time after which the log file is renamed with a timestamp suffix and a new one is started, 0 disables")
+	flag.IntVar(&logMaxBackups, "log-max-backups", logMaxBackups, "rotated log files kept, older ones are removed, 0 keeps all")
+	flag.IntVar(&logDebugRate, "log-debug-rate", logDebugRate, "maximum debug messages per second with the same text, the rest are dropped and counted in sampled_out of the next one, 0 means unlimited")
+	flag.StringVar(&fetcherConfig.RequestIDHeader, "forward-request-id-header", "", "header (e.g. X-Correlation-ID) in which the request id is sent with every url fetch over http, not sent when empty")
+	flag.DurationVar(&fetcherConfig.SlowUrlThreshold, "slow-url-threshold", 0, "log url fetches taking longer, retries and fallbacks included, as warnings with their timing breakdown, 0 disables")
+	flag.DurationVar(&fetcherConfig.SlowRequestThreshold, "slow-request-threshold", 0, "log client requests whose urls take longer to process as warnings with their slowest url, 0 disables")
+	var auditTarget string
+	var auditChain bool
+	flag.StringVar(&auditTarget, "audit-log", "", "append-only audit log of who requested which urls and when: a file path, syslog for the local syslog or syslog+udp://host:port, syslog+tcp://host:port for a remote one; disabled when empty")
+	flag.BoolVar(&auditChain, "audit-hash-chain", false, "hash-chain audit log records: each record carries the sha256 hash of the previous one, so removed or altered records are detectable")
+	var readyCheckCache bool
+	flag.BoolVar(&readyCheckCache, "readyz-check-redis", false, "report the server as not ready at /readyz while the Redis response cache is unreachable")
+	var drainDelay time.Duration
+	flag.DurationVar(&drainDelay, "shutdown-drain-delay", 0, "on SIGINT or SIGTERM keep serving requests for this long while /readyz reports the server as not ready, so load balancers stop routing to it first")
+	var debugAddr string
+	flag.StringVar(&debugAddr, "debug-addr", "", "separate admin address (e.g. localhost:6060) serving pprof profiles at /debug/pprof/ and expvar counters at /debug/vars; must not be reachable by clients, disabled when empty")
+	accessLogFormat := AccessLogOff
+	flag.StringVar(&accessLogFormat, "access-log", accessLogFormat, "log every request to stdout: off, common (Common Log Format followed by request id and duration in ms) or json")
+	var trustedProxies NetworkFlag
+	var tenantHeader, tenantKeysFile string
+	flag.StringVar(&tenantHeader, "tenant-header", "", "request header (e.g. X-API-Key) carrying the api key of the tenant whose usage request metrics are counted by, requires -tenant-keys; tenants are not identified when empty")
+	flag.StringVar(&tenantKeysFile, "tenant-keys", "", "file mapping api keys from the tenant header to tenants, one \"<key> <tenant>\" per line, unknown keys are counted as _other")
+	flag.Var((*BucketsFlag)(&fetchBuckets), "url-duration-buckets", "comma-separated increasing bucket bounds in seconds of the url fetch duration histogram")
+	flag.Var((*BucketsFlag)(&batchSizeBuckets), "request-urls-buckets", "comma-separated increasing bucket bounds of the histogram of urls per client request")
+	flag.Var((*BucketsFlag)(&stageBuckets), "conn-stage-buckets", "comma-separated increasing bucket bounds in seconds of the dns, connect and tls duration histograms")
+	flag.Var(&trustedProxies, "trusted-proxy", "network (CIDR or IP) of a load balancer or proxy in front of the server, repeatable; the client address of requests coming from it is taken from X-Forwarded-For")
+	var otlpEndpoint, otlpService string
+	traceRatio := 1.0
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP url of an OpenTelemetry collector (e.g. http://localhost:4318/v1/traces) to export spans of client requests and url fetches to; tracing is disabled when empty")
+	flag.StringVar(&otlpService, "otlp-service-name", "go-test-task", "service.name reported with exported spans")
+	flag.Float64Var(&traceRatio, "trace-sample-ratio", traceRatio, "share of traces started by the server that are exported, from 0 to 1; requests with a traceparent header follow its sampled flag")
+	flag.StringVar(&mode, "mode", mode, "serve runs the server, bench load-tests the fetch handler in-process against a local stub origin with the same settings, reports throughput, latency and allocations, and exits")
+	benchConfig := DefaultBenchConfig
+	flag.IntVar(&benchConfig.Requests, "bench-requests", benchConfig.Requests, "requests sent in bench mode")
+	flag.IntVar(&benchConfig.Concurrency, "bench-concurrency", benchConfig.Concurrency, "requests sent at the same time in bench mode")
+	flag.IntVar(&benchConfig.Urls, "bench-urls", benchConfig.Urls, "urls in each request in bench mode, more than the url limit makes requests chunked")
+	flag.IntVar(&benchConfig.BodySize, "bench-body-size", benchConfig.BodySize, "response body size in bytes of the stub origin in bench mode")
+	flag.DurationVar(&benchConfig.OriginLatency, "bench-origin-latency", benchConfig.OriginLatency, "how long the stub origin waits before responding in bench mode")
+	flag.Parse()
+	logOutput := io.Writer(os.Stderr)
+	var rotatingLog *RotatingFile
+	if logFile != "" {
+		var err error
+		if rotatingLog, err = OpenRotatingFile(logFile, logMaxBytes, logRotateInterval, logMaxBackups); err != nil {
+			fatal("Open log file", err)
+		}
+		logOutput = rotatingLog
+	}
+	logger, err := NewLogger(logOutput, logFormat, logLevel, logDebugRate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// сообщения стандартного log (например, ошибки http.Server) тоже идут в этот логгер
+	slog.SetDefault(logger)
+
+	fetcherConfig.RateLimits = rateLimits
+	fetcherConfig.AllowedNetworks = allowedNetworks
+	fetcherConfig.AllowHosts = allowHosts
+	fetcherConfig.DenyHosts = denyHosts
+	fetcherConfig.HTTPHosts = httpHosts
+	if err := reloadClientCerts(clientCerts); err != nil {
+		fatal("Load client certificates", err)
+	}
+	fetcherConfig.ClientCerts = clientCerts
+	fetcherConfig.InsecureTLSHosts = insecureHosts
+	fetcherConfig.HTTPVersions = httpVersions
+	fetcherConfig.Proxies = proxies
+	var readinessChecks []ReadinessCheck
+	if redisCache != "" {
+		cache, err := NewRedisCache(redisCache)
+		if err != nil {
+			fatal("Connect response cache", err)
+		}
+		fetcherConfig.ResponseCache = cache
+		if readyCheckCache {
+			readinessChecks = append(readinessChecks, ReadinessCheck{Name: "response_cache", Check: cache.Ping})
+		}
+	} else if cache := NewMemoryCache(responseCacheSize); cache != nil {
+		fetcherConfig.ResponseCache = cache
+	}
+	if len(caBundles) > 0 {
+		rootCAs, err := loadRootCAs(caBundles)
+		if err != nil {
+			fatal("Load CA bundles", err)
+		}
+		fetcherConfig.RootCAs = rootCAs
+	}
+	fetcherConfig.Retries.BackoffMs = int(retryBackoff / time.Millisecond)
+	fetcherConfig.Retries.MaxBackoffMs = int(retryMaxBackoff / time.Millisecond)
+	fetcherConfig.Retries.MaxRetryAfterMs = int(retryMaxRetryAfter / time.Millisecond)
+	// локальные схемы выключены по умолчанию: через них клиент читал бы файлы сервера
+	fetcherConfig.Schemes = make(map[string]UrlFetcher)
+	if fileRoot != "" {
+		files, err := NewFileFetcher(fileRoot)
+		if err != nil {
+			fatal("Open file root", err)
+		}
+		fetcherConfig.Schemes[SchemeFile] = files
+		ExtraSchemes = append(ExtraSchemes, SchemeFile)
+	}
+	if dataUrls {
+		fetcherConfig.Schemes[SchemeData] = DataFetcher{}
+		ExtraSchemes = append(ExtraSchemes, SchemeData)
+	}
+	if fetcherConfig.FTP {
+		fetcherConfig.FTPCredentials = ftpCredentials
+		ExtraSchemes = append(ExtraSchemes, SchemeFTP)
+	}
+	if fetcherConfig.SFTP {
+		hostKeys, signer, err := LoadSFTPKeys(sftpKnownHosts, sftpKeyFile)
+		if err != nil {
+			fatal("Load sftp keys", err)
+		}
+		fetcherConfig.SFTPCredentials = sftpCredentials
+		fetcherConfig.SFTPHostKeys, fetcherConfig.SFTPSigner = hostKeys, signer
+		ExtraSchemes = append(ExtraSchemes, SchemeSFTP)
+	}
+
+	if traceRatio < 0 || traceRatio > 1 {
+		fatal("Invalid flags", errors.New("Trace sample ratio must be between 0 and 1"))
+	}
+	if strings.ContainsAny(fetcherConfig.RequestIDHeader, " \t\r\n\"(),/:;<=>?@[\\]{}") {
+		fatal("Invalid flags", fmt.Errorf("Invalid request id header name %q", fetcherConfig.RequestIDHeader))
+	}
+	accessLog, err := NewAccessLog(accessLogFormat, os.Stdout)
+	if err != nil {
+		fatal("Invalid flags", err)
+	}
+	var tenantKeys map[string]string
+	if (tenantHeader == "") != (tenantKeysFile == "") {
+		// без файла ключей значения заголовка пришлось бы учитывать как есть, вместе с ключами API
+		fatal("Invalid flags", errors.New("Tenant header and tenant keys must be set together"))
+	}
+	if tenantKeysFile != "" {
+		if tenantKeys, err = LoadTenantKeys(tenantKeysFile); err != nil {
+			fatal("Load tenant keys", err)
+		}
+	}
+	tenants := NewTenants(tenantHeader, tenantKeys)
+
+	if limitsFile != "" {
+		if _, err := LoadLimitsFile(limitsFile, nil); err != nil {
+			fatal("Load limits", err)
+		}
+	}
+
+	switch mode {
+	case ModeServe:
+	case ModeBench:
+		if err := RunBench(benchConfig, fetcherConfig, os.Stdout); err != nil {
+			fatal("Bench", err)
+		}
+		return
+	default:
+		fatal("Invalid flags", fmt.Errorf("Unknown mode %q, must be %s or %s", mode, ModeServe, ModeBench))
+	}
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
@@ -229,32 +947,141 @@ func main() {
 	// т.к. shutdown не закрывается, поэтому не очень удобно осуществлять закрытие висящих в ожидании соединений
 	// quit будет закрываться при появлении сигнала из системы
 	quit := make(chan struct{})
+	// контекст всех входящих запросов, его отмена при завершении работы прерывает начатые запросы url
+	baseCtx, stopRequests := context.WithCancel(context.Background())
+	defer stopRequests()
 
-	// создаем сервер
-	mux := http.NewServeMux()
-	mux.Handle(HandlePattern, HandleConnection(quit, http.HandlerFunc(Handle)))
-	server := &http.Server{Addr: ListenAddr, Handler: mux}
+	// операции обработки запросов отправляются в коллектор OpenTelemetry, если он задан
+	tracer := NewTracer(otlpEndpoint, otlpService, traceRatio)
+	fetcherConfig.Tracer = tracer
+
+	// запросы пользователей записываются в журнал аудита, если он задан
+	if auditTarget != "" {
+		if fetcherConfig.AuditLog, err = OpenAuditLog(auditTarget, auditChain); err != nil {
+			fatal("Audit log", err)
+		}
+	}
+
+	// все url запрашиваются через общий пул соединений
+	fetcher := NewFetcher(fetcherConfig)
 
-	// запускаем сервер
+	// ограничение на число одновременных запросов общее для всех путей и gRPC
+	// scheduler своего рода семафор для контроля числа одновременно обрабатывающихся запросов
+	scheduler := NewBoundedScheduler(CurrentLimits().MaxSimultaneousClients, MaxQueuedClients, MaxClientQueueWait, quit)
+
+	// по SIGHUP перечитываем клиентские сертификаты, например после их обновления, и файл ограничений
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Println("ListenAndServe: ", err)
+		for range reload {
+			if limitsFile != "" {
+				reloadLimits(limitsFile, scheduler)
+			}
+			if err := fetcher.ReloadClientCerts(); err != nil {
+				slog.Error("Reload client certificates", "error", err)
+				continue
+			}
+			slog.Info("Client certificates reloaded")
 		}
 	}()
-	log.Println("Server started")
+
+	// создаем сервер
+	mux := http.NewServeMux()
+	limit := HandleConnection(scheduler, quit)
+	// операция запроса начинается до ожидания очереди, чтобы ожидание тоже попало в трассу
+	handler := HandleTracing(tracer, FetchPattern, limit(HandleFetch(fetcher)))
+	mux.Handle(FetchPattern, handler)
+	// тот же обработчик, но с выдачей результатов в виде Server-Sent Events
+	mux.Handle(FetchPattern+"/stream", handler)
+	// асинхронные задания: результаты забираются позже, не держа соединение открытым
+	jobs := HandleTracing(tracer, JobsPattern, HandleJobs(NewJobStore(quit, fetcher)))
+	mux.Handle(JobsPattern, jobs)
+	mux.Handle(JobsPattern+"/", jobs)
+
+	// проверки для балансировщика и оркестратора (например, probes в Kubernetes)
+	readiness := NewReadiness(readinessChecks...)
+	mux.Handle(HealthzPattern, HandleHealthz())
+	mux.Handle(ReadyzPattern, HandleReadyz(readiness))
+
+	// описание api для генерации клиентов
+	mux.Handle(OpenAPIPattern, HandleOpenAPI())
+	// изменение ограничений без перезапуска, только с токеном администратора
+	if adminTokenFile != "" {
+		token, err := ReadAdminToken(adminTokenFile)
+		if err != nil {
+			fatal("Read admin token", err)
+		}
+		mux.Handle(AdminLimitsPattern, HandleAdminLimits(token, scheduler))
+		mux.Handle(AdminStatsPattern, HandleAdminStats(token, fetcher, scheduler))
+	}
+	// метрики сервиса в формате Prometheus
+	mux.Handle(MetricsPattern, HandleMetrics(fetcher.requests, fetcher.hostErrors, fetcher.metrics, fetcher.pool, scheduler, fetcher.adaptive, fetcher.shedder))
+
+	// устаревшие пути без версии
+	mux.Handle(LegacyFetchPattern, HandleDeprecated(LegacyFetchPattern, FetchPattern, handler))
+	mux.Handle(LegacyFetchPattern+"/stream", HandleDeprecated(LegacyFetchPattern, FetchPattern, handler))
+	mux.Handle(LegacyJobsPattern, HandleDeprecated(LegacyJobsPattern, JobsPattern, jobs))
+	mux.Handle(LegacyJobsPattern+"/", HandleDeprecated(LegacyJobsPattern, JobsPattern, jobs))
+	// каждый запрос получает адрес клиента, арендатора и идентификатор для поиска в логах и записывается в журнал запросов
+	common := func(h http.Handler) http.Handler {
+		return HandleClientIP(trustedProxies, HandleTenant(tenants, HandleRequestID(HandleAccessLog(accessLog, h))))
+	}
+	// ответы сжимаются, если клиент это поддерживает
+	server := &http.Server{Addr: ListenAddr, Handler: common(HandleCompression(mux))}
+	// gRPC-api на отдельном адресе
+	grpcServer := NewGrpcServer(GrpcListenAddr, common(HandleTracing(tracer, GrpcFetchMethod, limit(HandleGrpcFetch(fetcher)))))
+
+	servers := []*http.Server{server, grpcServer}
+	// профили и счетчики для отладки работающего сервера - на отдельном адресе, недоступном пользователям
+	if debugAddr != "" {
+		servers = append(servers, NewDebugServer(debugAddr, func() any { return CollectStats(fetcher, scheduler) }))
+	}
+
+	// запускаем серверы
+	for _, srv := range servers {
+		srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("ListenAndServe", "addr", srv.Addr, "error", err)
+			}
+		}(srv)
+	}
+	readiness.SetReady()
+	slog.Info("Server started", "addr", ListenAddr, "grpc_addr", GrpcListenAddr, "debug_addr", debugAddr)
 
 	// блочимся до того момента, пока пользователь или система не прервет исполнение
 	<-shutdown
-	log.Println("Interruption from OS")
+	slog.Info("Interruption from OS")
+	// пока балансировщик не заметит неготовность сервера, запросы еще приходят и обрабатываются как обычно
+	readiness.Drain()
+	if drainDelay > 0 {
+		slog.Info("Draining", "delay", drainDelay)
+		time.Sleep(drainDelay)
+	}
 
 	// исполнение прервано, оповещаем об этом ждущие горутины, путем закрытия канала quit
 	close(quit)
-	// выключаем сервер
+	// выключаем серверы: начатые запросы дорабатываются до конца
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	if err := server.Shutdown(ctx); err != nil {
-		log.Println(err)
+	for _, srv := range servers {
+		err := srv.Shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			// запросы не успели завершиться: прерываем их запросы url, чтобы они ответили с тем, что уже получено
+			stopRequests()
+		}
+		if err != nil {
+			slog.Error("Shutdown", "addr", srv.Addr, "error", err)
+		}
 	}
+	// отправляем операции, завершенные к выключению
+	tracer.Shutdown(ctx)
 	cancel()
+	if err := fetcherConfig.AuditLog.Close(); err != nil {
+		slog.Error("Audit log", "error", err)
+	}
 
-	log.Println("Server stopped")
+	slog.Info("Server stopped")
+	if rotatingLog != nil {
+		rotatingLog.Close()
+	}
 }
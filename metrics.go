@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsPattern путь, по которому отдаются метрики сервиса в текстовом формате Prometheus
+const MetricsPattern = "/metrics"
+
+// Этапы установки соединения, длительность которых учитывается в метриках
+const (
+	StageDNS     = "dns"
+	StageConnect = "connect"
+	StageTLS     = "tls"
+)
+
+// stageBuckets границы гистограмм длительности этапов соединения, в секундах
+var stageBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// BucketsFlag границы гистограммы, задаются флагом через запятую по возрастанию
+type BucketsFlag []float64
+
+// String возвращает границы в формате флага
+func (f *BucketsFlag) String() string {
+	var parts []string
+	for _, bound := range *f {
+		parts = append(parts, strconv.FormatFloat(bound, 'g', -1, 64))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set заменяет границы значением флага
+func (f *BucketsFlag) Set(s string) error {
+	var bounds []float64
+	for _, part := range strings.Split(s, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsInf(bound, 0) || math.IsNaN(bound) {
+			return fmt.Errorf("%q is not a finite number", part)
+		}
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return fmt.Errorf("Bucket bounds must be increasing, %v follows %v", bound, bounds[len(bounds)-1])
+		}
+		bounds = append(bounds, bound)
+	}
+	*f = bounds
+	return nil
+}
+
+// maxExemplarLabelsLength максимальная длина меток примера в OpenMetrics (имена и значения вместе)
+const maxExemplarLabelsLength = 128
+
+// histogram гистограмма значений: counts[i] - сколько значений не больше bounds[i]
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+	// exemplars последние значения, попавшие в каждый интервал (последний - выше всех границ), с идентификаторами
+	// запросов, в которых они получены; выводятся только в формате OpenMetrics. nil - примеров еще не было
+	exemplars []exemplar
+}
+
+// exemplar пример значения гистограммы: значение value запроса requestID, полученное в момент at
+type exemplar struct {
+	requestID string
+	value     float64
+	at        time.Time
+}
+
+// newHistogram создает пустую гистограмму с границами bounds
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// observe учитывает значение v
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// observeExemplar учитывает значение v, полученное в запросе requestID, и запоминает его как пример
+func (h *histogram) observeExemplar(v float64, requestID string) {
+	h.observe(v)
+	if requestID == "" || len("request_id")+len(requestID) > maxExemplarLabelsLength {
+		return
+	}
+	if h.exemplars == nil {
+		h.exemplars = make([]exemplar, len(h.bounds)+1)
+	}
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.exemplars[i] = exemplar{requestID: requestID, value: v, at: time.Now()}
+}
+
+// writeText выводит гистограмму метрики name; labels - метки гистограммы вида `stage="dns",` или пустая строка
+func (h *histogram) writeText(w *metricsWriter, name, labels string) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		h.writeExemplar(w, i)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d", name, labels, h.count)
+	h.writeExemplar(w, len(h.bounds))
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// writeExemplar дописывает к строке интервала i пример значения (только в формате OpenMetrics) и завершает строку
+func (h *histogram) writeExemplar(w *metricsWriter, i int) {
+	if w.openMetrics && h.exemplars != nil && h.exemplars[i].requestID != "" {
+		e := h.exemplars[i]
+		fmt.Fprintf(w, " # {request_id=\"%s\"} %g %.3f", labelEscaper.Replace(e.requestID), e.value, float64(e.at.UnixMilli())/1000)
+	}
+	w.WriteByte('\n')
+}
+
+// ConnMetrics метрики исходящих соединений: сколько соединений взято из пула и сколько установлено заново,
+// сколько длились этапы установки, сколько соединений открыто и запросов выполняется по хостам.
+// nil-значение ничего не учитывает
+type ConnMetrics struct {
+	mu sync.Mutex
+	// reused и created соединения, полученные запросами: взятые из пула и установленные заново
+	reused, created uint64
+	// stages длительности этапов установки соединений
+	stages map[string]*histogram
+	// openConns открытые соединения по адресам (host:port), с которыми они установлены
+	openConns map[string]int
+	// activeRequests выполняющиеся запросы по хостам url
+	activeRequests map[string]int
+}
+
+// NewConnMetrics создает пустые метрики
+func NewConnMetrics() *ConnMetrics {
+	return &ConnMetrics{
+		stages:         make(map[string]*histogram),
+		openConns:      make(map[string]int),
+		activeRequests: make(map[string]int),
+	}
+}
+
+// gotConn учитывает соединение, полученное запросом
+func (m *ConnMetrics) gotConn(reused bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reused {
+		m.reused++
+	} else {
+		m.created++
+	}
+}
+
+// observeStage учитывает длительность этапа установки соединения
+func (m *ConnMetrics) observeStage(stage string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.stages[stage]
+	if !ok {
+		h = newHistogram(stageBuckets)
+		m.stages[stage] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// add изменяет значение по ключу key на delta, нулевые значения удаляются, чтобы не копить хосты
+func (m *ConnMetrics) add(values map[string]int, key string, delta int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values[key] += delta
+	if values[key] <= 0 {
+		delete(values, key)
+	}
+}
+
+// requestStarted и requestFinished учитывают выполняющийся запрос к хосту
+func (m *ConnMetrics) requestStarted(host string) {
+	if m != nil {
+		m.add(m.activeRequests, host, 1)
+	}
+}
+
+func (m *ConnMetrics) requestFinished(host string) {
+	if m != nil {
+		m.add(m.activeRequests, host, -1)
+	}
+}
+
+// dialContext оборачивает dial: установленные им соединения учитываются как открытые, пока не будут закрыты
+func (m *ConnMetrics) dialContext(dial dialFunc) dialFunc {
+	if m == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+		addr = strings.ToLower(addr)
+		m.add(m.openConns, addr, 1)
+		return &trackedConn{Conn: conn, metrics: m, addr: addr}, nil
+	}
+}
+
+// trackedConn соединение, учтенное в метриках как открытое
+type trackedConn struct {
+	net.Conn
+	metrics *ConnMetrics
+	addr    string
+	once    sync.Once
+}
+
+// Close закрывает соединение и учитывает это в метриках один раз, сколько бы раз его ни закрывали
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.metrics.add(c.metrics.openConns, c.addr, -1) })
+	return c.Conn.Close()
+}
+
+// labelEscaper экранирует значение метки Prometheus
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeText выводит метрики в текстовом формате Prometheus
+func (m *ConnMetrics) writeText(w *metricsWriter) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.counterHeader("fetch_connections_total", "Connections obtained by url requests, by whether an idle pooled connection was reused.")
+	fmt.Fprintf(w, "fetch_connections_total{reused=\"true\"} %d\n", m.reused)
+	fmt.Fprintf(w, "fetch_connections_total{reused=\"false\"} %d\n", m.created)
+
+	fmt.Fprintln(w, "# HELP fetch_connection_stage_seconds Duration of DNS lookups, TCP connects and TLS handshakes of new connections.")
+	fmt.Fprintln(w, "# TYPE fetch_connection_stage_seconds histogram")
+	for _, stage := range []string{StageDNS, StageConnect, StageTLS} {
+		h := m.stages[stage]
+		if h == nil {
+			h = newHistogram(stageBuckets)
+		}
+		h.writeText(w, "fetch_connection_stage_seconds", fmt.Sprintf("stage=%q,", stage))
+	}
+
+	fmt.Fprintln(w, "# HELP fetch_host_open_connections Open outbound connections by target address, idle ones included.")
+	fmt.Fprintln(w, "# TYPE fetch_host_open_connections gauge")
+	writeGauges(w, "fetch_host_open_connections", "addr", m.openConns)
+	fmt.Fprintln(w, "# HELP fetch_host_active_requests Url requests in progress by target host.")
+	fmt.Fprintln(w, "# TYPE fetch_host_active_requests gauge")
+	writeGauges(w, "fetch_host_active_requests", "host", m.activeRequests)
+}
+
+// writeGauges выводит значения values метрики name (gauge или counter) с меткой label, отсортированные по метке
+func writeGauges[V int | uint64](w *metricsWriter, name, label string, values map[string]V) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(key), values[key])
+	}
+}
+
+// metricsWriter выводит метрики в текстовом формате Prometheus или, если его запросил сборщик, в формате OpenMetrics
+type metricsWriter struct {
+	*bufio.Writer
+	// openMetrics вывод в формате OpenMetrics: с примерами значений гистограмм
+	openMetrics bool
+}
+
+// counterHeader выводит описание help и тип счетчика name. В OpenMetrics имя семейства счетчиков не содержит
+// суффикса _total, который есть у самих значений
+func (w *metricsWriter) counterHeader(name, help string) {
+	if w.openMetrics {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+}
+
+// metricsSource источник метрик для HandleMetrics, nil-значения источников ничего не выводят
+type metricsSource interface {
+	writeText(w *metricsWriter)
+}
+
+// HandleMetrics отдает метрики всех sources (исходящих соединений, запросов, пула, очереди запросов клиентов,
+// пределов подстройки числа одновременных запросов, нагрузки) в текстовом формате Prometheus, а сборщику,
+// который принимает OpenMetrics, - в этом формате, с идентификаторами запросов в примерах значений гистограмм
+func HandleMetrics(sources ...metricsSource) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w := &metricsWriter{Writer: bufio.NewWriter(rw), openMetrics: strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")}
+		if w.openMetrics {
+			rw.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		} else {
+			rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		}
+		for _, source := range sources {
+			source.writeText(w)
+		}
+		if w.openMetrics {
+			fmt.Fprintln(w, "# EOF")
+		}
+		w.Flush()
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+)
+
+// Простейшее кодирование MessagePack для итогового ответа пользователю.
+// Сторонние модули подключаются только для протоколов, которые вручную не реализовать (см. «Зависимости» в README),
+// а MessagePack к ним не относится, поэтому кодировщик написан вручную.
+// Ключи и состав полей совпадают с json-ответом, но тела ответов передаются как bin, без base64
+
+// appendMsgpackNil дописывает значение nil
+func appendMsgpackNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+// appendMsgpackBool дописывает логическое значение
+func appendMsgpackBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+// appendMsgpackInt дописывает целое число в самом коротком подходящем формате
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v < 128:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(v))
+	case v >= 0 && v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v >= 0 && v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v >= 0 && v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	}
+}
+
+// appendMsgpackFloat дописывает число с плавающей точкой (float64)
+func appendMsgpackFloat(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+}
+
+// appendMsgpackString дописывает строку
+func appendMsgpackString(b []byte, v string) []byte {
+	n := len(v)
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, v...)
+}
+
+// appendMsgpackBinary дописывает двоичные данные
+func appendMsgpackBinary(b []byte, v []byte) []byte {
+	n := len(v)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, v...)
+}
+
+// appendMsgpackArrayHeader дописывает заголовок массива из n элементов, сами элементы дописываются следом
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+// msgpackMap накапливает пары ключ-значение словаря, т.к. в заголовке словаря нужно их число
+type msgpackMap struct {
+	n int
+	b []byte
+}
+
+// key дописывает ключ очередной пары и возвращает буфер для дописывания значения
+func (m *msgpackMap) key(k string) []byte {
+	m.n++
+	return appendMsgpackString(m.b, k)
+}
+
+func (m *msgpackMap) String(k, v string)        { m.b = appendMsgpackString(m.key(k), v) }
+func (m *msgpackMap) Binary(k string, v []byte) { m.b = appendMsgpackBinary(m.key(k), v) }
+func (m *msgpackMap) Int(k string, v int64)     { m.b = appendMsgpackInt(m.key(k), v) }
+func (m *msgpackMap) Float(k string, v float64) { m.b = appendMsgpackFloat(m.key(k), v) }
+func (m *msgpackMap) Bool(k string, v bool)     { m.b = appendMsgpackBool(m.key(k), v) }
+func (m *msgpackMap) Nil(k string)              { m.b = appendMsgpackNil(m.key(k)) }
+
+// Raw дописывает уже закодированное значение
+func (m *msgpackMap) Raw(k string, v []byte) { m.b = append(m.key(k), v...) }
+
+// appendTo дописывает словарь целиком
+func (m *msgpackMap) appendTo(b []byte) []byte {
+	switch {
+	case m.n < 16:
+		b = append(b, 0x80|byte(m.n))
+	case m.n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xde), uint16(m.n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(m.n))
+	}
+	return append(b, m.b...)
+}
+
+// appendMsgpackStringMap дописывает словарь строк с упорядоченными ключами
+func appendMsgpackStringMap(b []byte, v map[string]string) []byte {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var m msgpackMap
+	for _, k := range keys {
+		m.String(k, v[k])
+	}
+	return m.appendTo(b)
+}
+
+// MarshalMsgpack кодирует итоговый ответ в MessagePack
+func (r ResultToUser) MarshalMsgpack() []byte {
+	var m msgpackMap
+	m.String("error", r.Error)
+	if r.ErrorCode != "" {
+		m.String("error_code", r.ErrorCode)
+	}
+	if r.Responses == nil {
+		m.Nil("responses")
+	} else {
+		responses := appendMsgpackArrayHeader(nil, len(r.Responses))
+		for _, res := range r.Responses {
+			responses = res.appendMsgpack(responses)
+		}
+		m.Raw("responses", responses)
+	}
+	if r.Failed != 0 {
+		m.Int("failed", int64(r.Failed))
+	}
+	m.Raw("summary", r.Summary.appendMsgpack(nil))
+	if r.RequestID != "" {
+		m.String("request_id", r.RequestID)
+	}
+	if r.Diff != nil {
+		var diff msgpackMap
+		diff.Bool("identical", r.Diff.Identical)
+		diff.Int("size_delta", r.Diff.SizeDelta)
+		if r.Diff.Unified != "" {
+			diff.String("unified", r.Diff.Unified)
+		}
+		m.Raw("diff", diff.appendTo(nil))
+	}
+	if r.NextCursor != "" {
+		m.String("next_cursor", r.NextCursor)
+	}
+	return m.appendTo(nil)
+}
+
+// appendMsgpack дописывает сводную статистику
+func (s Summary) appendMsgpack(b []byte) []byte {
+	var latency msgpackMap
+	latency.Float("min", s.Latency.Min)
+	latency.Float("max", s.Latency.Max)
+	latency.Float("mean", s.Latency.Mean)
+	latency.Float("p95", s.Latency.P95)
+
+	var m msgpackMap
+	m.Int("total", int64(s.Total))
+	m.Int("succeeded", int64(s.Succeeded))
+	m.Int("failed", int64(s.Failed))
+	m.Int("bytes", s.Bytes)
+	m.Raw("latency_ms", latency.appendTo(nil))
+	return m.appendTo(b)
+}
+
+// appendMsgpack дописывает результат запроса url
+func (r UrlResult) appendMsgpack(b []byte) []byte {
+	var m msgpackMap
+	m.Int("index", int64(r.Index))
+	m.String("url", r.Url)
+	if r.Response == nil {
+		m.Nil("response")
+	} else {
+		m.Binary("response", r.Response)
+	}
+	if r.StatusCode != 0 {
+		m.Int("status_code", int64(r.StatusCode))
+	}
+	if len(r.Headers) > 0 {
+		m.Raw("headers", appendMsgpackStringMap(nil, r.Headers))
+	}
+	m.Int("content_length", r.ContentLength)
+	if r.CompressedLength != 0 {
+		m.Int("compressed_length", r.CompressedLength)
+	}
+	if r.Charset != "" {
+		m.String("charset", r.Charset)
+	}
+	if r.FullLength != 0 {
+		m.Int("full_length", r.FullLength)
+	}
+	if r.RetryAfterMs != 0 {
+		m.Int("retry_after_ms", r.RetryAfterMs)
+	}
+	if r.Protocol != "" {
+		m.String("protocol", r.Protocol)
+	}
+	if r.RemoteAddr != "" {
+		m.String("remote_addr", r.RemoteAddr)
+	}
+	if r.NotModified {
+		m.Bool("not_modified", r.NotModified)
+	}
+	if r.Freshness != nil {
+		var freshness msgpackMap
+		freshness.String("source", r.Freshness.Source)
+		freshness.Int("lifetime_s", r.Freshness.LifetimeS)
+		freshness.String("expires", r.Freshness.Expires.Format(time.RFC3339))
+		if r.Freshness.NoStore {
+			freshness.Bool("no_store", r.Freshness.NoStore)
+		}
+		m.Raw("freshness", freshness.appendTo(nil))
+	}
+	if r.FinalUrl != "" {
+		m.String("final_url", r.FinalUrl)
+	}
+	if len(r.Redirects) > 0 {
+		redirects := appendMsgpackArrayHeader(nil, len(r.Redirects))
+		for _, hop := range r.Redirects {
+			var h msgpackMap
+			h.String("url", hop.Url)
+			h.Int("status_code", int64(hop.StatusCode))
+			h.String("location", hop.Location)
+			redirects = h.appendTo(redirects)
+		}
+		m.Raw("redirects", redirects)
+	}
+	if r.FallbackUrl != "" {
+		m.String("fallback_url", r.FallbackUrl)
+	}
+	if len(r.Cookies) > 0 {
+		cookies := appendMsgpackArrayHeader(nil, len(r.Cookies))
+		for _, cookie := range r.Cookies {
+			cookies = appendMsgpackString(cookies, cookie)
+		}
+		m.Raw("cookies", cookies)
+	}
+	if len(r.Trailers) > 0 {
+		m.Raw("trailers", appendMsgpackStringMap(nil, r.Trailers))
+	}
+	if r.TLS != nil {
+		var info msgpackMap
+		info.String("version", r.TLS.Version)
+		info.String("cipher_suite", r.TLS.CipherSuite)
+		info.String("subject", r.TLS.Subject)
+		info.String("issuer", r.TLS.Issuer)
+		info.String("not_after", r.TLS.NotAfter.Format(time.RFC3339))
+		m.Raw("tls", info.appendTo(nil))
+	}
+	if r.Policy != nil {
+		var policy msgpackMap
+		policy.String("action", r.Policy.Action)
+		if r.Policy.Rule != "" {
+			policy.String("rule", r.Policy.Rule)
+		}
+		m.Raw("policy", policy.appendTo(nil))
+	}
+	if r.BodyTruncated {
+		m.Bool("body_truncated", true)
+	}
+	if r.SHA256 != "" {
+		m.String("sha256", r.SHA256)
+	}
+	if r.ValidUTF8 != nil {
+		m.Bool("valid_utf8", *r.ValidUTF8)
+	}
+	if r.Deduplicated {
+		m.Bool("deduplicated", true)
+	}
+	if r.Coalesced {
+		m.Bool("coalesced", true)
+	}
+	if r.Attempts != 0 {
+		m.Int("attempts", int64(r.Attempts))
+	}
+	if r.Timing != nil {
+		var timing msgpackMap
+		timing.Float("dns_lookup_ms", r.Timing.DNSLookup)
+		timing.Float("tcp_connect_ms", r.Timing.TCPConnect)
+		timing.Float("tls_handshake_ms", r.Timing.TLSHandshake)
+		timing.Float("ttfb_ms", r.Timing.TTFB)
+		timing.Float("total_ms", r.Timing.Total)
+		timing.Bool("conn_reused", r.Timing.ConnReused)
+		m.Raw("timing", timing.appendTo(nil))
+	}
+	if r.Error != "" {
+		m.String("error", r.Error)
+	}
+	if r.ErrorCode != "" {
+		m.String("error_code", r.ErrorCode)
+	}
+	return m.appendTo(b)
+}
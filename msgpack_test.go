@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAppendMsgpackInt(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want string
+	}{
+		{0, "00"},
+		{127, "7f"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{128, "cc80"},
+		{256, "cd0100"},
+		{70000, "ce00011170"},
+		{1 << 32, "d30000000100000000"},
+		{-33, "d3ffffffffffffffdf"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(appendMsgpackInt(nil, tt.v)); got != tt.want {
+			t.Errorf("appendMsgpackInt(%d) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestAppendMsgpackString(t *testing.T) {
+	tests := []struct {
+		n          int
+		wantPrefix string
+	}{
+		{0, "a0"},
+		{31, "bf"},
+		{32, "d920"},
+		{256, "da0100"},
+		{1 << 16, "db00010000"},
+	}
+	for _, tt := range tests {
+		s := strings.Repeat("a", tt.n)
+		got := appendMsgpackString(nil, s)
+		if prefix := hex.EncodeToString(got[:len(got)-tt.n]); prefix != tt.wantPrefix || string(got[len(prefix)/2:]) != s {
+			t.Errorf("appendMsgpackString() of %d bytes has prefix %s, want %s", tt.n, prefix, tt.wantPrefix)
+		}
+	}
+}
+
+// decodeMsgpack разбирает значение MessagePack в форматах, которые дописывают функции appendMsgpack*:
+// словари становятся map[string]any, массивы - []any, целые - int64
+func decodeMsgpack(b []byte) (any, []byte, error) {
+	errShort := errors.New("truncated msgpack value")
+	if len(b) == 0 {
+		return nil, nil, errShort
+	}
+	c, b := b[0], b[1:]
+	// size читает беззнаковое число из n байт
+	size := func(n int) (int, error) {
+		if len(b) < n {
+			return 0, errShort
+		}
+		var v uint64
+		for _, x := range b[:n] {
+			v = v<<8 | uint64(x)
+		}
+		b = b[n:]
+		return int(v), nil
+	}
+	raw := func(n int, err error) ([]byte, error) {
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < n {
+			return nil, errShort
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+	var err error
+	var n int
+	switch {
+	case c <= 0x7f:
+		return int64(c), b, nil
+	case c >= 0xe0:
+		return int64(int8(c)), b, nil
+	case c == 0xc0:
+		return nil, b, nil
+	case c == 0xc2 || c == 0xc3:
+		return c == 0xc3, b, nil
+	case c == 0xcc || c == 0xcd || c == 0xce:
+		n, err = size(1 << (c - 0xcc))
+		return int64(n), b, err
+	case c == 0xd3:
+		n, err = size(8)
+		return int64(n), b, err
+	case c == 0xcb:
+		v, err := raw(8, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), b, nil
+	case c&0xe0 == 0xa0 || c == 0xd9 || c == 0xda || c == 0xdb:
+		if c&0xe0 == 0xa0 {
+			n = int(c & 0x1f)
+		} else {
+			n, err = size(1 << (c - 0xd9))
+		}
+		v, err := raw(n, err)
+		return string(v), b, err
+	case c == 0xc4 || c == 0xc5 || c == 0xc6:
+		v, err := raw(size(1 << (c - 0xc4)))
+		return v, b, err
+	case c&0xf0 == 0x90 || c == 0xdc || c == 0xdd:
+		if c&0xf0 == 0x90 {
+			n = int(c & 0x0f)
+		} else if n, err = size(2 << (c - 0xdc)); err != nil {
+			return nil, nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], b, err = decodeMsgpack(b); err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, b, nil
+	case c&0xf0 == 0x80 || c == 0xde || c == 0xdf:
+		if c&0xf0 == 0x80 {
+			n = int(c & 0x0f)
+		} else if n, err = size(2 << (c - 0xde)); err != nil {
+			return nil, nil, err
+		}
+		m := make(map[string]any, n)
+		for range n {
+			var k, v any
+			if k, b, err = decodeMsgpack(b); err != nil {
+				return nil, nil, err
+			}
+			if v, b, err = decodeMsgpack(b); err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, errors.New("msgpack map key is not a string")
+			}
+			m[key] = v
+		}
+		return m, b, nil
+	}
+	return nil, nil, errors.New("unsupported msgpack format")
+}
+
+func TestMarshalMsgpack(t *testing.T) {
+	// больше 15 результатов и заголовков, чтобы проверить длинные заголовки массивов и словарей
+	headers := make(map[string]string)
+	for _, k := range strings.Split("a b c d e f g h i j k l m n o p", " ") {
+		headers["X-"+k] = k
+	}
+	results := ResultToUser{ErrorCode: ErrorCodeUnexpectedStatus, Error: "unexpected_status: 503", Failed: 1, RequestID: "req-1"}
+	for i := range 17 {
+		results.Responses = append(results.Responses, UrlResult{Index: i, Url: "http://example.test/", Response: []byte{0, 1, 2}, StatusCode: 200})
+	}
+	results.Responses[0].Headers = headers
+	results.Responses[1].Response = nil
+	results.Summary = Summary{Total: 17, Succeeded: 16, Failed: 1, Bytes: 48, Latency: LatencySummary{Max: 1.5}}
+
+	decoded, rest, err := decodeMsgpack(results.MarshalMsgpack())
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("MarshalMsgpack() is not a single msgpack value: %v, %d bytes left", err, len(rest))
+	}
+	m := decoded.(map[string]any)
+	if m["error"] != results.Error || m["error_code"] != results.ErrorCode || m["failed"] != int64(1) || m["request_id"] != "req-1" {
+		t.Errorf("MarshalMsgpack() = %v", m)
+	}
+	summary := m["summary"].(map[string]any)
+	if summary["total"] != int64(17) || summary["latency_ms"].(map[string]any)["max"] != 1.5 {
+		t.Errorf("summary = %v", summary)
+	}
+
+	responses := m["responses"].([]any)
+	if len(responses) != 17 {
+		t.Fatalf("%d responses, want 17", len(responses))
+	}
+	first := responses[0].(map[string]any)
+	// тело передается двоичными данными, а не base64
+	if body, ok := first["response"].([]byte); !ok || !bytes.Equal(body, []byte{0, 1, 2}) {
+		t.Errorf("response = %#v, want binary body", first["response"])
+	}
+	wantHeaders := make(map[string]any)
+	for k, v := range headers {
+		wantHeaders[k] = v
+	}
+	if !reflect.DeepEqual(first["headers"], wantHeaders) {
+		t.Errorf("headers = %v, want %v", first["headers"], wantHeaders)
+	}
+	if second := responses[1].(map[string]any); second["response"] != nil || second["index"] != int64(1) {
+		t.Errorf("result without a body = %v", second)
+	}
+}
+
+func TestMarshalMsgpackNoResponses(t *testing.T) {
+	decoded, _, err := decodeMsgpack(ResultToUser{Error: "Too many urls"}.MarshalMsgpack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// как и в json, отсутствующий список результатов - nil, а не пустой массив
+	if m := decoded.(map[string]any); m["responses"] != nil || m["error"] != "Too many urls" {
+		t.Errorf("MarshalMsgpack() = %v", m)
+	}
+}
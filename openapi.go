@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenAPIPattern путь, по которому отдается описание api в формате OpenAPI 3
+const OpenAPIPattern = "/openapi.json"
+
+// JobCreated ответ на создание асинхронного задания
+type JobCreated struct {
+	ID string `json:"job_id"`
+}
+
+// schemaObject json-схема или другой объект документа OpenAPI
+type schemaObject = map[string]interface{}
+
+// openAPIGenerator строит схемы по типам Go через reflect,
+// поэтому описание api не может разойтись с тем, что на самом деле принимают и возвращают хэндлеры
+type openAPIGenerator struct {
+	components schemaObject // схемы именованных структур
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// ref возвращает ссылку на схему типа v, добавляя ее в components
+func (g *openAPIGenerator) ref(v interface{}) schemaObject {
+	return g.schema(reflect.TypeOf(v))
+}
+
+// schema возвращает json-схему типа t, именованные структуры описываются в components и подставляются ссылкой
+func (g *openAPIGenerator) schema(t reflect.Type) schemaObject {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+
+	case reflect.Struct:
+		if t == timeType {
+			return schemaObject{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			// сначала резервируем имя, чтобы не зациклиться на рекурсивных типах
+			g.components[t.Name()] = schemaObject{}
+			g.components[t.Name()] = g.object(t)
+		}
+		return schemaObject{"$ref": "#/components/schemas/" + t.Name()}
+
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte в json передается строкой в base64
+			return schemaObject{"type": "string", "format": "byte"}
+		}
+		return schemaObject{"type": "array", "items": g.schema(t.Elem())}
+
+	case reflect.Map:
+		return schemaObject{"type": "object", "additionalProperties": g.schema(t.Elem())}
+
+	case reflect.String:
+		return schemaObject{"type": "string"}
+
+	case reflect.Bool:
+		return schemaObject{"type": "boolean"}
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return schemaObject{"type": "integer", "format": "int32"}
+
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return schemaObject{"type": "integer", "format": "int64"}
+
+	case reflect.Float32, reflect.Float64:
+		return schemaObject{"type": "number", "format": "double"}
+	}
+	// остальные типы в api не используются
+	return schemaObject{}
+}
+
+// object описывает структуру по ее экспортируемым полям и их json-тегам
+func (g *openAPIGenerator) object(t reflect.Type) schemaObject {
+	properties := schemaObject{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// неэкспортируемые поля в json не попадают
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		properties[name] = g.schema(field.Type)
+	}
+	return schemaObject{"type": "object", "properties": properties}
+}
+
+// jsonContent описание тела запроса или ответа в json
+func jsonContent(schema schemaObject) schemaObject {
+	return schemaObject{"application/json": schemaObject{"schema": schema}}
+}
+
+// response описание ответа с кодом: description и, если задано, json-тело
+func response(description string, schema schemaObject) schemaObject {
+	r := schemaObject{"description": description}
+	if schema != nil {
+		r["content"] = jsonContent(schema)
+	}
+	return r
+}
+
+// BuildOpenAPI строит описание api в формате OpenAPI 3
+func BuildOpenAPI() schemaObject {
+	g := &openAPIGenerator{components: schemaObject{}}
+
+	fetchRequest := schemaObject{"required": true, "content": jsonContent(g.ref(Urls{}))}
+	textError := schemaObject{"description": "Incorrect request, error text in body",
+		"content": schemaObject{"text/plain": schemaObject{"schema": schemaObject{"type": "string"}}}}
+	tooLarge := schemaObject{"description": "Request body is larger than the server limit, error text in body",
+		"content": schemaObject{"text/plain": schemaObject{"schema": schemaObject{"type": "string"}}}}
+	tooBusy := schemaObject{"description": "Too many requests are waiting, retry after Retry-After seconds",
+		"headers": schemaObject{"Retry-After": schemaObject{"schema": schemaObject{"type": "integer"}}},
+		"content": schemaObject{"text/plain": schemaObject{"schema": schemaObject{"type": "string"}}}}
+	overloaded := schemaObject{"description": "Server is overloaded, retry after Retry-After seconds",
+		"headers": schemaObject{"Retry-After": schemaObject{"schema": schemaObject{"type": "integer"}}},
+		"content": schemaObject{"text/plain": schemaObject{"schema": schemaObject{"type": "string"}}}}
+	tooManyJobs := schemaObject{"description": "Too many jobs are stored, retry after Retry-After seconds",
+		"headers": schemaObject{"Retry-After": schemaObject{"schema": schemaObject{"type": "integer"}}},
+		"content": schemaObject{"text/plain": schemaObject{"schema": schemaObject{"type": "string"}}}}
+	jobID := []schemaObject{{"name": "id", "in": "path", "required": true, "schema": schemaObject{"type": "string"}}}
+
+	paths := schemaObject{
+		FetchPattern: schemaObject{
+			"post": schemaObject{
+				"summary":     "Fetch all urls and return results",
+				"requestBody": fetchRequest,
+				"responses": schemaObject{
+					"200": response("Results of all urls or error", g.ref(ResultToUser{})),
+					"400": textError,
+					"413": tooLarge,
+					"429": tooBusy,
+					"503": overloaded,
+				},
+			},
+		},
+		FetchPattern + "/stream": schemaObject{
+			"post": schemaObject{
+				"summary":     "Fetch all urls and stream results as Server-Sent Events",
+				"requestBody": fetchRequest,
+				"responses": schemaObject{
+					"200": schemaObject{"description": "Event result per url (UrlResult) and final event done",
+						"content": schemaObject{ContentTypeEventStream: schemaObject{"schema": schemaObject{"type": "string"}}}},
+					"400": textError,
+					"413": tooLarge,
+					"429": tooBusy,
+					"503": overloaded,
+				},
+			},
+		},
+		JobsPattern: schemaObject{
+			"post": schemaObject{
+				"summary":     "Create async job",
+				"requestBody": fetchRequest,
+				"responses": schemaObject{
+					"202": response("Job created", g.ref(JobCreated{})),
+					"400": textError,
+					"413": tooLarge,
+					"429": tooManyJobs,
+					"503": overloaded,
+				},
+			},
+		},
+		JobsPattern + "/{id}": schemaObject{
+			"parameters": jobID,
+			"get": schemaObject{
+				"summary":   "Job status and progress",
+				"responses": schemaObject{"200": response("Job status", g.ref(JobInfo{})), "404": response("Job not found", nil)},
+			},
+			"delete": schemaObject{
+				"summary":   "Cancel job",
+				"responses": schemaObject{"200": response("Final job status", g.ref(JobInfo{})), "404": response("Job not found", nil)},
+			},
+		},
+		JobsPattern + "/{id}/results": schemaObject{
+			"parameters": jobID,
+			"get": schemaObject{
+				"summary": "Job results",
+				"responses": schemaObject{
+					"200": response("Results of all urls or error", g.ref(ResultToUser{})),
+					"404": response("Job not found", nil),
+					"409": response("Job is not finished yet", nil),
+				},
+			},
+		},
+	}
+
+	return schemaObject{
+		"openapi":    "3.0.3",
+		"info":       schemaObject{"title": "go-test-task", "version": "1"},
+		"paths":      paths,
+		"components": schemaObject{"schemas": g.components},
+	}
+}
+
+// HandleOpenAPI отдает описание api, построенное один раз при первом запросе
+func HandleOpenAPI() http.Handler {
+	var once sync.Once
+	var spec schemaObject
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		once.Do(func() { spec = BuildOpenAPI() })
+		writeJSON(rw, http.StatusOK, spec)
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// Решения политики доступа к хостам
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// matchHostPattern проверяет, подходит ли host под шаблон: точное имя ("example.com"),
+// любой поддомен ("*.example.com") или любой хост ("*")
+func matchHostPattern(pattern, host string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// normalizeHost приводит имя хоста к виду, в котором оно сравнивается с шаблонами: в нижнем регистре
+// и без завершающей точки полного имени ("example.com." - тот же хост, что и "example.com")
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// HostPatternFlag список шаблонов имен хостов, задается повторяющимся флагом
+type HostPatternFlag []string
+
+// String возвращает шаблоны в формате флага
+func (f *HostPatternFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set добавляет шаблон из значения флага
+func (f *HostPatternFlag) Set(s string) error {
+	if s == "" || strings.ContainsAny(s, "/:") {
+		return fmt.Errorf("invalid host pattern %q", s)
+	}
+	*f = append(*f, strings.ToLower(s))
+	return nil
+}
+
+// matchAnyHostPattern проверяет, подходит ли host хотя бы под один из шаблонов
+func matchAnyHostPattern(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyRule правило политики доступа: шаблон имени хоста или сеть, в которую попадают его адреса
+type PolicyRule struct {
+	// Pattern правило как оно задано
+	Pattern string
+	// Network сеть правила, если правило задано в формате CIDR или адресом
+	Network netip.Prefix
+}
+
+// parsePolicyRule разбирает правило: сеть в формате CIDR, отдельный адрес или шаблон имени хоста
+func parsePolicyRule(s string) (PolicyRule, error) {
+	if s == "" {
+		return PolicyRule{}, fmt.Errorf("empty policy rule")
+	}
+	rule := PolicyRule{Pattern: strings.ToLower(s)}
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		rule.Network = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(s); err == nil {
+		rule.Network = netip.PrefixFrom(addr, addr.BitLen())
+	} else if strings.ContainsAny(s, "/:") {
+		return PolicyRule{}, fmt.Errorf("policy rule %q is neither a host pattern nor a CIDR", s)
+	}
+	return rule, nil
+}
+
+// matches проверяет, подходит ли хост с адресами addrs под правило.
+// Для правила-сети all требует, чтобы в сеть попадали все адреса, иначе достаточно одного
+func (r *PolicyRule) matches(host string, addrs []netip.Addr, all bool) bool {
+	if !r.Network.IsValid() {
+		return matchHostPattern(r.Pattern, host)
+	}
+	if len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		contains := r.Network.Contains(addr.Unmap())
+		if all && !contains {
+			return false
+		}
+		if !all && contains {
+			return true
+		}
+	}
+	return all
+}
+
+// PolicyRuleFlag список правил политики доступа, задается повторяющимся флагом
+type PolicyRuleFlag []PolicyRule
+
+// String возвращает правила в формате флага
+func (f *PolicyRuleFlag) String() string {
+	var parts []string
+	for _, r := range *f {
+		parts = append(parts, r.Pattern)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set добавляет правило из значения флага
+func (f *PolicyRuleFlag) Set(s string) error {
+	rule, err := parsePolicyRule(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+// PolicyDecision решение политики доступа для url
+type PolicyDecision struct {
+	// Action PolicyAllow или PolicyDeny
+	Action string `json:"action"`
+	// Rule правило, по которому принято решение; пустое, если не подошло ни одно правило
+	Rule string `json:"rule,omitempty"`
+}
+
+// PolicyRuleHTTPSOnly правило, по которому запрещен запрос по http в режиме только https
+const PolicyRuleHTTPSOnly = "https_only"
+
+// HostPolicy политика доступа к хостам: запрещающие правила проверяются первыми,
+// а если заданы разрешающие, то запрашивать можно только подходящие под них хосты.
+// Правила-сети проверяются по адресам, в которые разрешается имя хоста.
+// В режиме только https запросы по http разрешены лишь к хостам из httpHosts.
+// nil-значение разрешает все
+type HostPolicy struct {
+	allow []PolicyRule
+	deny  []PolicyRule
+	// resolve нужно ли разрешать имена хостов (есть правила-сети)
+	resolve bool
+	// httpsOnly запрещать запросы по http
+	httpsOnly bool
+	// httpHosts шаблоны хостов, к которым в режиме только https можно обращаться по http
+	httpHosts []string
+	// resolver разрешает имена хостов для правил-сетей
+	resolver *DNSResolver
+}
+
+// NewHostPolicy создает политику из разрешающих и запрещающих правил и режима только https,
+// если ограничений нет, возвращает nil
+func NewHostPolicy(allow, deny []PolicyRule, httpsOnly bool, httpHosts []string, resolver *DNSResolver) *HostPolicy {
+	if len(allow) == 0 && len(deny) == 0 && !httpsOnly {
+		return nil
+	}
+	p := &HostPolicy{allow: allow, deny: deny, httpsOnly: httpsOnly, httpHosts: httpHosts, resolver: resolver}
+	for _, rule := range append(append([]PolicyRule(nil), allow...), deny...) {
+		if rule.Network.IsValid() {
+			p.resolve = true
+		}
+	}
+	return p
+}
+
+// Evaluate принимает решение о доступе к host
+func (p *HostPolicy) Evaluate(ctx context.Context, host string) PolicyDecision {
+	host = normalizeHost(host)
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr.Unmap()}
+	} else if p.resolve {
+		// если имя не разрешается, правила-сети не подходят, а запрос url завершится ошибкой dns_error
+		addrs, _ = p.resolver.LookupNetIP(ctx, host)
+	}
+
+	for _, rule := range p.deny {
+		if rule.matches(host, addrs, false) {
+			return PolicyDecision{Action: PolicyDeny, Rule: rule.Pattern}
+		}
+	}
+	if len(p.allow) == 0 {
+		return PolicyDecision{Action: PolicyAllow}
+	}
+	for _, rule := range p.allow {
+		if rule.matches(host, addrs, true) {
+			return PolicyDecision{Action: PolicyAllow, Rule: rule.Pattern}
+		}
+	}
+	return PolicyDecision{Action: PolicyDeny}
+}
+
+// Check проверяет доступ к хосту url, возвращает решение (nil, если политика не задана)
+// и ошибку ErrorCodeBlockedByPolicy, если доступ запрещен
+func (p *HostPolicy) Check(ctx context.Context, u *url.URL) (*PolicyDecision, error) {
+	if p == nil {
+		return nil, nil
+	}
+	// ftp, как и http, передает данные открыто
+	scheme := strings.ToLower(u.Scheme)
+	if p.httpsOnly && (scheme == "http" || scheme == SchemeFTP) && !matchAnyHostPattern(p.httpHosts, normalizeHost(u.Hostname())) {
+		decision := PolicyDecision{Action: PolicyDeny, Rule: PolicyRuleHTTPSOnly}
+		return &decision, &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Plain %s is not allowed for host %s, use https", scheme, u.Hostname())}
+	}
+	decision := p.Evaluate(ctx, u.Hostname())
+	if decision.Action == PolicyAllow {
+		return &decision, nil
+	}
+	if decision.Rule != "" {
+		return &decision, &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Host %s is denied by rule %q", u.Hostname(), decision.Rule)}
+	}
+	return &decision, &FetchError{Code: ErrorCodeBlockedByPolicy, Err: fmt.Errorf("Host %s is not in the allowlist", u.Hostname())}
+}
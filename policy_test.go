@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"*", "example.com", true},
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPattern(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHostPattern(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+// policyRules разбирает правила политики
+func policyRules(t *testing.T, rules ...string) []PolicyRule {
+	t.Helper()
+	var parsed []PolicyRule
+	for _, s := range rules {
+		rule, err := parsePolicyRule(s)
+		if err != nil {
+			t.Fatalf("parsePolicyRule(%q) error = %v", s, err)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed
+}
+
+func TestHostPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		allow     []string
+		deny      []string
+		httpsOnly bool
+		httpHosts []string
+		url       string
+		wantDeny  bool
+		// wantRule правило отказа, пустое - хоста нет среди разрешенных
+		wantRule string
+	}{
+		{name: "no matching deny rule", deny: []string{"evil.test"}, url: "http://example.com/"},
+		{name: "exact deny rule", deny: []string{"evil.test"}, url: "http://evil.test/", wantDeny: true, wantRule: "evil.test"},
+		{name: "deny rule matches case-insensitively", deny: []string{"evil.test"}, url: "http://EVIL.test/", wantDeny: true, wantRule: "evil.test"},
+		{name: "deny rule matches the fully qualified name", deny: []string{"evil.test"}, url: "http://evil.test./", wantDeny: true, wantRule: "evil.test"},
+		{name: "wildcard deny rule matches the fully qualified name", deny: []string{"*.evil.test"}, url: "http://www.evil.test./", wantDeny: true, wantRule: "*.evil.test"},
+		{name: "deny network", deny: []string{"10.0.0.0/8"}, url: "http://10.1.2.3/", wantDeny: true, wantRule: "10.0.0.0/8"},
+		{name: "deny wins over allow", allow: []string{"*.example.com"}, deny: []string{"admin.example.com"}, url: "https://admin.example.com/", wantDeny: true, wantRule: "admin.example.com"},
+		{name: "allowlisted host", allow: []string{"*.example.com"}, url: "https://www.example.com/"},
+		{name: "allowlisted fully qualified name", allow: []string{"example.com"}, url: "https://example.com./"},
+		{name: "host outside the allowlist", allow: []string{"*.example.com"}, url: "https://other.test/", wantDeny: true},
+		{name: "https only denies http", httpsOnly: true, url: "http://example.com/", wantDeny: true, wantRule: PolicyRuleHTTPSOnly},
+		{name: "https only allows https", httpsOnly: true, url: "https://example.com/"},
+		{name: "http host with https only", httpsOnly: true, httpHosts: []string{"example.com"}, url: "http://example.com/"},
+		{name: "fully qualified http host with https only", httpsOnly: true, httpHosts: []string{"example.com"}, url: "http://example.com./"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewHostPolicy(policyRules(t, tt.allow...), policyRules(t, tt.deny...), tt.httpsOnly, tt.httpHosts, nil)
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decision, err := policy.Check(context.Background(), u)
+			if !tt.wantDeny {
+				if err != nil {
+					t.Fatalf("Check(%s) error = %v", tt.url, err)
+				}
+				if decision.Action != PolicyAllow {
+					t.Errorf("Check(%s) action = %s, want %s", tt.url, decision.Action, PolicyAllow)
+				}
+				return
+			}
+			var fetchErr *FetchError
+			if !errors.As(err, &fetchErr) || fetchErr.Code != ErrorCodeBlockedByPolicy {
+				t.Fatalf("Check(%s) error = %v, want %s", tt.url, err, ErrorCodeBlockedByPolicy)
+			}
+			if decision.Action != PolicyDeny || decision.Rule != tt.wantRule {
+				t.Errorf("Check(%s) = %+v, want deny by %q", tt.url, *decision, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestHostPolicyNil(t *testing.T) {
+	if policy := NewHostPolicy(nil, nil, false, nil, nil); policy != nil {
+		t.Fatalf("NewHostPolicy() without rules = %+v, want nil", policy)
+	}
+	var policy *HostPolicy
+	u, _ := url.Parse("http://127.0.0.1/")
+	if decision, err := policy.Check(context.Background(), u); decision != nil || err != nil {
+		t.Errorf("nil policy Check() = %v, %v, want no decision", decision, err)
+	}
+}
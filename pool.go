@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DefaultWorkerPoolSize число url, запрашиваемых одновременно по всем запросам пользователей, по умолчанию
+const DefaultWorkerPoolSize = 128
+
+// poolBatch задачи одного запроса пользователя в пуле
+type poolBatch struct {
+	ctx context.Context
+	run func(task int)
+	// next номер следующей задачи, count число задач: задачи [next, count) ждут выполнения
+	next, count int
+	// running сколько задач выполняется, limit сколько их может выполняться одновременно
+	running, limit int
+	done           chan struct{}
+	closed         bool
+}
+
+// finish закрывает done, когда задач не осталось (вызывается под мьютексом пула)
+func (b *poolBatch) finish() {
+	if !b.closed && b.next == b.count && b.running == 0 {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// WorkerPool общий для всех запросов пользователей пул рабочих горутин: сколько бы запросов ни обрабатывалось,
+// одновременно запрашивается не больше size url. Каждый запрос при этом занимает не больше своего числа горутин,
+// а освободившаяся горутина берет задачу следующего по кругу запроса, поэтому небольшой запрос
+// не ждет, пока выполнятся все задачи большого, поступившего раньше. Под нагрузкой LoadShedder уменьшает
+// число одновременно выполняемых задач (см. setCapacity).
+// nil-значение запускает для каждого запроса свои горутины
+type WorkerPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// batches запросы, у которых есть ожидающие задачи, в порядке поступления
+	batches []*poolBatch
+	// turn номер в batches запроса, с которого начинается поиск следующей задачи
+	turn int
+	// size число рабочих горутин, capacity сколько из них может выполнять задачи (меньше size под нагрузкой),
+	// busy сколько выполняет
+	size, capacity, busy int
+}
+
+// NewWorkerPool создает пул из size рабочих горутин, при size <= 0 возвращает nil
+func NewWorkerPool(size int) *WorkerPool {
+	if size <= 0 {
+		return nil
+	}
+	p := &WorkerPool{size: size, capacity: size}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Run выполняет run для задач с номерами [0, count), не больше limit одновременно, и дожидается их завершения.
+// При отмене ctx еще не начатые задачи не выполняются, а начатые прерываются через свой контекст
+func (p *WorkerPool) Run(ctx context.Context, count, limit int, run func(task int)) {
+	if count == 0 {
+		return
+	}
+	if p == nil {
+		runOwnWorkers(ctx, count, limit, run)
+		return
+	}
+
+	b := &poolBatch{ctx: ctx, run: run, count: count, limit: max(limit, 1), done: make(chan struct{})}
+	p.mu.Lock()
+	p.batches = append(p.batches, b)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	// оставшиеся задачи выполнять уже не нужно, ждем только начатые
+	b.count = b.next
+	p.remove(b)
+	b.finish()
+	p.mu.Unlock()
+	<-b.done
+}
+
+// work выполняет задачи запросов, пока они есть, и ждет новых
+func (p *WorkerPool) work() {
+	p.mu.Lock()
+	for {
+		b := p.pick()
+		if b == nil {
+			p.cond.Wait()
+			continue
+		}
+		task := b.next
+		b.next++
+		b.running++
+		p.busy++
+		if b.next == b.count {
+			p.remove(b)
+		}
+		p.mu.Unlock()
+
+		if b.ctx.Err() == nil {
+			b.run(task)
+		}
+
+		p.mu.Lock()
+		b.running--
+		p.busy--
+		b.finish()
+		if b.next < b.count {
+			// запрос упирался в свое ограничение, его следующую задачу может взять другая горутина
+			p.cond.Signal()
+		}
+	}
+}
+
+// pick возвращает следующий по кругу запрос, задачу которого можно начать, или nil (вызывается под мьютексом)
+func (p *WorkerPool) pick() *poolBatch {
+	if p.busy >= p.capacity {
+		return nil
+	}
+	for i := range p.batches {
+		n := (p.turn + i) % len(p.batches)
+		if b := p.batches[n]; b.running < b.limit {
+			// следующую задачу начнет уже другой запрос
+			p.turn = n + 1
+			return b
+		}
+	}
+	return nil
+}
+
+// remove убирает запрос из очереди (вызывается под мьютексом)
+func (p *WorkerPool) remove(b *poolBatch) {
+	for i, other := range p.batches {
+		if other == b {
+			p.batches = append(p.batches[:i:i], p.batches[i+1:]...)
+			if i < p.turn {
+				// запросы после удаленного сдвинулись, следующий по кругу сдвигается вместе с ними
+				p.turn--
+			}
+			return
+		}
+	}
+}
+
+// Capacity возвращает, сколько задач пул может выполнять одновременно, для nil-значения - 0
+func (p *WorkerPool) Capacity() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.capacity
+}
+
+// setCapacity ограничивает число одновременно выполняемых задач значением capacity (от 1 до размера пула).
+// Уже начатые задачи не прерываются, новые не начинаются, пока выполняющихся не станет меньше capacity
+func (p *WorkerPool) setCapacity(capacity int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	capacity = min(max(capacity, 1), p.size)
+	if capacity > p.capacity {
+		p.cond.Broadcast()
+	}
+	p.capacity = capacity
+}
+
+// stats возвращает загрузку пула, для nil-значения - nil
+func (p *WorkerPool) stats() *PoolStats {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &PoolStats{Size: p.size, Capacity: p.capacity, Busy: p.busy, QueuedUrls: p.queued()}
+}
+
+// queued возвращает число задач, ждущих свободной горутины. Вызывается под p.mu
+func (p *WorkerPool) queued() int {
+	queued := 0
+	for _, b := range p.batches {
+		queued += b.count - b.next
+	}
+	return queued
+}
+
+// writeText выводит загрузку пула в текстовом формате Prometheus
+func (p *WorkerPool) writeText(w *metricsWriter) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP fetch_worker_pool_size Workers of the shared pool fetching urls of all requests.")
+	fmt.Fprintln(w, "# TYPE fetch_worker_pool_size gauge")
+	fmt.Fprintf(w, "fetch_worker_pool_size %d\n", p.size)
+	fmt.Fprintln(w, "# HELP fetch_worker_pool_capacity Urls the shared worker pool may fetch at the same time, lowered under load.")
+	fmt.Fprintln(w, "# TYPE fetch_worker_pool_capacity gauge")
+	fmt.Fprintf(w, "fetch_worker_pool_capacity %d\n", p.capacity)
+	fmt.Fprintln(w, "# HELP fetch_worker_pool_busy Workers of the shared pool fetching an url.")
+	fmt.Fprintln(w, "# TYPE fetch_worker_pool_busy gauge")
+	fmt.Fprintf(w, "fetch_worker_pool_busy %d\n", p.busy)
+	fmt.Fprintln(w, "# HELP fetch_worker_pool_queued_urls Urls waiting for a worker of the shared pool.")
+	fmt.Fprintln(w, "# TYPE fetch_worker_pool_queued_urls gauge")
+	fmt.Fprintf(w, "fetch_worker_pool_queued_urls %d\n", p.queued())
+}
+
+// runOwnWorkers выполняет задачи запроса в limit собственных горутинах
+func runOwnWorkers(ctx context.Context, count, limit int, run func(task int)) {
+	tasks := make(chan int, count) // список задач (номеров)
+	//список задач спокойно формируем синхронно
+	for i := 0; i < count; i++ {
+		tasks <- i
+	}
+	// все задачи сформированы, можно закрыть канал
+	close(tasks)
+
+	var wg sync.WaitGroup
+	// создаем рабочие горутины
+	for i := 0; i < max(limit, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case task, ok := <-tasks:
+					// канал закрыт, значит уже нет заданий и можно завершаться
+					if !ok {
+						return
+					}
+					run(task)
+
+				case <-ctx.Done():
+					// прекращаем работу
+					return
+				}
+			}
+		}()
+	}
+	// ждем завершения работающих горутин
+	wg.Wait()
+}
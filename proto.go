@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Простейшее кодирование protobuf для сообщений из proto/fetch.proto.
+// Для нескольких сообщений не стоит подключать модуль protobuf (см. «Зависимости» в README), поэтому они кодируются вручную
+
+// типы полей protobuf
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// errProtoMalformed сообщение protobuf не удалось разобрать
+var errProtoMalformed = errors.New("malformed protobuf message")
+
+// appendProtoVarint дописывает число в формате varint
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendProtoTag дописывает ключ поля: номер и тип
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendProtoVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendProtoBytes дописывает поле с байтовым содержимым (строка, байты, вложенное сообщение)
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendProtoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendProtoString дописывает строковое поле, пустые значения в proto3 не передаются
+func appendProtoString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(v))
+}
+
+// appendProtoInt дописывает целочисленное поле, нулевые значения в proto3 не передаются
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoVarint)
+	return appendProtoVarint(b, uint64(v))
+}
+
+// appendProtoBool дописывает логическое поле, false в proto3 не передается
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoInt(b, field, 1)
+}
+
+// appendProtoDouble дописывает поле типа double, нулевые значения в proto3 не передаются
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// appendProtoStringMap дописывает поле типа map<string, string>
+func appendProtoStringMap(b []byte, field int, m map[string]string) []byte {
+	// порядок ключей фиксируем, чтобы одинаковые результаты кодировались одинаково
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry []byte
+		entry = appendProtoString(entry, 1, k)
+		entry = appendProtoString(entry, 2, m[k])
+		b = appendProtoBytes(b, field, entry)
+	}
+	return b
+}
+
+// MarshalProto кодирует итоговый ответ в сообщение FetchResponse
+func (r ResultToUser) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, r.Error)
+	for _, res := range r.Responses {
+		b = appendProtoBytes(b, 2, res.MarshalProto())
+	}
+	b = appendProtoInt(b, 3, int64(r.Failed))
+	b = appendProtoBytes(b, 4, r.Summary.MarshalProto())
+	b = appendProtoString(b, 5, r.NextCursor)
+	b = appendProtoString(b, 6, r.ErrorCode)
+	if r.Diff != nil {
+		b = appendProtoBytes(b, 7, r.Diff.MarshalProto())
+	}
+	b = appendProtoString(b, 8, r.RequestID)
+	return b
+}
+
+// MarshalProto кодирует сравнение тел в сообщение BodyDiff
+func (d BodyDiff) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoBool(b, 1, d.Identical)
+	b = appendProtoInt(b, 2, d.SizeDelta)
+	b = appendProtoString(b, 3, d.Unified)
+	return b
+}
+
+// MarshalProto кодирует сводную статистику в сообщение Summary
+func (s Summary) MarshalProto() []byte {
+	var latency []byte
+	latency = appendProtoDouble(latency, 1, s.Latency.Min)
+	latency = appendProtoDouble(latency, 2, s.Latency.Max)
+	latency = appendProtoDouble(latency, 3, s.Latency.Mean)
+	latency = appendProtoDouble(latency, 4, s.Latency.P95)
+
+	var b []byte
+	b = appendProtoInt(b, 1, int64(s.Total))
+	b = appendProtoInt(b, 2, int64(s.Succeeded))
+	b = appendProtoInt(b, 3, int64(s.Failed))
+	b = appendProtoInt(b, 4, s.Bytes)
+	if len(latency) > 0 {
+		b = appendProtoBytes(b, 5, latency)
+	}
+	return b
+}
+
+// MarshalProto кодирует результат в сообщение UrlResult
+func (r UrlResult) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, r.Url)
+	if len(r.Response) > 0 {
+		b = appendProtoBytes(b, 2, r.Response)
+	}
+	b = appendProtoInt(b, 3, int64(r.StatusCode))
+	b = appendProtoStringMap(b, 4, r.Headers)
+	b = appendProtoInt(b, 5, r.ContentLength)
+	b = appendProtoString(b, 6, r.FinalUrl)
+	if r.Timing != nil {
+		b = appendProtoBytes(b, 7, r.Timing.MarshalProto())
+	}
+	b = appendProtoString(b, 8, r.Error)
+	b = appendProtoBool(b, 9, r.BodyTruncated)
+	b = appendProtoString(b, 10, r.SHA256)
+	b = appendProtoBool(b, 11, r.Deduplicated)
+	b = appendProtoInt(b, 12, int64(r.Index))
+	b = appendProtoInt(b, 13, int64(r.Attempts))
+	for _, hop := range r.Redirects {
+		b = appendProtoBytes(b, 14, hop.MarshalProto())
+	}
+	b = appendProtoString(b, 15, r.FallbackUrl)
+	b = appendProtoString(b, 16, r.ErrorCode)
+	if r.TLS != nil {
+		b = appendProtoBytes(b, 17, r.TLS.MarshalProto())
+	}
+	for _, cookie := range r.Cookies {
+		b = appendProtoBytes(b, 18, []byte(cookie))
+	}
+	b = appendProtoStringMap(b, 19, r.Trailers)
+	if r.Policy != nil {
+		b = appendProtoBytes(b, 20, r.Policy.MarshalProto())
+	}
+	b = appendProtoString(b, 21, r.Protocol)
+	b = appendProtoString(b, 22, r.RemoteAddr)
+	b = appendProtoBool(b, 23, r.NotModified)
+	if r.Freshness != nil {
+		b = appendProtoBytes(b, 24, r.Freshness.MarshalProto())
+	}
+	b = appendProtoBool(b, 25, r.Coalesced)
+	b = appendProtoInt(b, 26, r.CompressedLength)
+	b = appendProtoString(b, 27, r.Charset)
+	b = appendProtoInt(b, 28, r.FullLength)
+	b = appendProtoInt(b, 29, r.RetryAfterMs)
+	return b
+}
+
+// MarshalProto кодирует свежесть ответа в сообщение Freshness
+func (f Freshness) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, f.Source)
+	b = appendProtoInt(b, 2, f.LifetimeS)
+	b = appendProtoInt(b, 3, f.Expires.Unix())
+	b = appendProtoBool(b, 4, f.NoStore)
+	return b
+}
+
+// MarshalProto кодирует решение политики доступа в сообщение PolicyDecision
+func (d PolicyDecision) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, d.Action)
+	b = appendProtoString(b, 2, d.Rule)
+	return b
+}
+
+// MarshalProto кодирует параметры TLS в сообщение TLSInfo
+func (t TLSInfo) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, t.Version)
+	b = appendProtoString(b, 2, t.CipherSuite)
+	b = appendProtoString(b, 3, t.Subject)
+	b = appendProtoString(b, 4, t.Issuer)
+	b = appendProtoInt(b, 5, t.NotAfter.Unix())
+	return b
+}
+
+// MarshalProto кодирует перенаправление в сообщение RedirectHop
+func (h RedirectHop) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, h.Url)
+	b = appendProtoInt(b, 2, int64(h.StatusCode))
+	b = appendProtoString(b, 3, h.Location)
+	return b
+}
+
+// MarshalProto кодирует разбивку времени в сообщение UrlTiming
+func (t UrlTiming) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoDouble(b, 1, t.DNSLookup)
+	b = appendProtoDouble(b, 2, t.TCPConnect)
+	b = appendProtoDouble(b, 3, t.TLSHandshake)
+	b = appendProtoDouble(b, 4, t.TTFB)
+	b = appendProtoDouble(b, 5, t.Total)
+	b = appendProtoBool(b, 6, t.ConnReused)
+	return b
+}
+
+// UnmarshalProto разбирает сообщение FetchRequest, неизвестные поля пропускаются
+func (u *Urls) UnmarshalProto(b []byte) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoMalformed
+		}
+		b = b[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		switch wireType {
+		case protoVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoMalformed
+			}
+			b = b[n:]
+			switch field {
+			case 2:
+				failFast := v != 0
+				u.FailFast = &failFast
+			case 3:
+				u.TimeoutMs = int(int32(v))
+			case 4:
+				u.MaxBodySize = int64(v)
+			case 5:
+				u.TruncateBody = v != 0
+			case 7:
+				u.Probe = v != 0
+			case 8:
+				u.Dedupe = v != 0
+			case 9:
+				u.Ordered = v != 0
+			case 10:
+				u.Concurrency = int(int32(v))
+			case 12:
+				u.MaxTotalBytes = int64(v)
+			case 13:
+				u.IncludeCookies = v != 0
+			case 14:
+				u.Chunked = v != 0
+			case 15:
+				u.CookieJar = v != 0
+			case 16:
+				u.InsecureTLS = v != 0
+			case 18:
+				u.Conditional = v != 0
+			case 19:
+				u.CachedBody = v != 0
+			case 20:
+				u.KeepCharset = v != 0
+			case 21:
+				u.MaxBytes = int64(v)
+			case 22:
+				u.UseRange = v != 0
+			}
+
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errProtoMalformed
+			}
+			v := b[n : n+int(length)]
+			b = b[n+int(length):]
+			switch field {
+			case 1:
+				u.Urls = append(u.Urls, string(v))
+			case 6:
+				u.BodyMode = string(v)
+			case 11:
+				u.Priority = string(v)
+			case 17:
+				u.IPFamily = string(v)
+			}
+
+		case protoFixed64:
+			if len(b) < 8 {
+				return errProtoMalformed
+			}
+			b = b[8:]
+
+		case protoFixed32:
+			if len(b) < 4 {
+				return errProtoMalformed
+			}
+			b = b[4:]
+
+		default:
+			return errProtoMalformed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// protoField поле разобранного сообщения protobuf
+type protoField struct {
+	field  int
+	varint uint64
+	bytes  []byte
+}
+
+// parseProto разбирает поля сообщения protobuf с типами varint, fixed64 и bytes
+func parseProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("malformed key in %x", b)
+		}
+		b = b[n:]
+		f := protoField{field: int(key >> 3)}
+		switch key & 7 {
+		case protoVarint:
+			if f.varint, n = binary.Uvarint(b); n <= 0 {
+				t.Fatalf("malformed varint in %x", b)
+			}
+			b = b[n:]
+		case protoFixed64:
+			f.varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				t.Fatalf("malformed length in %x", b)
+			}
+			f.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestAppendProtoVarint(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want string
+	}{
+		{0, "00"},
+		{1, "01"},
+		{127, "7f"},
+		{300, "ac02"},
+		{math.MaxUint64, "ffffffffffffffffff01"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(appendProtoVarint(nil, tt.v)); got != tt.want {
+			t.Errorf("appendProtoVarint(%d) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalProto(t *testing.T) {
+	results := ResultToUser{
+		Responses: []UrlResult{
+			{Index: 0, Url: "http://example.test/0", Response: []byte("body"), StatusCode: 200, Headers: map[string]string{"B": "2", "A": "1"}},
+			{Index: 1, Url: "http://example.test/1", Error: "unexpected_status: 503", ErrorCode: ErrorCodeUnexpectedStatus},
+		},
+		Failed:  1,
+		Summary: Summary{Total: 2, Succeeded: 1, Failed: 1, Latency: LatencySummary{Max: 1.5}},
+	}
+	fields := parseProto(t, results.MarshalProto())
+	// пустые error, next_cursor, error_code и request_id в proto3 не передаются
+	var got []int
+	for _, f := range fields {
+		got = append(got, f.field)
+	}
+	if want := []int{2, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("FetchResponse fields = %v, want %v", got, want)
+	}
+	if fields[2].varint != 1 {
+		t.Errorf("failed = %d, want 1", fields[2].varint)
+	}
+
+	first := parseProto(t, fields[0].bytes)
+	want := []protoField{
+		{field: 1, bytes: []byte("http://example.test/0")},
+		{field: 2, bytes: []byte("body")},
+		{field: 3, varint: 200},
+		// заголовки упорядочены по ключу
+		{field: 4, bytes: appendProtoString(appendProtoString(nil, 1, "A"), 2, "1")},
+		{field: 4, bytes: appendProtoString(appendProtoString(nil, 1, "B"), 2, "2")},
+	}
+	if !reflect.DeepEqual(first, want) {
+		t.Errorf("first UrlResult = %+v, want %+v", first, want)
+	}
+	second := parseProto(t, fields[1].bytes)
+	if len(second) != 4 || second[1].field != 8 || second[2].field != 12 || second[2].varint != 1 || string(second[3].bytes) != ErrorCodeUnexpectedStatus {
+		t.Errorf("second UrlResult = %+v", second)
+	}
+
+	summary := parseProto(t, fields[3].bytes)
+	latency := parseProto(t, summary[len(summary)-1].bytes)
+	if len(latency) != 1 || latency[0].field != 2 || math.Float64frombits(latency[0].varint) != 1.5 {
+		t.Errorf("latency = %+v, want only max 1.5", latency)
+	}
+}
+
+func TestUrlsUnmarshalProto(t *testing.T) {
+	var b []byte
+	b = appendProtoString(b, 1, "http://example.test/0")
+	b = appendProtoString(b, 1, "http://example.test/1")
+	// fail_fast: false передается явно, иначе действует значение по умолчанию
+	b = appendProtoVarint(appendProtoTag(b, 2, protoVarint), 0)
+	b = appendProtoInt(b, 3, 1500)
+	b = appendProtoString(b, 6, BodyModeHash)
+	b = appendProtoBool(b, 9, true)
+	// неизвестные поля всех типов пропускаются
+	b = appendProtoInt(b, 100, 1)
+	b = appendProtoDouble(b, 101, 1.5)
+	b = appendProtoString(b, 102, "unknown")
+	b = binary.LittleEndian.AppendUint32(appendProtoTag(b, 103, protoFixed32), 1)
+
+	var got Urls
+	if err := got.UnmarshalProto(b); err != nil {
+		t.Fatalf("UnmarshalProto() error = %v", err)
+	}
+	failFast := false
+	want := Urls{
+		Urls:      []string{"http://example.test/0", "http://example.test/1"},
+		FailFast:  &failFast,
+		TimeoutMs: 1500,
+		BodyMode:  BodyModeHash,
+		Ordered:   true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UnmarshalProto() = %+v, want %+v", got, want)
+	}
+}
+
+func TestUrlsUnmarshalProtoMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "truncated key", b: []byte{0x80}},
+		{name: "truncated varint", b: []byte{0x10, 0x80}},
+		{name: "length past the end", b: []byte{0x0a, 0x05, 'a'}},
+		{name: "truncated fixed64", b: []byte{0x09, 1, 2}},
+		{name: "truncated fixed32", b: []byte{0x0d, 1}},
+		{name: "group wire type", b: []byte{0x0b}},
+	}
+	for _, tt := range tests {
+		var u Urls
+		if err := u.UnmarshalProto(tt.b); err != errProtoMalformed {
+			t.Errorf("UnmarshalProto() of %s error = %v, want %v", tt.name, err, errProtoMalformed)
+		}
+	}
+}
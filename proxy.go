@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyDirect значение прокси, означающее соединение без прокси
+const ProxyDirect = "direct"
+
+// proxyDefaultPorts порты прокси по умолчанию для поддерживаемых схем
+var proxyDefaultPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// HostProxy прокси для хостов, подходящих под Pattern
+type HostProxy struct {
+	Pattern string
+	// URL адрес прокси (логин и пароль для аутентификации задаются в нем же), nil - соединение без прокси
+	URL *url.URL
+}
+
+// parseHostProxy разбирает прокси в формате [host=]url или [host=]direct, без хоста прокси используется для всех
+func parseHostProxy(s string) (HostProxy, error) {
+	pattern, rawUrl, ok := strings.Cut(s, "=")
+	// в шаблоне хоста не бывает ':' и '/', значит '=' относится к url (например, к паролю)
+	if !ok || strings.ContainsAny(pattern, ":/") {
+		pattern, rawUrl = "*", s
+	}
+	// значение не выводится в ошибках целиком: в нем может быть пароль
+	if pattern == "" || rawUrl == "" {
+		return HostProxy{}, fmt.Errorf("proxy must look like [host=]url")
+	}
+	proxy := HostProxy{Pattern: strings.ToLower(pattern)}
+	if rawUrl == ProxyDirect {
+		return proxy, nil
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return HostProxy{}, fmt.Errorf("invalid proxy url for %s", pattern)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := proxyDefaultPorts[u.Scheme]; !ok || u.Hostname() == "" {
+		return HostProxy{}, fmt.Errorf("proxy %q must be an http, https, socks5 or socks5h url", u.Redacted())
+	}
+	u.Host = strings.ToLower(u.Host)
+	proxy.URL = u
+	return proxy, nil
+}
+
+// String возвращает прокси в формате флага, пароль скрывается
+func (p HostProxy) String() string {
+	if p.URL == nil {
+		return p.Pattern + "=" + ProxyDirect
+	}
+	return p.Pattern + "=" + p.URL.Redacted()
+}
+
+// address возвращает адрес прокси (host:port), с которым соединяется транспорт
+func (p HostProxy) address() string {
+	port := p.URL.Port()
+	if port == "" {
+		port = proxyDefaultPorts[p.URL.Scheme]
+	}
+	return net.JoinHostPort(p.URL.Hostname(), port)
+}
+
+// ProxyFlag список прокси, задается повторяющимся флагом; прокси с одинаковым хостом образуют пул
+type ProxyFlag []HostProxy
+
+// String возвращает прокси в формате флага
+func (f *ProxyFlag) String() string {
+	var parts []string
+	for _, p := range *f {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set добавляет прокси из значения флага
+func (f *ProxyFlag) Set(s string) error {
+	proxy, err := parseHostProxy(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, proxy)
+	return nil
+}
+
+// Стратегии выбора прокси из пула
+const (
+	// ProxyRoundRobin прокси пула используются по очереди (по умолчанию)
+	ProxyRoundRobin = "round_robin"
+	// ProxyLeastErrors используется прокси с наименьшим числом ошибок, при равенстве - с наименьшим числом запросов
+	ProxyLeastErrors = "least_errors"
+)
+
+const (
+	// ProxyFailures число ошибок подряд, после которого прокси временно не используется
+	ProxyFailures = 3
+	// ProxyCoolDown время, на которое прокси перестает использоваться
+	ProxyCoolDown = 30 * time.Second
+)
+
+// poolProxy прокси пула и статистика запросов через него
+type poolProxy struct {
+	// url адрес прокси, nil - соединение без прокси
+	url      *url.URL
+	requests int64
+	errors   int64
+	// failures число ошибок подряд
+	failures int
+	// downUntil до какого момента прокси не используется
+	downUntil time.Time
+}
+
+// name возвращает адрес прокси без пароля для вывода в лог
+func (p *poolProxy) name() string {
+	if p.url == nil {
+		return ProxyDirect
+	}
+	return p.url.Redacted()
+}
+
+// proxyPool прокси, заданные для одного шаблона хостов
+type proxyPool struct {
+	pattern string
+	proxies []*poolProxy
+	// next номер прокси, с которого начинается выбор по очереди
+	next int
+}
+
+// proxyChoiceKey ключ в контексте запроса, по которому сохраняется выбранный для запроса прокси
+type proxyChoiceKey struct{}
+
+// ProxyRotator выбирает прокси для запросов. Прокси с одинаковым шаблоном хостов образуют пул, для хоста
+// используется пул первого подходящего шаблона, а прокси в нем выбираются по стратегии.
+// Прокси, запросы через который ProxyFailures раз подряд завершились ошибкой, не используется ProxyCoolDown,
+// пока в пуле есть работающие. nil-значение - прокси берется из переменных окружения
+type ProxyRotator struct {
+	strategy string
+	// guard проверяет хосты, запрашиваемые через прокси
+	guard *dialGuard
+
+	mu    sync.Mutex
+	pools []*proxyPool
+}
+
+// NewProxyRotator создает ProxyRotator для прокси proxies, хосты запросов через прокси проверяются guard.
+// Если прокси не заданы, возвращает nil
+func NewProxyRotator(proxies []HostProxy, strategy string, guard *dialGuard) *ProxyRotator {
+	if len(proxies) == 0 {
+		return nil
+	}
+	r := &ProxyRotator{strategy: strategy, guard: guard}
+	pools := make(map[string]*proxyPool)
+	for _, p := range proxies {
+		pool := pools[p.Pattern]
+		if pool == nil {
+			pool = &proxyPool{pattern: p.Pattern}
+			pools[p.Pattern] = pool
+			r.pools = append(r.pools, pool)
+		}
+		pool.proxies = append(pool.proxies, &poolProxy{url: p.URL})
+	}
+	return r
+}
+
+// ParseProxyRotation проверяет название стратегии выбора прокси
+func ParseProxyRotation(s string) (string, error) {
+	switch s {
+	case ProxyRoundRobin, ProxyLeastErrors:
+		return s, nil
+	}
+	return "", fmt.Errorf("proxy rotation must be %s or %s", ProxyRoundRobin, ProxyLeastErrors)
+}
+
+// choose выбирает прокси для host, nil - для хоста прокси не задан
+func (r *ProxyRotator) choose(host string) *poolProxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, pool := range r.pools {
+		if !matchHostPattern(pool.pattern, host) {
+			continue
+		}
+		now := time.Now()
+		var chosen *poolProxy
+		// сначала выбираем среди работающих прокси, если таких нет - среди всех
+		for _, anyState := range []bool{false, true} {
+			for i := range pool.proxies {
+				n := (pool.next + i) % len(pool.proxies)
+				p := pool.proxies[n]
+				if !anyState && now.Before(p.downUntil) {
+					continue
+				}
+				if r.strategy == ProxyLeastErrors {
+					if chosen == nil || p.errors < chosen.errors || p.errors == chosen.errors && p.requests < chosen.requests {
+						chosen = p
+					}
+					continue
+				}
+				chosen = p
+				pool.next = n + 1
+				break
+			}
+			if chosen != nil {
+				break
+			}
+		}
+		chosen.requests++
+		return chosen
+	}
+	return nil
+}
+
+// record учитывает результат запроса через прокси p
+func (r *ProxyRotator) record(p *poolProxy, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !failed {
+		if p.failures >= ProxyFailures {
+			slog.Info("Proxy is working again", "proxy", p.name())
+		}
+		p.failures = 0
+		p.downUntil = time.Time{}
+		return
+	}
+	p.errors++
+	p.failures++
+	if p.failures >= ProxyFailures {
+		if p.failures == ProxyFailures || !time.Now().Before(p.downUntil) {
+			slog.Warn("Proxy failed too many times in a row, not using it for a while", "proxy", p.name(), "failures", p.failures, "cooldown", ProxyCoolDown)
+		}
+		p.downUntil = time.Now().Add(ProxyCoolDown)
+	}
+}
+
+// proxy выбирает прокси для запроса, используется как http.Transport.Proxy.
+// Соединение с прокси не проверяется dialGuard, поэтому внутренние адреса в url запроса проверяются здесь
+func (r *ProxyRotator) proxy(req *http.Request) (*url.URL, error) {
+	p := r.choose(normalizeHost(req.URL.Hostname()))
+	if p == nil {
+		return nil, nil
+	}
+	if p.url != nil {
+		if err := r.guard.checkProxyTarget(req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	if choice, ok := req.Context().Value(proxyChoiceKey{}).(**poolProxy); ok {
+		*choice = p
+	}
+	return p.url, nil
+}
+
+// dialContext возвращает функцию установки соединений для транспорта: с прокси соединяется direct,
+// без проверки адреса (прокси задан при запуске и обычно находится во внутренней сети),
+// с остальными адресами - guarded
+func (r *ProxyRotator) dialContext(guarded dialFunc, direct *net.Dialer) dialFunc {
+	addrs := make(map[string]bool)
+	for _, pool := range r.pools {
+		for _, p := range pool.proxies {
+			if p.url != nil {
+				addrs[HostProxy{URL: p.url}.address()] = true
+			}
+		}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addrs[strings.ToLower(addr)] {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return guarded(ctx, network, addr)
+	}
+}
+
+// proxyTransport учитывает результаты запросов через прокси, выбранные ProxyRotator
+type proxyTransport struct {
+	base    http.RoundTripper
+	rotator *ProxyRotator
+}
+
+// RoundTrip выполняет запрос через base. Ошибкой прокси считается ошибка запроса
+// или ответ 407 (прокси не принял логин и пароль)
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var chosen *poolProxy
+	req = req.WithContext(context.WithValue(req.Context(), proxyChoiceKey{}, &chosen))
+	resp, err := t.base.RoundTrip(req)
+	// прокси direct не отслеживается, а отмененный запрос ничего не говорит о прокси
+	if chosen != nil && chosen.url != nil && req.Context().Err() == nil {
+		t.rotator.record(chosen, err != nil || resp.StatusCode == http.StatusProxyAuthRequired)
+	}
+	return resp, err
+}
+
+// CloseIdleConnections закрывает простаивающие соединения base
+func (t *proxyTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
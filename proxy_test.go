@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxyChooseFullyQualifiedHost(t *testing.T) {
+	proxy, err := parseHostProxy("internal.test=http://proxy.test:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator := NewProxyRotator([]HostProxy{proxy}, ProxyRoundRobin, &dialGuard{})
+	for _, target := range []string{"http://internal.test/", "http://INTERNAL.test./"} {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		got, err := rotator.proxy(req)
+		if err != nil || got == nil || got.Host != "proxy.test:3128" {
+			t.Errorf("proxy(%s) = %v, %v, want proxy.test:3128", target, got, err)
+		}
+	}
+}
+
+func TestProxyBlocksInternalTargets(t *testing.T) {
+	var proxied atomic.Int64
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		rw.Write([]byte("proxied"))
+	}))
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	fetcher := NewFetcher(FetcherConfig{
+		Proxies:       []HostProxy{{Pattern: "*", URL: proxyUrl}},
+		ProxyRotation: ProxyRoundRobin,
+	})
+
+	tests := []struct {
+		url         string
+		wantBlocked bool
+	}{
+		{url: "http://169.254.169.254/latest/meta-data/", wantBlocked: true},
+		{url: "http://127.0.0.1:8080/", wantBlocked: true},
+		{url: "http://[::1]/", wantBlocked: true},
+		{url: "http://[::ffff:10.0.0.1]/", wantBlocked: true},
+		{url: "http://localhost/", wantBlocked: true},
+		{url: "http://admin.localhost./", wantBlocked: true},
+		{url: "http://2130706433/", wantBlocked: true},
+		{url: "http://0x7f.1/", wantBlocked: true},
+		{url: "http://example.test/"},
+		{url: "http://203.0.113.10/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			before := proxied.Load()
+			_, err := fetcher.backend.Fetch(context.Background(), UrlRequest{Url: tt.url}, FetchOptions{})
+			var fetchErr *FetchError
+			blocked := errors.As(err, &fetchErr) && fetchErr.Code == ErrorCodeBlockedByPolicy
+			if blocked != tt.wantBlocked {
+				t.Fatalf("Fetch(%s) error = %v, want blocked %v", tt.url, err, tt.wantBlocked)
+			}
+			if sent := proxied.Load() != before; sent == tt.wantBlocked {
+				t.Errorf("request to %s sent to the proxy = %v", tt.url, sent)
+			}
+		})
+	}
+}
+
+func TestCheckProxyTargetAllowedNetwork(t *testing.T) {
+	guard := &dialGuard{allowed: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}}
+	for _, host := range []string{"127.0.0.1", "localhost", "::1"} {
+		if err := guard.checkProxyTarget(host); err != nil {
+			t.Errorf("checkProxyTarget(%s) error = %v with loopback allowed", host, err)
+		}
+	}
+	if err := guard.checkProxyTarget("10.0.0.1"); err == nil {
+		t.Error("checkProxyTarget(10.0.0.1) allowed a network outside -allow-network")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// rangeHeader возвращает значение заголовка Range для первых n байт тела
+func rangeHeader(n int64) string {
+	return "bytes=0-" + strconv.FormatInt(n-1, 10)
+}
+
+// contentRangeTotal возвращает полный размер тела из заголовка Content-Range ответа 206
+// (например, "bytes 0-99/12345"), -1 - размер неизвестен
+func contentRangeTotal(header string) int64 {
+	unit, resp, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(unit, "bytes") {
+		return -1
+	}
+	_, total, ok := strings.Cut(resp, "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
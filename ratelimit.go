@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedHosts число хостов, после которого из учета удаляются хосты с полным запасом запросов
+const maxRateLimitedHosts = 10000
+
+// RateLimit ограничение частоты запросов к хостам, подходящим под Pattern
+type RateLimit struct {
+	// Pattern хост ("example.com"), все его поддомены ("*.example.com") или все хосты ("*")
+	Pattern string
+	// Rate число запросов в секунду
+	Rate float64
+	// Burst сколько запросов можно выполнить подряд без ожидания
+	Burst int
+}
+
+// parseRateLimit разбирает ограничение вида pattern=rate или pattern=rate/burst
+func parseRateLimit(s string) (RateLimit, error) {
+	pattern, value, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" {
+		return RateLimit{}, fmt.Errorf("rate limit %q must look like host=rate or host=rate/burst", s)
+	}
+	limit := RateLimit{Pattern: strings.ToLower(pattern)}
+	rate, burst, hasBurst := strings.Cut(value, "/")
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil || limit.Rate <= 0 || math.IsInf(limit.Rate, 0) {
+		return RateLimit{}, fmt.Errorf("rate limit %q: rate must be a positive number", s)
+	}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("rate limit %q: burst must be a positive integer", s)
+		}
+	} else {
+		// без явного значения разрешаем подряд столько запросов, сколько приходится на секунду
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+	return limit, nil
+}
+
+// matches проверяет, подходит ли host под шаблон ограничения
+func (l *RateLimit) matches(host string) bool {
+	return matchHostPattern(l.Pattern, host)
+}
+
+// RateLimitFlag список ограничений частоты запросов, задается повторяющимся флагом
+type RateLimitFlag []RateLimit
+
+// String возвращает ограничения в формате флага
+func (f *RateLimitFlag) String() string {
+	var parts []string
+	for _, l := range *f {
+		parts = append(parts, fmt.Sprintf("%s=%g/%d", l.Pattern, l.Rate, l.Burst))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set добавляет ограничение из значения флага
+func (f *RateLimitFlag) Set(s string) error {
+	limit, err := parseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, limit)
+	return nil
+}
+
+// tokenBucket запас запросов к одному хосту: пополняется со скоростью rate, но не больше burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill пополняет запас на момент now
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// HostRateLimiter ограничивает частоту запросов к каждому хосту отдельно.
+// Для хоста действует первое подходящее под него ограничение, хосты без ограничения не учитываются.
+// nil-значение ничего не ограничивает
+type HostRateLimiter struct {
+	limits []RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewHostRateLimiter создает HostRateLimiter, без ограничений возвращает nil
+func NewHostRateLimiter(limits []RateLimit) *HostRateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &HostRateLimiter{limits: limits, buckets: make(map[string]*tokenBucket)}
+}
+
+// Wait дожидается, когда можно будет выполнить запрос к host.
+// Возвращает ошибку контекста, если ожидание прервано отменой ctx
+func (l *HostRateLimiter) Wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	delay, ok := l.reserve(host)
+	if !ok || delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// запрос не выполнен, возвращаем занятое им место
+		l.mu.Lock()
+		if b := l.buckets[host]; b != nil {
+			b.tokens = math.Min(b.burst, b.tokens+1)
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// reserve занимает место для запроса к host и возвращает, сколько ждать до его выполнения.
+// false означает, что для хоста нет ограничения
+func (l *HostRateLimiter) reserve(host string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.buckets[host]
+	if b == nil {
+		var limit *RateLimit
+		for i := range l.limits {
+			if l.limits[i].matches(host) {
+				limit = &l.limits[i]
+				break
+			}
+		}
+		if limit == nil {
+			return 0, false
+		}
+		if len(l.buckets) >= maxRateLimitedHosts {
+			l.removeIdle(now)
+		}
+		b = &tokenBucket{rate: limit.Rate, burst: float64(limit.Burst), tokens: float64(limit.Burst), last: now}
+		l.buckets[host] = b
+	}
+	b.refill(now)
+	// запас может уйти в минус: это очередь уже занятых мест
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), true
+}
+
+// removeIdle удаляет хосты, запас которых полностью восстановился (вызывается под мьютексом)
+func (l *HostRateLimiter) removeIdle(now time.Time) {
+	for host, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(l.buckets, host)
+		}
+	}
+}
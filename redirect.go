@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// MaxRedirects максимальное число перенаправлений, по которым сервер переходит при запросе одного url
+const MaxRedirects = 10
+
+// RedirectPolicy параметры перехода по перенаправлениям
+type RedirectPolicy struct {
+	// Follow переходить ли по перенаправлениям (по умолчанию да)
+	Follow *bool `json:"follow,omitempty"`
+	// Max максимальное число перенаправлений, ограничивается сверху MaxRedirects
+	Max int `json:"max,omitempty"`
+}
+
+// Validate проверяет параметры перенаправлений.
+// Текст возвращаемой ошибки предназначен для пользователя
+func (p *RedirectPolicy) Validate() error {
+	if p.Max < 0 {
+		return errors.New("Max redirects must not be negative")
+	}
+	return nil
+}
+
+// maxRedirects возвращает разрешенное число перенаправлений с учетом ограничений сервера, 0 - не переходить
+func (p *RedirectPolicy) maxRedirects() int {
+	if p == nil {
+		return MaxRedirects
+	}
+	if p.Follow != nil && !*p.Follow {
+		return 0
+	}
+	if p.Max > 0 && p.Max < MaxRedirects {
+		return p.Max
+	}
+	return MaxRedirects
+}
+
+// RedirectHop одно перенаправление: url, с которого оно пришло, код ответа и url, на который оно указывает
+type RedirectHop struct {
+	Url        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	// Location абсолютный url перехода (относительный Location разрешается относительно Url)
+	Location string `json:"location"`
+}
+
+// redirectRecorder записывает цепочку перенаправлений и ограничивает их число
+type redirectRecorder struct {
+	max  int
+	hops []RedirectHop
+	// policy политика доступа, которой должен соответствовать и url перенаправления
+	policy *HostPolicy
+}
+
+// CheckRedirect вызывается http.Client перед переходом по очередному перенаправлению
+func (r *redirectRecorder) CheckRedirect(req *http.Request, via []*http.Request) error {
+	// req.Response - ответ с перенаправлением, из-за которого делается req
+	if req.Response != nil {
+		r.hops = append(r.hops, RedirectHop{
+			Url:        req.Response.Request.URL.String(),
+			StatusCode: req.Response.StatusCode,
+			Location:   req.URL.String(),
+		})
+	}
+	if r.max == 0 {
+		// не переходим, пользователь получит сам ответ с перенаправлением
+		r.hops = r.hops[:len(r.hops)-1]
+		return http.ErrUseLastResponse
+	}
+	if len(via) > r.max {
+		return fmt.Errorf("stopped after %d redirects", r.max)
+	}
+	_, err := r.policy.Check(req.Context(), req.URL)
+	return err
+}
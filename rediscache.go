@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// redisKeyPrefix префикс ключей ответов в Redis, чтобы они не пересекались с ключами других сервисов
+	redisKeyPrefix = "fetch:response:"
+	// redisTimeout максимальное время одной команды Redis вместе с установкой соединения
+	redisTimeout = 2 * time.Second
+	// maxIdleRedisConns сколько простаивающих соединений с Redis хранится для повторного использования
+	maxIdleRedisConns = 16
+)
+
+// redisError ошибка, которую вернул сам Redis
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn соединение с Redis
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// RedisCache хранилище ответов в Redis: общее для всех экземпляров сервиса, поэтому ответ,
+// сохраненный одним экземпляром, используется для условных запросов всеми
+type RedisCache struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+
+	// idle простаивающие соединения
+	idle chan *redisConn
+}
+
+// NewRedisCache создает хранилище по адресу вида redis://[[user]:password@]host[:port][/db]
+// (rediss:// - соединение по TLS)
+func NewRedisCache(rawUrl string) (*RedisCache, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, errors.New("redis cache address must look like redis://[:password@]host[:port][/db]")
+	}
+	c := &RedisCache{
+		addr:   u.Host,
+		useTLS: u.Scheme == "rediss",
+		idle:   make(chan *redisConn, maxIdleRedisConns),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Get возвращает сохраненный ответ по ключу
+func (c *RedisCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	reply, err := c.do(ctx, "GET", redisKeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply to GET")
+	}
+	var resp CachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Set сохраняет ответ по ключу на время ttl
+func (c *RedisCache) Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "SET", redisKeyPrefix+key, string(data), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+// Ping проверяет, что Redis доступен
+func (c *RedisCache) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "PING")
+	return err
+}
+
+// do выполняет команду и возвращает ответ: nil, string, int64, []byte или []any
+func (c *RedisCache) do(ctx context.Context, args ...string) (any, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// после сетевой ошибки состояние соединения неизвестно
+		conn.conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return reply, err
+}
+
+// conn возвращает простаивающее соединение или устанавливает новое
+func (c *RedisCache) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		tlsConn := tls.Client(netConn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+	conn := &redisConn{conn: netConn, r: bufio.NewReader(netConn)}
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.do(ctx, args...); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// do отправляет команду в формате RESP (массив строк) и читает ответ
+func (c *redisConn) do(ctx context.Context, args ...string) (any, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+	cmd := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		cmd = append(cmd, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		cmd = append(cmd, arg+"\r\n"...)
+	}
+	if _, err := c.conn.Write(cmd); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply читает один ответ Redis
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: malformed reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			// $-1 - значения нет
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("redis: malformed reply")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	// RequestIDHeader заголовок с идентификатором запроса для сопоставления обращений в поддержку с логами
+	RequestIDHeader = "X-Request-ID"
+	// MaxRequestIDLength максимальная длина идентификатора запроса, присланного клиентом
+	MaxRequestIDLength = 128
+)
+
+// requestIDKey и clientIPKey ключи идентификатора запроса и адреса клиента в контексте
+type requestIDKey struct{}
+type clientIPKey struct{}
+
+// HandleRequestID принимает идентификатор запроса из заголовка X-Request-ID (или создает новый),
+// возвращает его в заголовке ответа и передает следующему хэндлеру h в контексте запроса
+func HandleRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		rw.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID возвращает идентификатор запроса из контекста, пустую строку - если его нет
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// HandleClientIP определяет адрес клиента и передает его следующему хэндлеру h в контексте запроса.
+// Адресом клиента считается адрес, с которого установлено соединение, а если он из доверенных сетей trusted
+// (балансировщики и прокси перед сервером) - последний адрес в X-Forwarded-For не из доверенных сетей
+func HandleClientIP(trusted []netip.Prefix, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, clientIP(r, trusted))))
+	})
+}
+
+// ClientIP возвращает адрес клиента из контекста, пустую строку - если его нет
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// clientIP возвращает адрес клиента запроса r с учетом доверенных сетей trusted (см. HandleClientIP)
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedAddr(host, trusted) {
+		return host
+	}
+	// каждый прокси дописывает в конец адрес, от которого получил запрос, поэтому идем с конца,
+	// пока адреса доверенные: первый недоверенный адрес добавлен нашим прокси и подделан быть не может
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(addr); err != nil {
+			// мусор в заголовке: дальше верить ему нельзя
+			break
+		}
+		host = addr
+		if !trustedAddr(addr, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedAddr проверяет, что адрес addr входит в одну из сетей trusted
+func trustedAddr(addr string, trusted []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validRequestID проверяет идентификатор от клиента: непустой, не слишком длинный, только видимые символы ASCII,
+// чтобы его можно было без опаски писать в логи и заголовки
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID создает случайный идентификатор запроса в формате UUID версии 4
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// без источника случайности работать дальше нельзя
+		panic(err)
+	}
+	id[6] = id[6]&0x0f | 0x40 // версия 4
+	id[8] = id[8]&0x3f | 0x80 // вариант RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
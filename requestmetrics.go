@@ -0,0 +1,153 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Исходы обработки запроса пользователя в метриках, помимо кодов ошибок (см. ErrorCode)
+const (
+	OutcomeOK          = "ok"
+	OutcomeInterrupted = "interrupted"
+)
+
+// batchSizeBuckets границы гистограммы числа url в запросе
+var batchSizeBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// fetchBuckets границы гистограммы длительности запроса url (с повторами и запасными url), в секундах
+var fetchBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// RequestMetrics метрики обработки запросов пользователей (http, gRPC и заданий) и их url: сколько запросов
+// обработано и с каким исходом, сколько в них url, сколько длились запросы url, чем завершились и сколько
+// байт получено. Если арендаторы определяются (см. HandleTenant), счетчики учитываются по арендаторам.
+// nil-значение ничего не учитывает
+type RequestMetrics struct {
+	mu sync.Mutex
+	// requests обработанные запросы по арендатору и исходу: OutcomeOK, OutcomeInterrupted или код ошибки
+	requests  map[tenantOutcome]uint64
+	batchSize *histogram
+	// urls обработанные url по арендатору и исходу: OutcomeOK или код ошибки
+	urls     map[tenantOutcome]uint64
+	duration *histogram
+	// bytes размер полученных тел ответов по арендаторам
+	bytes map[string]uint64
+}
+
+// tenantOutcome арендатор (пустой - арендаторы не определяются) и исход
+type tenantOutcome struct {
+	tenant, outcome string
+}
+
+// NewRequestMetrics создает пустые метрики
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{
+		requests:  make(map[tenantOutcome]uint64),
+		batchSize: newHistogram(batchSizeBuckets),
+		urls:      make(map[tenantOutcome]uint64),
+		duration:  newHistogram(fetchBuckets),
+		bytes:     make(map[string]uint64),
+	}
+}
+
+// observeRequest учитывает обработанный запрос ctx из urls url: interrupted - причина, по которой итог
+// не отправлен (пользователь ушел или ответ не записать), resultErr - ошибка, с которой отправлен итог
+func (m *RequestMetrics) observeRequest(ctx context.Context, urls int, interrupted, resultErr error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[tenantOutcome{Tenant(ctx), requestOutcome(interrupted, resultErr)}]++
+	m.batchSize.observeExemplar(float64(urls), RequestID(ctx))
+}
+
+// requestOutcome возвращает исход обработки запроса: OutcomeInterrupted, если итог не отправлен из-за interrupted,
+// код ошибки resultErr, с которой он отправлен, или OutcomeOK
+func requestOutcome(interrupted, resultErr error) string {
+	switch {
+	case interrupted != nil:
+		return OutcomeInterrupted
+	case resultErr != nil:
+		return ErrorCode(resultErr)
+	}
+	return OutcomeOK
+}
+
+// observeUrl учитывает запрос url из запроса пользователя ctx длительностью d с результатом result и ошибкой err
+func (m *RequestMetrics) observeUrl(ctx context.Context, d time.Duration, result UrlResult, err error) {
+	if m == nil {
+		return
+	}
+	outcome := OutcomeOK
+	if err != nil {
+		outcome = ErrorCode(err)
+	}
+	tenant := Tenant(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.urls[tenantOutcome{tenant, outcome}]++
+	m.duration.observeExemplar(d.Seconds(), RequestID(ctx))
+	if result.ContentLength > 0 {
+		m.bytes[tenant] += uint64(result.ContentLength)
+	}
+}
+
+// writeText выводит метрики в текстовом формате Prometheus
+func (m *RequestMetrics) writeText(w *metricsWriter) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.counterHeader("fetch_requests_total", "Client requests (http, gRPC and jobs) processed, by tenant if tenants are identified and outcome: ok, interrupted or the error code of the response.")
+	writeTenantCounts(w, "fetch_requests_total", m.requests)
+	fmt.Fprintln(w, "# HELP fetch_request_urls Urls in processed client requests.")
+	fmt.Fprintln(w, "# TYPE fetch_request_urls histogram")
+	m.batchSize.writeText(w, "fetch_request_urls", "")
+
+	w.counterHeader("fetch_urls_total", "Urls fetched, by tenant if tenants are identified and outcome: ok or the error code.")
+	writeTenantCounts(w, "fetch_urls_total", m.urls)
+	fmt.Fprintln(w, "# HELP fetch_url_duration_seconds Duration of url fetches, retries and fallbacks included.")
+	fmt.Fprintln(w, "# TYPE fetch_url_duration_seconds histogram")
+	m.duration.writeText(w, "fetch_url_duration_seconds", "")
+	w.counterHeader("fetch_url_bytes_total", "Bytes of response bodies received from target hosts, by tenant if tenants are identified.")
+	if len(m.bytes) == 0 {
+		fmt.Fprintln(w, "fetch_url_bytes_total 0")
+	}
+	for _, tenant := range slices.Sorted(maps.Keys(m.bytes)) {
+		fmt.Fprintf(w, "fetch_url_bytes_total%s %d\n", tenantLabel(tenant, ""), m.bytes[tenant])
+	}
+}
+
+// writeTenantCounts выводит счетчики метрики name по арендаторам и исходам
+func writeTenantCounts(w *metricsWriter, name string, counts map[tenantOutcome]uint64) {
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b tenantOutcome) int {
+		return cmp.Or(cmp.Compare(a.tenant, b.tenant), cmp.Compare(a.outcome, b.outcome))
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, tenantLabel(key.tenant, key.outcome), counts[key])
+	}
+}
+
+// tenantLabel возвращает метки арендатора tenant и исхода outcome вида {tenant="a",outcome="ok"},
+// пустые значения не выводятся
+func tenantLabel(tenant, outcome string) string {
+	var labels []string
+	if tenant != "" {
+		labels = append(labels, "tenant=\""+labelEscaper.Replace(tenant)+"\"")
+	}
+	if outcome != "" {
+		labels = append(labels, "outcome=\""+labelEscaper.Replace(outcome)+"\"")
+	}
+	if labels == nil {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// MaxRetries максимальное число повторных попыток запроса одного url, которое может указать пользователь
+	MaxRetries = 5
+	// DefaultMaxBackoffMs ограничение паузы перед повтором в миллисекундах, если оно не задано
+	DefaultMaxBackoffMs = 2000
+	// DefaultMaxRetryAfterMs сколько миллисекунд можно ждать повтора по Retry-After, если это не задано
+	DefaultMaxRetryAfterMs = 10000
+)
+
+// Условия повторного запроса url
+const (
+	// RetryOnTimeout повторять при превышении таймаута
+	RetryOnTimeout = "timeout"
+	// RetryOnConnection повторять при прочих ошибках соединения
+	RetryOnConnection = "connection"
+	// RetryOn5xx повторять при ответе с кодом 5xx
+	RetryOn5xx = "5xx"
+	// RetryOn429 повторять при ответе 429 Too Many Requests
+	RetryOn429 = "429"
+)
+
+// RetryPolicy параметры повторных попыток запроса url
+type RetryPolicy struct {
+	// Max число повторных попыток (не считая первой), ограничивается сверху MaxRetries
+	Max int `json:"max"`
+	// BackoffMs пауза перед первой повторной попыткой в миллисекундах, перед каждой следующей она удваивается
+	BackoffMs int `json:"backoff_ms,omitempty"`
+	// MaxBackoffMs ограничение паузы перед повторной попыткой в миллисекундах, по умолчанию DefaultMaxBackoffMs
+	MaxBackoffMs int `json:"max_backoff_ms,omitempty"`
+	// RetryOn при каких условиях повторять запрос, по умолчанию timeout, connection и 5xx
+	RetryOn []string `json:"retry_on,omitempty"`
+	// MaxRetryAfterMs сколько миллисекунд можно ждать повтора, если сервер в ответе 429 или 503 указал
+	// Retry-After: такая пауза заменяет обычную, а если она дольше, url не повторяется. По умолчанию DefaultMaxRetryAfterMs
+	MaxRetryAfterMs int `json:"max_retry_after_ms,omitempty"`
+}
+
+// Validate проверяет параметры повторов.
+// Текст возвращаемой ошибки предназначен для пользователя
+func (p *RetryPolicy) Validate() error {
+	if p.Max < 0 || p.BackoffMs < 0 || p.MaxBackoffMs < 0 || p.MaxRetryAfterMs < 0 {
+		return errors.New("Retries parameters must be positive")
+	}
+	for _, cond := range p.RetryOn {
+		switch cond {
+		case RetryOnTimeout, RetryOnConnection, RetryOn5xx, RetryOn429:
+		default:
+			return fmt.Errorf("Unknown retry condition %q", cond)
+		}
+	}
+	return nil
+}
+
+// normalized возвращает политику с учетом ограничений сервера и значений по умолчанию
+func (p RetryPolicy) normalized() RetryPolicy {
+	if p.Max > MaxRetries {
+		p.Max = MaxRetries
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = []string{RetryOnTimeout, RetryOnConnection, RetryOn5xx}
+	}
+	if p.MaxBackoffMs == 0 {
+		p.MaxBackoffMs = DefaultMaxBackoffMs
+	}
+	if p.MaxRetryAfterMs == 0 {
+		p.MaxRetryAfterMs = DefaultMaxRetryAfterMs
+	}
+	return p
+}
+
+// parseRetryAfter разбирает заголовок Retry-After: число секунд или дату, false - заголовка нет или он некорректен
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// backoff возвращает паузу перед повторной попыткой номер retry (с единицы): BackoffMs, удваиваемая
+// с каждой попыткой и ограниченная MaxBackoffMs. Чтобы повторы разных url не приходили на хост одновременно,
+// пауза выбирается случайно между половиной и полным значением
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay := time.Duration(p.BackoffMs) * time.Millisecond
+	limit := time.Duration(p.MaxBackoffMs) * time.Millisecond
+	for i := 1; i < retry && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// idempotentMethod проверяет, можно ли без ведома пользователя повторять запрос этим методом
+func idempotentMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// retryPolicy возвращает политику повторов для task: заданную в запросе пользователя, а если ее нет -
+// политику сервера по умолчанию, которая применяется только к GET и HEAD
+func (f *Fetcher) retryPolicy(task UrlRequest, opts FetchOptions) RetryPolicy {
+	if opts.Retries != nil {
+		return *opts.Retries
+	}
+	if task.Method != "" && !idempotentMethod(task.Method) {
+		return RetryPolicy{}
+	}
+	return f.retries
+}
+
+// shouldRetry проверяет, подходит ли результат попытки под условия повтора
+func (p *RetryPolicy) shouldRetry(result UrlResult, err error) bool {
+	switch ErrorCode(err) {
+	case ErrorCodeBlockedByPolicy, ErrorCodeHeadersTooLarge:
+		// повтор будет запрещен точно так же, а хост ответит такими же заголовками
+		return false
+	}
+	for _, cond := range p.RetryOn {
+		switch cond {
+		case RetryOnTimeout:
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return true
+			}
+		case RetryOnConnection:
+			var netErr net.Error
+			if errors.As(err, &netErr) && !netErr.Timeout() {
+				return true
+			}
+		case RetryOn5xx:
+			if err == nil && result.StatusCode >= 500 && result.StatusCode <= 599 {
+				return true
+			}
+		case RetryOn429:
+			if err == nil && result.StatusCode == 429 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequestUrlWithRetries запрашивает url, повторяя попытки согласно opts.Retries (или политике сервера по умолчанию).
+// Возвращает результат последней попытки, число попыток записывается в результат.
+// Отмена ctx прерывает запрос и ожидание перед повторной попыткой, тогда возвращается результат последней попытки
+func (f *Fetcher) RequestUrlWithRetries(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	decision, err := f.checkPolicy(ctx, task.Url, opts)
+	if err != nil {
+		return UrlResult{Url: task.Url, Response: []byte{}, Policy: decision}, err
+	}
+	policy := f.retryPolicy(task, opts)
+	for attempt := 1; ; attempt++ {
+		result, err := f.requestShared(ctx, task, opts)
+		result.Attempts = attempt
+		result.Policy = decision
+		if attempt > policy.Max || !policy.shouldRetry(result, err) {
+			return result, err
+		}
+
+		delay := policy.backoff(attempt)
+		if result.RetryAfterMs > 0 {
+			// сервер сам сообщил, когда повторить: ждем столько, если это разрешено и успевает до окончания обработки
+			delay = time.Duration(result.RetryAfterMs) * time.Millisecond
+			if delay > time.Duration(policy.MaxRetryAfterMs)*time.Millisecond {
+				return result, err
+			}
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				return result, err
+			}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		}
+	}
+}
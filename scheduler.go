@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Приоритеты обработки запросов
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// priorityLevels приоритеты в порядке обслуживания
+var priorityLevels = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// validatePriority проверяет приоритет запроса, пустой означает PriorityNormal.
+// Текст возвращаемой ошибки предназначен для пользователя
+func validatePriority(priority string) error {
+	if priority == "" {
+		return nil
+	}
+	for _, p := range priorityLevels {
+		if p == priority {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown priority %q", priority)
+}
+
+// priorityLevel возвращает номер очереди приоритета: 0 - самая приоритетная
+func priorityLevel(priority string) int {
+	for level, p := range priorityLevels {
+		if p == priority {
+			return level
+		}
+	}
+	return 1 // PriorityNormal
+}
+
+// Ошибки Acquire: ErrQueueFull и ErrQueueTimeout означают, что сервер перегружен и запрос стоит повторить позже
+var (
+	ErrQueueFull     = errors.New("Too many requests are waiting, retry later")
+	ErrQueueTimeout  = errors.New("Request waited too long for its turn, retry later")
+	ErrWaitCancelled = errors.New("Waiting for a turn was cancelled")
+)
+
+// Scheduler семафор с очередями по приоритету: когда все места заняты, освободившееся место
+// получает самый ранний из ожидающих с наибольшим приоритетом.
+// Запросы с низким приоритетом ждут, пока есть ожидающие с более высоким
+type Scheduler struct {
+	mu       sync.Mutex
+	capacity int
+	free     int
+	waiting  [][]chan struct{} // очереди ожидающих по номеру приоритета, канал закрывается при выдаче места
+	shutdown <-chan struct{}
+	// maxQueued сколько запросов может ждать одновременно, maxWait сколько запрос может ждать (0 - без ограничения)
+	maxQueued int
+	maxWait   time.Duration
+	// rejectedFull и rejectedTimeout сколько запросов отклонено из-за заполненной очереди и долгого ожидания
+	rejectedFull, rejectedTimeout uint64
+}
+
+// NewScheduler создает планировщик на capacity одновременно выполняемых запросов с неограниченной очередью.
+// shutdown закрывается при завершении работы сервера, прерывая ожидание
+func NewScheduler(capacity int, shutdown <-chan struct{}) *Scheduler {
+	return NewBoundedScheduler(capacity, 0, 0, shutdown)
+}
+
+// NewBoundedScheduler создает планировщик на capacity одновременно выполняемых запросов, в очереди которого
+// может ждать не больше maxQueued запросов и не дольше maxWait (0 - без ограничения)
+func NewBoundedScheduler(capacity, maxQueued int, maxWait time.Duration, shutdown <-chan struct{}) *Scheduler {
+	return &Scheduler{
+		capacity:  capacity,
+		free:      capacity,
+		waiting:   make([][]chan struct{}, len(priorityLevels)),
+		shutdown:  shutdown,
+		maxQueued: maxQueued,
+		maxWait:   maxWait,
+	}
+}
+
+// Acquire дожидается свободного места с учетом приоритета.
+// Возвращает ErrQueueFull, если очередь заполнена, ErrQueueTimeout, если место не освободилось за maxWait,
+// и ErrWaitCancelled, если ожидание прервано через cancel или завершением работы сервера
+func (s *Scheduler) Acquire(priority string, cancel <-chan struct{}) error {
+	level := priorityLevel(priority)
+
+	s.mu.Lock()
+	if s.free > 0 {
+		// свободное место есть только когда никто не ждет, поэтому очередь не нарушается
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	if s.maxQueued > 0 && s.queued() >= s.maxQueued {
+		s.rejectedFull++
+		s.mu.Unlock()
+		return ErrQueueFull
+	}
+	ready := make(chan struct{})
+	s.waiting[level] = append(s.waiting[level], ready)
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if s.maxWait > 0 {
+		timer := time.NewTimer(s.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	err := ErrWaitCancelled
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-cancel:
+	case <-s.shutdown:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-ready:
+		// место успело освободиться для нас одновременно с отменой, отдаем его следующему
+		s.release()
+		return err
+	default:
+	}
+	if err == ErrQueueTimeout {
+		s.rejectedTimeout++
+	}
+	queue := s.waiting[level]
+	for i, ch := range queue {
+		if ch == ready {
+			s.waiting[level] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	return err
+}
+
+// queued возвращает число ожидающих во всех очередях (вызывается под мьютексом)
+func (s *Scheduler) queued() int {
+	n := 0
+	for _, queue := range s.waiting {
+		n += len(queue)
+	}
+	return n
+}
+
+// RetryAfter возвращает, через сколько секунд отклоненному запросу стоит повторить попытку:
+// столько, сколько запрос может ждать в очереди, но не меньше секунды
+func (s *Scheduler) RetryAfter() int {
+	return max(1, int((s.maxWait+time.Second-1)/time.Second))
+}
+
+// Release освобождает место, полученное через Acquire
+func (s *Scheduler) Release() {
+	s.mu.Lock()
+	s.release()
+	s.mu.Unlock()
+}
+
+// release передает место первому ожидающему с наибольшим приоритетом (вызывается под мьютексом).
+// Если число мест уменьшено и занято больше мест, чем их стало, место не передается
+func (s *Scheduler) release() {
+	if s.free < 0 {
+		s.free++
+		return
+	}
+	for level, queue := range s.waiting {
+		if len(queue) > 0 {
+			close(queue[0])
+			s.waiting[level] = queue[1:]
+			return
+		}
+	}
+	s.free++
+}
+
+// SetCapacity меняет число одновременно выполняемых запросов. При уменьшении уже выполняющиеся запросы
+// не прерываются, но новые не начинаются, пока выполняющихся больше capacity; при увеличении новые места
+// сразу получают ожидающие. nil-значение ничего не меняет
+func (s *Scheduler) SetCapacity(capacity int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.free += capacity - s.capacity
+	s.capacity = capacity
+	for s.free > 0 && s.queued() > 0 {
+		s.free--
+		s.release()
+	}
+}
+
+// schedulerKey ключ планировщика в контексте запроса
+type schedulerKey struct{}
+
+// Admit дожидается очереди на обработку запроса r в общем планировщике (см. HandleConnection) с приоритетом priority.
+// Возвращает функцию освобождения места или ошибку Acquire
+func Admit(r *http.Request, priority string, cancel <-chan struct{}) (func(), error) {
+	scheduler, ok := r.Context().Value(schedulerKey{}).(*Scheduler)
+	if !ok {
+		// хэндлер вызван без ограничения
+		return func() {}, nil
+	}
+	if err := scheduler.Acquire(priority, cancel); err != nil {
+		return nil, err
+	}
+	return scheduler.Release, nil
+}
+
+// rejectBusy отвечает на запрос r, отклоненный планировщиком с ошибкой err, кодом 429 с заголовком Retry-After
+func rejectBusy(rw http.ResponseWriter, r *http.Request, err error) {
+	scheduler, _ := r.Context().Value(schedulerKey{}).(*Scheduler)
+	rw.Header().Set("Retry-After", fmt.Sprint(scheduler.RetryAfter()))
+	http.Error(rw, err.Error(), http.StatusTooManyRequests)
+}
+
+// withScheduler добавляет планировщик в контекст запроса
+func withScheduler(r *http.Request, scheduler *Scheduler) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), schedulerKey{}, scheduler))
+}
+
+// stats возвращает число обрабатываемых и ожидающих по приоритетам запросов
+func (s *Scheduler) stats() ClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := ClientStats{Active: s.capacity - s.free, Capacity: s.capacity, Queued: make(map[string]int)}
+	for level, priority := range priorityLevels {
+		stats.Queued[priority] = len(s.waiting[level])
+	}
+	return stats
+}
+
+// writeText выводит очереди и отказы планировщика запросов пользователей в текстовом формате Prometheus
+func (s *Scheduler) writeText(w *metricsWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP fetch_client_queue_depth Client requests waiting for their turn, by priority.")
+	fmt.Fprintln(w, "# TYPE fetch_client_queue_depth gauge")
+	for level, priority := range priorityLevels {
+		fmt.Fprintf(w, "fetch_client_queue_depth{priority=%q} %d\n", priority, len(s.waiting[level]))
+	}
+	fmt.Fprintln(w, "# HELP fetch_client_active Client requests being processed.")
+	fmt.Fprintln(w, "# TYPE fetch_client_active gauge")
+	fmt.Fprintf(w, "fetch_client_active %d\n", s.capacity-s.free)
+	w.counterHeader("fetch_client_rejected_total", "Client requests rejected with 429 because the queue was full or the wait too long.")
+	fmt.Fprintf(w, "fetch_client_rejected_total{reason=\"queue_full\"} %d\n", s.rejectedFull)
+	fmt.Fprintf(w, "fetch_client_rejected_total{reason=\"wait_timeout\"} %d\n", s.rejectedTimeout)
+}
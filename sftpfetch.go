@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SchemeSFTP схема url файлов на серверах SFTP, по умолчанию выключена
+const SchemeSFTP = "sftp"
+
+// parseSFTPCredential разбирает учетные данные вида pattern=user:password или pattern=user
+// (вход только по ключу -sftp-key-file)
+func parseSFTPCredential(s string) (FTPCredential, error) {
+	pattern, value, ok := strings.Cut(s, "=")
+	username, password, _ := strings.Cut(value, ":")
+	if !ok || pattern == "" || username == "" {
+		return FTPCredential{}, fmt.Errorf("sftp credentials %q must look like host=user:password or host=user", s)
+	}
+	return FTPCredential{Pattern: strings.ToLower(pattern), Username: username, Password: password}, nil
+}
+
+// SFTPCredentialFlag список учетных данных SFTP по хостам, задается повторяющимся флагом
+type SFTPCredentialFlag []FTPCredential
+
+// String возвращает учетные данные в формате флага, но без паролей
+func (f *SFTPCredentialFlag) String() string {
+	return (*FTPCredentialFlag)(f).String()
+}
+
+// Set добавляет учетные данные из значения флага
+func (f *SFTPCredentialFlag) Set(s string) error {
+	credential, err := parseSFTPCredential(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, credential)
+	return nil
+}
+
+// LoadSFTPKeys загружает проверку ключей хостов SFTP из файла knownHosts в формате OpenSSH known_hosts
+// (пустой путь - ~/.ssh/known_hosts) и закрытый ключ для входа из keyFile (пустой путь - без ключа)
+func LoadSFTPKeys(knownHosts, keyFile string) (ssh.HostKeyCallback, ssh.Signer, error) {
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, err
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyFile == "" {
+		return hostKeys, nil, nil
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Private key %s: %v", keyFile, err)
+	}
+	return hostKeys, signer, nil
+}
+
+// SFTPFetcher скачивает файлы по url вида sftp://[user[:password]@]host[:port]/path.
+// Путь url абсолютный, путь от домашнего каталога пользователя задается с /~/: sftp://host/~/a.txt.
+// Url, оканчивающийся на "/", и url каталога возвращают список его файлов.
+// Ключ сервера проверяется по known_hosts: к серверу с неизвестным или изменившимся ключом запрос не выполняется
+type SFTPFetcher struct {
+	// dial устанавливает соединения с проверкой адреса, как и для HTTP
+	dial dialFunc
+	// credentials учетные данные по хостам, для хоста действуют первые подходящие
+	credentials []FTPCredential
+	hostKeys    ssh.HostKeyCallback
+	// signer закрытый ключ для входа, nil - вход только по паролю
+	signer ssh.Signer
+}
+
+// NewSFTPFetcher создает SFTPFetcher, соединения устанавливаются через dial, ключи серверов проверяются hostKeys
+func NewSFTPFetcher(dial dialFunc, credentials []FTPCredential, hostKeys ssh.HostKeyCallback, signer ssh.Signer) *SFTPFetcher {
+	return &SFTPFetcher{dial: dial, credentials: credentials, hostKeys: hostKeys, signer: signer}
+}
+
+// login возвращает учетные данные для url: из самого url, из аутентификации basic запроса
+// или из настроек сервера для хоста. Пустой пользователь - учетных данных нет
+func (f *SFTPFetcher) login(u *url.URL, task UrlRequest) (string, string) {
+	if u.User != nil {
+		password, _ := u.User.Password()
+		return u.User.Username(), password
+	}
+	if task.Auth != nil && task.Auth.Type == AuthBasic {
+		return task.Auth.Username, task.Auth.Password
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, c := range f.credentials {
+		if matchHostPattern(c.Pattern, host) {
+			return c.Username, c.Password
+		}
+	}
+	return "", ""
+}
+
+// Fetch скачивает файл url как тело ответа с кодом 200. Отказы сервера возвращаются кодами HTTP:
+// вход не выполнен или учетных данных нет - 401, нет прав - 403, файла нет - 404, остальные - 502.
+// Неизвестный или изменившийся ключ сервера - ошибка tls_error
+func (f *SFTPFetcher) Fetch(ctx context.Context, task UrlRequest, opts FetchOptions) (UrlResult, error) {
+	start := time.Now()
+	result := UrlResult{Url: task.Url, Response: []byte{}, FinalUrl: task.Url, Protocol: "SFTP"}
+	timing := &UrlTiming{}
+	defer func() {
+		timing.Total = milliseconds(start, time.Now())
+		result.Timing = timing
+	}()
+
+	method, err := readOnlyMethod(task, opts)
+	if err != nil {
+		return result, err
+	}
+	u, err := url.Parse(task.Url)
+	if err != nil {
+		return result, &FetchError{Code: ErrorCodeInvalidUrl, Err: err}
+	}
+	user, password := f.login(u, task)
+	if user == "" {
+		result.StatusCode = http.StatusUnauthorized
+		return result, nil
+	}
+	name := u.Path
+	switch {
+	case name == "/~" || name == "/~/":
+		name = "."
+	case strings.HasPrefix(name, "/~/"):
+		// относительный путь sftp отсчитывается от домашнего каталога
+		name = strings.TrimPrefix(name, "/~/")
+	case name == "":
+		name = "/"
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	network := "tcp"
+	switch opts.IPFamily {
+	case IPFamilyV4:
+		network = "tcp4"
+	case IPFamilyV6:
+		network = "tcp6"
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	conn, err := f.dial(ctx, network, addr)
+	connected := time.Now()
+	timing.TCPConnect = milliseconds(start, connected)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	result.RemoteAddr = conn.RemoteAddr().String()
+	// отмена ctx прерывает и рукопожатие, и передачу файла
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// verified ключ сервера проверен, hostKeyErr - ошибка проверки
+	var verified bool
+	var hostKeyErr error
+	config := &ssh.ClientConfig{
+		User: user,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = f.hostKeys(hostname, remote, key)
+			verified = hostKeyErr == nil
+			return hostKeyErr
+		},
+	}
+	if f.signer != nil {
+		config.Auth = append(config.Auth, ssh.PublicKeys(f.signer))
+	}
+	if password != "" {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	timing.TLSHandshake = milliseconds(connected, time.Now())
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		return result, ctx.Err()
+	case hostKeyErr != nil:
+		return result, &FetchError{Code: ErrorCodeTLS, Err: fmt.Errorf("Host key of %s is not trusted: %v", u.Hostname(), hostKeyErr)}
+	case verified && !sftpConnError(err):
+		// ключ сервера проверен, а соединение не разорвано: сервер не принял учетные данные
+		result.StatusCode = http.StatusUnauthorized
+		return result, nil
+	default:
+		return result, err
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+	files, err := sftp.NewClient(client)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return result, err
+	}
+	defer files.Close()
+
+	firstByte := time.Time{}
+	err = sftpGet(files, &result, name, method, opts, &firstByte)
+	if !firstByte.IsZero() {
+		timing.TTFB = milliseconds(start, firstByte)
+	}
+	var status *sftp.StatusError
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case errors.Is(err, fs.ErrNotExist):
+		result.StatusCode, err = http.StatusNotFound, nil
+	case errors.Is(err, fs.ErrPermission):
+		result.StatusCode, err = http.StatusForbidden, nil
+	case errors.As(err, &status):
+		// отказ сервера - это ответ, а не ошибка соединения
+		result.StatusCode, err = http.StatusBadGateway, nil
+	}
+	return result, err
+}
+
+// sftpConnError проверяет, что рукопожатие SSH не удалось из-за соединения, а не отказа во входе
+func sftpConnError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// sftpGet записывает в result файл name (или список файлов, если name оканчивается на "/" или это каталог):
+// для HEAD только размер и время изменения. firstByte - момент начала передачи файла
+func sftpGet(files *sftp.Client, result *UrlResult, name, method string, opts FetchOptions, firstByte *time.Time) error {
+	info, err := files.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return sftpList(files, result, name, method, opts, firstByte)
+	}
+	if strings.HasSuffix(name, "/") {
+		return fs.ErrNotExist
+	}
+
+	result.StatusCode = http.StatusOK
+	result.Headers = map[string]string{"Last-Modified": info.ModTime().UTC().Format(http.TimeFormat)}
+	if method == http.MethodHead {
+		result.ContentLength = info.Size()
+		if contentType := contentTypeOf(name, nil); contentType != "" {
+			result.Headers["Content-Type"] = contentType
+		}
+		return nil
+	}
+	file, err := files.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	*firstByte = time.Now()
+	body := bufio.NewReader(file)
+	contentType := contentTypeOf(path.Base(name), body)
+	result.Headers["Content-Type"] = contentType
+	if opts.MaxBytes > 0 {
+		result.FullLength = info.Size()
+	}
+	return readLocalBody(result, body, info.Size(), contentType, opts)
+}
+
+// sftpList записывает в result список файлов каталога name по строке на файл, в алфавитном порядке
+func sftpList(files *sftp.Client, result *UrlResult, name, method string, opts FetchOptions, firstByte *time.Time) error {
+	entries, err := files.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	*firstByte = time.Now()
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	slices.Sort(names)
+	var listing strings.Builder
+	for _, name := range names {
+		listing.WriteString(name + "\n")
+	}
+	result.StatusCode = http.StatusOK
+	result.Headers = map[string]string{"Content-Type": "text/plain; charset=utf-8"}
+	if method == http.MethodHead {
+		result.ContentLength = int64(listing.Len())
+		return nil
+	}
+	return readLocalBody(result, strings.NewReader(listing.String()), int64(listing.Len()), "text/plain; charset=utf-8", opts)
+}
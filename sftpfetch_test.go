@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer запускает сервер SFTP с файлами каталога dir и входом user:secret.
+// Возвращает адрес сервера и его ключ
+func startSFTPServer(t *testing.T, dir string) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "user" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config, dir)
+		}
+	}()
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+// serveSFTP обслуживает одно соединение SSH с подсистемой sftp
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig, dir string) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(dir))
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+// writeKnownHosts записывает файл known_hosts с ключом key сервера addr
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) ssh.HostKeyCallback {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(file, []byte(knownhosts.Line([]string{addr}, key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hostKeys, _, err := LoadSFTPKeys(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hostKeys
+}
+
+func TestSFTPFetcher(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	addr, key := startSFTPServer(t, dir)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+
+	trusted := writeKnownHosts(t, addr, key)
+	untrusted := writeKnownHosts(t, addr, otherSigner.PublicKey())
+	credentials := []FTPCredential{{Pattern: "127.0.0.1", Username: "user", Password: "secret"}}
+	dial := (&net.Dialer{}).DialContext
+	opts := FetchOptions{MaxBodySize: MaxResponseBodySize}
+
+	tests := []struct {
+		name        string
+		hostKeys    ssh.HostKeyCallback
+		credentials []FTPCredential
+		task        UrlRequest
+		wantStatus  int
+		wantBody    string
+		wantLength  int64
+		wantCode    string
+	}{
+		{name: "file in the home directory", task: UrlRequest{Url: "sftp://" + addr + "/~/a.txt"}, wantStatus: http.StatusOK, wantBody: "hello", wantLength: 5},
+		{name: "absolute path", task: UrlRequest{Url: "sftp://" + addr + filepath.ToSlash(filepath.Join(dir, "a.txt"))}, wantStatus: http.StatusOK, wantBody: "hello", wantLength: 5},
+		{name: "head", task: UrlRequest{Url: "sftp://" + addr + "/~/a.txt", Method: http.MethodHead}, wantStatus: http.StatusOK, wantLength: 5},
+		{name: "directory listing", task: UrlRequest{Url: "sftp://" + addr + "/~/"}, wantStatus: http.StatusOK, wantBody: "a.txt\nsub\n", wantLength: 10},
+		{name: "missing file", task: UrlRequest{Url: "sftp://" + addr + "/~/missing.txt"}, wantStatus: http.StatusNotFound},
+		{name: "credentials in the url", credentials: []FTPCredential{}, task: UrlRequest{Url: "sftp://user:secret@" + addr + "/~/a.txt"}, wantStatus: http.StatusOK, wantBody: "hello", wantLength: 5},
+		{name: "wrong password", task: UrlRequest{Url: "sftp://user:wrong@" + addr + "/~/a.txt"}, wantStatus: http.StatusUnauthorized},
+		{name: "no credentials", credentials: []FTPCredential{}, task: UrlRequest{Url: "sftp://" + addr + "/~/a.txt"}, wantStatus: http.StatusUnauthorized},
+		{name: "untrusted host key", hostKeys: untrusted, task: UrlRequest{Url: "sftp://" + addr + "/~/a.txt"}, wantCode: ErrorCodeTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostKeys, creds := trusted, credentials
+			if tt.hostKeys != nil {
+				hostKeys = tt.hostKeys
+			}
+			if tt.credentials != nil {
+				creds = tt.credentials
+			}
+			fetcher := NewSFTPFetcher(dial, creds, hostKeys, nil)
+			result, err := fetcher.Fetch(context.Background(), tt.task, opts)
+			if code := ErrorCode(err); code != tt.wantCode {
+				t.Fatalf("Fetch() error = %v (%s), want %q", err, code, tt.wantCode)
+			}
+			if result.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", result.StatusCode, tt.wantStatus)
+			}
+			if string(result.Response) != tt.wantBody {
+				t.Errorf("body = %q, want %q", result.Response, tt.wantBody)
+			}
+			if tt.wantStatus == http.StatusOK && result.ContentLength != tt.wantLength {
+				t.Errorf("content length = %d, want %d", result.ContentLength, tt.wantLength)
+			}
+		})
+	}
+}
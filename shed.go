@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shedCheckInterval как часто проверяется нагрузка на сервер
+const shedCheckInterval = 500 * time.Millisecond
+
+// shedRetryAfter через сколько секунд клиенту предлагается повторить отклоненный запрос
+const shedRetryAfter = 1
+
+// Причины перегрузки сервера
+const (
+	ShedReasonHeap       = "heap"
+	ShedReasonGoroutines = "goroutines"
+	ShedReasonPending    = "pending_bytes"
+)
+
+// ErrOverloaded сервер перегружен и не принимает новые запросы
+var ErrOverloaded = errors.New("Server is overloaded, retry later")
+
+// heapMetric метрика runtime с размером занятой объектами кучи, читается без остановки программы
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// LoadShedder следит за памятью и числом горутин сервера и размером полученных, но еще не отправленных
+// пользователям тел ответов. Пока хоть одно из них выше порога, новые запросы отклоняются с кодом 503,
+// а число одновременных запросов url в общем пуле уменьшается вдвое при каждой проверке; когда нагрузка спадает,
+// оно так же удваивается до размера пула.
+// nil-значение ничего не ограничивает
+type LoadShedder struct {
+	maxHeap       uint64
+	maxGoroutines int
+	maxPending    int64
+	pool          *WorkerPool
+
+	// pending размер тел ответов, полученных и еще не переданных пользователям
+	pending atomic.Int64
+	// reason причина перегрузки по последней проверке, пустая - сервер не перегружен
+	mu       sync.Mutex
+	reason   string
+	heap     uint64
+	rejected map[string]uint64
+}
+
+// NewLoadShedder создает LoadShedder с порогами занятой кучи maxHeap, числа горутин maxGoroutines и размера
+// неотправленных тел ответов maxPending (0 - порог не проверяется) и запускает проверку нагрузки.
+// Без порогов возвращает nil
+func NewLoadShedder(maxHeap uint64, maxGoroutines int, maxPending int64, pool *WorkerPool) *LoadShedder {
+	if maxHeap == 0 && maxGoroutines <= 0 && maxPending <= 0 {
+		return nil
+	}
+	s := &LoadShedder{
+		maxHeap:       maxHeap,
+		maxGoroutines: maxGoroutines,
+		maxPending:    maxPending,
+		pool:          pool,
+		rejected:      make(map[string]uint64),
+	}
+	go s.run()
+	return s
+}
+
+// run проверяет нагрузку каждые shedCheckInterval
+func (s *LoadShedder) run() {
+	samples := []metrics.Sample{{Name: heapMetric}}
+	ticker := time.NewTicker(shedCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		metrics.Read(samples)
+		var heap uint64
+		if samples[0].Value.Kind() == metrics.KindUint64 {
+			heap = samples[0].Value.Uint64()
+		}
+		s.check(heap, runtime.NumGoroutine())
+	}
+}
+
+// check обновляет состояние по занятой куче heap и числу горутин goroutines
+func (s *LoadShedder) check(heap uint64, goroutines int) {
+	reason := ""
+	switch {
+	case s.maxHeap > 0 && heap > s.maxHeap:
+		reason = ShedReasonHeap
+	case s.maxGoroutines > 0 && goroutines > s.maxGoroutines:
+		reason = ShedReasonGoroutines
+	case s.maxPending > 0 && s.pending.Load() > s.maxPending:
+		reason = ShedReasonPending
+	}
+
+	s.mu.Lock()
+	previous := s.reason
+	s.reason, s.heap = reason, heap
+	s.mu.Unlock()
+
+	if reason != "" {
+		s.pool.setCapacity(s.pool.Capacity() / 2)
+	} else {
+		s.pool.setCapacity(s.pool.Capacity() * 2)
+	}
+	if reason != previous {
+		if reason != "" {
+			slog.Warn("Server is overloaded, shedding load", "reason", reason, "heap_bytes", heap, "goroutines", goroutines, "pending_bytes", s.pending.Load())
+		} else {
+			slog.Info("Server load is back to normal")
+		}
+	}
+}
+
+// Check возвращает ErrOverloaded, если сервер перегружен и новый запрос надо отклонить, и учитывает отказ
+func (s *LoadShedder) Check() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reason := s.reason
+	if reason == "" && s.maxPending > 0 && s.pending.Load() > s.maxPending {
+		// неотправленные тела растут быстрее, чем проходят проверки, поэтому проверяются при каждом запросе
+		reason = ShedReasonPending
+	}
+	if reason == "" {
+		return nil
+	}
+	s.rejected[reason]++
+	return ErrOverloaded
+}
+
+// hold и release учитывают тело ответа размера size как полученное и как переданное пользователю
+func (s *LoadShedder) hold(size int) {
+	if s != nil && size > 0 {
+		s.pending.Add(int64(size))
+	}
+}
+
+func (s *LoadShedder) release(size int) {
+	if s != nil && size > 0 {
+		s.pending.Add(-int64(size))
+	}
+}
+
+// rejectOverloaded отвечает на запрос, отклоненный из-за перегрузки сервера
+func rejectOverloaded(rw http.ResponseWriter, err error) {
+	rw.Header().Set("Retry-After", fmt.Sprint(shedRetryAfter))
+	http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+}
+
+// writeText выводит состояние нагрузки и отказы в текстовом формате Prometheus
+func (s *LoadShedder) writeText(w *metricsWriter) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	overloaded := 0
+	if s.reason != "" {
+		overloaded = 1
+	}
+	fmt.Fprintln(w, "# HELP fetch_overloaded Whether new client requests are rejected with 503 because of memory, goroutine or pending body pressure.")
+	fmt.Fprintln(w, "# TYPE fetch_overloaded gauge")
+	fmt.Fprintf(w, "fetch_overloaded %d\n", overloaded)
+	fmt.Fprintln(w, "# HELP fetch_heap_bytes Heap occupied by objects at the last load check.")
+	fmt.Fprintln(w, "# TYPE fetch_heap_bytes gauge")
+	fmt.Fprintf(w, "fetch_heap_bytes %d\n", s.heap)
+	fmt.Fprintln(w, "# HELP fetch_pending_body_bytes Response bodies fetched but not yet handed to clients.")
+	fmt.Fprintln(w, "# TYPE fetch_pending_body_bytes gauge")
+	fmt.Fprintf(w, "fetch_pending_body_bytes %d\n", s.pending.Load())
+	w.counterHeader("fetch_overload_rejected_total", "Client requests rejected with 503 because the server was overloaded, by reason.")
+	for _, reason := range []string{ShedReasonHeap, ShedReasonGoroutines, ShedReasonPending} {
+		fmt.Fprintf(w, "fetch_overload_rejected_total{reason=%q} %d\n", reason, s.rejected[reason])
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// flightCall запрос url, результат которого ждут одна или несколько горутин
+type flightCall struct {
+	// done закрывается, когда результат готов
+	done   chan struct{}
+	result UrlResult
+	err    error
+	// waiters сколько горутин ждут результат, когда их не остается, запрос прерывается
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup объединяет одинаковые запросы url, выполняющиеся одновременно (в том числе из запросов разных
+// клиентов): выполняется один запрос, а его результат получают все. nil-значение - запросы не объединяются
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// newFlightGroup создает flightGroup, если enabled, иначе возвращает nil
+func newFlightGroup(enabled bool) *flightGroup {
+	if !enabled {
+		return nil
+	}
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// do выполняет fn или, если такой же запрос по ключу key уже выполняется, дожидается его результата.
+// fn выполняется с контекстом, который отменяется, только когда результат не нужен ни одной горутине;
+// значения контекста берутся из ctx первой горутины. shared - результат получен вместе с другими горутинами
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (UrlResult, error)) (result UrlResult, err error, shared bool) {
+	if g == nil {
+		result, err = fn(ctx)
+		return result, err, false
+	}
+
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if ok {
+		call.waiters++
+	} else {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &flightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.calls[key] = call
+		go func() {
+			call.result, call.err = fn(callCtx)
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		g.mu.Lock()
+		shared = ok || call.waiters > 1
+		g.mu.Unlock()
+		return call.result, call.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// результат больше никому не нужен
+			call.cancel()
+		}
+		g.mu.Unlock()
+		return UrlResult{Response: []byte{}}, ctx.Err(), false
+	}
+}
+
+// taskKey возвращает ключ запроса url: одинаковые запросы дают одинаковый ключ
+func taskKey(task UrlRequest) string {
+	// json.Marshal сортирует ключи заголовков, поэтому одинаковые запросы дают одинаковый ключ.
+	// Секреты аутентификации в json скрыты, поэтому добавляются к ключу отдельно
+	key, _ := json.Marshal(task)
+	if task.Auth != nil {
+		key = append(key, task.Auth.Username+"\x00"+task.Auth.Password+"\x00"+task.Auth.Token...)
+	}
+	return string(key)
+}
+
+// flightKey возвращает ключ для объединения одновременных запросов url, false - запрос объединять нельзя:
+// у него есть побочные эффекты (метод не GET и не HEAD, тело) или общие куки запроса пользователя
+func flightKey(task UrlRequest, opts FetchOptions) (string, bool) {
+	if task.Method != "" && task.Method != http.MethodGet && task.Method != http.MethodHead || task.Body != "" || opts.Jar != nil {
+		return "", false
+	}
+	// повторы выполняются каждым запросом отдельно, на одну попытку они не влияют
+	opts.Retries = nil
+	return fmt.Sprintf("%s\x00%+v", taskKey(task), opts), true
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// AdminStatsPattern путь, по которому администратор получает снимок состояния сервера
+const AdminStatsPattern = "/admin/stats"
+
+// startedAt время запуска сервера
+var startedAt = time.Now()
+
+// ServerStats снимок состояния сервера для администратора
+type ServerStats struct {
+	StartedAt     time.Time   `json:"started_at"`
+	UptimeSeconds float64     `json:"uptime_seconds"`
+	Clients       ClientStats `json:"clients"`
+	// WorkerPool загрузка общего пула, нет - у каждого запроса свои рабочие горутины
+	WorkerPool *PoolStats `json:"worker_pool,omitempty"`
+	// Circuits хосты с неудачными запросами подряд, по алфавиту
+	Circuits []CircuitStats `json:"circuits"`
+	// ResponseCache и DNSCache обращения к кэшам ответов и адресов хостов, нет - кэш выключен
+	ResponseCache *CacheStats `json:"response_cache,omitempty"`
+	DNSCache      *CacheStats `json:"dns_cache,omitempty"`
+	// HostErrors неудачные запросы к хостам (с повторами) по хостам и категориям (см. HostErrors)
+	HostErrors map[string]map[string]uint64 `json:"host_errors"`
+	// Adaptive текущие пределы одновременных запросов AIMD, нет - подстройка выключена
+	Adaptive *AdaptiveStats `json:"adaptive_concurrency,omitempty"`
+}
+
+// AdaptiveStats пределы одновременных запросов AIMD по всем хостам и по хостам (см. AdaptiveLimiter)
+type AdaptiveStats struct {
+	Global AdaptiveLimitStats `json:"global"`
+	// Hosts хосты с запросами или сниженным пределом, по алфавиту
+	Hosts []AdaptiveLimitStats `json:"hosts"`
+}
+
+// AdaptiveLimitStats текущий предел, его верхняя граница, выполняющиеся и ожидающие запросы
+type AdaptiveLimitStats struct {
+	Host     string `json:"host,omitempty"`
+	Limit    int    `json:"limit"`
+	Max      int    `json:"max"`
+	InFlight int    `json:"in_flight"`
+	Waiting  int    `json:"waiting"`
+}
+
+// ClientStats запросы пользователей: сколько обрабатывается из скольких возможных и сколько ждут по приоритетам
+type ClientStats struct {
+	Active   int            `json:"active"`
+	Capacity int            `json:"capacity"`
+	Queued   map[string]int `json:"queued"`
+}
+
+// PoolStats загрузка общего пула рабочих горутин
+type PoolStats struct {
+	Size int `json:"size"`
+	// Capacity сколько url пул может запрашивать сейчас, меньше Size при перегрузке сервера
+	Capacity   int `json:"capacity"`
+	Busy       int `json:"busy"`
+	QueuedUrls int `json:"queued_urls"`
+}
+
+// CircuitStats состояние запросов к хосту
+type CircuitStats struct {
+	Host     string `json:"host"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	// OpenUntil до какого момента запросы к хосту не выполняются, только в состоянии CircuitOpen
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// CacheStats обращения к кэшу: найденные и не найденные значения и доля найденных
+type CacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// cacheCounter считает обращения к кэшу, nil-значение ничего не считает
+type cacheCounter struct {
+	hits, misses atomic.Uint64
+}
+
+// record учитывает обращение к кэшу: hit - значение найдено
+func (c *cacheCounter) record(hit bool) {
+	if c == nil {
+		return
+	}
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// stats возвращает число обращений, для nil-значения - nil
+func (c *cacheCounter) stats() *CacheStats {
+	if c == nil {
+		return nil
+	}
+	s := &CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRate = float64(s.Hits) / float64(total)
+	}
+	return s
+}
+
+// countingCache кэш ответов, считающий обращения к нему
+type countingCache struct {
+	ResponseCache
+	counter *cacheCounter
+}
+
+func (c *countingCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	resp, err := c.ResponseCache.Get(ctx, key)
+	if err == nil {
+		// недоступный кэш ничего не говорит о том, нашелся бы в нем ответ
+		c.counter.record(resp != nil)
+	}
+	return resp, err
+}
+
+// CollectStats собирает снимок состояния сервера: запросов пользователей scheduler, пула, хостов и кэшей fetcher
+func CollectStats(fetcher *Fetcher, scheduler *Scheduler) ServerStats {
+	circuits := fetcher.circuits.stats()
+	if circuits == nil {
+		circuits = []CircuitStats{}
+	}
+	return ServerStats{
+		StartedAt:     startedAt,
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+		Clients:       scheduler.stats(),
+		WorkerPool:    fetcher.pool.stats(),
+		Circuits:      circuits,
+		ResponseCache: fetcher.responseCache.stats(),
+		DNSCache:      fetcher.resolver.stats(),
+		HostErrors:    fetcher.hostErrors.stats(),
+		Adaptive:      fetcher.adaptive.stats(),
+	}
+}
+
+// HandleAdminStats отдает снимок состояния сервера (см. ServerStats) в формате json.
+// Доступ только с заголовком Authorization: Bearer <token>
+func HandleAdminStats(token string, fetcher *Fetcher, scheduler *Scheduler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(rw, r, token) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, http.StatusOK, CollectStats(fetcher, scheduler))
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Summary сводная статистика по обработанным url
+type Summary struct {
+	// Total число обработанных url
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	// Bytes суммарный размер полученных тел ответов
+	Bytes   int64          `json:"bytes"`
+	Latency LatencySummary `json:"latency_ms"`
+
+	latencies []float64 // общее время запроса каждого url, для расчета перцентилей
+}
+
+// LatencySummary статистика общего времени запроса url, в миллисекундах
+type LatencySummary struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	P95  float64 `json:"p95"`
+}
+
+// add учитывает результат запроса url
+func (s *Summary) add(res UrlResult) {
+	s.Total++
+	if res.Error != "" {
+		s.Failed++
+	} else {
+		s.Succeeded++
+	}
+	s.Bytes += res.ContentLength
+	if res.Timing != nil {
+		s.latencies = append(s.latencies, res.Timing.Total)
+	}
+}
+
+// finish рассчитывает статистику времени запросов по всем учтенным url
+func (s *Summary) finish() {
+	if len(s.latencies) == 0 {
+		s.Latency = LatencySummary{}
+		return
+	}
+	sort.Float64s(s.latencies)
+
+	var sum float64
+	for _, l := range s.latencies {
+		sum += l
+	}
+	n := len(s.latencies)
+	s.Latency = LatencySummary{
+		Min:  s.latencies[0],
+		Max:  s.latencies[n-1],
+		Mean: sum / float64(n),
+		P95:  percentile(s.latencies, 0.95),
+	}
+}
+
+// percentile возвращает перцентиль p (от 0 до 1) отсортированных значений sorted по ближайшему рангу
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[max(int(math.Ceil(p*float64(len(sorted))))-1, 0)]
+}
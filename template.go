@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// templatePart часть шаблона url: обычный текст или имя переменной
+type templatePart struct {
+	text     string
+	variable bool
+}
+
+// parseUrlTemplate разбивает шаблон на текст и переменные вида {name}.
+// Скобки без закрывающей пары и пустые {} считаются обычным текстом
+func parseUrlTemplate(template string) []templatePart {
+	var parts []templatePart
+	text := 0 // начало еще не добавленного текста
+	for i := 0; i < len(template); i++ {
+		if template[i] != '{' {
+			continue
+		}
+		end := strings.IndexByte(template[i+1:], '}')
+		if end <= 0 {
+			continue
+		}
+		if text < i {
+			parts = append(parts, templatePart{text: template[text:i]})
+		}
+		parts = append(parts, templatePart{text: template[i+1 : i+1+end], variable: true})
+		i += end + 1
+		text = i + 1
+	}
+	if text < len(template) {
+		parts = append(parts, templatePart{text: template[text:]})
+	}
+	return parts
+}
+
+// templateVariables возвращает имена переменных шаблона в порядке первого появления
+func templateVariables(parts []templatePart) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, part := range parts {
+		if part.variable && !seen[part.text] {
+			seen[part.text] = true
+			names = append(names, part.text)
+		}
+	}
+	return names
+}
+
+// validateTemplate проверяет, что для всех переменных шаблона заданы значения.
+// Текст возвращаемой ошибки предназначен для пользователя
+func validateTemplate(template string, vars map[string][]string) error {
+	if template == "" {
+		if len(vars) > 0 {
+			return errors.New("Vars are allowed only with template")
+		}
+		return nil
+	}
+	for _, name := range templateVariables(parseUrlTemplate(template)) {
+		if len(vars[name]) == 0 {
+			return fmt.Errorf("No values for template variable %q", name)
+		}
+	}
+	return nil
+}
+
+// templateUrlCount возвращает число url, получаемых из шаблона (все сочетания значений переменных).
+// Чтобы не переполниться на огромных списках, счет останавливается, как только превышен limit
+func templateUrlCount(template string, vars map[string][]string, limit int) int {
+	if template == "" {
+		return 0
+	}
+	count := 1
+	for _, name := range templateVariables(parseUrlTemplate(template)) {
+		count *= len(vars[name])
+		if count > limit {
+			return limit + 1
+		}
+	}
+	return count
+}
+
+// expandUrlTemplate подставляет в шаблон все сочетания значений переменных.
+// Значения подставляются как есть, без экранирования; первая переменная меняется медленнее всех
+func expandUrlTemplate(template string, vars map[string][]string) []string {
+	parts := parseUrlTemplate(template)
+	names := templateVariables(parts)
+
+	var urls []string
+	values := make(map[string]string, len(names))
+	var expand func(n int)
+	expand = func(n int) {
+		if n < len(names) {
+			for _, value := range vars[names[n]] {
+				values[names[n]] = value
+				expand(n + 1)
+			}
+			return
+		}
+		var b strings.Builder
+		for _, part := range parts {
+			if part.variable {
+				b.WriteString(values[part.text])
+			} else {
+				b.WriteString(part.text)
+			}
+		}
+		urls = append(urls, b.String())
+	}
+	expand(0)
+	return urls
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// TenantNone арендатор запросов без заголовка арендатора
+	TenantNone = "_none"
+	// TenantOther арендатор запросов с неизвестным ключом
+	TenantOther = "_other"
+)
+
+// tenantKey ключ арендатора в контексте
+type tenantKey struct{}
+
+// Tenants определяет арендатора (клиента сервиса), от имени которого выполняется запрос, по ключу API
+// в заголовке header, чтобы учитывать использование сервиса по арендаторам. Арендаторами считаются только
+// заданные в keys: само значение заголовка никуда не попадает, так что ключи не видны в метриках и журнале аудита,
+// а клиент не может выдать себя за другого арендатора или раздуть метрики новыми значениями
+type Tenants struct {
+	header string
+	// keys арендаторы по ключам API
+	keys map[string]string
+}
+
+// NewTenants создает определение арендатора по заголовку header и ключам keys.
+// С пустым header возвращает nil
+func NewTenants(header string, keys map[string]string) *Tenants {
+	if header == "" {
+		return nil
+	}
+	return &Tenants{header: header, keys: keys}
+}
+
+// LoadTenantKeys читает файл ключей API: строки вида "<ключ> <арендатор>", пустые строки и строки,
+// начинающиеся с #, пропускаются
+func LoadTenantKeys(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Tenant keys file %s, line %d: must be \"<key> <tenant>\"", path, n)
+		}
+		keys[fields[0]] = fields[1]
+	}
+	return keys, scanner.Err()
+}
+
+// resolve возвращает арендатора по значению заголовка value
+func (t *Tenants) resolve(value string) string {
+	if value == "" {
+		return TenantNone
+	}
+	if tenant, ok := t.keys[value]; ok {
+		return tenant
+	}
+	return TenantOther
+}
+
+// HandleTenant определяет арендатора запроса и передает его следующему хэндлеру h в контексте запроса.
+// Без tenants возвращает h
+func HandleTenant(tenants *Tenants, h http.Handler) http.Handler {
+	if tenants == nil {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		tenant := tenants.resolve(r.Header.Get(tenants.header))
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
+
+// Tenant возвращает арендатора из контекста, пустую строку - если арендаторы не определяются
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTenantKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys")
+	if err := os.WriteFile(path, []byte("# ключи арендаторов\n\nkey-1 acme\n  key-2   globex  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadTenantKeys(path)
+	if err != nil {
+		t.Fatalf("LoadTenantKeys() error = %v", err)
+	}
+	if len(keys) != 2 || keys["key-1"] != "acme" || keys["key-2"] != "globex" {
+		t.Errorf("LoadTenantKeys() = %v", keys)
+	}
+
+	bad := filepath.Join(dir, "bad")
+	if err := os.WriteFile(bad, []byte("key-1 acme\nkey-2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTenantKeys(bad); err == nil {
+		t.Error("LoadTenantKeys() of a line without a tenant succeeded")
+	}
+}
+
+func TestHandleTenant(t *testing.T) {
+	if NewTenants("", nil) != nil {
+		t.Error("NewTenants() without a header is not nil")
+	}
+	tenants := NewTenants("X-API-Key", map[string]string{"key-1": "acme"})
+	var got string
+	h := HandleTenant(tenants, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = Tenant(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "known key", header: "key-1", want: "acme"},
+		{name: "no header", header: "", want: TenantNone},
+		// значение заголовка не становится арендатором, даже если совпадает с названием арендатора
+		{name: "unknown key", header: "acme", want: TenantOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("X-API-Key", tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("tenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
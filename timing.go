@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// UrlTiming разбивка времени запроса одного url по этапам, в миллисекундах.
+// Этапы, которых не было (например, TLS для http или DNS для ip-адреса), остаются нулевыми
+type UrlTiming struct {
+	DNSLookup    float64 `json:"dns_lookup_ms"`
+	TCPConnect   float64 `json:"tcp_connect_ms"`
+	TLSHandshake float64 `json:"tls_handshake_ms"`
+	// TTFB время от начала запроса до получения первого байта ответа
+	TTFB  float64 `json:"ttfb_ms"`
+	Total float64 `json:"total_ms"`
+	// ConnReused соединение взято из пула, поэтому DNS, соединение и TLS не заняли времени
+	ConnReused bool `json:"conn_reused"`
+}
+
+// timingTrace собирает моменты наступления этапов запроса через httptrace.
+// Хуки соединения могут вызываться из разных горутин (параллельное подключение по ipv4 и ipv6), поэтому под мьютексом
+type timingTrace struct {
+	mu                  sync.Mutex
+	start               time.Time
+	dnsStart, dnsDone   time.Time
+	connStart, connDone time.Time
+	tlsStart, tlsDone   time.Time
+	firstByte           time.Time
+	gotConn             time.Time
+	// remoteAddr адрес последнего полученного соединения
+	remoteAddr string
+	// reused последнее полученное соединение взято из пула
+	reused bool
+	// metrics метрики соединений, в которые попадают этапы, nil - не учитываются
+	metrics *ConnMetrics
+}
+
+// newTimingTrace создает трассировку, отсчитывающую время от текущего момента
+// и учитывающую соединения в metrics
+func newTimingTrace(metrics *ConnMetrics) *timingTrace {
+	return &timingTrace{start: time.Now(), metrics: metrics}
+}
+
+// ClientTrace возвращает хуки httptrace, заполняющие моменты этапов запроса
+func (t *timingTrace) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.finish(StageDNS, &t.dnsStart, &t.dnsDone) },
+		ConnectStart:         func(string, string) { t.mark(&t.connStart) },
+		ConnectDone:          func(string, string, error) { t.finish(StageConnect, &t.connStart, &t.connDone) },
+		TLSHandshakeStart:    func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.finish(StageTLS, &t.tlsStart, &t.tlsDone) },
+		GotConn:              t.gotConnection,
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	}
+}
+
+// gotConnection запоминает момент получения соединения и адрес, с которым оно установлено
+func (t *timingTrace) gotConnection(info httptrace.GotConnInfo) {
+	t.mark(&t.gotConn)
+	t.mu.Lock()
+	t.remoteAddr = info.Conn.RemoteAddr().String()
+	t.reused = info.Reused
+	t.mu.Unlock()
+	t.metrics.gotConn(info.Reused)
+}
+
+// RemoteAddr возвращает адрес последнего полученного соединения, пустой - соединения не было
+func (t *timingTrace) RemoteAddr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remoteAddr
+}
+
+// mark запоминает текущий момент как момент наступления этапа
+func (t *timingTrace) mark(moment *time.Time) {
+	t.mu.Lock()
+	*moment = time.Now()
+	t.mu.Unlock()
+}
+
+// finish запоминает текущий момент как окончание этапа stage, начатого в start, и учитывает его длительность в метриках
+func (t *timingTrace) finish(stage string, start, done *time.Time) {
+	t.mu.Lock()
+	*done = time.Now()
+	began := *start
+	t.mu.Unlock()
+	if !began.IsZero() {
+		t.metrics.observeStage(stage, done.Sub(began))
+	}
+}
+
+// Timing возвращает разбивку по этапам, считая текущий момент окончанием запроса
+func (t *timingTrace) Timing() *UrlTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &UrlTiming{
+		DNSLookup:    milliseconds(t.dnsStart, t.dnsDone),
+		TCPConnect:   milliseconds(t.connStart, t.connDone),
+		TLSHandshake: milliseconds(t.tlsStart, t.tlsDone),
+		TTFB:         milliseconds(t.start, t.firstByte),
+		Total:        milliseconds(t.start, time.Now()),
+		ConnReused:   t.reused,
+	}
+}
+
+// Connected возвращает, было ли получено соединение для запроса (включая TLS-рукопожатие)
+func (t *timingTrace) Connected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.gotConn.IsZero()
+}
+
+// milliseconds возвращает длительность промежутка в миллисекундах, 0 - если этап не завершился
+func milliseconds(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// TLSInfo параметры TLS-соединения с url и сертификат сервера (только для https)
+type TLSInfo struct {
+	// Version версия TLS, например "TLS 1.3"
+	Version string `json:"version"`
+	// CipherSuite название набора шифров
+	CipherSuite string `json:"cipher_suite"`
+	// Subject владелец сертификата сервера
+	Subject string `json:"subject"`
+	// Issuer кто выдал сертификат сервера
+	Issuer string `json:"issuer"`
+	// NotAfter окончание срока действия сертификата сервера
+	NotAfter time.Time `json:"not_after"`
+}
+
+// newTLSInfo собирает параметры TLS-соединения, nil - если соединение без TLS
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) > 0 {
+		// первым идет сертификат самого сервера, за ним промежуточные
+		cert := state.PeerCertificates[0]
+		info.Subject = cert.Subject.String()
+		info.Issuer = cert.Issuer.String()
+		info.NotAfter = cert.NotAfter
+	}
+	return info
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader заголовок с контекстом трассировки по W3C Trace Context
+const TraceparentHeader = "traceparent"
+
+// Вид операции в OTLP (SpanKind)
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// Параметры отправки операций
+const (
+	// traceBatchSize сколько завершенных операций накапливать, прежде чем отправить их, не дожидаясь traceExportInterval
+	traceBatchSize = 512
+	// traceQueueSize сколько завершенных операций может ждать отправки, следующие отбрасываются
+	traceQueueSize = 8192
+	// traceExportInterval как часто отправлять накопленные операции
+	traceExportInterval = 5 * time.Second
+	// traceExportTimeout время на отправку одной пачки операций
+	traceExportTimeout = 10 * time.Second
+)
+
+// spanContext идентификаторы операции, передаваемые дочерним операциям и в заголовке traceparent
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent разбирает заголовок traceparent вида 00-<trace-id>-<parent-id>-<flags>.
+// Возвращает false для неверного заголовка: тогда трассировка начинается заново
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+// spanAttr атрибут операции: значение string, int64 или bool
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// Span операция трассировки: обработка запроса пользователя или запрос одного url.
+// nil-значение ничего не записывает
+type Span struct {
+	tracer   *Tracer
+	context  spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []spanAttr
+	// errMessage текст ошибки, с которой завершилась операция
+	errMessage string
+	ended      bool
+}
+
+// SetAttr добавляет атрибут операции: value приводится к string, int64 или bool
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil || !s.context.sampled {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case string, int64, bool:
+	default:
+		value = fmt.Sprint(v)
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, spanAttr{key, value})
+	s.mu.Unlock()
+}
+
+// SetError отмечает, что операция завершилась ошибкой err
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil || !s.context.sampled {
+		return
+	}
+	s.mu.Lock()
+	s.errMessage = err.Error()
+	s.mu.Unlock()
+	s.SetAttr("error.type", ErrorCode(err))
+}
+
+// End завершает операцию и передает ее на отправку, повторные вызовы ничего не делают
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.context.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// spanKey ключ текущей операции в контексте
+type spanKey struct{}
+
+// spanFromContext возвращает текущую операцию из контекста, nil - если ее нет
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Tracer записывает операции обработки запросов и отправляет их в коллектор OpenTelemetry по OTLP/HTTP
+// в кодировке json. Операции копятся и отправляются пачками в фоне, при переполнении очереди лишние
+// отбрасываются, чтобы недоступный коллектор не влиял на обработку запросов.
+// nil-значение ничего не записывает
+type Tracer struct {
+	endpoint string
+	service  string
+	ratio    float64
+	client   *http.Client
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped uint64
+	// failing предыдущая отправка не удалась: об ошибках отправки пишем в лог только при смене состояния
+	failing bool
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewTracer создает Tracer, отправляющий операции по адресу endpoint (например, http://collector:4318/v1/traces)
+// от имени сервиса service. ratio - доля записываемых трасс, которые начинает сам сервер, для трасс
+// из заголовка traceparent действует решение клиента. Без endpoint возвращает nil
+func NewTracer(endpoint, service string, ratio float64) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		endpoint: endpoint,
+		service:  service,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start начинает операцию name вида kind, дочернюю к текущей операции ctx (или к remote, если ее нет),
+// и возвращает контекст с ней. Операцию нужно завершить через End
+func (t *Tracer) Start(ctx context.Context, name string, kind int, remote *spanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	switch parent := spanFromContext(ctx); {
+	case parent != nil:
+		span.context.traceID, span.context.sampled = parent.context.traceID, parent.context.sampled
+		span.parentID = parent.context.spanID
+	case remote != nil:
+		span.context.traceID, span.context.sampled = remote.traceID, remote.sampled
+		span.parentID = remote.spanID
+	default:
+		span.context.traceID = newTraceID()
+		span.context.sampled = rand.Float64() < t.ratio
+	}
+	span.context.spanID = newSpanID()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// newTraceID и newSpanID создают случайные идентификаторы трассы и операции: они должны быть уникальными,
+// но не секретными, поэтому криптографический генератор не нужен
+func newTraceID() [16]byte {
+	var id [16]byte
+	for id == [16]byte{} {
+		binary.LittleEndian.PutUint64(id[:8], rand.Uint64())
+		binary.LittleEndian.PutUint64(id[8:], rand.Uint64())
+	}
+	return id
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		binary.LittleEndian.PutUint64(id[:], rand.Uint64())
+	}
+	return id
+}
+
+// enqueue ставит завершенную операцию в очередь на отправку
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= traceQueueSize {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, span)
+	if len(t.queue) >= traceBatchSize {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run отправляет накопленные операции каждые traceExportInterval или по заполнении пачки
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.wake:
+		case <-t.stop:
+			t.flush()
+			return
+		}
+		t.flush()
+	}
+}
+
+// Shutdown отправляет накопленные операции и прекращает отправку, ctx ограничивает ожидание
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	select {
+	case <-t.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// flush отправляет все накопленные операции пачками не больше traceBatchSize
+func (t *Tracer) flush() {
+	for {
+		t.mu.Lock()
+		n := min(len(t.queue), traceBatchSize)
+		batch := t.queue[:n:n]
+		t.queue = t.queue[n:]
+		dropped := t.dropped
+		t.dropped = 0
+		t.mu.Unlock()
+		if dropped > 0 {
+			slog.Warn("Tracing: spans dropped, the export queue was full", "spans", dropped)
+		}
+		if n == 0 {
+			return
+		}
+		err := t.export(batch)
+		if err != nil && !t.failing {
+			slog.Warn("Tracing: export failed", "error", err)
+		} else if err == nil && t.failing {
+			slog.Info("Tracing: export recovered")
+		}
+		t.failing = err != nil
+	}
+}
+
+// export отправляет пачку операций в коллектор
+func (t *Tracer) export(batch []*Span) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(t.otlpRequest(batch)); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp* структуры запроса ExportTraceServiceRequest в кодировке json (идентификаторы - в hex, 64-битные
+// числа - строками)
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpRequest строит запрос на отправку пачки операций
+func (t *Tracer) otlpRequest(batch []*Span) otlpExportRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	scope.Scope.Name = t.service
+	for _, span := range batch {
+		span.mu.Lock()
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.context.traceID[:]),
+			SpanID:            hex.EncodeToString(span.context.spanID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1}, // OK
+		}
+		if span.parentID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		for _, attr := range span.attrs {
+			s.Attributes = append(s.Attributes, otlpAttr(attr.key, attr.value))
+		}
+		if span.errMessage != "" {
+			s.Status = otlpStatus{Code: 2, Message: span.errMessage} // ERROR
+		}
+		span.mu.Unlock()
+		scope.Spans = append(scope.Spans, s)
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", t.service)}
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+// otlpAttr переводит атрибут в формат OTLP
+func otlpAttr(key string, value any) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+// HandleTracing записывает обработку запроса хэндлером h как операцию route (например, "POST /v1/fetch"),
+// продолжая трассу из заголовка traceparent, если клиент его прислал. Без tracer возвращает h
+func HandleTracing(tracer *Tracer, route string, h http.Handler) http.Handler {
+	if tracer == nil {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var remote *spanContext
+		if sc, ok := parseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			remote = &sc
+		}
+		ctx, span := tracer.Start(r.Context(), r.Method+" "+route, SpanKindServer, remote)
+		defer span.End()
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("request.id", RequestID(ctx))
+
+		recorder := &statusRecorder{ResponseWriter: rw}
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttr("http.response.status_code", recorder.Status())
+		span.SetAttr("http.response.body.size", recorder.bytes)
+	})
+}
+
+// urlSpanAttrs добавляет к операции запроса url его адрес (без учетных данных), хост и результат
+func urlSpanAttrs(span *Span, task UrlRequest, result UrlResult, err error) {
+	if span == nil {
+		return
+	}
+	if u, parseErr := url.Parse(task.Url); parseErr == nil {
+		span.SetAttr("url.full", u.Redacted())
+		span.SetAttr("server.address", u.Hostname())
+	}
+	if result.StatusCode != 0 {
+		span.SetAttr("http.response.status_code", result.StatusCode)
+	}
+	span.SetAttr("http.response.body.size", result.ContentLength)
+	if result.Attempts > 1 {
+		span.SetAttr("fetch.retries", result.Attempts-1)
+	}
+	span.SetError(err)
+}
+
+// statusRecorder запоминает код и размер ответа хэндлера, не мешая потоковой отправке (Flush)
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush нужен потоковым ответам (NDJSON, SSE, gRPC)
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap дает http.ResponseController доступ к исходному ответу
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status возвращает код ответа: если хэндлер ничего не записал, net/http ответит 200
+func (w *statusRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Версии HTTP, которые можно задать для хоста
+const (
+	// HTTPVersion1 только HTTP/1.1
+	HTTPVersion1 = "1.1"
+	// HTTPVersion2 HTTP/2, если сервер поддерживает его при TLS-рукопожатии, иначе HTTP/1.1 (по умолчанию)
+	HTTPVersion2 = "2"
+	// HTTPVersionH2C HTTP/2 и для http без TLS (prior knowledge, сервер обязан его поддерживать)
+	HTTPVersionH2C = "h2c"
+	// HTTPVersion3 HTTP/3 (QUIC) для https, сервер обязан его поддерживать; http запрашивается как по умолчанию
+	HTTPVersion3 = "3"
+)
+
+// HostHTTPVersion версия HTTP для хостов, подходящих под Pattern
+type HostHTTPVersion struct {
+	Pattern string
+	Version string
+}
+
+// HTTPVersionFlag список версий HTTP по хостам, задается повторяющимся флагом
+type HTTPVersionFlag []HostHTTPVersion
+
+// String возвращает версии в формате флага
+func (f *HTTPVersionFlag) String() string {
+	var parts []string
+	for _, v := range *f {
+		parts = append(parts, v.Pattern+"="+v.Version)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set добавляет версию из значения флага вида host=version
+func (f *HTTPVersionFlag) Set(s string) error {
+	pattern, version, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("HTTP version %q must look like host=version", s)
+	}
+	switch version {
+	case HTTPVersion1, HTTPVersion2, HTTPVersionH2C, HTTPVersion3:
+	default:
+		return fmt.Errorf("HTTP version %q: version must be %s, %s, %s or %s", s, HTTPVersion1, HTTPVersion2, HTTPVersionH2C, HTTPVersion3)
+	}
+	*f = append(*f, HostHTTPVersion{Pattern: strings.ToLower(pattern), Version: version})
+	return nil
+}
+
+// insecureTLSKey ключ в контексте запроса url, разрешающий не проверять сертификат сервера
+type insecureTLSKey struct{}
+
+// withInsecureTLS помечает контекст запроса url: сертификат сервера можно не проверять,
+// если хост входит в список разрешенных на сервере
+func withInsecureTLS(ctx context.Context) context.Context {
+	return context.WithValue(ctx, insecureTLSKey{}, true)
+}
+
+// Семейства адресов, с которыми устанавливаются соединения
+const (
+	// IPFamilyAny адреса любого семейства (по умолчанию)
+	IPFamilyAny = "any"
+	// IPFamilyV4 только IPv4-адреса
+	IPFamilyV4 = "v4"
+	// IPFamilyV6 только IPv6-адреса
+	IPFamilyV6 = "v6"
+)
+
+// ipFamilyKey ключ в контексте запроса url, задающий семейство адресов для соединений
+type ipFamilyKey struct{}
+
+// withIPFamily помечает контекст запроса url: соединения устанавливаются только с адресами семейства family
+func withIPFamily(ctx context.Context, family string) context.Context {
+	return context.WithValue(ctx, ipFamilyKey{}, family)
+}
+
+// transportKey настройки транспорта, зависящие от хоста и запроса
+type transportKey struct {
+	// cert номер клиентского сертификата, -1 - без сертификата
+	cert int
+	// insecure не проверять сертификат сервера
+	insecure bool
+	// version версия HTTP, пустая - по умолчанию
+	version string
+	// family семейство адресов, пустое - любое
+	family string
+}
+
+// hostTransport выбирает для каждого запроса (в том числе для каждого перенаправления) транспорт по хосту:
+// с подходящим клиентским сертификатом, нужной версией HTTP и без проверки сертификата сервера,
+// если это запрошено и разрешено для хоста, а также с запрошенным семейством адресов.
+// Все транспорты - копии основного с теми же настройками, создаются при первом запросе с такими настройками,
+// поэтому соединения с разными настройками не смешиваются в одном пуле.
+// По HTTP/3 запрашиваются url https хостов с версией HTTPVersion3, а с altSvc - и хостов без заданной версии,
+// объявивших HTTP/3 в заголовке Alt-Svc
+type hostTransport struct {
+	base  *http.Transport
+	certs []*ClientCert
+	// insecureHosts шаблоны хостов, для которых можно не проверять сертификат сервера
+	insecureHosts []string
+	// versions версии HTTP по хостам, для хоста действует первая подходящая
+	versions []HostHTTPVersion
+	// quic соединения для HTTP/3, nil - HTTP/3 не используется
+	quic *quicDialer
+	// altSvc объявления HTTP/3 по хостам, nil - Alt-Svc не учитывается
+	altSvc *altSvcCache
+
+	mu         sync.Mutex
+	transports map[transportKey]*http.Transport
+	http3      map[transportKey]*http3.Transport
+}
+
+// newHostTransport создает транспорт на основе base. С quicDial хосты с версией HTTPVersion3 запрашиваются
+// по HTTP/3, а с altSvc по HTTP/3 запрашиваются и хосты, объявившие его в Alt-Svc
+func newHostTransport(base *http.Transport, certs []*ClientCert, insecureHosts []string, versions []HostHTTPVersion, quicDial *quicDialer, altSvc bool) http.RoundTripper {
+	t := &hostTransport{
+		base:          base,
+		certs:         certs,
+		insecureHosts: insecureHosts,
+		versions:      versions,
+		quic:          quicDial,
+		transports:    map[transportKey]*http.Transport{{cert: -1}: base},
+		http3:         make(map[transportKey]*http3.Transport),
+	}
+	if quicDial != nil && altSvc {
+		t.altSvc = newAltSvcCache()
+	}
+	return t
+}
+
+// RoundTrip выполняет запрос через транспорт, подходящий под хост запроса
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := normalizeHost(req.URL.Hostname())
+	key := transportKey{cert: -1}
+	for i, c := range t.certs {
+		if matchHostPattern(c.Pattern, host) {
+			key.cert = i
+			break
+		}
+	}
+	key.insecure = req.Context().Value(insecureTLSKey{}) != nil && matchAnyHostPattern(t.insecureHosts, host)
+	for _, v := range t.versions {
+		if matchHostPattern(v.Pattern, host) {
+			key.version = v.Version
+			break
+		}
+	}
+	key.family, _ = req.Context().Value(ipFamilyKey{}).(string)
+	if t.quic == nil || req.URL.Scheme != "https" {
+		return t.transport(key).RoundTrip(req)
+	}
+	if key.version == HTTPVersion3 {
+		return t.http3Transport(key).RoundTrip(req)
+	}
+	if t.altSvc == nil || key.version != "" {
+		return t.transport(key).RoundTrip(req)
+	}
+
+	origin := urlOrigin(req)
+	if addr, ok := t.altSvc.lookup(origin); ok && rewindable(req) {
+		resp, err := t.http3Transport(key).RoundTrip(req.WithContext(context.WithValue(req.Context(), altSvcAddrKey{}, addr)))
+		if err == nil || req.Context().Err() != nil {
+			return resp, err
+		}
+		// по HTTP/3 сервер недоступен (например, UDP закрыт сетью): больше он по нему не запрашивается,
+		// а запрос повторяется по TCP
+		t.altSvc.forget(origin)
+		if req, err = retryOverTCP(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.transport(key).RoundTrip(req)
+	if err == nil {
+		t.altSvc.update(origin, resp.Header.Get("Alt-Svc"))
+	}
+	return resp, err
+}
+
+// http3Transport возвращает транспорт HTTP/3 с настройками key, создавая его при необходимости
+func (t *hostTransport) http3Transport(key transportKey) *http3.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if transport, ok := t.http3[key]; ok {
+		return transport
+	}
+
+	tlsConfig := &tls.Config{}
+	if t.base.TLSClientConfig != nil {
+		tlsConfig = t.base.TLSClientConfig.Clone()
+	}
+	if key.cert >= 0 {
+		tlsConfig.GetClientCertificate = t.certs[key.cert].getClientCertificate
+	}
+	tlsConfig.InsecureSkipVerify = key.insecure
+	transport := &http3.Transport{
+		TLSClientConfig:        tlsConfig,
+		QUICConfig:             &quic.Config{MaxIdleTimeout: t.base.IdleConnTimeout},
+		Dial:                   t.quic.dial,
+		MaxResponseHeaderBytes: int(t.base.MaxResponseHeaderBytes),
+		// тело ответа распаковывает HTTPFetcher, как и для HTTP/1.1 и HTTP/2
+		DisableCompression: true,
+	}
+	t.http3[key] = transport
+	return transport
+}
+
+// transport возвращает транспорт с настройками key, создавая его при необходимости
+func (t *hostTransport) transport(key transportKey) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if transport, ok := t.transports[key]; ok {
+		return transport
+	}
+
+	transport := t.base.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	if key.cert >= 0 {
+		transport.TLSClientConfig.GetClientCertificate = t.certs[key.cert].getClientCertificate
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = key.insecure
+	switch key.version {
+	case HTTPVersion1:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	case HTTPVersion2:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+		transport.Protocols.SetHTTP2(true)
+	case HTTPVersionH2C:
+		// без HTTP1 транспорт использует HTTP/2 и для http без TLS
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if transport.Protocols != nil {
+		// основной транспорт мог уже добавить h2 в ALPN, протоколы для TLS выберет новый транспорт
+		transport.TLSClientConfig.NextProtos = nil
+	}
+	if key.family != "" {
+		network := "tcp4"
+		if key.family == IPFamilyV6 {
+			network = "tcp6"
+		}
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+	}
+	t.transports[key] = transport
+	return transport
+}
+
+// CloseIdleConnections закрывает простаивающие соединения всех транспортов
+func (t *hostTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+	for _, transport := range t.http3 {
+		transport.CloseIdleConnections()
+	}
+}
+
+// headerLimitTransport ограничивает заголовки ответов base (в том числе ответов с перенаправлениями):
+// ответ, в котором заголовков больше maxHeaders, и ответ, заголовки которого не уместились
+// в MaxResponseHeaderBytes транспорта, завершаются ошибкой headers_too_large
+type headerLimitTransport struct {
+	base       http.RoundTripper
+	maxHeaders int
+}
+
+// RoundTrip выполняет запрос через base и проверяет заголовки ответа
+func (t *headerLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		// для этой ошибки в net/http нет отдельного типа, различается только текст (для HTTP/1 и HTTP/2)
+		if msg := err.Error(); strings.Contains(msg, "server response headers exceeded") || strings.Contains(msg, "response header list larger than") {
+			err = &FetchError{Code: ErrorCodeHeadersTooLarge, Err: err}
+		}
+		return resp, err
+	}
+	count := 0
+	for _, values := range resp.Header {
+		count += len(values)
+	}
+	if t.maxHeaders > 0 && count > t.maxHeaders {
+		resp.Body.Close()
+		return nil, &FetchError{Code: ErrorCodeHeadersTooLarge, Err: fmt.Errorf("Response has %d headers, at most %d are allowed", count, t.maxHeaders)}
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections закрывает простаивающие соединения base
+func (t *headerLimitTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// ContentTypeNDJSON тип содержимого для потоковой выдачи результатов (один json-объект на строку)
+	ContentTypeNDJSON = "application/x-ndjson"
+	// ContentTypeEventStream тип содержимого для выдачи результатов в виде Server-Sent Events
+	ContentTypeEventStream = "text/event-stream"
+	// ContentTypeMsgpack тип содержимого для выдачи итогового ответа в MessagePack
+	ContentTypeMsgpack = "application/msgpack"
+	// ContentTypeProtobuf тип содержимого для выдачи итогового ответа сообщением FetchResponse (proto/fetch.proto)
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+// ResultWriter отвечает за отправку результатов обработки url пользователю
+type ResultWriter interface {
+	// WriteResult вызывается для каждого успешно обработанного url сразу по готовности
+	WriteResult(res UrlResult) error
+	// Finish вызывается по окончании обработки, err - ошибка обработки (nil, если все ok)
+	Finish(err error)
+}
+
+// NewResultWriter выбирает способ выдачи результатов исходя из запроса пользователя:
+// Server-Sent Events при запросе на .../stream или Accept: text/event-stream,
+// потоковый NDJSON при ?stream=1 или Accept: application/x-ndjson, итоговый ответ в MessagePack или protobuf
+// целиком (см. writeResults), иначе итоговый ответ json, упаковываемый по мере готовности результатов.
+// В режиме сравнения тел (request.Diff) ответ всегда отправляется целиком
+func NewResultWriter(rw http.ResponseWriter, r *http.Request, request Urls) ResultWriter {
+	accept := r.Header.Get("Accept")
+	requestID := RequestID(r.Context())
+	if request.Diff {
+		// тела сравниваются по окончании обработки, поэтому их приходится накапливать
+		return &bufferedResultWriter{rw: rw, accept: accept, results: ResultToUser{RequestID: requestID, diff: request.Diff}}
+	}
+
+	// без сброса буфера потоковая выдача не имеет смысла
+	if flusher, canFlush := rw.(http.Flusher); canFlush {
+		switch {
+		case path.Base(r.URL.Path) == "stream" || strings.Contains(accept, ContentTypeEventStream):
+			return &sseResultWriter{rw: rw, flusher: flusher, requestID: requestID}
+		case r.URL.Query().Get("stream") == "1" || strings.Contains(accept, ContentTypeNDJSON):
+			return &ndjsonResultWriter{rw: rw, flusher: flusher, requestID: requestID}
+		}
+	}
+	if acceptsMsgpack(accept) || acceptsProto(accept) {
+		return &bufferedResultWriter{rw: rw, accept: accept, results: ResultToUser{RequestID: requestID}}
+	}
+	return &jsonResultWriter{rw: rw, results: ResultToUser{RequestID: requestID}}
+}
+
+// bufferedResultWriter накапливает результаты и отправляет их целиком по окончании обработки
+type bufferedResultWriter struct {
+	rw      http.ResponseWriter
+	accept  string // заголовок Accept запроса, определяет формат ответа
+	results ResultToUser
+}
+
+func (w *bufferedResultWriter) WriteResult(res UrlResult) error {
+	w.results.add(res)
+	return nil
+}
+
+func (w *bufferedResultWriter) Finish(err error) {
+	w.results.finish(err)
+	// упаковываем и отправляем
+	writeResults(w.rw, w.accept, w.results)
+}
+
+// writeResults упаковывает итоговый ответ в запрошенном в Accept формате и отправляет пользователю:
+// MessagePack, protobuf или json (по умолчанию)
+func writeResults(rw http.ResponseWriter, accept string, results ResultToUser) {
+	var contentType string
+	var body []byte
+	switch {
+	case acceptsMsgpack(accept):
+		contentType, body = ContentTypeMsgpack, results.MarshalMsgpack()
+	case acceptsProto(accept):
+		contentType, body = ContentTypeProtobuf, results.MarshalProto()
+	default:
+		writeJSON(rw, http.StatusOK, results)
+		return
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// acceptsMsgpack и acceptsProto проверяют, что итоговый ответ просят в MessagePack и protobuf
+func acceptsMsgpack(accept string) bool {
+	return strings.Contains(accept, ContentTypeMsgpack) || strings.Contains(accept, "application/x-msgpack")
+}
+
+func acceptsProto(accept string) bool {
+	return strings.Contains(accept, ContentTypeProtobuf) || strings.Contains(accept, "application/x-protobuf")
+}
+
+// jsonResultWriter отправляет итоговый ответ json по частям: каждый результат упаковывается в массив responses
+// сразу по готовности, а ошибка, сводка и остальные поля - после него. Так в памяти не накапливаются тела
+// ответов всех url, но ошибка, прервавшая обработку (ошибка url в режиме fail_fast или срок запроса),
+// не убирает из ответа уже отправленные результаты
+type jsonResultWriter struct {
+	rw      http.ResponseWriter
+	encoder *json.Encoder // nil, пока не отправлен первый результат
+	results ResultToUser  // сводка по отправленным результатам, сами результаты не хранятся
+}
+
+func (w *jsonResultWriter) WriteResult(res UrlResult) error {
+	prefix := ","
+	if w.encoder == nil {
+		w.rw.Header().Set("Content-Type", "application/json")
+		w.rw.WriteHeader(http.StatusOK)
+		w.encoder = json.NewEncoder(w.rw)
+		prefix = `{"responses":[`
+	}
+	if _, err := io.WriteString(w.rw, prefix); err != nil {
+		return err
+	}
+	if err := w.encoder.Encode(res); err != nil {
+		return err
+	}
+	// тело уже отправлено, держать его незачем: учитываем результат только в сводке
+	if res.Error != "" {
+		w.results.Failed++
+	}
+	w.results.Summary.add(res)
+	return nil
+}
+
+func (w *jsonResultWriter) Finish(err error) {
+	w.results.finish(err)
+	if w.encoder == nil {
+		// результатов нет (пустой список или ошибка до первого результата): ответ такой же, как целиком
+		writeJSON(w.rw, http.StatusOK, w.results)
+		return
+	}
+	// остальные поля итогового ответа дописываются после массива результатов
+	tail, err := json.Marshal(struct {
+		Error     string  `json:"error"`
+		ErrorCode string  `json:"error_code,omitempty"`
+		Failed    int     `json:"failed,omitempty"`
+		Summary   Summary `json:"summary"`
+		RequestID string  `json:"request_id,omitempty"`
+	}{w.results.Error, w.results.ErrorCode, w.results.Failed, w.results.Summary, w.results.RequestID})
+	if err != nil {
+		logRequest(slog.LevelError, w.results.RequestID, "Error on marshal", "error", err)
+		return
+	}
+	if _, err := io.WriteString(w.rw, "],"+string(tail[1:])); err != nil {
+		logRequest(slog.LevelWarn, w.results.RequestID, "Error on write", "error", err)
+	}
+}
+
+// ndjsonResultWriter отправляет каждый результат отдельной строкой сразу по готовности,
+// не удерживая тела ответов в памяти
+type ndjsonResultWriter struct {
+	rw        http.ResponseWriter
+	flusher   http.Flusher
+	started   bool
+	requestID string
+}
+
+// streamError строка потока, сообщающая об ошибке обработки
+type streamError struct {
+	Error     string `json:"error"`
+	ErrorCode string `json:"error_code,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (w *ndjsonResultWriter) WriteResult(res UrlResult) error {
+	return w.writeLine(res)
+}
+
+func (w *ndjsonResultWriter) Finish(err error) {
+	if err != nil {
+		// уже отправленные результаты не отозвать, поэтому ошибку сообщаем последней строкой
+		if err := w.writeLine(streamError{err.Error(), ErrorCode(err), w.requestID}); err != nil {
+			logRequest(slog.LevelWarn, w.requestID, "Error on stream write", "error", err)
+		}
+		return
+	}
+	if !w.started {
+		// пустой список url: отдаем хотя бы заголовки
+		w.start()
+	}
+}
+
+// start отправляет заголовки ответа перед первой строкой
+func (w *ndjsonResultWriter) start() {
+	w.started = true
+	w.rw.Header().Set("Content-Type", ContentTypeNDJSON)
+	w.rw.WriteHeader(http.StatusOK)
+}
+
+// writeLine упаковывает v в одну строку и сразу отправляет ее пользователю
+func (w *ndjsonResultWriter) writeLine(v interface{}) error {
+	line := getBuffer()
+	defer putBuffer(line)
+	// Encode завершает json переводом строки
+	if err := json.NewEncoder(line).Encode(v); err != nil {
+		return err
+	}
+	if !w.started {
+		w.start()
+	}
+	if _, err := w.rw.Write(line.Bytes()); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+// sseResultWriter отправляет результаты в виде Server-Sent Events:
+// событие result на каждый url и итоговое событие done
+type sseResultWriter struct {
+	rw        http.ResponseWriter
+	flusher   http.Flusher
+	started   bool
+	summary   Summary // статистика по уже отправленным результатам
+	requestID string
+}
+
+// sseDone данные итогового события done
+type sseDone struct {
+	Error     string  `json:"error"`
+	ErrorCode string  `json:"error_code,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	Count     int     `json:"count"`
+	Failed    int     `json:"failed"`
+	Summary   Summary `json:"summary"`
+}
+
+func (w *sseResultWriter) WriteResult(res UrlResult) error {
+	if err := w.writeEvent("result", res); err != nil {
+		return err
+	}
+	w.summary.add(res)
+	return nil
+}
+
+func (w *sseResultWriter) Finish(err error) {
+	w.summary.finish()
+	done := sseDone{RequestID: w.requestID, Count: w.summary.Total, Failed: w.summary.Failed, Summary: w.summary}
+	if err != nil {
+		done.Error = err.Error()
+		done.ErrorCode = ErrorCode(err)
+	}
+	if err := w.writeEvent("done", done); err != nil {
+		logRequest(slog.LevelWarn, w.requestID, "Error on stream write", "error", err)
+	}
+}
+
+// writeEvent упаковывает v в данные события event и сразу отправляет его пользователю
+func (w *sseResultWriter) writeEvent(event string, v interface{}) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	fmt.Fprintf(buf, "event: %s\ndata: ", event)
+	// json не содержит переводов строк, поэтому данные умещаются в одну строку data:,
+	// а перевод строки после json добавляет Encode
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	if !w.started {
+		w.started = true
+		w.rw.Header().Set("Content-Type", ContentTypeEventStream)
+		w.rw.Header().Set("Cache-Control", "no-cache")
+		w.rw.WriteHeader(http.StatusOK)
+	}
+	if _, err := w.rw.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+// orderedResultWriter передает результаты следующему writer в порядке url в запросе:
+// результат, пришедший раньше предыдущих, ждет, пока они будут готовы
+type orderedResultWriter struct {
+	next    ResultWriter
+	pending map[int]UrlResult // готовые результаты, ожидающие своей очереди
+	expect  int               // номер url, результат которого должен быть следующим
+}
+
+// newOrderedResultWriter оборачивает writer, упорядочивая результаты по UrlResult.Index
+func newOrderedResultWriter(next ResultWriter) *orderedResultWriter {
+	return &orderedResultWriter{next: next, pending: make(map[int]UrlResult)}
+}
+
+func (w *orderedResultWriter) WriteResult(res UrlResult) error {
+	w.pending[res.Index] = res
+	// отдаем все результаты, для которых подошла очередь
+	for {
+		ready, ok := w.pending[w.expect]
+		if !ok {
+			return nil
+		}
+		delete(w.pending, w.expect)
+		w.expect++
+		if err := w.next.WriteResult(ready); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *orderedResultWriter) Finish(err error) {
+	w.next.Finish(err)
+}
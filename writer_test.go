@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewResultWriterJSON(t *testing.T) {
+	failFast := false
+	errUrl := fmt.Errorf("%w: 503", ErrUnexpectedStatus)
+
+	tests := []struct {
+		name    string
+		request Urls
+		// finish ошибка, с которой завершается обработка после первого результата
+		finish        error
+		wantResponses int
+		wantCode      string
+	}{
+		{name: "fail_fast success", request: Urls{}, wantResponses: 2},
+		{name: "fail_fast error keeps sent results", request: Urls{}, finish: errUrl, wantResponses: 1, wantCode: ErrorCodeUnexpectedStatus},
+		{name: "fail_fast off deadline", request: Urls{FailFast: &failFast}, finish: ErrDeadlineExceeded, wantResponses: 1, wantCode: ErrorCodeDeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writer := NewResultWriter(rec, httptest.NewRequest(http.MethodPost, "/v1/fetch", nil), tt.request)
+			if _, ok := writer.(*jsonResultWriter); !ok {
+				t.Fatalf("NewResultWriter() = %T, want *jsonResultWriter", writer)
+			}
+			writer.WriteResult(UrlResult{Index: 0, Url: "http://example.test/0", Response: []byte("body")})
+			if tt.finish == nil {
+				writer.WriteResult(UrlResult{Index: 1, Url: "http://example.test/1", Response: []byte("body")})
+			}
+			writer.Finish(tt.finish)
+			// результаты отправлены сразу и не удерживаются до конца обработки
+			if held := writer.(*jsonResultWriter).results.Responses; held != nil {
+				t.Errorf("writer holds %d results", len(held))
+			}
+
+			var got ResultToUser
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response %s is not json: %v", rec.Body, err)
+			}
+			if len(got.Responses) != tt.wantResponses || got.ErrorCode != tt.wantCode {
+				t.Errorf("response has %d results and error code %q, want %d and %q", len(got.Responses), got.ErrorCode, tt.wantResponses, tt.wantCode)
+			}
+			if (got.Error != "") != (tt.finish != nil) {
+				t.Errorf("response error = %q, want error %v", got.Error, tt.finish)
+			}
+		})
+	}
+}
+
+func TestNewResultWriterBuffered(t *testing.T) {
+	tests := []struct {
+		name    string
+		accept  string
+		request Urls
+	}{
+		{name: "msgpack", accept: ContentTypeMsgpack},
+		{name: "protobuf", accept: ContentTypeProtobuf},
+		{name: "diff", request: Urls{Diff: true}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/v1/fetch", nil)
+		req.Header.Set("Accept", tt.accept)
+		writer := NewResultWriter(httptest.NewRecorder(), req, tt.request)
+		if _, ok := writer.(*bufferedResultWriter); !ok {
+			t.Errorf("NewResultWriter() for %s = %T, want *bufferedResultWriter", tt.name, writer)
+		}
+	}
+}